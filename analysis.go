@@ -51,53 +51,15 @@ func PortfolioReturns(returnsList [][]Percent, targetAllocations []Percent) ([]P
 // I want to play with rebalance_factor. Instead of rebalancing exactly, we can overshoot or undershoot the
 // transactions, to "juice" it up.
 // I want to see how that tweak in rebalancing strategy affects the performance of various portfolios.
+// See SimulateTrading for other rebalancing policies.
 // Example:
 //     portfolio_trading_simulation([TSM, ITB], [60, 40])
 func PortfolioTradingSimulation(returnsList [][]Percent, targetAllocations []Percent, rebalanceFactor float64) ([]Percent, error) {
-	if math.Abs(sum(targetAllocations).Float()-1.00) > 0.00000000000001 {
-		return nil, fmt.Errorf("targetAllocations must sum to 100%%, got %v", sum(targetAllocations))
-	}
-	if len(targetAllocations) != len(returnsList) {
-		return nil, fmt.Errorf("lists must have the same length: targetAllocations (%d), returnsList (%d)", len(targetAllocations), len(returnsList))
-	}
-	var cumulativeReturnsL = make([]Percent, 0, len(returnsList[0]))
-	{
-		var (
-			// our initial allocation of 1.000 will simply be according to the target allocations.
-			// Shorthand to clone targetAllocations. See: https://github.com/go101/go101/wiki/How-to-efficiently-clone-a-slice%3F
-			allocations = append(targetAllocations[:0:0], targetAllocations...)
-			// slice to reuse for calculations in each iteration
-			eoyAllocation = make([]Percent, len(targetAllocations))
-		)
-		zipWalk(returnsList, func(oneReturnSet []Percent) {
-			// fmt.Println("\noneReturnSet", fmt.Sprintf("%v", oneReturnSet))
-			// apply the returns to the current allocation
-			startSum := sum(allocations)
-			var eoySum Percent
-			for i := range allocations {
-				value := allocations[i] * (oneReturnSet[i] + 1)
-				eoyAllocation[i] = value
-				eoySum += value
-			}
-			cumulativeReturnsL = append(cumulativeReturnsL, (eoySum/startSum)-1)
-			// fmt.Println("eoyAllocation", fmt.Sprintf("%v", eoyAllocation), "eoySum", eoySum)
-
-			// update allocations -- calculate the transactions to perform, and apply
-			for i := range targetAllocations {
-				target := targetAllocations[i] * eoySum
-				transaction := (target - eoyAllocation[i]) * Percent(rebalanceFactor)
-				// fmt.Println("transaction", i+1, transaction)
-				allocation := eoyAllocation[i] + transaction
-				if allocation < 0 {
-					panic("no allocation can go below zero! maybe rebalanceFactor is too extreme?")
-				}
-				allocations[i] = allocation
-			}
-			// fmt.Println("post-transaction allocation", fmt.Sprintf("%v", allocations))
-			return
-		})
+	sim, err := SimulateTrading(returnsList, targetAllocations, TradingParams{Policy: RebalanceWithFactor(rebalanceFactor)})
+	if err != nil {
+		return nil, err
 	}
-	return cumulativeReturnsL, nil
+	return sim.Returns, nil
 }
 
 // calculates the cumulative growth of the returns
@@ -0,0 +1,421 @@
+package portfolio_analysis
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	. "github.com/slatteryjim/portfolio-analysis/types"
+)
+
+// AssetConstraints restrict the assets and allocations a search considers.
+// The searches prune their enumerations with them, rather than filtering the results.
+// The zero value allows everything.
+type AssetConstraints struct {
+	// Required assets are in every portfolio.
+	Required []string
+	// Forbidden assets are in none of them.
+	Forbidden []string
+	// MaxAssets limits the number of assets held, when it's above zero.
+	MaxAssets int
+	// AtLeastOneOf has groups of assets, and every portfolio holds at least one asset of each group.
+	AtLeastOneOf [][]string
+	// Weights bound the total allocation of an asset, or of a group of assets.
+	Weights []WeightBound
+}
+
+// WeightBound bounds the total allocation of the assets.
+type WeightBound struct {
+	Assets []string
+	Min    Percent
+	// Max of zero means no maximum. Use Forbidden to exclude assets.
+	Max Percent
+}
+
+// weightTolerance absorbs the rounding of summed percentages.
+const weightTolerance = 1e-9
+
+func (b WeightBound) max() Percent {
+	if b.Max == 0 {
+		return 1
+	}
+	return b.Max
+}
+
+func (b WeightBound) contains(asset string) bool {
+	return containsString(b.Assets, asset)
+}
+
+// ParseAssetConstraints parses constraints written one per line, like:
+//
+//	# comments and blank lines are ignored
+//	require: TSM, Gold
+//	forbid: LT STRIPS, T-Bill
+//	max assets: 4
+//	at least one of: LTT, ITT
+//	Gold >= 10%
+//	Gold <= 30%
+//	TSM + SCV <= 50%
+func ParseAssetConstraints(text string) (AssetConstraints, error) {
+	var c AssetConstraints
+	scanner := bufio.NewScanner(strings.NewReader(text))
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimSpace(scanner.Text())
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = strings.TrimSpace(line[:i])
+		}
+		if line == "" {
+			continue
+		}
+		if err := c.parseLine(line); err != nil {
+			return AssetConstraints{}, fmt.Errorf("line %d: %q: %w", lineNumber, line, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return AssetConstraints{}, err
+	}
+	return c, c.Validate()
+}
+
+func (c *AssetConstraints) parseLine(line string) error {
+	if keyword, value, ok := strings.Cut(line, ":"); ok {
+		switch strings.ToLower(strings.TrimSpace(keyword)) {
+		case "require":
+			c.Required = append(c.Required, splitAssets(value, ",")...)
+		case "forbid":
+			c.Forbidden = append(c.Forbidden, splitAssets(value, ",")...)
+		case "at least one of":
+			c.AtLeastOneOf = append(c.AtLeastOneOf, splitAssets(value, ","))
+		case "max assets":
+			n, err := strconv.Atoi(strings.TrimSpace(value))
+			if err != nil || n <= 0 {
+				return errors.New("max assets must be a positive number")
+			}
+			c.MaxAssets = n
+		default:
+			return fmt.Errorf("unknown constraint %q", keyword)
+		}
+		return nil
+	}
+	for _, op := range []string{">=", "<="} {
+		if assets, value, ok := strings.Cut(line, op); ok {
+			percent, err := parsePercent(value)
+			if err != nil {
+				return err
+			}
+			bound := c.weightBound(splitAssets(assets, "+"))
+			if bound == nil {
+				return errors.New("no assets")
+			}
+			if op == ">=" {
+				bound.Min = percent
+			} else if percent == 0 {
+				return errors.New("use forbid to exclude assets")
+			} else {
+				bound.Max = percent
+			}
+			return nil
+		}
+	}
+	return errors.New("expected a constraint like `require: TSM` or `TSM <= 30%`")
+}
+
+// weightBound returns the bound of the assets, adding it if it's new, so a min and a max share one bound.
+func (c *AssetConstraints) weightBound(assets []string) *WeightBound {
+	if len(assets) == 0 {
+		return nil
+	}
+	for i, b := range c.Weights {
+		if strings.Join(b.Assets, "+") == strings.Join(assets, "+") {
+			return &c.Weights[i]
+		}
+	}
+	c.Weights = append(c.Weights, WeightBound{Assets: assets})
+	return &c.Weights[len(c.Weights)-1]
+}
+
+func splitAssets(s, sep string) []string {
+	var res []string
+	for _, asset := range strings.Split(s, sep) {
+		if asset = strings.TrimSpace(asset); asset != "" {
+			res = append(res, asset)
+		}
+	}
+	return res
+}
+
+func parsePercent(s string) (Percent, error) {
+	s = strings.TrimSuffix(strings.TrimSpace(s), "%")
+	f, err := strconv.ParseFloat(strings.TrimSpace(s), 64)
+	if err != nil || f < 0 || f > 100 {
+		return 0, fmt.Errorf("expected a percentage from 0%% to 100%%, got %q", s)
+	}
+	return Percent(f / 100), nil
+}
+
+// String formats the constraints in the language ParseAssetConstraints reads.
+func (c AssetConstraints) String() string {
+	var lines []string
+	if len(c.Required) > 0 {
+		lines = append(lines, "require: "+strings.Join(c.Required, ", "))
+	}
+	if len(c.Forbidden) > 0 {
+		lines = append(lines, "forbid: "+strings.Join(c.Forbidden, ", "))
+	}
+	if c.MaxAssets > 0 {
+		lines = append(lines, fmt.Sprintf("max assets: %d", c.MaxAssets))
+	}
+	for _, group := range c.AtLeastOneOf {
+		lines = append(lines, "at least one of: "+strings.Join(group, ", "))
+	}
+	for _, b := range c.Weights {
+		assets := strings.Join(b.Assets, " + ")
+		if b.Min > 0 {
+			lines = append(lines, fmt.Sprintf("%s >= %s", assets, formatPercentValue(b.Min)))
+		}
+		if b.Max > 0 {
+			lines = append(lines, fmt.Sprintf("%s <= %s", assets, formatPercentValue(b.Max)))
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+func formatPercentValue(p Percent) string {
+	return strconv.FormatFloat(p.Float()*100, 'f', -1, 64) + "%"
+}
+
+// Validate returns an error if the constraints contradict themselves.
+func (c AssetConstraints) Validate() error {
+	for _, asset := range c.Required {
+		if containsString(c.Forbidden, asset) {
+			return fmt.Errorf("%s is both required and forbidden", asset)
+		}
+	}
+	if c.MaxAssets > 0 && len(c.Required) > c.MaxAssets {
+		return fmt.Errorf("%d assets are required, but the max is %d", len(c.Required), c.MaxAssets)
+	}
+	for _, group := range c.AtLeastOneOf {
+		if len(group) == 0 {
+			return errors.New("an empty group for at least one of")
+		}
+	}
+	for _, b := range c.Weights {
+		if b.Max > 0 && b.Min > b.Max {
+			return fmt.Errorf("%s: min %v is greater than max %v", strings.Join(b.Assets, " + "), b.Min, b.Max)
+		}
+	}
+	return nil
+}
+
+// AllowsAssets returns true if the set of assets could be held: it has the required assets, none of the forbidden,
+// no more than the max assets, and at least one of each group.
+func (c AssetConstraints) AllowsAssets(assets []string) bool {
+	if c.MaxAssets > 0 && len(assets) > c.MaxAssets {
+		return false
+	}
+	for _, asset := range c.Required {
+		if !containsString(assets, asset) {
+			return false
+		}
+	}
+	for _, asset := range assets {
+		if containsString(c.Forbidden, asset) {
+			return false
+		}
+	}
+	for _, group := range c.AtLeastOneOf {
+		if !containsAny(assets, group) {
+			return false
+		}
+	}
+	return true
+}
+
+// Allows returns true if the portfolio satisfies all of the constraints. Assets at 0% aren't held.
+func (c AssetConstraints) Allows(assets []string, percentages []Percent) bool {
+	var held []string
+	for i, asset := range assets {
+		if percentages[i] > 0 {
+			held = append(held, asset)
+		}
+	}
+	if !c.AllowsAssets(held) {
+		return false
+	}
+	for _, b := range c.Weights {
+		var total Percent
+		for i, asset := range assets {
+			if b.contains(asset) {
+				total += percentages[i]
+			}
+		}
+		if total < b.Min-weightTolerance || total > b.max()+weightTolerance {
+			return false
+		}
+	}
+	return true
+}
+
+// Combinations is like the Combinations function, but only returns the combinations the constraints allow.
+// It prunes the enumeration: forbidden assets are never considered, required assets are never skipped,
+// and no asset is added beyond the max assets, or beyond a weight's max.
+func (c AssetConstraints) Combinations(assets []string, percentages []Percent) []Combination {
+	var allowed []string
+	for _, asset := range assets {
+		if !containsString(c.Forbidden, asset) {
+			allowed = append(allowed, asset)
+		}
+	}
+	if len(percentages) == 0 {
+		return nil
+	}
+	var (
+		res         []Combination
+		last        = percentages[len(percentages)-1]
+		held        []string
+		allocations []Percent
+		totals      = make([]Percent, len(c.Weights))
+		walk        func(i int, prev int)
+	)
+	// walk adds the assets from index i, with cumulative percentages after index prev
+	walk = func(i int, prev int) {
+		if prev >= 0 && percentages[prev] == last {
+			if c.Allows(held, allocations) {
+				res = append(res, Combination{
+					Assets:      append([]string(nil), held...),
+					Percentages: append([]Percent(nil), allocations...),
+				})
+			}
+			return
+		}
+		if i == len(allowed) || (c.MaxAssets > 0 && len(held) == c.MaxAssets) {
+			return
+		}
+		asset := allowed[i]
+		// skip this asset, unless it's required
+		if !containsString(c.Required, asset) {
+			walk(i+1, prev)
+		}
+		var prevPercentage Percent
+		if prev >= 0 {
+			prevPercentage = percentages[prev]
+		}
+		for j := prev + 1; j < len(percentages); j++ {
+			allocation := percentages[j] - prevPercentage
+			if !c.addWeight(totals, asset, allocation) {
+				// the allocations only grow from here
+				break
+			}
+			held, allocations = append(held, asset), append(allocations, allocation)
+			walk(i+1, j)
+			held, allocations = held[:len(held)-1], allocations[:len(allocations)-1]
+			c.addWeight(totals, asset, -allocation)
+		}
+	}
+	walk(0, -1)
+	return res
+}
+
+// addWeight adds the allocation of the asset to the totals of its weight bounds,
+// unless it would exceed one of their maxes.
+func (c AssetConstraints) addWeight(totals []Percent, asset string, allocation Percent) bool {
+	for i, b := range c.Weights {
+		if b.contains(asset) && totals[i]+allocation > b.max()+weightTolerance {
+			return false
+		}
+	}
+	for i, b := range c.Weights {
+		if b.contains(asset) {
+			totals[i] += allocation
+		}
+	}
+	return true
+}
+
+// EnumerateCombinations is like the EnumerateCombinations function, but only enumerates the sets of k assets the
+// constraints allow. The forbidden assets are dropped and the required assets are always included before
+// enumerating the rest, so the disallowed sets aren't visited.
+func (c AssetConstraints) EnumerateCombinations(xs []string, k int, kBuffer []string, combination func() error) error {
+	if c.MaxAssets > 0 && k > c.MaxAssets {
+		return nil
+	}
+	var (
+		required []string
+		rest     []string
+	)
+	for _, x := range xs {
+		switch {
+		case containsString(c.Required, x):
+			required = append(required, x)
+		case !containsString(c.Forbidden, x):
+			rest = append(rest, x)
+		}
+	}
+	if len(required) < len(c.Required) || len(required) > k {
+		// a required asset isn't available, or there are too many of them
+		return nil
+	}
+	copy(kBuffer, required)
+	if len(required) == k {
+		if !c.AllowsAssets(kBuffer) {
+			return nil
+		}
+		if err := combination(); err != nil && err != ErrEndEnumeration {
+			return err
+		}
+		return nil
+	}
+	return EnumerateCombinations(rest, k-len(required), kBuffer[len(required):], func() error {
+		if !c.AllowsAssets(kBuffer) {
+			return nil
+		}
+		return combination()
+	})
+}
+
+// WeightBounds returns the least and most that each of the assets can hold, considering the bounds containing it.
+// A group's min doesn't bound its members, since the others could make it up.
+func (c AssetConstraints) WeightBounds(asset string) (min, max Percent) {
+	max = 1
+	for _, b := range c.Weights {
+		if !b.contains(asset) {
+			continue
+		}
+		if len(b.Assets) == 1 && b.Min > min {
+			min = b.Min
+		}
+		if b.max() < max {
+			max = b.max()
+		}
+	}
+	return min, max
+}
+
+func containsString(xs []string, x string) bool {
+	for _, s := range xs {
+		if s == x {
+			return true
+		}
+	}
+	return false
+}
+
+func containsAny(xs []string, ys []string) bool {
+	for _, y := range ys {
+		if containsString(xs, y) {
+			return true
+		}
+	}
+	return false
+}
+
+// GoEnumerateCombinations is like the GoEnumerateCombinations function, but only publishes the sets of k assets
+// the constraints allow.
+func (c AssetConstraints) GoEnumerateCombinations(ctx context.Context, xs []string, k, batchSize int) <-chan [][]string {
+	return goEnumerateCombinations(ctx, k, batchSize, func(kBuffer []string, combination func() error) error {
+		return c.EnumerateCombinations(xs, k, kBuffer, combination)
+	})
+}
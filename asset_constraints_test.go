@@ -0,0 +1,174 @@
+package portfolio_analysis
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"testing"
+
+	. "github.com/onsi/gomega"
+
+	. "github.com/slatteryjim/portfolio-analysis/types"
+)
+
+func TestParseAssetConstraints(t *testing.T) {
+	t.Run("valid", func(t *testing.T) {
+		g := NewGomegaWithT(t)
+		c, err := ParseAssetConstraints(`
+			# keep it simple
+			require: TSM, Gold
+			forbid: LT STRIPS, T-Bill
+			max assets: 4 # at most
+			at least one of: LTT, ITT
+			Gold >= 10%
+			Gold <= 30
+			TSM + SCV <= 50%
+		`)
+		g.Expect(err).To(Succeed())
+		g.Expect(c).To(Equal(AssetConstraints{
+			Required:     []string{"TSM", "Gold"},
+			Forbidden:    []string{"LT STRIPS", "T-Bill"},
+			MaxAssets:    4,
+			AtLeastOneOf: [][]string{{"LTT", "ITT"}},
+			Weights: []WeightBound{
+				{Assets: []string{"Gold"}, Min: 0.1, Max: 0.3},
+				{Assets: []string{"TSM", "SCV"}, Max: 0.5},
+			},
+		}))
+		g.Expect(c.String()).To(Equal(`require: TSM, Gold
+forbid: LT STRIPS, T-Bill
+max assets: 4
+at least one of: LTT, ITT
+Gold >= 10%
+Gold <= 30%
+TSM + SCV <= 50%`))
+		// round trip
+		g.Expect(ParseAssetConstraints(c.String())).To(Equal(c))
+	})
+	t.Run("invalid", func(t *testing.T) {
+		for _, tc := range []struct {
+			text string
+			err  string
+		}{
+			{"allow: TSM", `line 1: "allow: TSM": unknown constraint "allow"`},
+			{"max assets: none", `line 1: "max assets: none": max assets must be a positive number`},
+			{"\nTSM > 10%", `line 2: "TSM > 10%": expected a constraint like ` + "`require: TSM` or `TSM <= 30%`"},
+			{"TSM <= 110%", `line 1: "TSM <= 110%": expected a percentage from 0% to 100%, got "110"`},
+			{"TSM <= 0%", `line 1: "TSM <= 0%": use forbid to exclude assets`},
+			{" + <= 10%", `line 1: "+ <= 10%": no assets`},
+			{"require: TSM\nforbid: TSM", "TSM is both required and forbidden"},
+			{"require: TSM, SCV\nmax assets: 1", "2 assets are required, but the max is 1"},
+			{"TSM >= 50%\nTSM <= 40%", "TSM: min 50% is greater than max 40%"},
+		} {
+			g := NewGomegaWithT(t)
+			_, err := ParseAssetConstraints(tc.text)
+			g.Expect(err).To(MatchError(tc.err), "%q", tc.text)
+		}
+	})
+}
+
+func TestAssetConstraints_Allows(t *testing.T) {
+	g := NewGomegaWithT(t)
+	c := AssetConstraints{
+		Required:     []string{"TSM"},
+		Forbidden:    []string{"REIT"},
+		MaxAssets:    3,
+		AtLeastOneOf: [][]string{{"LTT", "STT"}},
+		Weights:      []WeightBound{{Assets: []string{"LTT", "STT"}, Min: 0.2, Max: 0.5}},
+	}
+	g.Expect(c.Allows([]string{"TSM", "LTT"}, ReadablePercents(70, 30))).To(BeTrue())
+	g.Expect(c.Allows([]string{"TSM", "LTT", "STT"}, ReadablePercents(50, 25, 25))).To(BeTrue())
+	// a 0% asset isn't held
+	g.Expect(c.Allows([]string{"TSM", "LTT", "REIT"}, ReadablePercents(70, 30, 0))).To(BeTrue())
+	g.Expect(c.Allows([]string{"TSM", "LTT", "REIT"}, ReadablePercents(60, 30, 10))).To(BeFalse())
+	g.Expect(c.Allows([]string{"SCV", "LTT"}, ReadablePercents(70, 30))).To(BeFalse())
+	g.Expect(c.Allows([]string{"TSM", "GLD"}, ReadablePercents(70, 30))).To(BeFalse())
+	g.Expect(c.Allows([]string{"TSM", "LTT", "STT", "GLD"}, ReadablePercents(40, 10, 10, 40))).To(BeFalse())
+	g.Expect(c.Allows([]string{"TSM", "LTT"}, ReadablePercents(90, 10))).To(BeFalse())
+	g.Expect(c.Allows([]string{"TSM", "LTT"}, ReadablePercents(40, 60))).To(BeFalse())
+}
+
+func TestAssetConstraints_Combinations(t *testing.T) {
+	assets := []string{"TSM", "SCV", "LTT", "STT", "GLD", "REIT"}
+	percentages := ReadablePercents(SeriesRange(10)...)
+	for _, c := range []AssetConstraints{
+		{},
+		{Required: []string{"TSM", "GLD"}},
+		{Forbidden: []string{"SCV", "REIT"}},
+		{MaxAssets: 2},
+		{AtLeastOneOf: [][]string{{"LTT", "STT"}, {"GLD", "REIT"}}},
+		{Weights: []WeightBound{{Assets: []string{"TSM"}, Min: 0.3}, {Assets: []string{"LTT", "STT"}, Max: 0.2}}},
+		{
+			Required:  []string{"TSM"},
+			Forbidden: []string{"REIT"},
+			MaxAssets: 4,
+			Weights:   []WeightBound{{Assets: []string{"GLD"}, Min: 0.1, Max: 0.2}, {Assets: []string{"TSM", "SCV"}, Max: 0.6}},
+		},
+	} {
+		t.Run(fmt.Sprintf("%+v", c), func(t *testing.T) {
+			g := NewGomegaWithT(t)
+			var expected []Combination
+			for _, combination := range Combinations(assets, percentages) {
+				if c.Allows(combination.Assets, combination.Percentages) {
+					expected = append(expected, combination)
+				}
+			}
+			g.Expect(expected).ToNot(BeEmpty())
+			g.Expect(combinationStrings(c.Combinations(assets, percentages))).To(Equal(combinationStrings(expected)))
+		})
+	}
+}
+
+func TestAssetConstraints_EnumerateCombinations(t *testing.T) {
+	names := []string{"TSM", "SCV", "LTT", "STT", "GLD", "REIT", "STB"}
+	for _, c := range []AssetConstraints{
+		{},
+		{Required: []string{"TSM", "GLD"}},
+		{Required: []string{"TSM", "GLD", "SCV"}},
+		{Required: []string{"Foo"}},
+		{Forbidden: []string{"SCV", "REIT"}},
+		{MaxAssets: 2},
+		{AtLeastOneOf: [][]string{{"LTT", "STT"}}},
+		{Required: []string{"TSM"}, Forbidden: []string{"STB"}, AtLeastOneOf: [][]string{{"LTT", "STT"}, {"GLD"}}},
+	} {
+		for k := 1; k <= 4; k++ {
+			t.Run(fmt.Sprintf("k=%d %+v", k, c), func(t *testing.T) {
+				g := NewGomegaWithT(t)
+				var expected [][]string
+				kBuffer := make([]string, k)
+				g.Expect(EnumerateCombinations(names, k, kBuffer, func() error {
+					if c.AllowsAssets(kBuffer) {
+						expected = append(expected, append([]string(nil), kBuffer...))
+					}
+					return nil
+				})).To(Succeed())
+
+				var actual [][]string
+				g.Expect(c.EnumerateCombinations(names, k, kBuffer, func() error {
+					actual = append(actual, append([]string(nil), kBuffer...))
+					return nil
+				})).To(Succeed())
+				g.Expect(actual).To(HaveLen(len(expected)))
+				for _, assets := range actual {
+					g.Expect(c.AllowsAssets(assets)).To(BeTrue())
+				}
+
+				var batched [][]string
+				for batch := range c.GoEnumerateCombinations(context.Background(), names, k, 3) {
+					batched = append(batched, batch...)
+				}
+				g.Expect(batched).To(Equal(actual))
+			})
+		}
+	}
+}
+
+// combinationStrings formats the combinations, sorted, to compare them regardless of their order.
+func combinationStrings(combinations []Combination) []string {
+	var res []string
+	for _, c := range combinations {
+		res = append(res, fmt.Sprint(c.Assets, c.Percentages))
+	}
+	sort.Strings(res)
+	return res
+}
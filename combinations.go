@@ -1,10 +1,10 @@
 package portfolio_analysis
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"sync"
-	"time"
 
 	"github.com/slatteryjim/portfolio-analysis/data"
 	. "github.com/slatteryjim/portfolio-analysis/types"
@@ -129,25 +129,146 @@ func EnumerateCombinations(xs []string, k int, kBuffer []string, combination fun
 	return EnumerateCombinations(rest, k, kBuffer, passThroughAllCombinations)
 }
 
+// EnumerateCombinationsFrom is like EnumerateCombinations, but it starts from the combination with the given rank,
+// skipping all of the combinations before it. The combinations are enumerated in the same order,
+// so a search that was stopped can pick up where it left off.
+func EnumerateCombinationsFrom(xs []string, k, start int, kBuffer []string, combination func() error) error {
+	if len(xs) == 0 || k <= 0 || len(xs) < k {
+		return nil
+	}
+	return EnumerateCombinationRange(xs, k, start, Binomial(len(xs), k), kBuffer, combination)
+}
+
+// EnumerateCombinationRange is like EnumerateCombinations, but it only enumerates the combinations
+// ranked from start up to, but not including, end.
+func EnumerateCombinationRange(xs []string, k, start, end int, kBuffer []string, combination func() error) error {
+	n := len(xs)
+	if n == 0 || k <= 0 || n < k {
+		return nil
+	}
+	if total := Binomial(n, k); end > total {
+		end = total
+	}
+	if start >= end {
+		return nil
+	}
+	indices := UnrankCombination(n, k, start)
+	for rank := start; rank < end; rank++ {
+		for i, index := range indices {
+			kBuffer[i] = xs[index]
+		}
+		if err := combination(); err != nil {
+			if err == ErrEndEnumeration {
+				return nil
+			}
+			return err
+		}
+		// advance the rightmost index that isn't already as far right as it can go, and pack the rest after it
+		i := k - 1
+		for i >= 0 && indices[i] == n-k+i {
+			i--
+		}
+		if i < 0 {
+			return nil
+		}
+		indices[i]++
+		for j := i + 1; j < k; j++ {
+			indices[j] = indices[j-1] + 1
+		}
+	}
+	return nil
+}
+
+// ShardRange returns the range of ranks [start, end) of the given shard, when the total number of combinations
+// is split as evenly as possible into the number of shards. The shards are numbered from 0.
+func ShardRange(total, shard, shards int) (start, end int) {
+	if shards <= 0 || shard < 0 || shard >= shards {
+		panic(fmt.Sprintf("shard %d out of range of %d shards", shard, shards))
+	}
+	// the first shards each take one extra, if it doesn't divide evenly
+	size, extra := total/shards, total%shards
+	start, end = shard*size, (shard+1)*size
+	if shard < extra {
+		return start + shard, end + shard + 1
+	}
+	return start + extra, end + extra
+}
+
+// RankCombination returns the position of the combination, given as the ascending indices of the chosen
+// values out of n, in the order that EnumerateCombinations enumerates them.
+func RankCombination(n int, indices []int) int {
+	var (
+		k    = len(indices)
+		rank = 0
+		next = 0
+	)
+	for i, index := range indices {
+		// count the combinations that choose a smaller value in this position
+		for j := next; j < index; j++ {
+			rank += Binomial(n-1-j, k-1-i)
+		}
+		next = index + 1
+	}
+	return rank
+}
+
+// UnrankCombination returns the ascending indices of the combination of k values out of n with the given rank.
+// It's the inverse of RankCombination.
+func UnrankCombination(n, k, rank int) []int {
+	var (
+		indices = make([]int, k)
+		next    = 0
+	)
+	for i := range indices {
+		// skip past the blocks of combinations that choose a smaller value in this position
+		for {
+			block := Binomial(n-1-next, k-1-i)
+			if rank < block {
+				break
+			}
+			rank -= block
+			next++
+		}
+		indices[i] = next
+		next++
+	}
+	return indices
+}
+
 // GoEnumerateCombinations calls EnumerateCombinations on a goroutine, and returns
 // a channel on which it publishes the combinations in batches if the given size.
-func GoEnumerateCombinations(xs []string, k, batchSize int) <-chan [][]string {
+// It stops early, closing the channel, once the context is done.
+func GoEnumerateCombinations(ctx context.Context, xs []string, k, batchSize int) <-chan [][]string {
+	return goEnumerateCombinations(ctx, k, batchSize, func(kBuffer []string, combination func() error) error {
+		return EnumerateCombinations(xs, k, kBuffer, combination)
+	})
+}
+
+// GoEnumerateCombinationsFrom is like GoEnumerateCombinations, but it starts from the combination with the given rank.
+func GoEnumerateCombinationsFrom(ctx context.Context, xs []string, k, start, batchSize int) <-chan [][]string {
+	return GoEnumerateCombinationRange(ctx, xs, k, start, Binomial(len(xs), k), batchSize)
+}
+
+// GoEnumerateCombinationRange is like GoEnumerateCombinations, but it only enumerates the combinations
+// ranked from start up to, but not including, end.
+func GoEnumerateCombinationRange(ctx context.Context, xs []string, k, start, end, batchSize int) <-chan [][]string {
+	return goEnumerateCombinations(ctx, k, batchSize, func(kBuffer []string, combination func() error) error {
+		return EnumerateCombinationRange(xs, k, start, end, kBuffer, combination)
+	})
+}
+
+// goEnumerateCombinations calls the enumerate function on a goroutine, and returns
+// a channel on which it publishes the combinations in batches if the given size.
+func goEnumerateCombinations(ctx context.Context, k, batchSize int, enumerate func(kBuffer []string, combination func() error) error) <-chan [][]string {
 	out := make(chan [][]string, 1000)
-	total := Binomial(len(xs), k)
 	go func() {
 		defer close(out)
 		var (
 			kBuffer = make([]string, k)
 			batch   = make([][]string, 0, batchSize)
 		)
-		count := 0
-		// ignore returned error, our callback function won't return anything worth propagating
-		_ = EnumerateCombinations(xs, k, kBuffer, func() error {
-			count++
-			if count%20_000_000 == 0 {
-				fmt.Printf(" - combination #%d of %d (%0.1f%%) at %s\n", count, total, float64(count)/float64(total)*100, time.Now())
-			}
-
+		// ignore returned error, our callback function only stops the enumeration once the context is done
+		_ = enumerate(kBuffer, func() error {
 			combination := make([]string, k)
 			copy(combination, kBuffer)
 
@@ -157,7 +278,11 @@ func GoEnumerateCombinations(xs []string, k, batchSize int) <-chan [][]string {
 			// dump batch if full
 			if len(batch) == batchSize {
 				// try to write this batch to channel
-				out <- batch
+				select {
+				case out <- batch:
+				case <-ctx.Done():
+					return ctx.Err()
+				}
 				// reset batch
 				batch = make([][]string, 0, batchSize)
 			}
@@ -166,23 +291,38 @@ func GoEnumerateCombinations(xs []string, k, batchSize int) <-chan [][]string {
 		// dump any partial batch remaining
 		if len(batch) > 0 {
 			// try to write this batch to channel
-			out <- batch
+			select {
+			case out <- batch:
+			case <-ctx.Done():
+			}
 		}
 	}()
 	return out
 }
 
 // GoMerge merges the output from multiple channels into a single output channel.
-// Once all of the given channels are closed, the returned output channel is closed.
-func GoMerge(channels ...<-chan *PortfolioStat) <-chan *PortfolioStat {
+// Once all of the given channels are closed, or the context is done, the returned output channel is closed.
+func GoMerge(ctx context.Context, channels ...<-chan *PortfolioStat) <-chan *PortfolioStat {
 	var wg sync.WaitGroup
 	out := make(chan *PortfolioStat, 1000)
 
 	worker := func(c <-chan *PortfolioStat) {
 		defer wg.Done()
 		// pump data into shared output
-		for x := range c {
-			out <- x
+		for {
+			select {
+			case x, ok := <-c:
+				if !ok {
+					return
+				}
+				select {
+				case out <- x:
+				case <-ctx.Done():
+					return
+				}
+			case <-ctx.Done():
+				return
+			}
 		}
 	}
 
@@ -248,9 +388,18 @@ func Binomial(n, k int) int {
 	return b
 }
 
+// GoldenButterflyCombination returns the Golden Butterfly portfolio: 20% each of LTT, Gold, STT, SCV and TSM.
+func GoldenButterflyCombination() Combination {
+	return Combination{
+		Assets:      []string{"LTT", "Gold", "STT", "SCV", "TSM"},
+		Percentages: ReadablePercents(20, 20, 20, 20, 20),
+	}
+}
+
 func MustGoldenButterflyStat() *PortfolioStat {
-	assets := []string{"LTT", "Gold", "STT", "SCV", "TSM"}
-	targetAllocations := ReadablePercents(20, 20, 20, 20, 20)
+	combination := GoldenButterflyCombination()
+	assets := combination.Assets
+	targetAllocations := combination.Percentages
 	returnsList := data.PortfolioReturnsList(assets...)
 	returns, err := PortfolioReturns(returnsList, targetAllocations)
 	if err != nil {
@@ -2,6 +2,7 @@ package portfolio_analysis
 
 import (
 	"compress/gzip"
+	"context"
 	"database/sql"
 	"encoding/csv"
 	"encoding/gob"
@@ -11,6 +12,7 @@ import (
 	"math"
 	"os"
 	"runtime"
+	"sort"
 	"strconv"
 	"strings"
 	"testing"
@@ -349,7 +351,7 @@ func TestAllKAssetPortfolios__Deprecated(t *testing.T) {
 				}()
 				return out
 			}
-			combinationsCh := GoEnumerateCombinations(data.Names(), k, 10_000)
+			combinationsCh := GoEnumerateCombinations(context.Background(), data.Names(), k, 10_000)
 			// fan out to multiple workers
 			// k=6
 			//  6 workers: 1278067 portfolios per second
@@ -366,10 +368,8 @@ func TestAllKAssetPortfolios__Deprecated(t *testing.T) {
 				workersOutput = append(workersOutput, results)
 			}
 			// merge workers' output
-			resultsCh := GoMerge(workersOutput...)
-			// encode to file
-			// err := goblEncodeToFile(goblFileBetterThanGB(k), resultsCh)
-			// g.Expect(err).To(Succeed())
+			resultsCh := GoMerge(context.Background(), workersOutput...)
+			// to save them to a file, write them to a v2.GobLinesSink with v2.WriteResults
 
 			// just count results
 			count := 0
@@ -469,27 +469,6 @@ func TestAllKAssetPortfolios__Deprecated(t *testing.T) {
 		goblFileBetterThanGB = func(k int) string {
 			return fmt.Sprintf("testdata/snapshot/TestAllKAssetPortfolios_PortfolioStats_k%d_betterThanGoldenButterfly.gobl.gz", k)
 		}
-		t.Run("save asset lists", func(t *testing.T) {
-			t.Skip()
-			g := NewGomegaWithT(t)
-
-			var (
-				output = "testdata/betterThanGoldenButterflyPortfolios.jsonl.gz"
-			)
-			jsonl := make(chan interface{})
-			jsonlErrCh := GoJSONLEncodeToFile(jsonl, output)
-			for k := 1; k <= 11; k++ {
-				input := goblFileBetterThanGB(k)
-				err := goblDecodeFromFile(input, func(stat *PortfolioStat) bool {
-					jsonl <- stat.Assets
-					return true
-				})
-				g.Expect(err).To(Succeed())
-			}
-
-			close(jsonl)
-			g.Expect(<-jsonlErrCh).To(Succeed())
-		})
 		t.Run("convert to CSV", func(t *testing.T) {
 			g := NewGomegaWithT(t)
 
@@ -858,39 +837,6 @@ func TestSingle(t *testing.T) {
 	}
 }
 
-func GoJSONLEncodeToFile(items <-chan interface{}, filename string) <-chan error {
-	startAt := time.Now()
-
-	errorCh := make(chan error)
-
-	go func() (err error) {
-		defer func() {
-			errorCh <- err
-			close(errorCh)
-		}()
-		var count int
-		fmt.Println("JSONL-encoding data to", filename)
-		f, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
-		if err != nil {
-			return err
-		}
-		defer f.Close()
-		gzipWriter := gzip.NewWriter(f)
-		defer gzipWriter.Close()
-		jsonWriter := json.NewEncoder(gzipWriter)
-		for item := range items {
-			count++
-			err = jsonWriter.Encode(item)
-			if err != nil {
-				return fmt.Errorf("error writing row #%d (%s): %w", count, item, err)
-			}
-		}
-		fmt.Println("Finished writing in", time.Since(startAt))
-		return nil
-	}()
-	return errorCh
-}
-
 func mustJSONMarshal(obj interface{}) string {
 	marshal, err := json.Marshal(obj)
 	if err != nil {
@@ -916,29 +862,6 @@ func gobDecodeFromFile(g *GomegaWithT, filename string) []*PortfolioStat {
 	return obj
 }
 
-// goblEncodeToFile writes the GOB-encoded object to a file.
-func goblEncodeToFile(t *testing.T, filename string, obj <-chan *PortfolioStat) error {
-	startAt := time.Now()
-	Log(t, "GOBL-encoding rows to", filename)
-	f, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
-	if err != nil {
-		return err
-	}
-	defer f.Close()
-	gzipWriter := gzip.NewWriter(f)
-	defer gzipWriter.Close()
-	encoder := gob.NewEncoder(gzipWriter)
-	n := 0
-	for o := range obj {
-		n++
-		if err = encoder.Encode(o); err != nil {
-			return err
-		}
-	}
-	Log(t, "Finished writing", n, "rows in", time.Since(startAt))
-	return nil
-}
-
 // goblDecodeFromFile reads the GOB-encoded object from a file.
 func goblDecodeFromFile(filename string, handle func(*PortfolioStat) (shouldContinue bool)) error {
 	startAt := time.Now()
@@ -1201,6 +1124,60 @@ func TestEnumerateCombinations(t *testing.T) {
 	})
 }
 
+func TestGoEnumerateCombinations(t *testing.T) {
+	t.Run("all combinations", func(t *testing.T) {
+		g := NewGomegaWithT(t)
+		var count int
+		for batch := range GoEnumerateCombinations(context.Background(), data.Names(), 2, 100) {
+			count += len(batch)
+		}
+		g.Expect(count).To(Equal(Binomial(len(data.Names()), 2)))
+	})
+	t.Run("cancelled", func(t *testing.T) {
+		g := NewGomegaWithT(t)
+		goroutines := runtime.NumGoroutine()
+		ctx, cancel := context.WithCancel(context.Background())
+		combinationsCh := GoEnumerateCombinations(ctx, data.Names(), 5, 10)
+		<-combinationsCh
+		cancel()
+		var count int
+		for batch := range combinationsCh {
+			count += len(batch)
+		}
+		// only the batches buffered before it was cancelled, and possibly one more that was ready to send
+		g.Expect(count).To(BeNumerically("<=", (1000+1)*10))
+		g.Eventually(runtime.NumGoroutine).Should(BeNumerically("<=", goroutines))
+	})
+}
+
+func TestGoMerge(t *testing.T) {
+	t.Run("all results", func(t *testing.T) {
+		g := NewGomegaWithT(t)
+		a, b := make(chan *PortfolioStat, 2), make(chan *PortfolioStat, 1)
+		a <- &PortfolioStat{PWR30: 1}
+		a <- &PortfolioStat{PWR30: 2}
+		b <- &PortfolioStat{PWR30: 3}
+		close(a)
+		close(b)
+		var pwrs []Percent
+		for stat := range GoMerge(context.Background(), a, b) {
+			pwrs = append(pwrs, stat.PWR30)
+		}
+		g.Expect(pwrs).To(ConsistOf(Percent(1), Percent(2), Percent(3)))
+	})
+	t.Run("cancelled", func(t *testing.T) {
+		g := NewGomegaWithT(t)
+		goroutines := runtime.NumGoroutine()
+		ctx, cancel := context.WithCancel(context.Background())
+		// the inputs are never closed
+		a, b := make(chan *PortfolioStat), make(chan *PortfolioStat)
+		out := GoMerge(ctx, a, b)
+		cancel()
+		g.Eventually(out).Should(BeClosed())
+		g.Eventually(runtime.NumGoroutine).Should(BeNumerically("<=", goroutines))
+	})
+}
+
 // BenchmarkEnumerateCombinations/100_choose_2-12         	1000000000	         0.00119 ns/op
 // BenchmarkEnumerateCombinations/100_choose_3-12         	1000000000	         0.0298 ns/op
 // BenchmarkEnumerateCombinations/50_choose_4-12          	1000000000	         0.0303 ns/op
@@ -1256,3 +1233,163 @@ func Benchmark_portfolioReturnsAltogether(b *testing.B) {
 		}
 	}
 }
+
+func TestRankCombination(t *testing.T) {
+	g := NewGomegaWithT(t)
+	for _, tc := range []struct{ n, k int }{{1, 1}, {5, 1}, {5, 2}, {6, 3}, {7, 7}, {10, 4}} {
+		var (
+			indices = make([]int, tc.n)
+			kBuffer = make([]int, tc.k)
+			rank    = 0
+		)
+		for i := range indices {
+			indices[i] = i
+		}
+		// the ranks follow the order of EnumerateCombinations
+		err := enumerateIndexCombinations(indices, tc.k, kBuffer, func() error {
+			g.Expect(RankCombination(tc.n, kBuffer)).To(Equal(rank), "%v", kBuffer)
+			g.Expect(UnrankCombination(tc.n, tc.k, rank)).To(Equal(kBuffer), "%d", rank)
+			rank++
+			return nil
+		})
+		g.Expect(err).To(Succeed())
+		g.Expect(rank).To(Equal(Binomial(tc.n, tc.k)))
+	}
+}
+
+// enumerateIndexCombinations enumerates the combinations of indices by way of EnumerateCombinations.
+func enumerateIndexCombinations(indices []int, k int, kBuffer []int, combination func() error) error {
+	var (
+		xs       = make([]string, len(indices))
+		xsBuffer = make([]string, k)
+	)
+	for i, index := range indices {
+		xs[i] = strconv.Itoa(index)
+	}
+	return EnumerateCombinations(xs, k, xsBuffer, func() error {
+		for i, x := range xsBuffer {
+			kBuffer[i], _ = strconv.Atoi(x)
+		}
+		return combination()
+	})
+}
+
+func TestEnumerateCombinationsFrom(t *testing.T) {
+	g := NewGomegaWithT(t)
+	xs := []string{"a", "b", "c", "d", "e", "f", "g"}
+	for k := 1; k <= len(xs); k++ {
+		var all []string
+		kBuffer := make([]string, k)
+		g.Expect(EnumerateCombinations(xs, k, kBuffer, func() error {
+			all = append(all, strings.Join(kBuffer, ""))
+			return nil
+		})).To(Succeed())
+
+		for start := 0; start <= len(all); start++ {
+			var rest []string
+			g.Expect(EnumerateCombinationsFrom(xs, k, start, kBuffer, func() error {
+				rest = append(rest, strings.Join(kBuffer, ""))
+				return nil
+			})).To(Succeed())
+			if start == len(all) {
+				g.Expect(rest).To(BeEmpty())
+			} else {
+				g.Expect(rest).To(Equal(all[start:]), "k=%d start=%d", k, start)
+			}
+		}
+	}
+
+	t.Run("stops early", func(t *testing.T) {
+		g := NewGomegaWithT(t)
+		var count int
+		g.Expect(EnumerateCombinationsFrom(xs, 3, 5, make([]string, 3), func() error {
+			count++
+			if count == 2 {
+				return ErrEndEnumeration
+			}
+			return nil
+		})).To(Succeed())
+		g.Expect(count).To(Equal(2))
+	})
+}
+
+func TestGoEnumerateCombinationsFrom(t *testing.T) {
+	g := NewGomegaWithT(t)
+	var combinations [][]string
+	for batch := range GoEnumerateCombinationsFrom(context.Background(), []string{"a", "b", "c", "d", "e"}, 3, 7, 2) {
+		combinations = append(combinations, batch...)
+	}
+	g.Expect(combinations).To(Equal([][]string{{"b", "c", "e"}, {"b", "d", "e"}, {"c", "d", "e"}}))
+}
+
+func TestEnumerateCombinationRange(t *testing.T) {
+	g := NewGomegaWithT(t)
+	xs := []string{"a", "b", "c", "d", "e", "f"}
+	kBuffer := make([]string, 3)
+	var all []string
+	g.Expect(EnumerateCombinations(xs, 3, kBuffer, func() error {
+		all = append(all, strings.Join(kBuffer, ""))
+		return nil
+	})).To(Succeed())
+
+	enumerate := func(start, end int) []string {
+		var res []string
+		g.Expect(EnumerateCombinationRange(xs, 3, start, end, kBuffer, func() error {
+			res = append(res, strings.Join(kBuffer, ""))
+			return nil
+		})).To(Succeed())
+		return res
+	}
+	g.Expect(enumerate(0, 20)).To(Equal(all))
+	g.Expect(enumerate(4, 7)).To(Equal(all[4:7]))
+	g.Expect(enumerate(19, 20)).To(Equal([]string{"def"}))
+	g.Expect(enumerate(5, 5)).To(BeEmpty())
+	g.Expect(enumerate(7, 4)).To(BeEmpty())
+	// the end is clamped to the number of combinations
+	g.Expect(enumerate(18, 100)).To(Equal(all[18:]))
+}
+
+func TestShardRange(t *testing.T) {
+	g := NewGomegaWithT(t)
+	for _, tc := range []struct{ total, shards int }{{0, 3}, {1, 3}, {10, 1}, {10, 3}, {12, 4}, {20, 7}, {3, 5}} {
+		// the shards cover the whole range, in order, without overlapping
+		var (
+			next  = 0
+			sizes []int
+		)
+		for shard := 0; shard < tc.shards; shard++ {
+			start, end := ShardRange(tc.total, shard, tc.shards)
+			g.Expect(start).To(Equal(next), "%+v shard %d", tc, shard)
+			next = end
+			sizes = append(sizes, end-start)
+		}
+		g.Expect(next).To(Equal(tc.total), "%+v", tc)
+		// as evenly as possible
+		sort.Ints(sizes)
+		g.Expect(sizes[len(sizes)-1]-sizes[0]).To(BeNumerically("<=", 1), "%+v", tc)
+	}
+	g.Expect(func() { ShardRange(10, 3, 3) }).To(Panic())
+	g.Expect(func() { ShardRange(10, 0, 0) }).To(Panic())
+}
+
+func TestGoEnumerateCombinationRange(t *testing.T) {
+	g := NewGomegaWithT(t)
+	// the shards' combinations add up to all of the combinations
+	var (
+		names = data.Names()
+		all   = map[string]bool{}
+	)
+	for shard := 0; shard < 3; shard++ {
+		start, end := ShardRange(Binomial(len(names), 3), shard, 3)
+		for batch := range GoEnumerateCombinationRange(context.Background(), names, 3, start, end, 1000) {
+			for _, combination := range batch {
+				key := strings.Join(combination, "|")
+				if all[key] {
+					t.Fatalf("%s is in more than one shard", key)
+				}
+				all[key] = true
+			}
+		}
+	}
+	g.Expect(all).To(HaveLen(Binomial(len(names), 3)))
+}
@@ -1,7 +1,9 @@
 package data
 
 import (
+	"crypto/sha256"
 	"encoding/csv"
+	"encoding/hex"
 	"fmt"
 	"math"
 	"sort"
@@ -59,8 +61,31 @@ func PortfolioReturnsList(assetNames ...string) [][]Percent {
 	return res
 }
 
-// _seriesByName has all of the Series organized by asset name
-var _seriesByName map[string]Series
+// PortfolioInflation returns the annual inflation rates for the years that the given assets overlap,
+// lining up with the returns from PortfolioReturnsList.
+// The Simba data series are all inflation-adjusted, so inflation is derived from the real returns of
+// "Hard Cash", which simply loses the inflation rate each year.
+func PortfolioInflation(assetNames ...string) []Percent {
+	// Hard Cash has data for every year, so including it won't change the overlapping years
+	hardCash := PortfolioReturnsList(append([]string{"Hard Cash"}, assetNames...)...)[0]
+	res := make([]Percent, len(hardCash))
+	for i, r := range hardCash {
+		res[i] = 1/(1+r) - 1
+	}
+	return res
+}
+
+// Revision identifies the revision of the returns data, so anything computed from it can tell when it's changed.
+func Revision() string {
+	return _revision
+}
+
+var (
+	// _seriesByName has all of the Series organized by asset name
+	_seriesByName map[string]Series
+	// _revision is the spreadsheet's revision, and a hash of its content
+	_revision string
+)
 
 func init() {
 	var err error
@@ -68,6 +93,8 @@ func init() {
 	if err != nil {
 		panic(err.Error())
 	}
+	hash := sha256.Sum256([]byte(simbaBacktestingSpreadsheetRev21bTSV))
+	_revision = "simba-rev21b-" + hex.EncodeToString(hash[:])[:12]
 }
 
 // parseSimbaTSV parses TSV content from the Simba Backtesting Spreadsheet,
@@ -55,6 +55,24 @@ func TestPortfolioReturnsList(t *testing.T) {
 	}))
 }
 
+func TestPortfolioInflation(t *testing.T) {
+	g := NewGomegaWithT(t)
+	g.Expect(PortfolioInflation()).To(HaveLen(len(MustFind("Hard Cash").AnnualReturns)))
+
+	// lines up with the returns of the assets
+	inflation := PortfolioInflation("TSM", "Gold")
+	g.Expect(inflation).To(HaveLen(len(PortfolioReturnsList("TSM", "Gold")[0])))
+
+	// 1969 had 6.2% inflation (December to December), and 1974 had 12.3%
+	g.Expect(inflation[0].Float()).To(BeNumerically("~", 0.062, 0.001))
+	g.Expect(inflation[5].Float()).To(BeNumerically("~", 0.123, 0.001))
+}
+
+func TestRevision(t *testing.T) {
+	g := NewGomegaWithT(t)
+	g.Expect(Revision()).To(MatchRegexp(`^simba-rev21b-[0-9a-f]{12}$`))
+}
+
 // Wow, 1 millisecond (1 million nanoseconds)
 // Benchmark_parseSimbaTSV-12    	    1088	   1095898 ns/op
 func Benchmark_parseSimbaTSV(b *testing.B) {
@@ -0,0 +1,515 @@
+package portfolio_analysis
+
+import (
+	"compress/gzip"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"math/rand"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/slatteryjim/portfolio-analysis/data"
+	. "github.com/slatteryjim/portfolio-analysis/types"
+)
+
+// EvolveOptions configures Evolve.
+type EvolveOptions struct {
+	// Universe is the assets to choose from. Defaults to all of the assets in Returns, or the data package.
+	Universe []string
+	// NumAssets is the number of assets in each portfolio. Some of them may be reduced to 0%.
+	NumAssets int
+	// Step is the granularity of the allocations. Defaults to 1%.
+	Step Percent
+	// Objectives are the metrics to improve. The archive holds the Pareto front over all of them.
+	Objectives []*Metric
+	// Constraints must all be satisfied. Portfolios violating them are only kept while there aren't enough others.
+	Constraints []Constraint
+	// PopulationSize defaults to 100.
+	PopulationSize int
+	// Generations is the total number of generations to evolve, including those of a resumed checkpoint. Defaults to 100.
+	Generations int
+	// CrossoverRate is the chance that a child is bred from two parents rather than copied from one. Defaults to 0.7.
+	CrossoverRate float64
+	// SwapRate is the chance that a child swaps one of its assets for another from the universe. Defaults to 0.2.
+	// Every child also moves a random amount of its allocation from one asset to another.
+	SwapRate float64
+	// Seed seeds the search, so it's deterministic, even when resumed from a checkpoint.
+	Seed int64
+	// Checkpoint, if set, is the file the population is saved to after every generation.
+	// ResumeEvolution continues from it.
+	Checkpoint string
+	// Returns has the annual returns of each asset, by name. Defaults to the returns in the data package.
+	Returns map[string][]Percent
+}
+
+// Evolution is the state of an evolutionary search, as saved to a checkpoint.
+type Evolution struct {
+	// Generation is the number of generations evolved so far.
+	Generation int
+	// Evaluations is the number of portfolios evaluated so far. Only the population and archive are checkpointed,
+	// so a resumed search may evaluate some of the earlier portfolios again.
+	Evaluations int
+	// Population is the current population, best first.
+	Population []*PortfolioStat
+	// Best has the best portfolio satisfying the constraints found so far for each objective, by name.
+	Best map[string]*PortfolioStat
+	// Archive is the Pareto front of all the portfolios satisfying the constraints found so far.
+	Archive []*PortfolioStat
+
+	// The options the search started with, which ResumeEvolution requires to be the same, so it continues the same
+	// search. The objectives are the names of the metrics.
+	Seed       int64
+	NumAssets  int
+	Step       Percent
+	Objectives []string
+	Universe   []string
+}
+
+// sameSearch returns an error if the state isn't of a search with the options, which must have their defaults set.
+func (e *Evolution) sameSearch(opts EvolveOptions) error {
+	objectives := metricNames(opts.Objectives)
+	switch {
+	case e.Seed != opts.Seed:
+		return fmt.Errorf("is for the seed %d, not %d", e.Seed, opts.Seed)
+	case e.NumAssets != opts.NumAssets || e.Step != opts.Step:
+		return fmt.Errorf("is for %d assets in steps of %v, not %d in steps of %v", e.NumAssets, e.Step, opts.NumAssets, opts.Step)
+	case !reflect.DeepEqual(e.Objectives, objectives):
+		return fmt.Errorf("is for the objectives %v, not %v", e.Objectives, objectives)
+	case !reflect.DeepEqual(e.Universe, opts.Universe):
+		return fmt.Errorf("is for the universe %v, not %v", e.Universe, opts.Universe)
+	}
+	return nil
+}
+
+func (e Evolution) String() string {
+	var sb strings.Builder
+	sb.WriteString(fmt.Sprintf("Generation %d, %d evaluations, %d in the archive", e.Generation, e.Evaluations, len(e.Archive)))
+	var names []string
+	for name := range e.Best {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		sb.WriteString(fmt.Sprintf("\nBest %s: %v", name, e.Best[name]))
+	}
+	return sb.String()
+}
+
+// Evolve searches the joint space of asset sets and allocations with a genetic algorithm.
+// Each generation breeds children by crossover, moving allocation between assets, and swapping assets, and keeps the
+// best of the parents and children: those satisfying the constraints, by their Pareto front over the objectives.
+//
+// It's for when exhaustively enumerating the combinations of assets and allocations is infeasible.
+func Evolve(opts EvolveOptions) (*Evolution, error) {
+	e, err := newEvolver(opts)
+	if err != nil {
+		return nil, err
+	}
+	if err := e.initialize(); err != nil {
+		return nil, err
+	}
+	return e.run()
+}
+
+// ResumeEvolution continues the search saved in the checkpoint file, until opts.Generations.
+// The options should be the same as those of the original search, so it continues deterministically: it returns an
+// error if the seed, number of assets, step, objectives, or universe differ.
+func ResumeEvolution(checkpoint string, opts EvolveOptions) (*Evolution, error) {
+	e, err := newEvolver(opts)
+	if err != nil {
+		return nil, err
+	}
+	state, err := LoadEvolution(checkpoint)
+	if err != nil {
+		return nil, err
+	}
+	if err := state.sameSearch(e.opts); err != nil {
+		return nil, fmt.Errorf("checkpoint %q %w", checkpoint, err)
+	}
+	if err := e.restore(state); err != nil {
+		return nil, err
+	}
+	return e.run()
+}
+
+// LoadEvolution reads the state of a search from a checkpoint file.
+func LoadEvolution(filename string) (*Evolution, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	gzipReader, err := gzip.NewReader(f)
+	if err != nil {
+		return nil, err
+	}
+	var state Evolution
+	if err := gob.NewDecoder(gzipReader).Decode(&state); err != nil {
+		return nil, fmt.Errorf("decoding checkpoint %q: %w", filename, err)
+	}
+	return &state, nil
+}
+
+// Save writes the state to the file, replacing it only once it's completely written.
+func (e *Evolution) Save(filename string) error {
+	tmp := filename + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	gzipped := gzip.NewWriter(f)
+	if err := gob.NewEncoder(gzipped).Encode(e); err != nil {
+		f.Close()
+		return err
+	}
+	if err := gzipped.Close(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filename)
+}
+
+type evolver struct {
+	opts  EvolveOptions
+	total int
+	state *Evolution
+	// evaluated caches the stats of the portfolios, by their key
+	evaluated map[string]*PortfolioStat
+	archive   *ParetoFrontier
+}
+
+// individual is a portfolio in units of the step, with its assets sorted.
+type individual struct {
+	assets []string
+	units  []int
+}
+
+func (in individual) key() string {
+	return fmt.Sprint(in.assets, in.units)
+}
+
+func newEvolver(opts EvolveOptions) (*evolver, error) {
+	if len(opts.Objectives) == 0 {
+		return nil, errors.New("at least one objective is required")
+	}
+	if opts.Step == 0 {
+		opts.Step = 0.01
+	}
+	if opts.PopulationSize == 0 {
+		opts.PopulationSize = 100
+	}
+	if opts.Generations == 0 {
+		opts.Generations = 100
+	}
+	if opts.CrossoverRate == 0 {
+		opts.CrossoverRate = 0.7
+	}
+	if opts.SwapRate == 0 {
+		opts.SwapRate = 0.2
+	}
+	if len(opts.Universe) == 0 {
+		if opts.Returns != nil {
+			for asset := range opts.Returns {
+				opts.Universe = append(opts.Universe, asset)
+			}
+			sort.Strings(opts.Universe)
+		} else {
+			opts.Universe = data.Names()
+		}
+	}
+	if opts.NumAssets <= 0 || opts.NumAssets > len(opts.Universe) {
+		return nil, fmt.Errorf("the number of assets must be between 1 and %d, got %d", len(opts.Universe), opts.NumAssets)
+	}
+	if opts.Returns != nil {
+		for _, asset := range opts.Universe {
+			if _, ok := opts.Returns[asset]; !ok {
+				return nil, fmt.Errorf("asset not found in map: %q", asset)
+			}
+		}
+	}
+	total, err := toUnits([]Percent{1}, opts.Step)
+	if err != nil {
+		return nil, fmt.Errorf("step doesn't divide evenly into 100%%: %w", err)
+	}
+	return &evolver{
+		opts:      opts,
+		total:     total[0],
+		evaluated: map[string]*PortfolioStat{},
+		archive:   NewParetoFrontier(opts.Objectives...),
+	}, nil
+}
+
+// initialize creates a random population.
+func (e *evolver) initialize() error {
+	e.state = &Evolution{
+		Best:       map[string]*PortfolioStat{},
+		Seed:       e.opts.Seed,
+		NumAssets:  e.opts.NumAssets,
+		Step:       e.opts.Step,
+		Objectives: metricNames(e.opts.Objectives),
+		Universe:   e.opts.Universe,
+	}
+	r := e.rand()
+	for len(e.state.Population) < e.opts.PopulationSize {
+		var in individual
+		for _, i := range r.Perm(len(e.opts.Universe))[:e.opts.NumAssets] {
+			in.assets = append(in.assets, e.opts.Universe[i])
+		}
+		in.units = randomUnits(r, e.opts.NumAssets, e.total)
+		stat, err := e.evaluate(in)
+		if err != nil {
+			return err
+		}
+		e.state.Population = append(e.state.Population, stat)
+	}
+	e.state.Population = e.survivors(e.state.Population)
+	return nil
+}
+
+// restore continues from a saved state, without evaluating the saved portfolios again.
+func (e *evolver) restore(state *Evolution) error {
+	if state.Best == nil {
+		state.Best = map[string]*PortfolioStat{}
+	}
+	e.state = state
+	// the population is cached last, so children matching its members are recognized as duplicates
+	for _, stat := range append(append([]*PortfolioStat(nil), state.Archive...), state.Population...) {
+		in, err := e.individualOf(stat)
+		if err != nil {
+			return err
+		}
+		e.evaluated[in.key()] = stat
+	}
+	for _, stat := range state.Archive {
+		e.archive.Add(stat)
+	}
+	return nil
+}
+
+func (e *evolver) run() (*Evolution, error) {
+	for e.state.Generation < e.opts.Generations {
+		r := e.rand()
+		parents := e.state.Population
+		var children []*PortfolioStat
+		for len(children) < e.opts.PopulationSize {
+			child, err := e.individualOf(e.tournament(r, parents))
+			if err != nil {
+				return nil, err
+			}
+			if r.Float64() < e.opts.CrossoverRate {
+				other, err := e.individualOf(e.tournament(r, parents))
+				if err != nil {
+					return nil, err
+				}
+				child = e.crossover(r, child, other)
+			}
+			e.moveAllocation(r, child)
+			if r.Float64() < e.opts.SwapRate {
+				e.swapAsset(r, child)
+			}
+			stat, err := e.evaluate(child)
+			if err != nil {
+				return nil, err
+			}
+			children = append(children, stat)
+		}
+		e.state.Population = e.survivors(append(append([]*PortfolioStat(nil), parents...), children...))
+		e.state.Generation++
+		e.state.Archive = e.archive.Front()
+		if e.opts.Checkpoint != "" {
+			if err := e.state.Save(e.opts.Checkpoint); err != nil {
+				return nil, fmt.Errorf("saving checkpoint: %w", err)
+			}
+		}
+	}
+	e.state.Archive = e.archive.Front()
+	return e.state, nil
+}
+
+// rand returns the random numbers for the current generation, so a resumed search makes the same choices.
+func (e *evolver) rand() *rand.Rand {
+	return rand.New(rand.NewSource(e.opts.Seed + int64(e.state.Generation)*1_000_003))
+}
+
+func (e *evolver) evaluate(in individual) (*PortfolioStat, error) {
+	sortIndividual(in)
+	key := in.key()
+	if stat, ok := e.evaluated[key]; ok {
+		return stat, nil
+	}
+	percentages := make([]Percent, len(in.units))
+	for i, u := range in.units {
+		percentages[i] = Percent(float64(u) / float64(e.total))
+	}
+	var returnsList [][]Percent
+	if e.opts.Returns == nil {
+		returnsList = data.PortfolioReturnsList(in.assets...)
+	} else {
+		for _, asset := range in.assets {
+			returnsList = append(returnsList, e.opts.Returns[asset])
+		}
+	}
+	returns, err := PortfolioReturns(returnsList, percentages)
+	if err != nil {
+		return nil, err
+	}
+	stat := EvaluatePortfolio(returns, Combination{Assets: in.assets, Percentages: percentages})
+	e.evaluated[key] = stat
+	e.state.Evaluations++
+
+	if e.violation(stat) == 0 {
+		e.archive.Add(stat)
+		for _, m := range e.opts.Objectives {
+			if best, ok := e.state.Best[m.Name]; !ok || m.Better(m.Value(stat), m.Value(best)) {
+				e.state.Best[m.Name] = stat
+			}
+		}
+	}
+	return stat, nil
+}
+
+func (e *evolver) individualOf(stat *PortfolioStat) (individual, error) {
+	units, err := toUnits(stat.Percentages, e.opts.Step)
+	if err != nil {
+		return individual{}, err
+	}
+	return individual{assets: append([]string(nil), stat.Assets...), units: units}, nil
+}
+
+func (e *evolver) violation(p *PortfolioStat) float64 {
+	var total float64
+	for _, c := range e.opts.Constraints {
+		total += c.violation(p)
+	}
+	return total
+}
+
+// survivors returns the best of the distinct portfolios, up to the population size, best first:
+// those satisfying the constraints by their Pareto front, and the rest by their violation of the constraints.
+func (e *evolver) survivors(candidates []*PortfolioStat) []*PortfolioStat {
+	var (
+		seen       = map[*PortfolioStat]bool{}
+		feasible   []*PortfolioStat
+		infeasible []*PortfolioStat
+	)
+	for _, stat := range candidates {
+		if seen[stat] {
+			continue
+		}
+		seen[stat] = true
+		if e.violation(stat) == 0 {
+			feasible = append(feasible, stat)
+		} else {
+			infeasible = append(infeasible, stat)
+		}
+	}
+	var res []*PortfolioStat
+	for _, front := range ParetoFronts(feasible, 0, e.opts.Objectives...) {
+		if len(res) >= e.opts.PopulationSize {
+			break
+		}
+		res = append(res, front...)
+	}
+	if len(res) < e.opts.PopulationSize {
+		sort.SliceStable(infeasible, func(i, j int) bool { return e.violation(infeasible[i]) < e.violation(infeasible[j]) })
+		res = append(res, infeasible...)
+	}
+	if len(res) > e.opts.PopulationSize {
+		res = res[:e.opts.PopulationSize]
+	}
+	return res
+}
+
+// tournament picks the better of two random members of the population, which is sorted best first.
+func (e *evolver) tournament(r *rand.Rand, population []*PortfolioStat) *PortfolioStat {
+	a, b := r.Intn(len(population)), r.Intn(len(population))
+	if b < a {
+		a = b
+	}
+	return population[a]
+}
+
+// crossover breeds a child holding a random selection of its parents' assets, at their average allocation.
+func (e *evolver) crossover(r *rand.Rand, a, b individual) individual {
+	units := map[string]int{}
+	var assets []string
+	for _, parent := range []individual{a, b} {
+		for i, asset := range parent.assets {
+			if _, ok := units[asset]; !ok {
+				assets = append(assets, asset)
+			}
+			units[asset] += parent.units[i]
+		}
+	}
+	r.Shuffle(len(assets), func(i, j int) { assets[i], assets[j] = assets[j], assets[i] })
+	child := individual{assets: assets[:e.opts.NumAssets], units: make([]int, e.opts.NumAssets)}
+	remaining := e.total
+	for i, asset := range child.assets {
+		child.units[i] = units[asset] / 2
+		remaining -= child.units[i]
+	}
+	// hand out what's left, one unit at a time, to random assets
+	for ; remaining > 0; remaining-- {
+		child.units[r.Intn(len(child.units))]++
+	}
+	return child
+}
+
+// moveAllocation moves a random amount, up to a tenth of the total, from one asset to another.
+func (e *evolver) moveAllocation(r *rand.Rand, in individual) {
+	if len(in.units) < 2 {
+		return
+	}
+	from, to := r.Intn(len(in.units)), r.Intn(len(in.units)-1)
+	if to >= from {
+		to++
+	}
+	maxMove := e.total / 10
+	if maxMove < 1 {
+		maxMove = 1
+	}
+	move := r.Intn(maxMove) + 1
+	if move > in.units[from] {
+		move = in.units[from]
+	}
+	in.units[from] -= move
+	in.units[to] += move
+}
+
+// swapAsset replaces one of the assets with another from the universe, keeping its allocation.
+func (e *evolver) swapAsset(r *rand.Rand, in individual) {
+	held := map[string]bool{}
+	for _, asset := range in.assets {
+		held[asset] = true
+	}
+	var others []string
+	for _, asset := range e.opts.Universe {
+		if !held[asset] {
+			others = append(others, asset)
+		}
+	}
+	if len(others) == 0 {
+		return
+	}
+	in.assets[r.Intn(len(in.assets))] = others[r.Intn(len(others))]
+}
+
+// sortIndividual sorts the assets by name, so each portfolio has one key.
+func sortIndividual(in individual) {
+	sort.Sort(individualByAsset(in))
+}
+
+type individualByAsset individual
+
+func (in individualByAsset) Len() int           { return len(in.assets) }
+func (in individualByAsset) Less(i, j int) bool { return in.assets[i] < in.assets[j] }
+func (in individualByAsset) Swap(i, j int) {
+	in.assets[i], in.assets[j] = in.assets[j], in.assets[i]
+	in.units[i], in.units[j] = in.units[j], in.units[i]
+}
@@ -0,0 +1,139 @@
+package portfolio_analysis
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	. "github.com/onsi/gomega"
+
+	. "github.com/slatteryjim/portfolio-analysis/types"
+)
+
+func TestEvolve(t *testing.T) {
+	opts := EvolveOptions{
+		// REIT's returns start later than the others'
+		Universe:       []string{"TSM", "SCV", "LTT", "STT", "GLD"},
+		NumAssets:      3,
+		Step:           0.05,
+		Objectives:     MustMetrics("PWR30", "UlcerScore"),
+		Constraints:    []Constraint{{Metric: MustMetrics("StdDev")[0], Bound: 0.12}},
+		PopulationSize: 30,
+		Generations:    10,
+		Seed:           1,
+		Returns:        assetMap,
+	}
+	t.Run("search", func(t *testing.T) {
+		g := NewGomegaWithT(t)
+		res, err := Evolve(opts)
+		g.Expect(err).To(Succeed())
+		t.Log(res)
+		g.Expect(res.Generation).To(Equal(10))
+		g.Expect(res.Population).To(HaveLen(30))
+		g.Expect(res.Best).To(HaveKey("PWR30"))
+		g.Expect(res.Best).To(HaveKey("UlcerScore"))
+		g.Expect(res.Archive).To(ContainElement(res.Best["PWR30"]))
+
+		// the archive is a Pareto front satisfying the constraints
+		g.Expect(ParetoFront(res.Archive, opts.Objectives...)).To(Equal(res.Archive))
+		for _, stat := range res.Archive {
+			g.Expect(opts.Constraints[0].Satisfied(stat)).To(BeTrue())
+			g.Expect(stat.Assets).To(HaveLen(3))
+			g.Expect(sum(stat.Percentages).Float()).To(BeNumerically("~", 1, 1e-9))
+			g.Expect(stat.PWR30).To(BeNumerically("<=", res.Best["PWR30"].PWR30))
+			g.Expect(stat.UlcerScore).To(BeNumerically(">=", res.Best["UlcerScore"].UlcerScore))
+		}
+		// evolving improves on the initial population
+		initial, err := Evolve(EvolveOptions{Universe: opts.Universe, NumAssets: 3, Step: 0.05, Objectives: opts.Objectives, Constraints: opts.Constraints,
+			PopulationSize: 30, Generations: -1, Seed: 1, Returns: assetMap})
+		g.Expect(err).To(Succeed())
+		g.Expect(initial.Generation).To(Equal(0))
+		g.Expect(res.Best["PWR30"].PWR30).To(BeNumerically(">", initial.Best["PWR30"].PWR30))
+
+		// deterministic
+		again, err := Evolve(opts)
+		g.Expect(err).To(Succeed())
+		g.Expect(again).To(Equal(res))
+	})
+	t.Run("resumed from a checkpoint", func(t *testing.T) {
+		g := NewGomegaWithT(t)
+		uninterrupted, err := Evolve(opts)
+		g.Expect(err).To(Succeed())
+
+		opts := opts
+		opts.Checkpoint = filepath.Join(t.TempDir(), "evolution.gob.gz")
+		opts.Generations = 4
+		_, err = Evolve(opts)
+		g.Expect(err).To(Succeed())
+		saved, err := LoadEvolution(opts.Checkpoint)
+		g.Expect(err).To(Succeed())
+		g.Expect(saved.Generation).To(Equal(4))
+		g.Expect(saved.Population).To(HaveLen(30))
+
+		opts.Generations = 10
+		resumed, err := ResumeEvolution(opts.Checkpoint, opts)
+		g.Expect(err).To(Succeed())
+		g.Expect(resumed.Generation).To(Equal(10))
+		g.Expect(resumed.Evaluations).To(BeNumerically(">=", uninterrupted.Evaluations))
+		g.Expect(resumed.Population).To(Equal(uninterrupted.Population))
+		g.Expect(resumed.Best).To(Equal(uninterrupted.Best))
+		g.Expect(resumed.Archive).To(ConsistOf(uninterrupted.Archive))
+
+		// the final state was checkpointed too
+		saved, err = LoadEvolution(opts.Checkpoint)
+		g.Expect(err).To(Succeed())
+		g.Expect(saved).To(Equal(resumed))
+	})
+	t.Run("errors", func(t *testing.T) {
+		g := NewGomegaWithT(t)
+		_, err := Evolve(EvolveOptions{NumAssets: 3})
+		g.Expect(err).To(MatchError("at least one objective is required"))
+		_, err = Evolve(EvolveOptions{Objectives: opts.Objectives, NumAssets: 7, Returns: assetMap})
+		g.Expect(err).To(MatchError("the number of assets must be between 1 and 6, got 7"))
+		_, err = Evolve(EvolveOptions{Objectives: opts.Objectives, NumAssets: 2, Universe: []string{"TSM", "Foo"}, Returns: assetMap})
+		g.Expect(err).To(MatchError(`asset not found in map: "Foo"`))
+		_, err = ResumeEvolution(filepath.Join(t.TempDir(), "missing"), opts)
+		g.Expect(err).To(HaveOccurred())
+	})
+	t.Run("resuming a different search", func(t *testing.T) {
+		g := NewGomegaWithT(t)
+		opts := opts
+		opts.Checkpoint = filepath.Join(t.TempDir(), "evolution.gob.gz")
+		opts.Generations = 2
+		_, err := Evolve(opts)
+		g.Expect(err).To(Succeed())
+		saved, err := LoadEvolution(opts.Checkpoint)
+		g.Expect(err).To(Succeed())
+		g.Expect(saved.Seed).To(Equal(int64(1)))
+		g.Expect(saved.NumAssets).To(Equal(3))
+		g.Expect(saved.Step).To(Equal(Percent(0.05)))
+		g.Expect(saved.Objectives).To(Equal([]string{"PWR30", "UlcerScore"}))
+		g.Expect(saved.Universe).To(Equal(opts.Universe))
+
+		opts.Generations = 4
+		expectMismatch := func(opts EvolveOptions, message string) {
+			_, err := ResumeEvolution(opts.Checkpoint, opts)
+			g.Expect(err).To(MatchError(fmt.Sprintf("checkpoint %q %s", opts.Checkpoint, message)))
+		}
+		other := opts
+		other.Seed = 2
+		expectMismatch(other, "is for the seed 1, not 2")
+		other = opts
+		other.NumAssets = 2
+		expectMismatch(other, "is for 3 assets in steps of 5%, not 2 in steps of 5%")
+		other = opts
+		other.Step = 0.1
+		expectMismatch(other, "is for 3 assets in steps of 5%, not 3 in steps of 10%")
+		other = opts
+		other.Objectives = MustMetrics("PWR30")
+		expectMismatch(other, "is for the objectives [PWR30 UlcerScore], not [PWR30]")
+		other = opts
+		other.Universe = []string{"TSM", "SCV", "LTT", "STT"}
+		expectMismatch(other, "is for the universe [TSM SCV LTT STT GLD], not [TSM SCV LTT STT]")
+
+		// the same search resumes
+		resumed, err := ResumeEvolution(opts.Checkpoint, opts)
+		g.Expect(err).To(Succeed())
+		g.Expect(resumed.Generation).To(Equal(4))
+	})
+}
@@ -0,0 +1,347 @@
+package portfolio_analysis
+
+import (
+	"fmt"
+	"math"
+	"sync"
+
+	. "github.com/slatteryjim/portfolio-analysis/types"
+)
+
+// metricKernel computes the metrics that look at every window of a portfolio's returns, without allocating.
+// It's the equivalent of minPWRAndSWR, AllPWRs, baselineReturn, startDateSensitivity and drawdownScores, which build
+// slices of every window and of its cumulative growth, in O(n·w) time for n years of w-year windows, or O(n²) for the
+// drawdowns. Instead, the kernel computes the cumulative growth of the returns once, and the sums of its inverses, so
+// each window's growth and harmonic mean are a ratio and a difference of them, and every metric takes O(n) time.
+// The drawdowns are found in one pass, from the last year to the first, with a stack of the lows since each high.
+//
+// As it multiplies and divides in a different order than the functions it replaces, its results aren't identical to
+// theirs. They're within a relative error of 1e-9 for the returns in the data package (see TestMetricKernel), and
+// the metrics computed by the kernel have a Version that's incremented, so values stored by earlier versions aren't
+// used. Its buffers are reused from one portfolio to the next.
+type metricKernel struct {
+	returns []Percent
+	// growth[i] is the cumulative growth of the first i returns, starting with 1,
+	// so the growth of the returns from i to j is growth[j]/growth[i]
+	growth []float64
+	// inverses[i] is the sum of 1/growth[j] for j < i, for the harmonic means of the windows' cumulative growth
+	inverses []float64
+
+	// scratch space
+	values []float64
+	stack  []drawdownLows
+}
+
+// drawdownLows is the lowest point and the sum of the cumulative growth of the years from a high, until the next
+// year that's at least as high.
+type drawdownLows struct {
+	index  int
+	lowest float64
+	sum    float64
+}
+
+// metricKernels holds the kernels that aren't being used, to be reused by the next evaluation.
+var metricKernels = sync.Pool{
+	New: func() any { return new(metricKernel) },
+}
+
+// getMetricKernel returns a kernel prepared for the returns.
+// It should be put back in metricKernels once it's no longer used.
+func getMetricKernel(returns []Percent) *metricKernel {
+	k := metricKernels.Get().(*metricKernel)
+	k.reset(returns)
+	return k
+}
+
+// reset prepares the kernel for the returns, computing their cumulative growth.
+// It panics if a return loses everything, as the growth of any window after it would be undefined.
+func (k *metricKernel) reset(returns []Percent) {
+	k.returns = returns
+	k.growth = append(k.growth[:0], 1)
+	k.inverses = append(k.inverses[:0], 0, 1)
+	growth := 1.0
+	for i, r := range returns {
+		multiplier := r.GrowthMultiplier().Float()
+		if multiplier <= 0 {
+			panic(fmt.Sprintf("returns must be greater than -100%%, but #%d is %v", i+1, r))
+		}
+		growth *= multiplier
+		k.growth = append(k.growth, growth)
+		k.inverses = append(k.inverses, k.inverses[i+1]+1/growth)
+	}
+}
+
+// checkWindows panics, like subSlices, if there aren't nYears of returns.
+func (k *metricKernel) checkWindows(nYears int) {
+	if nYears > len(k.returns) {
+		panic(fmt.Sprintf("n (%d) cannot be greater than the length of the original slice (%d)", nYears, len(k.returns)))
+	}
+}
+
+// windows returns the number of nYears-long windows of the returns, like the length of subSlices.
+func (k *metricKernel) windows(nYears int) int {
+	k.checkWindows(nYears)
+	if len(k.returns) == 0 {
+		return 0
+	}
+	return len(k.returns) - nYears + 1
+}
+
+// cagr is the equivalent of the cagr func, for the nYears returns starting at the index.
+func (k *metricKernel) cagr(start, nYears int) Percent {
+	product := k.growth[start+nYears] / k.growth[start]
+	return Percent(math.Pow(product, 1/float64(nYears)) - 1)
+}
+
+// pwrAndSWR is the equivalent of the pwrAndSWR func, for the nYears returns starting at the index.
+// The harmonic mean of the window's cumulative growth, which starts with 1, is the number of values over the sum of
+// their inverses, and each inverse is the inverse of the cumulative growth since the first year times its growth.
+func (k *metricKernel) pwrAndSWR(start, nYears int) (Percent, Percent) {
+	var (
+		growth   = k.growth[start+nYears] / k.growth[start]
+		inverses = k.growth[start] * (k.inverses[start+nYears+1] - k.inverses[start])
+		length   = Percent(nYears + 1)
+		swr      = length / Percent(inverses) / length
+		pwr      = swr * Percent(1.00-1/growth)
+	)
+	return pwr, swr
+}
+
+// minPWRAndSWR is the equivalent of the minPWRAndSWR func.
+func (k *metricKernel) minPWRAndSWR(nYears int) (Percent, Percent) {
+	if nYears == 0 {
+		return 0, 0
+	}
+	var (
+		minPerpetual = Percent(math.MaxFloat64)
+		minSafe      = Percent(math.MaxFloat64)
+	)
+	for i, n := 0, k.windows(nYears); i < n; i++ {
+		thisPWR, thisSWR := k.pwrAndSWR(i, nYears)
+		if thisSWR < minSafe {
+			minSafe = thisSWR
+		}
+		if thisPWR < minPerpetual {
+			minPerpetual = thisPWR
+		}
+	}
+	return minPerpetual, minSafe
+}
+
+// pwrs is the equivalent of AllPWRs. The PWRs are in the kernel's scratch space, so they're overwritten by the next
+// calculation.
+func (k *metricKernel) pwrs(nYears int) []float64 {
+	k.values = k.values[:0]
+	if nYears == 0 {
+		return k.values
+	}
+	for i, n := 0, k.windows(nYears); i < n; i++ {
+		pwr, _ := k.pwrAndSWR(i, nYears)
+		k.values = append(k.values, pwr.Float())
+	}
+	return k.values
+}
+
+// baselineReturn is the equivalent of the baselineReturn func.
+func (k *metricKernel) baselineReturn(nYears int, percentile Percent) Percent {
+	if len(k.returns) == 0 {
+		return 0
+	}
+	if percentile < 0 || percentile >= 1.00 {
+		panic(fmt.Sprintf("percentile must be in the range [0,1.00) but got %f", percentile))
+	}
+	// the CAGR only grows with the window's growth, so the window at the percentile is the same for both, and only
+	// its CAGR needs computing
+	k.values = k.values[:0]
+	for i, n := 0, k.windows(nYears); i < n; i++ {
+		k.values = append(k.values, k.growth[i+nYears]/k.growth[i])
+	}
+	// selecting the value at the index is the same as sorting them all and indexing it
+	growth := selectNth(k.values, int(Percent(len(k.values))*percentile))
+	return Percent(math.Pow(growth, 1/float64(nYears)) - 1)
+}
+
+// startDateSensitivity is the equivalent of the startDateSensitivity func.
+func (k *metricKernel) startDateSensitivity() Percent {
+	k.checkWindows(20)
+	// each 10-year CAGR is the second half of one 20-year window, and the first half of another
+	k.values = k.values[:0]
+	for i, n := 0, k.windows(10); i < n; i++ {
+		k.values = append(k.values, k.cagr(i, 10).Float())
+	}
+	var worstShortfall, bestImprovement Percent
+	for i, n := 0, k.windows(20); i < n; i++ {
+		var (
+			firstTwenty  = Percent(k.values[i])
+			secondTwenty = Percent(k.values[i+10])
+			diff         = secondTwenty - firstTwenty
+		)
+		if firstTwenty > secondTwenty {
+			if diff < worstShortfall {
+				worstShortfall = diff
+			}
+		} else if diff > bestImprovement {
+			bestImprovement = diff
+		}
+	}
+	return bestImprovement - worstShortfall
+}
+
+// drawdownScores is the equivalent of the drawdownScores func.
+// The drawdown starting at each year lasts until the cumulative growth recovers to where it was, so it covers the
+// years until the next one that's at least as high. Going from the last year to the first, the stack holds the
+// lowest point and the sum of the growth from each of the later highs until the one after it, so each year's
+// drawdown is made of the highs it pops off the stack, because they're lower than it.
+func (k *metricKernel) drawdownScores() (maxUlcerScore float64, deepestDrawdown Percent, longestDrawdown int) {
+	k.stack = k.stack[:0]
+	n := len(k.returns)
+	for i := n; i >= 0; i-- {
+		var (
+			high      = k.growth[i]
+			lows      = drawdownLows{index: i, lowest: high, sum: high}
+			lowest    = math.MaxFloat64
+			sum       float64
+			recovered = true
+		)
+		for len(k.stack) > 0 && k.growth[k.stack[len(k.stack)-1].index] < high {
+			top := k.stack[len(k.stack)-1]
+			k.stack = k.stack[:len(k.stack)-1]
+			lowest = math.Min(lowest, top.lowest)
+			sum += top.sum
+		}
+		// the drawdown lasts until the next year that's at least as high, or until the end
+		end := n + 1
+		if len(k.stack) > 0 {
+			end = k.stack[len(k.stack)-1].index
+		} else {
+			recovered = false
+		}
+		lows.lowest = math.Min(high, lowest)
+		lows.sum += sum
+		k.stack = append(k.stack, lows)
+
+		length := end - i - 1
+		if i == n || length == 0 {
+			continue
+		}
+		score := (float64(length) - sum/high) * 10
+		if !recovered {
+			score *= 2
+		}
+		if score > maxUlcerScore {
+			maxUlcerScore = score
+		}
+		if lowestPoint := Percent(lowest/high - 1); lowestPoint < deepestDrawdown {
+			deepestDrawdown = lowestPoint
+		}
+		if length > longestDrawdown {
+			longestDrawdown = length
+		}
+	}
+	return maxUlcerScore, deepestDrawdown, longestDrawdown
+}
+
+// minOf is the equivalent of MinPWR's minimum, for the values of pwrs.
+func minOf(xs []float64) float64 {
+	res := math.MaxFloat64
+	for _, x := range xs {
+		if x < res {
+			res = x
+		}
+	}
+	return res
+}
+
+// standardDeviation is the equivalent of StandardDeviation, without converting the values to a []Percent.
+func standardDeviation(xs []float64) float64 {
+	n := float64(len(xs))
+	if n == 0 {
+		panic("returns list must not be empty")
+	}
+	var sum float64
+	for _, x := range xs {
+		sum += x
+	}
+	var (
+		avg               = sum / n
+		sumOfSquaredDiffs float64
+	)
+	for _, x := range xs {
+		sumOfSquaredDiffs += math.Pow(x-avg, 2)
+	}
+	return math.Sqrt((1 / n) * sumOfSquaredDiffs)
+}
+
+// slope is the equivalent of Slope, without allocating its x's, which are the percentages 1 through n.
+func slope(ys []float64) float64 {
+	var (
+		n        = len(ys)
+		x        = func(i int) float64 { return ReadablePercent(float64(i) + 1).Float() }
+		xsSum    float64
+		ysSum    float64
+		xsSquare float64
+		ysSquare float64
+	)
+	for i, y := range ys {
+		xsSum += x(i)
+		ysSum += y
+	}
+	xsAvg, ysAvg := xsSum/float64(n), ysSum/float64(n)
+	for i, y := range ys {
+		xsSquare += math.Pow(x(i)-xsAvg, 2)
+		ysSquare += math.Pow(y-ysAvg, 2)
+	}
+	var (
+		xsStddev   = math.Sqrt((1 / float64(n)) * xsSquare)
+		ysStddev   = math.Sqrt((1 / float64(n)) * ysSquare)
+		sumOfStuff float64
+	)
+	for i, y := range ys {
+		sumOfStuff += (x(i) - xsAvg) * (y - ysAvg)
+	}
+	correlation := sumOfStuff / (xsStddev * ysStddev) / float64(n)
+	return correlation * (ysStddev / xsStddev)
+}
+
+// selectNth returns the value that would be at index n if the values were sorted, reordering them in the process.
+// It's Hoare's quickselect, which runs in linear time on average, without allocating.
+func selectNth(xs []float64, n int) float64 {
+	lo, hi := 0, len(xs)-1
+	for lo < hi {
+		// partition around the median of three, so sorted input isn't the worst case
+		mid := lo + (hi-lo)/2
+		if xs[mid] < xs[lo] {
+			xs[mid], xs[lo] = xs[lo], xs[mid]
+		}
+		if xs[hi] < xs[lo] {
+			xs[hi], xs[lo] = xs[lo], xs[hi]
+		}
+		if xs[hi] < xs[mid] {
+			xs[hi], xs[mid] = xs[mid], xs[hi]
+		}
+		pivot := xs[mid]
+		i, j := lo, hi
+		for i <= j {
+			for xs[i] < pivot {
+				i++
+			}
+			for xs[j] > pivot {
+				j--
+			}
+			if i <= j {
+				xs[i], xs[j] = xs[j], xs[i]
+				i++
+				j--
+			}
+		}
+		switch {
+		case n <= j:
+			hi = j
+		case n >= i:
+			lo = i
+		default:
+			return xs[n]
+		}
+	}
+	return xs[n]
+}
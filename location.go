@@ -0,0 +1,277 @@
+package portfolio_analysis
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+
+	"github.com/slatteryjim/portfolio-analysis/data"
+	. "github.com/slatteryjim/portfolio-analysis/types"
+)
+
+// AccountType determines how an account is taxed.
+type AccountType int
+
+const (
+	// Taxable accounts pay taxes on dividends and realized gains every year.
+	Taxable AccountType = iota
+	// TaxDeferred accounts (like a traditional IRA) grow untaxed, but withdrawals are taxed at the ordinary rate.
+	TaxDeferred
+	// Roth accounts are never taxed.
+	Roth
+)
+
+func (t AccountType) String() string {
+	switch t {
+	case Taxable:
+		return "Taxable"
+	case TaxDeferred:
+		return "TaxDeferred"
+	case Roth:
+		return "Roth"
+	}
+	return fmt.Sprintf("AccountType(%d)", int(t))
+}
+
+// Account is one of the accounts holding a portfolio.
+type Account struct {
+	Name string
+	Type AccountType
+	// Balance is the account's share of the whole portfolio.
+	Balance Percent
+}
+
+// AssetLocationParams configures EvaluateAssetLocations.
+type AssetLocationParams struct {
+	Accounts []Account
+	// Step is the granularity of the placements, as a fraction of the whole portfolio (e.g. 0.05).
+	// All of the account balances and asset percentages must be multiples of it.
+	Step Percent
+	// Policy rebalances the holdings within each account.
+	Policy RebalancePolicy
+	Rates  TaxRates
+	// Assets has the tax treatment of each asset in the combination, as used by the taxable accounts.
+	// Defaults to TaxTreatments of the assets.
+	Assets []AssetTaxTreatment
+}
+
+// AssetLocation is one way to place a combination's assets in the accounts, and its after-tax performance.
+type AssetLocation struct {
+	Accounts []Account
+	Assets   []string
+	// Holdings has, for each account, the share of the whole portfolio held in each asset.
+	Holdings [][]Percent
+
+	AfterTax TaxedMetrics
+}
+
+func (l AssetLocation) String() string {
+	var sb strings.Builder
+	for a, account := range l.Accounts {
+		if a > 0 {
+			sb.WriteString(" ")
+		}
+		sb.WriteString(account.Name + ":{")
+		first := true
+		for i, holding := range l.Holdings[a] {
+			if holding == 0 {
+				continue
+			}
+			if !first {
+				sb.WriteString(" ")
+			}
+			first = false
+			sb.WriteString(fmt.Sprintf("%s:%v", l.Assets[i], holding))
+		}
+		sb.WriteString("}")
+	}
+	return fmt.Sprintf("%s CAGR:%0.3f%% PWR:%0.3f%% SWR:%0.3f%%",
+		sb.String(), l.AfterTax.CAGR*100, l.AfterTax.PWR30*100, l.AfterTax.SWR30*100)
+}
+
+// EvaluateAssetLocations searches all of the ways to place the combination's assets in the given accounts,
+// keeping the overall allocation fixed, and evaluates each placement's after-tax performance.
+// Each account is rebalanced on its own, and the tax-deferred accounts are valued after the taxes owed
+// on withdrawal. The results are sorted by after-tax PWR30, best first.
+func EvaluateAssetLocations(p Combination, params AssetLocationParams) ([]AssetLocation, error) {
+	if params.Step <= 0 {
+		return nil, fmt.Errorf("step must be greater than zero")
+	}
+	if params.Policy == nil {
+		params.Policy = RebalanceAnnually
+	}
+	if params.Assets == nil {
+		params.Assets = TaxTreatments(p.Assets...)
+	}
+	if len(params.Assets) != len(p.Assets) {
+		return nil, fmt.Errorf("tax treatments must be given for each asset: got %d treatments for %d assets", len(params.Assets), len(p.Assets))
+	}
+	assetUnits, err := toUnits(p.Percentages, params.Step)
+	if err != nil {
+		return nil, fmt.Errorf("asset percentages: %w", err)
+	}
+	balances := make([]Percent, len(params.Accounts))
+	for a, account := range params.Accounts {
+		balances[a] = account.Balance
+	}
+	accountUnits, err := toUnits(balances, params.Step)
+	if err != nil {
+		return nil, fmt.Errorf("account balances: %w", err)
+	}
+	if sumInts(assetUnits) != sumInts(accountUnits) {
+		return nil, fmt.Errorf("account balances must sum to 100%%, got %v", sum(balances))
+	}
+
+	var (
+		returnsList = data.PortfolioReturnsList(p.Assets...)
+		inflation   = data.PortfolioInflation(p.Assets...)
+		// the account simulations are cached, since the same contents show up in many placements
+		accountValues = map[string][]GrowthMultiplier{}
+		res           []AssetLocation
+	)
+	var simulateAccount = func(account Account, units []int) ([]GrowthMultiplier, error) {
+		key := fmt.Sprint(account.Type, units)
+		if values, ok := accountValues[key]; ok {
+			return values, nil
+		}
+		var (
+			accountReturns    [][]Percent
+			targetAllocations []Percent
+			treatments        []AssetTaxTreatment
+			total             = sumInts(units)
+		)
+		for i, u := range units {
+			if u == 0 {
+				continue
+			}
+			accountReturns = append(accountReturns, returnsList[i])
+			targetAllocations = append(targetAllocations, Percent(u)/Percent(total))
+			treatments = append(treatments, params.Assets[i])
+		}
+		trading := TradingParams{Policy: params.Policy}
+		if account.Type == Taxable {
+			trading.Taxes = &TaxParams{Rates: params.Rates, Assets: treatments, Inflation: inflation}
+		}
+		sim, err := SimulateTrading(accountReturns, targetAllocations, trading)
+		if err != nil {
+			return nil, err
+		}
+		values := cumulativeList(sim.Returns)
+		if account.Type == TaxDeferred {
+			for i := range values {
+				values[i] *= GrowthMultiplier(1 - params.Rates.Ordinary)
+			}
+		}
+		accountValues[key] = values
+		return values, nil
+	}
+
+	err = enumeratePlacements(accountUnits, assetUnits, func(placement [][]int) error {
+		// add up the after-tax value of all the accounts each year
+		portfolioValues := make([]GrowthMultiplier, len(returnsList[0])+1)
+		location := AssetLocation{
+			Accounts: params.Accounts,
+			Assets:   p.Assets,
+			Holdings: make([][]Percent, len(placement)),
+		}
+		for a, units := range placement {
+			location.Holdings[a] = make([]Percent, len(units))
+			for i, u := range units {
+				location.Holdings[a][i] = Percent(u) * params.Step
+			}
+			if accountUnits[a] == 0 {
+				continue
+			}
+			values, err := simulateAccount(params.Accounts[a], units)
+			if err != nil {
+				return err
+			}
+			for year, value := range values {
+				portfolioValues[year] += value * GrowthMultiplier(balances[a])
+			}
+		}
+		returns := make([]Percent, len(returnsList[0]))
+		for year := range returns {
+			returns[year] = Percent(portfolioValues[year+1]/portfolioValues[year]) - 1
+		}
+		location.AfterTax = taxedMetrics(returns)
+		res = append(res, location)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.SliceStable(res, func(i, j int) bool { return res[i].AfterTax.PWR30 > res[j].AfterTax.PWR30 })
+	return res, nil
+}
+
+// enumeratePlacements calls fn with every way to fill the accounts (each holding accountUnits) with the
+// assets (each of assetUnits). The placement is indexed by account, then asset, and is reused between calls.
+func enumeratePlacements(accountUnits, assetUnits []int, fn func(placement [][]int) error) error {
+	placement := make([][]int, len(accountUnits))
+	for a := range placement {
+		placement[a] = make([]int, len(assetUnits))
+	}
+	var (
+		accountRemaining = append([]int(nil), accountUnits...)
+		place            func(asset, account, assetRemaining int) error
+	)
+	place = func(asset, account, assetRemaining int) error {
+		if asset == len(assetUnits) {
+			return fn(placement)
+		}
+		if account == len(accountUnits)-1 {
+			// the last account takes whatever is left of this asset
+			if assetRemaining > accountRemaining[account] {
+				return nil
+			}
+			placement[account][asset] = assetRemaining
+			accountRemaining[account] -= assetRemaining
+			defer func() { accountRemaining[account] += assetRemaining }()
+			if asset+1 == len(assetUnits) {
+				return place(asset+1, 0, 0)
+			}
+			return place(asset+1, 0, assetUnits[asset+1])
+		}
+		maxUnits := assetRemaining
+		if accountRemaining[account] < maxUnits {
+			maxUnits = accountRemaining[account]
+		}
+		for u := 0; u <= maxUnits; u++ {
+			placement[account][asset] = u
+			accountRemaining[account] -= u
+			err := place(asset, account+1, assetRemaining-u)
+			accountRemaining[account] += u
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if len(assetUnits) == 0 || len(accountUnits) == 0 {
+		return nil
+	}
+	return place(0, 0, assetUnits[0])
+}
+
+// toUnits converts the percentages into a whole number of steps, or returns an error if they aren't multiples of the step.
+func toUnits(ps []Percent, step Percent) ([]int, error) {
+	res := make([]int, len(ps))
+	for i, p := range ps {
+		units := math.Round((p / step).Float())
+		if math.Abs(units*step.Float()-p.Float()) > 0.0000001 {
+			return nil, fmt.Errorf("%v is not a multiple of the step %v", p, step)
+		}
+		res[i] = int(units)
+	}
+	return res, nil
+}
+
+func sumInts(xs []int) int {
+	var sum int
+	for _, x := range xs {
+		sum += x
+	}
+	return sum
+}
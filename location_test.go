@@ -0,0 +1,99 @@
+package portfolio_analysis
+
+import (
+	"testing"
+
+	. "github.com/onsi/gomega"
+
+	. "github.com/slatteryjim/portfolio-analysis/types"
+)
+
+func TestEvaluateAssetLocations(t *testing.T) {
+	var (
+		combination = Combination{
+			Assets:      []string{"TSM", "SCV", "LTT", "STT", "Gold"},
+			Percentages: ReadablePercents(20, 20, 20, 20, 20),
+		}
+		rates    = TaxRates{LongTermGains: 0.15, Collectibles: 0.28, Ordinary: 0.32}
+		accounts = []Account{
+			{Name: "Brokerage", Type: Taxable, Balance: 0.4},
+			{Name: "IRA", Type: TaxDeferred, Balance: 0.4},
+			{Name: "Roth", Type: Roth, Balance: 0.2},
+		}
+	)
+	t.Run("errors", func(t *testing.T) {
+		g := NewGomegaWithT(t)
+		_, err := EvaluateAssetLocations(combination, AssetLocationParams{Accounts: accounts})
+		g.Expect(err).To(MatchError("step must be greater than zero"))
+
+		_, err = EvaluateAssetLocations(combination, AssetLocationParams{Accounts: accounts, Step: 0.15})
+		g.Expect(err).To(MatchError("asset percentages: 20% is not a multiple of the step 15%"))
+
+		_, err = EvaluateAssetLocations(combination, AssetLocationParams{Accounts: accounts[:2], Step: 0.2})
+		g.Expect(err).To(MatchError("account balances must sum to 100%, got 80%"))
+	})
+	t.Run("a single account", func(t *testing.T) {
+		g := NewGomegaWithT(t)
+		locations, err := EvaluateAssetLocations(combination, AssetLocationParams{
+			Accounts: []Account{{Name: "Brokerage", Type: Taxable, Balance: 1}},
+			Step:     0.2,
+			Rates:    rates,
+		})
+		g.Expect(err).To(Succeed())
+		g.Expect(locations).To(HaveLen(1))
+
+		stat, err := EvaluateTaxableAccount(combination, TradingParams{
+			Policy: RebalanceAnnually,
+			Taxes:  &TaxParams{Rates: rates, Assets: TaxTreatments(combination.Assets...)},
+		})
+		g.Expect(err).To(Succeed())
+		g.Expect(locations[0].AfterTax.PWR30).To(BeNumerically("~", stat.AfterTax.PWR30, 1e-14))
+	})
+	t.Run("all placements", func(t *testing.T) {
+		g := NewGomegaWithT(t)
+		locations, err := EvaluateAssetLocations(combination, AssetLocationParams{
+			Accounts: accounts,
+			Step:     0.2,
+			Rates:    rates,
+		})
+		g.Expect(err).To(Succeed())
+		// placing 5 assets of one step each into accounts of 2, 2, and 1 steps: 5!/(2!*2!*1!)
+		g.Expect(locations).To(HaveLen(30))
+		for _, l := range locations[:5] {
+			t.Log(l)
+		}
+		for i, l := range locations {
+			// the overall allocation is unchanged
+			for asset := range combination.Assets {
+				var total Percent
+				for a := range accounts {
+					total += l.Holdings[a][asset]
+				}
+				g.Expect(total.Float()).To(BeNumerically("~", 0.2, 1e-15))
+			}
+			if i > 0 {
+				g.Expect(l.AfterTax.PWR30).To(BeNumerically("<=", locations[i-1].AfterTax.PWR30))
+			}
+		}
+	})
+}
+
+func Test_enumeratePlacements(t *testing.T) {
+	g := NewGomegaWithT(t)
+	var placements [][][]int
+	err := enumeratePlacements([]int{1, 2}, []int{2, 1}, func(placement [][]int) error {
+		placements = append(placements, [][]int{
+			append([]int(nil), placement[0]...),
+			append([]int(nil), placement[1]...),
+		})
+		return nil
+	})
+	g.Expect(err).To(Succeed())
+	g.Expect(placements).To(Equal([][][]int{
+		{{0, 1}, {2, 0}},
+		{{1, 0}, {1, 1}},
+	}))
+
+	err = enumeratePlacements([]int{1, 2}, []int{2, 1}, func([][]int) error { return ErrEndEnumeration })
+	g.Expect(err).To(Equal(ErrEndEnumeration))
+}
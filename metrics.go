@@ -0,0 +1,385 @@
+package portfolio_analysis
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	. "github.com/slatteryjim/portfolio-analysis/types"
+)
+
+// Metric describes one of the performance metrics evaluated for every portfolio.
+// PortfolioStat's String, DiffPerformance, AsGoodOrBetterThan, ranking, and the SQLite output
+// all iterate over the registered metrics, so adding a metric only takes a call to RegisterMetric.
+type Metric struct {
+	// Name identifies the metric, and matches its PortfolioStat field for the built-in metrics.
+	Name string
+	// Label is the short name used by PortfolioStat.String. Defaults to Name.
+	Label string
+	// Column is the name of the metric's column in the SQLite output. Defaults to the lowercase Name.
+	Column string
+	// LessIsBetter is true for metrics like StdDev, where a lower value is better.
+	LessIsBetter bool
+	// Format formats a value of the metric. Defaults to "%v".
+	Format func(value float64) string
+	// Compute calculates the metric from a portfolio's returns.
+	Compute func(in *MetricInputs) float64
+	// Cost is the relative expense of Compute. EvaluatePortfolioIfAsGoodOrBetterThan checks the cheaper
+	// metrics first, so it can give up before computing the expensive ones.
+	Cost int
+	// Version identifies how Compute calculates the metric. It should be incremented whenever a change to Compute
+	// changes the metric's values, so the values stored by an earlier version, like v2.EvaluationCache's, aren't used.
+	Version int
+	// Unranked metrics, like the spread of the 10-year PWRs, are only computed for the outputs that write them, like
+	// v2.SQLiteSink, with ComputeUnranked. Portfolios aren't evaluated, compared, ranked or scored on them, and their
+	// values aren't kept in PortfolioStat, so they're left out of Metrics and MetricsByCost.
+	Unranked bool
+
+	// the built-in metrics are stored in their own PortfolioStat fields, the rest in PortfolioStat.Extra.
+	get     func(*PortfolioStat) float64
+	set     func(*PortfolioStat, float64)
+	rankRef func(*PortfolioStat) *Rank
+}
+
+// Value returns the metric's value for the given portfolio.
+func (m *Metric) Value(p *PortfolioStat) float64 {
+	if m.get != nil {
+		return m.get(p)
+	}
+	return p.Extra[m.Name]
+}
+
+// SetValue sets the metric's value for the given portfolio.
+func (m *Metric) SetValue(p *PortfolioStat, value float64) {
+	if m.set != nil {
+		m.set(p, value)
+		return
+	}
+	if p.Extra == nil {
+		p.Extra = map[string]float64{}
+	}
+	p.Extra[m.Name] = value
+}
+
+// Rank returns the portfolio's rank on this metric.
+func (m *Metric) Rank(p *PortfolioStat) Rank {
+	if m.rankRef != nil {
+		return *m.rankRef(p)
+	}
+	return p.ExtraRanks[m.Name]
+}
+
+// SetRank sets the portfolio's rank on this metric.
+func (m *Metric) SetRank(p *PortfolioStat, rank Rank) {
+	if m.rankRef != nil {
+		*m.rankRef(p) = rank
+		return
+	}
+	if p.ExtraRanks == nil {
+		p.ExtraRanks = map[string]Rank{}
+	}
+	p.ExtraRanks[m.Name] = rank
+}
+
+// AsGoodOrBetter returns true if the value a is as good or better than b.
+func (m *Metric) AsGoodOrBetter(a, b float64) bool {
+	if m.LessIsBetter {
+		return a <= b
+	}
+	return a >= b
+}
+
+// Better returns true if the value a is strictly better than b.
+func (m *Metric) Better(a, b float64) bool {
+	if m.LessIsBetter {
+		return a < b
+	}
+	return a > b
+}
+
+func (m *Metric) String() string {
+	return m.Name
+}
+
+// MetricInputs holds a portfolio's returns, and caches the calculations shared by several metrics.
+// Release should be called once the metrics are computed, so the buffers they used can be reused.
+type MetricInputs struct {
+	Returns []Percent
+
+	kernel *metricKernel
+
+	hasWithdrawalRates bool
+	pwr30, swr30       Percent
+
+	hasDrawdowns    bool
+	ulcerScore      float64
+	deepestDrawdown Percent
+	longestDrawdown int
+}
+
+// prepareKernel returns the kernel prepared for the returns.
+func (in *MetricInputs) prepareKernel() *metricKernel {
+	if in.kernel == nil {
+		in.kernel = getMetricKernel(in.Returns)
+	}
+	return in.kernel
+}
+
+// Release returns the buffers used to compute the metrics, to be reused by the next portfolio's metrics.
+// The inputs can still be used afterward, but they'll need new buffers.
+func (in *MetricInputs) Release() {
+	if in.kernel != nil {
+		metricKernels.Put(in.kernel)
+		in.kernel = nil
+	}
+}
+
+// WithdrawalRates returns the minimum 30-year PWR and SWR.
+func (in *MetricInputs) WithdrawalRates() (pwr30, swr30 Percent) {
+	if !in.hasWithdrawalRates {
+		in.pwr30, in.swr30 = in.prepareKernel().minPWRAndSWR(30)
+		in.hasWithdrawalRates = true
+	}
+	return in.pwr30, in.swr30
+}
+
+// Drawdowns returns the scores of drawdownScores.
+func (in *MetricInputs) Drawdowns() (ulcerScore float64, deepestDrawdown Percent, longestDrawdown int) {
+	if !in.hasDrawdowns {
+		in.ulcerScore, in.deepestDrawdown, in.longestDrawdown = in.prepareKernel().drawdownScores()
+		in.hasDrawdowns = true
+	}
+	return in.ulcerScore, in.deepestDrawdown, in.longestDrawdown
+}
+
+var (
+	// metrics is the registry of the ranked metrics, in the order they're displayed.
+	metrics = []*Metric{
+		{
+			Name: "AvgReturn", Label: "AvgReturn", Column: "avg_return", Format: formatPercent(3), Cost: 1,
+			Compute: func(in *MetricInputs) float64 { return average(in.Returns).Float() },
+			get:     func(p *PortfolioStat) float64 { return p.AvgReturn.Float() },
+			set:     func(p *PortfolioStat, v float64) { p.AvgReturn = Percent(v) },
+			rankRef: func(p *PortfolioStat) *Rank { return &p.AvgReturnRank },
+		},
+		{
+			Name: "BaselineLTReturn", Label: "BLT", Column: "baseline_lt_return", Format: formatPercent(3), Cost: 4, Version: 1,
+			Compute: func(in *MetricInputs) float64 { return in.prepareKernel().baselineReturn(15, 0.15).Float() },
+			get:     func(p *PortfolioStat) float64 { return p.BaselineLTReturn.Float() },
+			set:     func(p *PortfolioStat, v float64) { p.BaselineLTReturn = Percent(v) },
+			rankRef: func(p *PortfolioStat) *Rank { return &p.BaselineLTReturnRank },
+		},
+		{
+			Name: "BaselineSTReturn", Label: "BST", Column: "baseline_st_return", Format: formatPercent(3), Cost: 6, Version: 1,
+			Compute: func(in *MetricInputs) float64 { return in.prepareKernel().baselineReturn(3, 0.15).Float() },
+			get:     func(p *PortfolioStat) float64 { return p.BaselineSTReturn.Float() },
+			set:     func(p *PortfolioStat, v float64) { p.BaselineSTReturn = Percent(v) },
+			rankRef: func(p *PortfolioStat) *Rank { return &p.BaselineSTReturnRank },
+		},
+		{
+			Name: "PWR30", Label: "PWR", Column: "pwr30", Format: formatPercent(3), Cost: 3, Version: 1,
+			Compute: func(in *MetricInputs) float64 { pwr30, _ := in.WithdrawalRates(); return pwr30.Float() },
+			get:     func(p *PortfolioStat) float64 { return p.PWR30.Float() },
+			set:     func(p *PortfolioStat, v float64) { p.PWR30 = Percent(v) },
+			rankRef: func(p *PortfolioStat) *Rank { return &p.PWR30Rank },
+		},
+		{
+			Name: "SWR30", Label: "SWR", Column: "swr30", Format: formatPercent(3), Cost: 3, Version: 1,
+			Compute: func(in *MetricInputs) float64 { _, swr30 := in.WithdrawalRates(); return swr30.Float() },
+			get:     func(p *PortfolioStat) float64 { return p.SWR30.Float() },
+			set:     func(p *PortfolioStat, v float64) { p.SWR30 = Percent(v) },
+			rankRef: func(p *PortfolioStat) *Rank { return &p.SWR30Rank },
+		},
+		{
+			Name: "StdDev", Label: "StdDev", Column: "std_dev", LessIsBetter: true, Format: formatPercent(3), Cost: 2,
+			Compute: func(in *MetricInputs) float64 { return StandardDeviation(in.Returns).Float() },
+			get:     func(p *PortfolioStat) float64 { return p.StdDev.Float() },
+			set:     func(p *PortfolioStat, v float64) { p.StdDev = Percent(v) },
+			rankRef: func(p *PortfolioStat) *Rank { return &p.StdDevRank },
+		},
+		{
+			Name: "UlcerScore", Label: "Ulcer", Column: "ulcer_score", LessIsBetter: true, Cost: 5, Version: 1,
+			Format:  func(v float64) string { return fmt.Sprintf("%0.1f", v) },
+			Compute: func(in *MetricInputs) float64 { ulcerScore, _, _ := in.Drawdowns(); return ulcerScore },
+			get:     func(p *PortfolioStat) float64 { return p.UlcerScore },
+			set:     func(p *PortfolioStat, v float64) { p.UlcerScore = v },
+			rankRef: func(p *PortfolioStat) *Rank { return &p.UlcerScoreRank },
+		},
+		{
+			Name: "DeepestDrawdown", Label: "DeepestDrawdown", Column: "deepest_drawdown", Format: formatPercent(2), Cost: 5, Version: 1,
+			Compute: func(in *MetricInputs) float64 { _, deepest, _ := in.Drawdowns(); return deepest.Float() },
+			get:     func(p *PortfolioStat) float64 { return p.DeepestDrawdown.Float() },
+			set:     func(p *PortfolioStat, v float64) { p.DeepestDrawdown = Percent(v) },
+			rankRef: func(p *PortfolioStat) *Rank { return &p.DeepestDrawdownRank },
+		},
+		{
+			Name: "LongestDrawdown", Label: "LongestDrawdown", Column: "longest_drawdown", LessIsBetter: true, Cost: 5, Version: 1,
+			Format:  func(v float64) string { return fmt.Sprintf("%d", int(v)) },
+			Compute: func(in *MetricInputs) float64 { _, _, longest := in.Drawdowns(); return float64(longest) },
+			get:     func(p *PortfolioStat) float64 { return float64(p.LongestDrawdown) },
+			set:     func(p *PortfolioStat, v float64) { p.LongestDrawdown = int(v) },
+			rankRef: func(p *PortfolioStat) *Rank { return &p.LongestDrawdownRank },
+		},
+		{
+			Name: "StartDateSensitivity", Label: "StartDateSensitivity", Column: "startdate_sensitivity", LessIsBetter: true, Format: formatPercent(2), Cost: 7, Version: 1,
+			Compute: func(in *MetricInputs) float64 { return in.prepareKernel().startDateSensitivity().Float() },
+			get:     func(p *PortfolioStat) float64 { return p.StartDateSensitivity.Float() },
+			set:     func(p *PortfolioStat, v float64) { p.StartDateSensitivity = Percent(v) },
+			rankRef: func(p *PortfolioStat) *Rank { return &p.StartDateSensitivityRank },
+		},
+	}
+
+	// unrankedMetrics is the registry of the Unranked metrics, in the order they're written.
+	unrankedMetrics = []*Metric{
+		{
+			Name: "PWR5", Label: "PWR5", Column: "pwr5", Format: formatPercent(3), Cost: 3, Unranked: true,
+			Compute: func(in *MetricInputs) float64 { return minOf(in.prepareKernel().pwrs(5)) },
+		},
+		{
+			Name: "PWR10", Label: "PWR10", Column: "pwr10", Format: formatPercent(3), Cost: 3, Unranked: true,
+			Compute: func(in *MetricInputs) float64 { return minOf(in.prepareKernel().pwrs(10)) },
+		},
+		{
+			Name: "PWR10StdDev", Label: "PWR10StdDev", Column: "pwr10_stdev", LessIsBetter: true, Format: formatPercent(3), Cost: 3, Unranked: true,
+			Compute: func(in *MetricInputs) float64 { return standardDeviation(in.prepareKernel().pwrs(10)) },
+		},
+		{
+			Name: "PWR10Slope", Label: "PWR10Slope", Column: "pwr10_slope", Format: formatPercent(3), Cost: 3, Unranked: true,
+			Compute: func(in *MetricInputs) float64 { return slope(in.prepareKernel().pwrs(10)) },
+		},
+		{
+			Name: "PWR30StdDev", Label: "PWR30StdDev", Column: "pwr30_stdev", LessIsBetter: true, Format: formatPercent(3), Cost: 3, Unranked: true,
+			Compute: func(in *MetricInputs) float64 { return standardDeviation(in.prepareKernel().pwrs(30)) },
+		},
+		{
+			Name: "PWR30Slope", Label: "PWR30Slope", Column: "pwr30_slope", Format: formatPercent(3), Cost: 3, Unranked: true,
+			Compute: func(in *MetricInputs) float64 { return slope(in.prepareKernel().pwrs(30)) },
+		},
+	}
+
+	// metricsByCost is the registry sorted by Cost, for filtering.
+	metricsByCost = sortMetricsByCost(metrics)
+)
+
+// Metrics returns all of the registered metrics that portfolios are ranked on, in the order they're displayed.
+func Metrics() []*Metric {
+	return append([]*Metric(nil), metrics...)
+}
+
+// UnrankedMetrics returns all of the registered Unranked metrics, in the order ComputeUnranked computes them.
+func UnrankedMetrics() []*Metric {
+	return append([]*Metric(nil), unrankedMetrics...)
+}
+
+// ComputeUnranked appends the values of the UnrankedMetrics, in order, computed from a portfolio's returns.
+func ComputeUnranked(values []float64, returns []Percent) []float64 {
+	in := MetricInputs{Returns: returns}
+	defer in.Release()
+	for _, m := range unrankedMetrics {
+		values = append(values, m.Compute(&in))
+	}
+	return values
+}
+
+// MetricsByCost returns all of the registered metrics that portfolios are ranked on, from the cheapest to compute to
+// the most expensive.
+func MetricsByCost() []*Metric {
+	return append([]*Metric(nil), metricsByCost...)
+}
+
+// MetricByName returns the registered metric with the given name.
+func MetricByName(name string) (*Metric, bool) {
+	for _, registered := range [][]*Metric{metrics, unrankedMetrics} {
+		for _, m := range registered {
+			if m.Name == name {
+				return m, true
+			}
+		}
+	}
+	return nil, false
+}
+
+// MustMetrics returns the registered metrics with the given names, panicking if any aren't found.
+func MustMetrics(names ...string) []*Metric {
+	res := make([]*Metric, len(names))
+	for i, name := range names {
+		m, ok := MetricByName(name)
+		if !ok {
+			panic("unknown metric: " + name)
+		}
+		res[i] = m
+	}
+	return res
+}
+
+// metricNames returns the names of the metrics, the inverse of MustMetrics.
+func metricNames(metrics []*Metric) []string {
+	names := make([]string, len(metrics))
+	for i, m := range metrics {
+		names[i] = m.Name
+	}
+	return names
+}
+
+// RegisterMetric adds a metric to the registry, so it is evaluated, ranked, and reported for every portfolio.
+// Its values and ranks are stored in PortfolioStat.Extra and PortfolioStat.ExtraRanks, unless it's Unranked.
+// It isn't safe to call concurrently with evaluations, so metrics should be registered up front (e.g. in an init func).
+func RegisterMetric(m Metric) *Metric {
+	if m.Name == "" {
+		panic("metric must have a name")
+	}
+	if m.Compute == nil {
+		panic(fmt.Sprintf("metric %q must have a Compute func", m.Name))
+	}
+	if _, ok := MetricByName(m.Name); ok {
+		panic(fmt.Sprintf("metric %q is already registered", m.Name))
+	}
+	if m.Label == "" {
+		m.Label = m.Name
+	}
+	if m.Column == "" {
+		m.Column = strings.ToLower(m.Name)
+	}
+	if m.Format == nil {
+		m.Format = func(v float64) string { return fmt.Sprint(v) }
+	}
+	m.get, m.set, m.rankRef = nil, nil, nil
+	registered := &m
+	if m.Unranked {
+		unrankedMetrics = append(unrankedMetrics, registered)
+		return registered
+	}
+	metrics = append(metrics, registered)
+	metricsByCost = sortMetricsByCost(metrics)
+	return registered
+}
+
+// unregisterMetric removes a metric added by RegisterMetric. It's only used by tests.
+func unregisterMetric(m *Metric) {
+	for i, registered := range metrics {
+		if registered == m {
+			metrics = append(metrics[:i:i], metrics[i+1:]...)
+			break
+		}
+	}
+	for i, registered := range unrankedMetrics {
+		if registered == m {
+			unrankedMetrics = append(unrankedMetrics[:i:i], unrankedMetrics[i+1:]...)
+			break
+		}
+	}
+	metricsByCost = sortMetricsByCost(metrics)
+}
+
+func sortMetricsByCost(ms []*Metric) []*Metric {
+	res := append([]*Metric(nil), ms...)
+	sort.SliceStable(res, func(i, j int) bool { return res[i].Cost < res[j].Cost })
+	return res
+}
+
+// formatPercent formats a Percent value as a readable percentage with the given number of decimals.
+func formatPercent(decimals int) func(float64) string {
+	return func(v float64) string {
+		return fmt.Sprintf("%0.*f%%", decimals, v*100)
+	}
+}
@@ -0,0 +1,160 @@
+package portfolio_analysis
+
+import (
+	"testing"
+
+	. "github.com/onsi/gomega"
+
+	. "github.com/slatteryjim/portfolio-analysis/types"
+)
+
+func TestMetrics(t *testing.T) {
+	g := NewGomegaWithT(t)
+	var names []string
+	for _, m := range Metrics() {
+		names = append(names, m.Name)
+	}
+	g.Expect(names).To(Equal([]string{"AvgReturn", "BaselineLTReturn", "BaselineSTReturn", "PWR30", "SWR30",
+		"StdDev", "UlcerScore", "DeepestDrawdown", "LongestDrawdown", "StartDateSensitivity"}))
+
+	pwr30, ok := MetricByName("PWR30")
+	g.Expect(ok).To(BeTrue())
+	stat := MustGoldenButterflyStat()
+	g.Expect(pwr30.Value(stat)).To(Equal(stat.PWR30.Float()))
+	pwr30.SetRank(stat, Rank{Ordinal: 3})
+	g.Expect(stat.PWR30Rank).To(Equal(Rank{Ordinal: 3}))
+
+	_, ok = MetricByName("Nope")
+	g.Expect(ok).To(BeFalse())
+
+	stdDev, _ := MetricByName("StdDev")
+	g.Expect(stdDev.AsGoodOrBetter(0.1, 0.1)).To(BeTrue())
+	g.Expect(stdDev.AsGoodOrBetter(0.1, 0.2)).To(BeTrue())
+	g.Expect(stdDev.Better(0.2, 0.1)).To(BeFalse())
+	g.Expect(pwr30.Better(0.2, 0.1)).To(BeTrue())
+
+	// the same metrics, cheapest first
+	byCost := MetricsByCost()
+	g.Expect(byCost).To(ConsistOf(Metrics()))
+	for i := 1; i < len(byCost); i++ {
+		g.Expect(byCost[i-1].Cost).To(BeNumerically("<=", byCost[i].Cost))
+	}
+}
+
+func TestUnrankedMetrics(t *testing.T) {
+	g := NewGomegaWithT(t)
+	var names []string
+	for _, m := range UnrankedMetrics() {
+		g.Expect(m.Unranked).To(BeTrue(), m.Name)
+		g.Expect(Metrics()).ToNot(ContainElement(m), m.Name)
+		names = append(names, m.Name)
+	}
+	g.Expect(names).To(Equal([]string{"PWR5", "PWR10", "PWR10StdDev", "PWR10Slope", "PWR30StdDev", "PWR30Slope"}))
+	pwr10, ok := MetricByName("PWR10")
+	g.Expect(ok).To(BeTrue())
+	g.Expect(pwr10.Column).To(Equal("pwr10"))
+
+	// they're only computed when they're asked for
+	var (
+		returns     = MustGoldenButterflyStat().MustReturns()
+		pwrs10      = AllPWRs(returns, 10)
+		pwrs30      = AllPWRs(returns, 30)
+		minPWR5, _  = MinPWR(returns, 5)
+		minPWR10, _ = MinPWR(returns, 10)
+	)
+	unranked := ComputeUnranked(nil, returns)
+	for i, expected := range []Percent{
+		minPWR5,
+		minPWR10,
+		StandardDeviation(pwrs10),
+		Slope(pwrs10),
+		StandardDeviation(pwrs30),
+		Slope(pwrs30),
+	} {
+		// the kernel's PWRs are within its tolerance of AllPWRs'
+		g.Expect(unranked[i]).To(BeNumerically("~", expected.Float(), kernelTolerance), names[i])
+	}
+	g.Expect(unranked).To(HaveLen(len(names)))
+	stat := EvaluatePortfolio(returns, GoldenButterflyCombination())
+	g.Expect(stat.Extra).To(BeNil())
+
+	extra := RegisterMetric(Metric{
+		Name:     "CAGR",
+		Unranked: true,
+		Compute:  func(in *MetricInputs) float64 { return cagr(in.Returns).Float() },
+	})
+	defer unregisterMetric(extra)
+	g.Expect(UnrankedMetrics()).To(HaveLen(len(names) + 1))
+	g.Expect(Metrics()).ToNot(ContainElement(extra))
+	g.Expect(ComputeUnranked(nil, returns)).To(HaveLen(len(names) + 1))
+	g.Expect(EvaluatePortfolio(returns, GoldenButterflyCombination()).Extra).To(BeNil())
+}
+
+func TestRegisterMetric(t *testing.T) {
+	g := NewGomegaWithT(t)
+	g.Expect(func() { RegisterMetric(Metric{Name: "PWR30", Compute: func(*MetricInputs) float64 { return 0 }}) }).To(Panic())
+	g.Expect(func() { RegisterMetric(Metric{Name: "CAGR"}) }).To(Panic())
+
+	cagrMetric := RegisterMetric(Metric{
+		Name:    "CAGR",
+		Format:  formatPercent(3),
+		Compute: func(in *MetricInputs) float64 { return cagr(in.Returns).Float() },
+	})
+	defer unregisterMetric(cagrMetric)
+	g.Expect(cagrMetric.Label).To(Equal("CAGR"))
+	g.Expect(cagrMetric.Column).To(Equal("cagr"))
+
+	gb := Combination{Assets: []string{"TSM", "SCV", "LTT", "STT", "GLD"}, Percentages: ReadablePercents(20, 20, 20, 20, 20)}
+	stat := EvaluatePortfolio(GoldenButterfly, gb)
+	g.Expect(stat.Extra).To(Equal(map[string]float64{"CAGR": cagr(GoldenButterfly).Float()}))
+	g.Expect(stat.String()).To(HaveSuffix(" CAGR:5.493%(0)"))
+
+	// the new metric takes part in the comparisons
+	worse := stat.Clone()
+	cagrMetric.SetValue(worse, 0.01)
+	g.Expect(stat.AsGoodOrBetterThan(worse)).To(BeTrue())
+	g.Expect(worse.AsGoodOrBetterThan(stat)).To(BeFalse())
+	g.Expect(stat.DiffPerformance(*worse).Extra["CAGR"]).To(BeNumerically("~", cagr(GoldenButterfly)-0.01, 1e-15))
+	g.Expect(EvaluatePortfolioIfAsGoodOrBetterThan(GoldenButterfly, gb, worse)).ToNot(BeNil())
+	g.Expect(EvaluatePortfolioIfAsGoodOrBetterThan(TSM, gb, worse)).To(BeNil())
+
+	// and in the rankings
+	results := []*PortfolioStat{worse, stat}
+	RankPortfoliosInPlace(results)
+	g.Expect(stat.ExtraRanks["CAGR"].Ordinal).To(Equal(1))
+	g.Expect(worse.ExtraRanks["CAGR"].Ordinal).To(Equal(2))
+	// and in the overall rank, where it's the only difference
+	g.Expect(DefaultScoringProfile().Weights).To(HaveKeyWithValue("CAGR", 1.0))
+	g.Expect(stat.OverallRankScore).To(BeNumerically("<", worse.OverallRankScore))
+	g.Expect(AsGoodOrBetterThan(worse)(stat)).To(BeTrue())
+	g.Expect(AsGoodOrBetterThan(stat)(worse)).To(BeFalse())
+}
+
+func TestPortfolioStat_Clone(t *testing.T) {
+	g := NewGomegaWithT(t)
+	stat := MustGoldenButterflyStat()
+	for i, m := range Metrics() {
+		m.SetRank(stat, Rank{Ordinal: i + 1, Percentage: float64(i)})
+	}
+	stat.Extra = map[string]float64{"Other": 1}
+
+	clone := stat.Clone()
+	g.Expect(clone).To(Equal(stat))
+	// every rank is copied
+	g.Expect(clone.BaselineLTReturnRank.Ordinal).To(Equal(2))
+	g.Expect(clone.BaselineSTReturnRank.Ordinal).To(Equal(3))
+
+	// deep copy
+	clone.Assets[0] = "changed"
+	clone.Extra["Other"] = 2
+	g.Expect(stat.Assets[0]).To(Equal("LTT"))
+	g.Expect(stat.Extra["Other"]).To(Equal(1.0))
+}
+
+func TestEvaluatePortfolioIfAsGoodOrBetterThan(t *testing.T) {
+	g := NewGomegaWithT(t)
+	gb := Combination{Assets: []string{"TSM", "SCV", "LTT", "STT", "GLD"}, Percentages: ReadablePercents(20, 20, 20, 20, 20)}
+	stat := EvaluatePortfolio(GoldenButterfly, gb)
+	g.Expect(EvaluatePortfolioIfAsGoodOrBetterThan(GoldenButterfly, gb, stat)).To(Equal(stat))
+	g.Expect(EvaluatePortfolioIfAsGoodOrBetterThan(TSM, gb, stat)).To(BeNil())
+}
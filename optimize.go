@@ -0,0 +1,279 @@
+package portfolio_analysis
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"sort"
+	"strings"
+
+	"github.com/slatteryjim/portfolio-analysis/data"
+	. "github.com/slatteryjim/portfolio-analysis/types"
+)
+
+// Constraint requires a portfolio's metric to be as good or better than the Bound,
+// e.g. an UlcerScore of at most 5, or a PWR30 of at least 4%.
+type Constraint struct {
+	Metric *Metric
+	Bound  float64
+}
+
+// Satisfied returns true if the portfolio's metric is as good or better than the bound.
+func (c Constraint) Satisfied(p *PortfolioStat) bool {
+	return c.Metric.AsGoodOrBetter(c.Metric.Value(p), c.Bound)
+}
+
+// violation returns how far the portfolio's metric is past the bound, or zero if it's satisfied.
+func (c Constraint) violation(p *PortfolioStat) float64 {
+	if c.Satisfied(p) {
+		return 0
+	}
+	return math.Abs(c.Metric.Value(p) - c.Bound)
+}
+
+func (c Constraint) String() string {
+	op := ">="
+	if c.Metric.LessIsBetter {
+		op = "<="
+	}
+	return fmt.Sprintf("%s %s %s", c.Metric.Name, op, c.Metric.Format(c.Bound))
+}
+
+// OptimizeOptions configures OptimizeAllocation.
+type OptimizeOptions struct {
+	// Objective is the metric to improve: maximized, or minimized if less is better.
+	Objective *Metric
+	// Constraints must all be satisfied. While they aren't, the climb reduces their violation first.
+	Constraints []Constraint
+	// Step is the amount moved from one asset to another at a time. Defaults to 1%.
+	Step Percent
+	// Restarts is the number of additional climbs from random allocations.
+	Restarts int
+	// Seed seeds the random restarts, so the optimization is deterministic.
+	Seed int64
+	// MaxSteps limits the moves of each climb. Defaults to 10,000.
+	MaxSteps int
+	// Returns has the annual returns of each asset, by name. Defaults to the returns in the data package.
+	Returns map[string][]Percent
+}
+
+// Climb is the path one hill-climb took, from its starting allocation to a local optimum.
+type Climb struct {
+	Path []*PortfolioStat
+}
+
+// Start returns the portfolio the climb started from.
+func (c Climb) Start() *PortfolioStat {
+	return c.Path[0]
+}
+
+// End returns the local optimum the climb finished at.
+func (c Climb) End() *PortfolioStat {
+	return c.Path[len(c.Path)-1]
+}
+
+// Optimization is the result of OptimizeAllocation.
+type Optimization struct {
+	// Best is the best portfolio found by any of the climbs.
+	Best *PortfolioStat
+	// Feasible is true if the best portfolio satisfies all of the constraints.
+	Feasible bool
+	// Climbs has the path of each climb: the first starts from the given combination, the rest from random allocations.
+	Climbs []Climb
+	// Evaluations is the number of distinct allocations evaluated.
+	Evaluations int
+}
+
+func (o Optimization) String() string {
+	var sb strings.Builder
+	sb.WriteString(fmt.Sprintf("Best (feasible: %v, %d evaluations): %v", o.Feasible, o.Evaluations, o.Best))
+	for i, c := range o.Climbs {
+		sb.WriteString(fmt.Sprintf("\nClimb #%d, %d steps: %v -> %v", i+1, len(c.Path)-1, c.Start().Percentages, c.End().Percentages))
+	}
+	return sb.String()
+}
+
+// OptimizeAllocation refines the allocation of the combination's assets by local search.
+// Each climb repeatedly makes the best move of one step from one asset to another, until no move
+// improves the objective (or reduces the constraints' violation). Assets can be reduced to 0%.
+// The first climb starts from the given combination, and each restart from a random allocation.
+func OptimizeAllocation(start Combination, opts OptimizeOptions) (*Optimization, error) {
+	if opts.Objective == nil {
+		return nil, errors.New("an objective is required")
+	}
+	if opts.Step == 0 {
+		opts.Step = 0.01
+	}
+	if opts.MaxSteps == 0 {
+		opts.MaxSteps = 10_000
+	}
+	if len(start.Assets) != len(start.Percentages) {
+		return nil, fmt.Errorf("%d assets but %d percentages", len(start.Assets), len(start.Percentages))
+	}
+	total, err := toUnits([]Percent{1}, opts.Step)
+	if err != nil {
+		return nil, fmt.Errorf("step doesn't divide evenly into 100%%: %w", err)
+	}
+	units, err := toUnits(start.Percentages, opts.Step)
+	if err != nil {
+		return nil, err
+	}
+	if sumInts(units) != total[0] {
+		return nil, fmt.Errorf("percentages must sum to 100%%, got %v", sum(start.Percentages))
+	}
+	var returnsList [][]Percent
+	if opts.Returns == nil {
+		returnsList = data.PortfolioReturnsList(start.Assets...)
+	} else {
+		for _, asset := range start.Assets {
+			returns, ok := opts.Returns[asset]
+			if !ok {
+				return nil, fmt.Errorf("asset not found in map: %q", asset)
+			}
+			returnsList = append(returnsList, returns)
+		}
+	}
+
+	o, err := newOptimizer(opts, start.Assets, returnsList)
+	if err != nil {
+		return nil, err
+	}
+	r := rand.New(rand.NewSource(opts.Seed))
+	res := &Optimization{}
+	for i := 0; i <= opts.Restarts; i++ {
+		if i > 0 {
+			units = randomUnits(r, len(start.Assets), o.total)
+		}
+		climb, err := o.climb(units)
+		if err != nil {
+			return nil, err
+		}
+		res.Climbs = append(res.Climbs, climb)
+		if res.Best == nil || o.better(climb.End(), res.Best) {
+			res.Best = climb.End()
+		}
+	}
+	res.Feasible = o.violation(res.Best) == 0
+	res.Evaluations = len(o.evaluated)
+	return res, nil
+}
+
+type optimizer struct {
+	opts   OptimizeOptions
+	assets []string
+	total  int
+	// sweep computes the returns of each allocation from the last one evaluated, which is usually a step or two away
+	sweep *AllocationSweep
+	// evaluated caches the stats of the allocations, by their units
+	evaluated map[string]*PortfolioStat
+}
+
+func newOptimizer(opts OptimizeOptions, assets []string, returnsList [][]Percent) (*optimizer, error) {
+	sweep, err := NewAllocationSweep(returnsList, opts.Step)
+	if err != nil {
+		return nil, err
+	}
+	return &optimizer{
+		opts:      opts,
+		assets:    assets,
+		total:     sweep.Total(),
+		sweep:     sweep,
+		evaluated: map[string]*PortfolioStat{},
+	}, nil
+}
+
+func (o *optimizer) climb(units []int) (Climb, error) {
+	units = append([]int(nil), units...)
+	current, err := o.evaluate(units)
+	if err != nil {
+		return Climb{}, err
+	}
+	climb := Climb{Path: []*PortfolioStat{current}}
+	for len(climb.Path) <= o.opts.MaxSteps {
+		var (
+			best  *PortfolioStat
+			bestI int
+			bestJ int
+		)
+		// move a step from asset i to asset j
+		for i := range units {
+			if units[i] == 0 {
+				continue
+			}
+			for j := range units {
+				if i == j {
+					continue
+				}
+				units[i]--
+				units[j]++
+				stat, err := o.evaluate(units)
+				units[i]++
+				units[j]--
+				if err != nil {
+					return Climb{}, err
+				}
+				if o.better(stat, current) && (best == nil || o.better(stat, best)) {
+					best, bestI, bestJ = stat, i, j
+				}
+			}
+		}
+		if best == nil {
+			break // a local optimum
+		}
+		units[bestI]--
+		units[bestJ]++
+		current = best
+		climb.Path = append(climb.Path, current)
+	}
+	return climb, nil
+}
+
+func (o *optimizer) evaluate(units []int) (*PortfolioStat, error) {
+	key := fmt.Sprint(units)
+	if stat, ok := o.evaluated[key]; ok {
+		return stat, nil
+	}
+	percentages := make([]Percent, len(units))
+	for i, u := range units {
+		percentages[i] = Percent(float64(u) / float64(o.total))
+	}
+	returns, err := o.sweep.SetUnits(units)
+	if err != nil {
+		return nil, err
+	}
+	stat := EvaluatePortfolio(returns, Combination{Assets: o.assets, Percentages: percentages})
+	o.evaluated[key] = stat
+	return stat, nil
+}
+
+// better returns true if a has less constraint violation than b, or the same violation and a better objective.
+func (o *optimizer) better(a, b *PortfolioStat) bool {
+	if va, vb := o.violation(a), o.violation(b); va != vb {
+		return va < vb
+	}
+	return o.opts.Objective.Better(o.opts.Objective.Value(a), o.opts.Objective.Value(b))
+}
+
+func (o *optimizer) violation(p *PortfolioStat) float64 {
+	var total float64
+	for _, c := range o.opts.Constraints {
+		total += c.violation(p)
+	}
+	return total
+}
+
+// randomUnits returns a random split of the total units among n assets, uniformly chosen from all the possible splits.
+func randomUnits(r *rand.Rand, n, total int) []int {
+	// choose n-1 bars among the total+n-1 positions of the "stars and bars"
+	bars := r.Perm(total + n - 1)[:n-1]
+	sort.Ints(bars)
+	res := make([]int, n)
+	prev := -1
+	for i, bar := range bars {
+		res[i] = bar - prev - 1
+		prev = bar
+	}
+	res[n-1] = total + n - 1 - prev - 1
+	return res
+}
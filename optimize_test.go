@@ -0,0 +1,140 @@
+package portfolio_analysis
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+
+	. "github.com/onsi/gomega"
+
+	. "github.com/slatteryjim/portfolio-analysis/types"
+)
+
+func TestConstraint(t *testing.T) {
+	g := NewGomegaWithT(t)
+	ulcer := Constraint{Metric: MustMetrics("UlcerScore")[0], Bound: 3}
+	g.Expect(ulcer.String()).To(Equal("UlcerScore <= 3.0"))
+	g.Expect(ulcer.Satisfied(&PortfolioStat{UlcerScore: 3})).To(BeTrue())
+	g.Expect(ulcer.Satisfied(&PortfolioStat{UlcerScore: 3.5})).To(BeFalse())
+	g.Expect(ulcer.violation(&PortfolioStat{UlcerScore: 3.5})).To(Equal(0.5))
+
+	pwr := Constraint{Metric: MustMetrics("PWR30")[0], Bound: 0.04}
+	g.Expect(pwr.String()).To(Equal("PWR30 >= 4.000%"))
+	g.Expect(pwr.Satisfied(&PortfolioStat{PWR30: 0.041})).To(BeTrue())
+	g.Expect(pwr.Satisfied(&PortfolioStat{PWR30: 0.039})).To(BeFalse())
+}
+
+func TestOptimizeAllocation(t *testing.T) {
+	gb := combinationsGoldenButterfly[0]
+	opts := OptimizeOptions{
+		Objective: MustMetrics("PWR30")[0],
+		Step:      0.05,
+		Restarts:  3,
+		Seed:      1,
+		Returns:   assetMap,
+	}
+	// expectLocalOptimum checks that no single move improves on the climb's end
+	expectLocalOptimum := func(g *WithT, o *optimizer, end *PortfolioStat) {
+		units, err := toUnits(end.Percentages, opts.Step)
+		g.Expect(err).To(Succeed())
+		for i := range units {
+			for j := range units {
+				if i == j || units[i] == 0 {
+					continue
+				}
+				units[i]--
+				units[j]++
+				neighbour, err := o.evaluate(units)
+				g.Expect(err).To(Succeed())
+				g.Expect(o.better(neighbour, end)).To(BeFalse(), "%v beats %v", neighbour.Percentages, end.Percentages)
+				units[i]++
+				units[j]--
+			}
+		}
+	}
+	t.Run("maximize PWR30", func(t *testing.T) {
+		g := NewGomegaWithT(t)
+		res, err := OptimizeAllocation(gb, opts)
+		g.Expect(err).To(Succeed())
+		t.Log(res)
+		g.Expect(res.Feasible).To(BeTrue())
+		g.Expect(res.Climbs).To(HaveLen(4))
+		g.Expect(res.Climbs[0].Start().Percentages).To(Equal(gb.Percentages))
+		g.Expect(res.Best.Assets).To(Equal(gb.Assets))
+		g.Expect(res.Best.PWR30).To(BeNumerically(">", res.Climbs[0].Start().PWR30))
+
+		o, err := newOptimizer(opts, gb.Assets, [][]Percent{TSM, SCV, LTT, STT, GLD})
+		g.Expect(err).To(Succeed())
+		for _, climb := range res.Climbs {
+			g.Expect(res.Best.PWR30).To(BeNumerically(">=", climb.End().PWR30))
+			for i := 1; i < len(climb.Path); i++ {
+				// each step improves, moving 5% from one asset to another
+				g.Expect(climb.Path[i].PWR30).To(BeNumerically(">", climb.Path[i-1].PWR30))
+				var moved Percent
+				for j, p := range climb.Path[i].Percentages {
+					moved += Percent(math.Abs((p - climb.Path[i-1].Percentages[j]).Float()))
+				}
+				g.Expect(moved.Float()).To(BeNumerically("~", 0.1, 1e-9))
+			}
+			// the stats match a regular evaluation
+			returns, err := PortfolioReturns([][]Percent{TSM, SCV, LTT, STT, GLD}, climb.End().Percentages)
+			g.Expect(err).To(Succeed())
+			g.Expect(climb.End()).To(Equal(EvaluatePortfolio(returns, Combination{Assets: gb.Assets, Percentages: climb.End().Percentages})))
+			expectLocalOptimum(g, o, climb.End())
+		}
+
+		// deterministic
+		again, err := OptimizeAllocation(gb, opts)
+		g.Expect(err).To(Succeed())
+		g.Expect(again).To(Equal(res))
+	})
+	t.Run("subject to a constraint", func(t *testing.T) {
+		g := NewGomegaWithT(t)
+		opts := opts
+		opts.Constraints = []Constraint{{Metric: MustMetrics("UlcerScore")[0], Bound: 2}}
+		res, err := OptimizeAllocation(gb, opts)
+		g.Expect(err).To(Succeed())
+		t.Log(res)
+		g.Expect(res.Feasible).To(BeTrue())
+		g.Expect(res.Best.UlcerScore).To(BeNumerically("<=", 2))
+
+		unconstrained, err := OptimizeAllocation(gb, OptimizeOptions{Objective: opts.Objective, Step: opts.Step, Restarts: 3, Seed: 1, Returns: assetMap})
+		g.Expect(err).To(Succeed())
+		g.Expect(res.Best.PWR30).To(BeNumerically("<=", unconstrained.Best.PWR30))
+
+		// infeasible
+		opts.Constraints = []Constraint{{Metric: MustMetrics("UlcerScore")[0], Bound: 0}}
+		res, err = OptimizeAllocation(gb, opts)
+		g.Expect(err).To(Succeed())
+		g.Expect(res.Feasible).To(BeFalse())
+	})
+	t.Run("errors", func(t *testing.T) {
+		g := NewGomegaWithT(t)
+		_, err := OptimizeAllocation(gb, OptimizeOptions{})
+		g.Expect(err).To(MatchError("an objective is required"))
+		_, err = OptimizeAllocation(gb, OptimizeOptions{Objective: opts.Objective, Step: 0.03})
+		g.Expect(err).To(MatchError("step doesn't divide evenly into 100%: 100% is not a multiple of the step 3%"))
+		_, err = OptimizeAllocation(Combination{Assets: []string{"TSM"}, Percentages: ReadablePercents(50)}, opts)
+		g.Expect(err).To(MatchError("percentages must sum to 100%, got 50%"))
+		_, err = OptimizeAllocation(Combination{Assets: []string{"TSM"}, Percentages: ReadablePercents(12)}, opts)
+		g.Expect(err).To(MatchError("12% is not a multiple of the step 5%"))
+		_, err = OptimizeAllocation(Combination{Assets: []string{"Foo"}, Percentages: ReadablePercents(100)}, opts)
+		g.Expect(err).To(MatchError(`asset not found in map: "Foo"`))
+	})
+}
+
+func Test_randomUnits(t *testing.T) {
+	g := NewGomegaWithT(t)
+	r := rand.New(rand.NewSource(1))
+	seen := map[[3]int]int{}
+	for i := 0; i < 1000; i++ {
+		units := randomUnits(r, 3, 4)
+		g.Expect(sumInts(units)).To(Equal(4))
+		seen[[3]int{units[0], units[1], units[2]}]++
+	}
+	// all 15 splits, roughly uniformly
+	g.Expect(seen).To(HaveLen(15))
+	for _, n := range seen {
+		g.Expect(n).To(BeNumerically("~", 1000/15, 30))
+	}
+}
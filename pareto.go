@@ -0,0 +1,148 @@
+package portfolio_analysis
+
+import (
+	"sort"
+)
+
+// Dominates returns true if p is as good or better than the other on all the given metrics,
+// and strictly better on at least one. With no metrics given, all of the registered metrics are compared.
+func (p *PortfolioStat) Dominates(other *PortfolioStat, metrics ...*Metric) bool {
+	return dominates(p, other, metricsOrAll(metrics))
+}
+
+func dominates(p, other *PortfolioStat, metrics []*Metric) bool {
+	better := false
+	for _, m := range metrics {
+		a, b := m.Value(p), m.Value(other)
+		if !m.AsGoodOrBetter(a, b) {
+			return false
+		}
+		if a != b {
+			better = true
+		}
+	}
+	return better
+}
+
+// ParetoFront returns the non-dominated portfolios: those that no other portfolio beats on one of the
+// given metrics without being worse on another. With no metrics given, all of the registered metrics are used.
+// The results are in the order of the first metric, best first. The input isn't modified.
+//
+// It sorts the portfolios lexicographically by the metrics, so a portfolio can only be dominated by one
+// that comes before it, and only needs to be compared against the front found so far.
+func ParetoFront(results []*PortfolioStat, metrics ...*Metric) []*PortfolioStat {
+	metrics = metricsOrAll(metrics)
+	sorted := append([]*PortfolioStat(nil), results...)
+	sortLexicographically(sorted, metrics)
+	return filterFront(sorted, metrics, nil)
+}
+
+// ParetoFronts peels off successive Pareto fronts (up to maxFronts, or all of them if maxFronts <= 0).
+// The first is the ParetoFront, the second is the front of what remains, and so on.
+func ParetoFronts(results []*PortfolioStat, maxFronts int, metrics ...*Metric) [][]*PortfolioStat {
+	metrics = metricsOrAll(metrics)
+	remaining := append([]*PortfolioStat(nil), results...)
+	sortLexicographically(remaining, metrics)
+	var fronts [][]*PortfolioStat
+	for len(remaining) > 0 && (maxFronts <= 0 || len(fronts) < maxFronts) {
+		var rest []*PortfolioStat
+		fronts = append(fronts, filterFront(remaining, metrics, &rest))
+		remaining = rest
+	}
+	return fronts
+}
+
+// filterFront returns the front of the lexicographically sorted portfolios.
+// If dominated isn't nil, the dominated portfolios are appended to it, still sorted.
+func filterFront(sorted []*PortfolioStat, metrics []*Metric, dominated *[]*PortfolioStat) []*PortfolioStat {
+	var front []*PortfolioStat
+	for _, p := range sorted {
+		isDominated := false
+		for _, f := range front {
+			if dominates(f, p, metrics) {
+				isDominated = true
+				break
+			}
+		}
+		if !isDominated {
+			front = append(front, p)
+		} else if dominated != nil {
+			*dominated = append(*dominated, p)
+		}
+	}
+	return front
+}
+
+func sortLexicographically(results []*PortfolioStat, metrics []*Metric) {
+	sort.SliceStable(results, func(i, j int) bool {
+		for _, m := range metrics {
+			a, b := m.Value(results[i]), m.Value(results[j])
+			if a != b {
+				return m.Better(a, b)
+			}
+		}
+		return false
+	})
+}
+
+// ParetoFrontier maintains the Pareto front of a stream of portfolios, so the front of a huge search
+// can be found without holding all of the results in memory. Only the current front is kept.
+type ParetoFrontier struct {
+	metrics []*Metric
+	front   []*PortfolioStat
+}
+
+// NewParetoFrontier returns an empty frontier over the given metrics, or all of the registered metrics if none are given.
+func NewParetoFrontier(metrics ...*Metric) *ParetoFrontier {
+	return &ParetoFrontier{metrics: metricsOrAll(metrics)}
+}
+
+// Add adds the portfolio to the front, unless it's dominated, and drops any portfolios it dominates.
+// Returns true if it was added.
+func (f *ParetoFrontier) Add(p *PortfolioStat) bool {
+	for _, existing := range f.front {
+		if dominates(existing, p, f.metrics) {
+			return false
+		}
+	}
+	// drop the portfolios it dominates, filtering in place
+	kept := f.front[:0]
+	for _, existing := range f.front {
+		if !dominates(p, existing, f.metrics) {
+			kept = append(kept, existing)
+		}
+	}
+	for i := len(kept); i < len(f.front); i++ {
+		f.front[i] = nil // let them be garbage collected
+	}
+	f.front = append(kept, p)
+	return true
+}
+
+// Len returns the number of portfolios on the front.
+func (f *ParetoFrontier) Len() int {
+	return len(f.front)
+}
+
+// Front returns the current front, in the order of the first metric, best first.
+func (f *ParetoFrontier) Front() []*PortfolioStat {
+	res := append([]*PortfolioStat(nil), f.front...)
+	sortLexicographically(res, f.metrics)
+	return res
+}
+
+// ParetoFrontOf reads all of the results from the channel, and returns their Pareto front.
+func ParetoFrontOf(results <-chan *PortfolioStat, metrics ...*Metric) []*PortfolioStat {
+	f := NewParetoFrontier(metrics...)
+	for p := range results {
+		f.Add(p)
+	}
+	return f.Front()
+}
+
+func metricsOrAll(ms []*Metric) []*Metric {
+	if len(ms) == 0 {
+		return metrics
+	}
+	return ms
+}
@@ -0,0 +1,141 @@
+package portfolio_analysis
+
+import (
+	"math/rand"
+	"testing"
+
+	. "github.com/onsi/gomega"
+
+	. "github.com/slatteryjim/portfolio-analysis/types"
+)
+
+func randomStats(n int, seed int64) []*PortfolioStat {
+	r := rand.New(rand.NewSource(seed))
+	res := make([]*PortfolioStat, n)
+	for i := range res {
+		res[i] = &PortfolioStat{
+			PWR30:  Percent(r.Intn(20)) / 1000,
+			StdDev: Percent(r.Intn(20)) / 100,
+			// some ties
+			UlcerScore: float64(r.Intn(3)),
+		}
+	}
+	return res
+}
+
+// bruteForceParetoFront compares every pair.
+func bruteForceParetoFront(results []*PortfolioStat, metrics []*Metric) []*PortfolioStat {
+	var front []*PortfolioStat
+	for _, p := range results {
+		dominated := false
+		for _, other := range results {
+			if other.Dominates(p, metrics...) {
+				dominated = true
+				break
+			}
+		}
+		if !dominated {
+			front = append(front, p)
+		}
+	}
+	return front
+}
+
+func TestPortfolioStat_Dominates(t *testing.T) {
+	g := NewGomegaWithT(t)
+	metrics := MustMetrics("PWR30", "StdDev")
+	a := &PortfolioStat{PWR30: 0.05, StdDev: 0.10}
+	g.Expect(a.Dominates(&PortfolioStat{PWR30: 0.04, StdDev: 0.10}, metrics...)).To(BeTrue())
+	g.Expect(a.Dominates(&PortfolioStat{PWR30: 0.05, StdDev: 0.11}, metrics...)).To(BeTrue())
+	g.Expect(a.Dominates(&PortfolioStat{PWR30: 0.04, StdDev: 0.09}, metrics...)).To(BeFalse())
+	// equal isn't dominated
+	g.Expect(a.Dominates(a, metrics...)).To(BeFalse())
+	// all metrics, by default
+	g.Expect(a.Dominates(&PortfolioStat{PWR30: 0.04, StdDev: 0.10, AvgReturn: 0.01})).To(BeFalse())
+}
+
+func TestParetoFront(t *testing.T) {
+	metrics := MustMetrics("PWR30", "StdDev", "UlcerScore")
+	t.Run("matches brute force", func(t *testing.T) {
+		g := NewGomegaWithT(t)
+		for seed := int64(0); seed < 10; seed++ {
+			stats := randomStats(500, seed)
+			expected := bruteForceParetoFront(stats, metrics)
+			front := ParetoFront(stats, metrics...)
+			g.Expect(front).To(ConsistOf(expected))
+			// sorted by the first metric, best first
+			for i := 1; i < len(front); i++ {
+				g.Expect(front[i].PWR30).To(BeNumerically("<=", front[i-1].PWR30))
+			}
+
+			frontier := NewParetoFrontier(metrics...)
+			for _, p := range stats {
+				frontier.Add(p)
+			}
+			g.Expect(frontier.Len()).To(Equal(len(expected)))
+			g.Expect(frontier.Front()).To(Equal(front))
+		}
+	})
+	t.Run("layered fronts", func(t *testing.T) {
+		g := NewGomegaWithT(t)
+		stats := randomStats(300, 42)
+		fronts := ParetoFronts(stats, 0, metrics...)
+		g.Expect(fronts[0]).To(Equal(ParetoFront(stats, metrics...)))
+		var (
+			total     int
+			remaining = stats
+		)
+		for _, front := range fronts {
+			g.Expect(front).To(ConsistOf(bruteForceParetoFront(remaining, metrics)))
+			remaining = without(remaining, front)
+			total += len(front)
+		}
+		g.Expect(total).To(Equal(len(stats)))
+
+		g.Expect(ParetoFronts(stats, 2, metrics...)).To(Equal(fronts[:2]))
+		g.Expect(ParetoFronts(nil, 2, metrics...)).To(BeEmpty())
+	})
+	t.Run("streamed from a channel", func(t *testing.T) {
+		g := NewGomegaWithT(t)
+		stats := randomStats(200, 7)
+		ch := make(chan *PortfolioStat)
+		go func() {
+			defer close(ch)
+			for _, p := range stats {
+				ch <- p
+			}
+		}()
+		g.Expect(ParetoFrontOf(ch, metrics...)).To(Equal(ParetoFront(stats, metrics...)))
+	})
+	t.Run("rebalance factors of the Golden Butterfly", func(t *testing.T) {
+		g := NewGomegaWithT(t)
+		gb := Combination{Assets: []string{"TSM", "SCV", "LTT", "STT", "GLD"}, Percentages: ReadablePercents(20, 20, 20, 20, 20)}
+		var results []*PortfolioStat
+		for f := 0.0; f <= 1.9; f += 0.1 {
+			returns, err := PortfolioTradingSimulation([][]Percent{TSM, SCV, LTT, STT, GLD}, gb.Percentages, f)
+			g.Expect(err).To(Succeed())
+			stat := EvaluatePortfolio(returns, gb)
+			stat.RebalanceFactor = f
+			results = append(results, stat)
+		}
+		front := ParetoFront(results, MustMetrics("PWR30", "StdDev")...)
+		for _, p := range front {
+			t.Log(p)
+		}
+		g.Expect(front).To(ConsistOf(bruteForceParetoFront(results, MustMetrics("PWR30", "StdDev"))))
+	})
+}
+
+func without(stats, remove []*PortfolioStat) []*PortfolioStat {
+	removed := map[*PortfolioStat]bool{}
+	for _, p := range remove {
+		removed[p] = true
+	}
+	var res []*PortfolioStat
+	for _, p := range stats {
+		if !removed[p] {
+			res = append(res, p)
+		}
+	}
+	return res
+}
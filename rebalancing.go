@@ -0,0 +1,316 @@
+package portfolio_analysis
+
+import (
+	"fmt"
+	"math"
+
+	. "github.com/slatteryjim/portfolio-analysis/types"
+)
+
+// RebalancePolicy decides, at the end of each year, how far to move the portfolio's holdings back
+// towards the target allocations.
+type RebalancePolicy interface {
+	// RebalanceFactor is called at the end of each year (zero-based), after that year's returns have been applied.
+	// holdings are the current value of each asset, and targetAllocations are the desired weights.
+	// It returns 0 to leave the holdings untouched, or 1 to rebalance exactly to the targets.
+	// Other values overshoot or undershoot the transactions.
+	RebalanceFactor(year int, holdings, targetAllocations []Percent) float64
+	String() string
+}
+
+// policyValidator is implemented by the policies that can be misconfigured, so SimulateTrading can reject them
+// before simulating.
+type policyValidator interface {
+	Validate() error
+}
+
+var (
+	// RebalanceAnnually rebalances exactly to the target allocations at the end of every year.
+	// This is what PortfolioReturns assumes.
+	RebalanceAnnually RebalancePolicy = RebalanceEveryNYears(1)
+
+	// NeverRebalance simply buys and holds the initial allocation.
+	NeverRebalance RebalancePolicy = neverRebalance{}
+)
+
+type neverRebalance struct{}
+
+func (neverRebalance) RebalanceFactor(int, []Percent, []Percent) float64 { return 0 }
+func (neverRebalance) String() string                                    { return "Never" }
+
+// RebalanceEveryNYears rebalances exactly to the target allocations at the end of every nth year.
+type RebalanceEveryNYears int
+
+// Validate returns an error unless n is greater than zero.
+func (n RebalanceEveryNYears) Validate() error {
+	if n <= 0 {
+		return fmt.Errorf("RebalanceEveryNYears must be greater than zero but got %d", int(n))
+	}
+	return nil
+}
+
+func (n RebalanceEveryNYears) RebalanceFactor(year int, _, _ []Percent) float64 {
+	if err := n.Validate(); err != nil {
+		panic(err.Error())
+	}
+	if (year+1)%int(n) == 0 {
+		return 1
+	}
+	return 0
+}
+
+func (n RebalanceEveryNYears) String() string {
+	if n == 1 {
+		return "Annually"
+	}
+	return fmt.Sprintf("Every%dYears", int(n))
+}
+
+// RebalanceWithFactor rebalances every year, but scales the transactions by the given factor.
+// Instead of rebalancing exactly, we can overshoot (>1) or undershoot (<1) the transactions, to "juice" it up.
+type RebalanceWithFactor float64
+
+func (f RebalanceWithFactor) RebalanceFactor(int, []Percent, []Percent) float64 { return float64(f) }
+func (f RebalanceWithFactor) String() string                                    { return fmt.Sprintf("Factor%0.2f", float64(f)) }
+
+// RebalanceBands only rebalances (exactly to the targets) once any asset has drifted outside of its tolerance band.
+// An asset is out of band if its weight differs from its target by more than Absolute percentage points,
+// or by more than Relative of its target weight. A zero tolerance disables that check.
+// The popular "5/25 rule" is RebalanceBands{Absolute: 0.05, Relative: 0.25}.
+type RebalanceBands struct {
+	Absolute Percent
+	Relative Percent
+}
+
+func (b RebalanceBands) RebalanceFactor(_ int, holdings, targetAllocations []Percent) float64 {
+	total := sum(holdings)
+	for i, holding := range holdings {
+		var (
+			target = targetAllocations[i]
+			drift  = Percent(math.Abs((holding/total - target).Float()))
+		)
+		if b.Absolute > 0 && drift > b.Absolute {
+			return 1
+		}
+		if b.Relative > 0 && target > 0 && drift/target > b.Relative {
+			return 1
+		}
+	}
+	return 0
+}
+
+func (b RebalanceBands) String() string {
+	return fmt.Sprintf("Bands%v/%v", b.Absolute, b.Relative)
+}
+
+// TradingCosts are charged whenever trades are made, and are deducted from the portfolio's balance.
+type TradingCosts struct {
+	// Proportional is charged on the value of each trade, e.g. 0.001 for a 0.1% commission or spread.
+	Proportional Percent
+	// Fixed is charged for each asset bought or sold, as a fraction of the portfolio's initial balance.
+	// For example, $10 per trade on a $100,000 portfolio would be 0.0001.
+	Fixed Percent
+}
+
+// TradingParams configures SimulateTrading.
+type TradingParams struct {
+	Policy RebalancePolicy
+	Costs  TradingCosts
+	// Taxes simulates a taxable account, if given.
+	Taxes *TaxParams
+}
+
+// TradingSimulation holds the results of SimulateTrading.
+type TradingSimulation struct {
+	// Returns is the portfolio's return for each year, after any trading costs.
+	Returns []Percent
+	// RebalanceCount is the number of years in which any transactions were made.
+	RebalanceCount int
+	// Turnover is the sum of each year's turnover, where a year's turnover is the total value traded
+	// (half of the absolute value of all buys and sells) as a fraction of the portfolio's value.
+	Turnover Percent
+	// Costs is the sum of all trading costs paid, as a fraction of the portfolio's initial balance.
+	Costs Percent
+	// Taxes is the sum of all taxes paid, as a fraction of the portfolio's initial balance (nominal).
+	Taxes Percent
+	// LiquidationTaxes is the taxes that would be owed on the remaining gains if everything were sold at the end.
+	LiquidationTaxes Percent
+	// Years is the ledger of the transactions made at the end of each year.
+	Years []TradingYear
+}
+
+// TradingYear records the transactions made at the end of one year.
+type TradingYear struct {
+	// Transactions is the value bought (positive) or sold (negative) of each asset,
+	// as a fraction of the portfolio's initial balance.
+	Transactions []Percent
+	// Turnover is the total value traded as a fraction of the portfolio's value.
+	Turnover Percent
+	// Costs is the trading costs paid, as a fraction of the portfolio's initial balance.
+	Costs Percent
+	// Taxes is the taxes paid on dividends and realized gains, as a fraction of the portfolio's initial balance.
+	Taxes Percent
+}
+
+// AnnualTurnover returns the average turnover per year.
+func (s TradingSimulation) AnnualTurnover() Percent {
+	if len(s.Returns) == 0 {
+		return 0
+	}
+	return s.Turnover / Percent(len(s.Returns))
+}
+
+// SimulateTrading takes a list of multiple asset returns and the target allocations, and simulates
+// holding the portfolio over the years, using the given policy to decide when to rebalance.
+// The portfolio starts with a balance of 1.00.
+// When simulating a taxable account, the costs and taxes are paid out of the holdings, and the returns are
+// still real returns, even though the simulation itself tracks nominal values.
+func SimulateTrading(returnsList [][]Percent, targetAllocations []Percent, params TradingParams) (*TradingSimulation, error) {
+	if math.Abs(sum(targetAllocations).Float()-1.00) > 0.00000000000001 {
+		return nil, fmt.Errorf("targetAllocations must sum to 100%%, got %v", sum(targetAllocations))
+	}
+	if len(targetAllocations) != len(returnsList) {
+		return nil, fmt.Errorf("lists must have the same length: targetAllocations (%d), returnsList (%d)", len(targetAllocations), len(returnsList))
+	}
+	if params.Policy == nil {
+		return nil, fmt.Errorf("a rebalance policy is required")
+	}
+	if v, ok := params.Policy.(policyValidator); ok {
+		if err := v.Validate(); err != nil {
+			return nil, err
+		}
+	}
+	var (
+		res = &TradingSimulation{
+			Returns: make([]Percent, 0, len(returnsList[0])),
+			Years:   make([]TradingYear, 0, len(returnsList[0])),
+		}
+		// our initial allocation of 1.000 will simply be according to the target allocations.
+		// Shorthand to clone targetAllocations. See: https://github.com/go101/go101/wiki/How-to-efficiently-clone-a-slice%3F
+		allocations = append(targetAllocations[:0:0], targetAllocations...)
+		// slice to reuse for calculations in each iteration
+		eoyAllocation = make([]Percent, len(targetAllocations))
+		year          = 0
+		account       *taxableAccount
+	)
+	if params.Taxes != nil {
+		var err error
+		if account, err = newTaxableAccount(*params.Taxes, targetAllocations, len(returnsList[0])); err != nil {
+			return nil, err
+		}
+	}
+	zipWalk(returnsList, func(oneReturnSet []Percent) {
+		// apply the returns to the current allocation
+		startSum := sum(allocations)
+		var eoySum Percent
+		for i := range allocations {
+			value := allocations[i] * (oneReturnSet[i] + 1)
+			if account != nil {
+				value = account.grow(year, i, allocations[i], oneReturnSet[i])
+			}
+			eoyAllocation[i] = value
+			eoySum += value
+		}
+
+		// update allocations -- calculate the transactions to perform, and apply
+		var (
+			rebalanceFactor = params.Policy.RebalanceFactor(year, eoyAllocation, targetAllocations)
+			ledger          = TradingYear{Transactions: make([]Percent, len(targetAllocations))}
+			traded          Percent
+		)
+		for i := range targetAllocations {
+			target := targetAllocations[i] * eoySum
+			transaction := (target - eoyAllocation[i]) * Percent(rebalanceFactor)
+			allocation := eoyAllocation[i] + transaction
+			if allocation < 0 {
+				panic("no allocation can go below zero! maybe rebalanceFactor is too extreme?")
+			}
+			allocations[i] = allocation
+			ledger.Transactions[i] = transaction
+			if account != nil && transaction != 0 {
+				account.trade(i, transaction)
+			}
+			if transaction != 0 {
+				traded += Percent(math.Abs(transaction.Float()))
+				ledger.Costs += params.Costs.Fixed
+			}
+		}
+		ledger.Costs += traded * params.Costs.Proportional
+		if traded > 0 {
+			res.RebalanceCount++
+			ledger.Turnover = traded / 2 / eoySum
+			res.Turnover += ledger.Turnover
+		}
+		payments := ledger.Costs
+		if account != nil {
+			// the dividend taxes were already paid out of the holdings
+			dividendTaxes, gainsTaxes := account.settleYear()
+			ledger.Taxes = dividendTaxes + gainsTaxes
+			res.Taxes += ledger.Taxes
+			payments += gainsTaxes
+		}
+		if payments > 0 {
+			// pay the costs out of each holding, in proportion to its size
+			remaining := 1 - payments/eoySum
+			if remaining < 0 {
+				panic("trading costs and taxes exceeded the portfolio's balance!")
+			}
+			for i := range allocations {
+				allocations[i] *= remaining
+			}
+			if account != nil {
+				account.scale(remaining)
+			}
+			eoySum -= payments
+		}
+		res.Costs += ledger.Costs
+		yearReturn := (eoySum / startSum) - 1
+		if account != nil && account.Inflation != nil {
+			yearReturn = (yearReturn+1)/(account.Inflation[year]+1) - 1
+		}
+		res.Returns = append(res.Returns, yearReturn)
+		res.Years = append(res.Years, ledger)
+		year++
+	})
+	if account != nil {
+		res.LiquidationTaxes = account.liquidationTaxes()
+	}
+	return res, nil
+}
+
+// RebalanceEvaluation is the performance of one allocation under a particular RebalancePolicy.
+type RebalanceEvaluation struct {
+	Policy         RebalancePolicy
+	Stat           *PortfolioStat
+	RebalanceCount int
+	Turnover       Percent
+	Costs          Percent
+}
+
+func (e RebalanceEvaluation) String() string {
+	return fmt.Sprintf("%v Rebalances:%d Turnover:%0.1f%% Costs:%0.3f%% %v", e.Policy, e.RebalanceCount, e.Turnover*100, e.Costs*100, e.Stat)
+}
+
+// EvaluateRebalancePolicies evaluates the same combination under each of the given policies,
+// so their performance can be compared. The given trading costs are applied to every policy.
+func EvaluateRebalancePolicies(returnsList [][]Percent, p Combination, costs TradingCosts, policies ...RebalancePolicy) ([]RebalanceEvaluation, error) {
+	res := make([]RebalanceEvaluation, 0, len(policies))
+	for _, policy := range policies {
+		sim, err := SimulateTrading(returnsList, p.Percentages, TradingParams{Policy: policy, Costs: costs})
+		if err != nil {
+			return nil, fmt.Errorf("policy %v: %w", policy, err)
+		}
+		stat := EvaluatePortfolio(sim.Returns, p)
+		if f, ok := policy.(RebalanceWithFactor); ok {
+			stat.RebalanceFactor = float64(f)
+		}
+		res = append(res, RebalanceEvaluation{
+			Policy:         policy,
+			Stat:           stat,
+			RebalanceCount: sim.RebalanceCount,
+			Turnover:       sim.Turnover,
+			Costs:          sim.Costs,
+		})
+	}
+	return res, nil
+}
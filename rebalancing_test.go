@@ -0,0 +1,222 @@
+package portfolio_analysis
+
+import (
+	"testing"
+
+	. "github.com/onsi/gomega"
+
+	. "github.com/slatteryjim/portfolio-analysis/types"
+)
+
+func TestRebalancePolicies(t *testing.T) {
+	var (
+		holdings          = ReadablePercents(60, 40)
+		targetAllocations = ReadablePercents(50, 50)
+	)
+	t.Run("NeverRebalance", func(t *testing.T) {
+		g := NewGomegaWithT(t)
+		for year := 0; year < 5; year++ {
+			g.Expect(NeverRebalance.RebalanceFactor(year, holdings, targetAllocations)).To(Equal(0.0))
+		}
+		g.Expect(NeverRebalance.String()).To(Equal("Never"))
+	})
+	t.Run("RebalanceEveryNYears", func(t *testing.T) {
+		g := NewGomegaWithT(t)
+		var factors []float64
+		for year := 0; year < 6; year++ {
+			factors = append(factors, RebalanceEveryNYears(3).RebalanceFactor(year, holdings, targetAllocations))
+		}
+		g.Expect(factors).To(Equal([]float64{0, 0, 1, 0, 0, 1}))
+		g.Expect(RebalanceAnnually.RebalanceFactor(0, holdings, targetAllocations)).To(Equal(1.0))
+		g.Expect(RebalanceAnnually.String()).To(Equal("Annually"))
+		g.Expect(RebalanceEveryNYears(3).String()).To(Equal("Every3Years"))
+
+		g.Expect(RebalanceEveryNYears(3).Validate()).To(Succeed())
+		g.Expect(RebalanceEveryNYears(0).Validate()).To(MatchError("RebalanceEveryNYears must be greater than zero but got 0"))
+		g.Expect(func() {
+			RebalanceEveryNYears(0).RebalanceFactor(0, holdings, targetAllocations)
+		}).To(Panic())
+	})
+	t.Run("RebalanceWithFactor", func(t *testing.T) {
+		g := NewGomegaWithT(t)
+		g.Expect(RebalanceWithFactor(1.5).RebalanceFactor(0, holdings, targetAllocations)).To(Equal(1.5))
+		g.Expect(RebalanceWithFactor(1.5).String()).To(Equal("Factor1.50"))
+	})
+	t.Run("RebalanceBands", func(t *testing.T) {
+		g := NewGomegaWithT(t)
+		fiveTwentyFive := RebalanceBands{Absolute: 0.05, Relative: 0.25}
+		g.Expect(fiveTwentyFive.String()).To(Equal("Bands5%/25%"))
+
+		// within 5 percentage points
+		g.Expect(fiveTwentyFive.RebalanceFactor(0, ReadablePercents(54, 46), targetAllocations)).To(Equal(0.0))
+		// drifted more than 5 percentage points
+		g.Expect(fiveTwentyFive.RebalanceFactor(0, ReadablePercents(56, 44), targetAllocations)).To(Equal(1.0))
+		// a small allocation drifted by more than 25% of its target
+		g.Expect(fiveTwentyFive.RebalanceFactor(0, ReadablePercents(86, 14), ReadablePercents(90, 10))).To(Equal(1.0))
+		g.Expect(fiveTwentyFive.RebalanceFactor(0, ReadablePercents(88, 12), ReadablePercents(90, 10))).To(Equal(0.0))
+		// holdings don't need to sum to 1
+		g.Expect(fiveTwentyFive.RebalanceFactor(0, ReadablePercents(108, 92), targetAllocations)).To(Equal(0.0))
+		g.Expect(fiveTwentyFive.RebalanceFactor(0, ReadablePercents(120, 80), targetAllocations)).To(Equal(1.0))
+		// zero tolerances are disabled
+		g.Expect(RebalanceBands{}.RebalanceFactor(0, ReadablePercents(99, 1), targetAllocations)).To(Equal(0.0))
+	})
+}
+
+func TestSimulateTrading(t *testing.T) {
+	var (
+		assets = [][]Percent{
+			ReadablePercents(20, 20, 20), // first asset greatly outperforms second
+			ReadablePercents(0, 0, 0),
+		}
+		targetAllocations = ReadablePercents(50, 50)
+	)
+	t.Run("errors", func(t *testing.T) {
+		g := NewGomegaWithT(t)
+		_, err := SimulateTrading(nil, nil, TradingParams{Policy: RebalanceAnnually})
+		g.Expect(err).To(MatchError("targetAllocations must sum to 100%, got 0%"))
+	})
+	t.Run("annually", func(t *testing.T) {
+		g := NewGomegaWithT(t)
+		sim, err := SimulateTrading(assets, targetAllocations, TradingParams{Policy: RebalanceAnnually})
+		g.Expect(err).To(Succeed())
+		// the returns of PortfolioTradingSimulation with a factor of 1, before it delegated to SimulateTrading
+		g.Expect(sim.Returns).To(Equal([]Percent{0.10000000000000009, 0.09999999999999987, 0.10000000000000009}))
+		g.Expect(sim.RebalanceCount).To(Equal(3))
+		// each year the first asset grows to 0.6 of 1.1, so 0.05 of 1.1 is traded
+		g.Expect(sim.Turnover.Float()).To(BeNumerically("~", 3*0.05/1.1, 1e-15))
+		g.Expect(sim.AnnualTurnover().Float()).To(BeNumerically("~", 0.05/1.1, 1e-15))
+	})
+	t.Run("never rebalancing has no turnover", func(t *testing.T) {
+		g := NewGomegaWithT(t)
+		sim, err := SimulateTrading(assets, targetAllocations, TradingParams{Policy: NeverRebalance})
+		g.Expect(err).To(Succeed())
+		// the returns of PortfolioTradingSimulation with a factor of 0, before it delegated to SimulateTrading
+		g.Expect(sim.Returns).To(Equal([]Percent{0.10000000000000009, 0.1090909090909089, 0.11803278688524577}))
+		g.Expect(sim.RebalanceCount).To(Equal(0))
+		g.Expect(sim.Turnover).To(Equal(Percent(0)))
+	})
+	t.Run("every 2 years", func(t *testing.T) {
+		g := NewGomegaWithT(t)
+		sim, err := SimulateTrading(assets, targetAllocations, TradingParams{Policy: RebalanceEveryNYears(2)})
+		g.Expect(err).To(Succeed())
+		g.Expect(sim.RebalanceCount).To(Equal(1))
+		g.Expect(sim.Returns).To(Equal([]Percent{0.10000000000000009, 0.1090909090909089, 0.10000000000000009}))
+	})
+	t.Run("bands only rebalance once drifted", func(t *testing.T) {
+		g := NewGomegaWithT(t)
+		sim, err := SimulateTrading(assets, targetAllocations, TradingParams{Policy: RebalanceBands{Absolute: 0.06}})
+		g.Expect(err).To(Succeed())
+		// weights drift to 54.5%, then 59.0% (rebalance), then 54.5%
+		g.Expect(sim.RebalanceCount).To(Equal(1))
+	})
+	t.Run("overshooting", func(t *testing.T) {
+		g := NewGomegaWithT(t)
+		sim, err := SimulateTrading(assets, targetAllocations, TradingParams{Policy: RebalanceWithFactor(1.5)})
+		g.Expect(err).To(Succeed())
+		// the returns of PortfolioTradingSimulation with a factor of 1.5, before it delegated to SimulateTrading
+		g.Expect(sim.Returns).To(Equal([]Percent{0.10000000000000009, 0.09545454545454546, 0.09771784232365155}))
+	})
+	t.Run("policy is required", func(t *testing.T) {
+		g := NewGomegaWithT(t)
+		_, err := SimulateTrading(assets, targetAllocations, TradingParams{})
+		g.Expect(err).To(MatchError("a rebalance policy is required"))
+	})
+	t.Run("policy is validated", func(t *testing.T) {
+		g := NewGomegaWithT(t)
+		_, err := SimulateTrading(assets, targetAllocations, TradingParams{Policy: RebalanceEveryNYears(0)})
+		g.Expect(err).To(MatchError("RebalanceEveryNYears must be greater than zero but got 0"))
+		_, err = SimulateTrading(assets, targetAllocations, TradingParams{Policy: RebalanceEveryNYears(-1)})
+		g.Expect(err).To(MatchError("RebalanceEveryNYears must be greater than zero but got -1"))
+	})
+	t.Run("transaction ledger", func(t *testing.T) {
+		g := NewGomegaWithT(t)
+		sim, err := SimulateTrading(assets, targetAllocations, TradingParams{Policy: RebalanceEveryNYears(2)})
+		g.Expect(err).To(Succeed())
+		g.Expect(sim.Years).To(HaveLen(3))
+		g.Expect(sim.Years[0]).To(Equal(TradingYear{Transactions: []Percent{0, 0}}))
+		// after two years, the first asset has grown to 0.72 and the second is still 0.5
+		rebalance := sim.Years[1]
+		g.Expect(rebalance.Transactions[0].Float()).To(BeNumerically("~", -0.11, 1e-15))
+		g.Expect(rebalance.Transactions[1].Float()).To(BeNumerically("~", 0.11, 1e-15))
+		g.Expect(rebalance.Turnover.Float()).To(BeNumerically("~", 0.11/1.22, 1e-15))
+		g.Expect(rebalance.Costs).To(Equal(Percent(0)))
+		g.Expect(sim.Costs).To(Equal(Percent(0)))
+	})
+	t.Run("trading costs are deducted from the balance", func(t *testing.T) {
+		g := NewGomegaWithT(t)
+		free, err := SimulateTrading(assets, targetAllocations, TradingParams{Policy: RebalanceAnnually})
+		g.Expect(err).To(Succeed())
+		sim, err := SimulateTrading(assets, targetAllocations, TradingParams{
+			Policy: RebalanceAnnually,
+			Costs:  TradingCosts{Proportional: 0.01, Fixed: 0.001},
+		})
+		g.Expect(err).To(Succeed())
+		g.Expect(sim.Turnover).To(Equal(free.Turnover))
+
+		// first year: traded 0.05 each way, so 1% of 0.1, plus two fixed costs
+		firstYearCosts := 0.01*0.1 + 2*0.001
+		g.Expect(sim.Years[0].Costs.Float()).To(BeNumerically("~", firstYearCosts, 1e-15))
+		g.Expect(sim.Returns[0].Float()).To(BeNumerically("~", 0.1-firstYearCosts, 1e-15))
+		for i := range sim.Returns {
+			g.Expect(sim.Returns[i]).To(BeNumerically("<", free.Returns[i]))
+		}
+		var totalCosts Percent
+		for _, year := range sim.Years {
+			totalCosts += year.Costs
+		}
+		g.Expect(sim.Costs).To(Equal(totalCosts))
+	})
+	t.Run("costs can't exceed the balance", func(t *testing.T) {
+		g := NewGomegaWithT(t)
+		g.Expect(func() {
+			_, _ = SimulateTrading(assets, targetAllocations, TradingParams{
+				Policy: RebalanceAnnually,
+				Costs:  TradingCosts{Fixed: 1},
+			})
+		}).To(Panic())
+	})
+}
+
+func TestEvaluateRebalancePolicies(t *testing.T) {
+	g := NewGomegaWithT(t)
+	combination := Combination{
+		Assets:      []string{"TSM", "SCV", "LTT", "STT", "GLD"},
+		Percentages: ReadablePercents(20, 20, 20, 20, 20),
+	}
+	evaluations, err := EvaluateRebalancePolicies([][]Percent{TSM, SCV, LTT, STT, GLD}, combination, TradingCosts{},
+		RebalanceAnnually, RebalanceEveryNYears(3), RebalanceBands{Absolute: 0.05, Relative: 0.25}, NeverRebalance, RebalanceWithFactor(1.5))
+	g.Expect(err).To(Succeed())
+	g.Expect(evaluations).To(HaveLen(5))
+	for _, e := range evaluations {
+		t.Log(e)
+	}
+
+	annually := evaluations[0]
+	g.Expect(annually.Stat.PWR30).To(BeNumerically("~", EvaluatePortfolio(GoldenButterfly, combination).PWR30, 1e-15))
+	g.Expect(annually.RebalanceCount).To(Equal(len(GoldenButterfly)))
+
+	everyThree, bands, never, factor := evaluations[1], evaluations[2], evaluations[3], evaluations[4]
+	g.Expect(everyThree.RebalanceCount).To(Equal(len(GoldenButterfly) / 3))
+	g.Expect(bands.RebalanceCount).To(BeNumerically("<", annually.RebalanceCount))
+	g.Expect(bands.Turnover).To(BeNumerically("<", annually.Turnover))
+	g.Expect(never.RebalanceCount).To(Equal(0))
+	g.Expect(factor.Stat.RebalanceFactor).To(Equal(1.5))
+	g.Expect(factor.Turnover).To(BeNumerically(">", annually.Turnover))
+
+	t.Run("do juiced rebalance factors still win after costs?", func(t *testing.T) {
+		g := NewGomegaWithT(t)
+		withCosts, err := EvaluateRebalancePolicies([][]Percent{TSM, SCV, LTT, STT, GLD}, combination,
+			TradingCosts{Proportional: 0.002}, RebalanceAnnually, RebalanceWithFactor(1.5))
+		g.Expect(err).To(Succeed())
+		for i, free := range []RebalanceEvaluation{annually, factor} {
+			t.Log(withCosts[i])
+			g.Expect(withCosts[i].Costs).To(BeNumerically(">", 0))
+			g.Expect(withCosts[i].Turnover).To(BeNumerically("~", free.Turnover, 1e-12))
+			g.Expect(withCosts[i].Stat.AvgReturn).To(BeNumerically("<", free.Stat.AvgReturn))
+		}
+		g.Expect(withCosts[1].Costs).To(BeNumerically(">", withCosts[0].Costs))
+	})
+
+	_, err = EvaluateRebalancePolicies([][]Percent{TSM}, combination, TradingCosts{}, RebalanceAnnually)
+	g.Expect(err).To(MatchError("policy Annually: lists must have the same length: targetAllocations (5), returnsList (1)"))
+}
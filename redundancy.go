@@ -0,0 +1,130 @@
+package portfolio_analysis
+
+import (
+	"fmt"
+	"sort"
+)
+
+// RedundancyOptions configures EliminateRedundantPortfolios.
+type RedundancyOptions struct {
+	// Metrics are the metrics compared. Defaults to all of the registered metrics.
+	Metrics []*Metric
+	// Tolerances has, by metric name, how much better a portfolio has to be for the improvement to be meaningful.
+	// Metrics that aren't listed have no tolerance: any improvement counts.
+	Tolerances map[string]float64
+	// SubsetsOnly only compares a portfolio against those holding a subset of its assets.
+	// Otherwise, any portfolio with fewer assets can make it redundant.
+	SubsetsOnly bool
+}
+
+// EliminatedPortfolio is a portfolio dropped by EliminateRedundantPortfolios.
+type EliminatedPortfolio struct {
+	Stat *PortfolioStat
+	// RedundantTo is the simpler portfolio that is as good, within the tolerances, on every metric.
+	RedundantTo *PortfolioStat
+	Reason      string
+}
+
+func (e EliminatedPortfolio) String() string {
+	return fmt.Sprintf("%v %v: %s", e.Stat.Assets, e.Stat.Percentages, e.Reason)
+}
+
+// EliminateRedundantPortfolios removes the portfolios that are redundant to a portfolio with fewer assets:
+// the extra assets didn't improve any metric by more than its tolerance. The assets held are the ones with
+// a percentage above zero. Each eliminated portfolio reports the simplest portfolio it was redundant to.
+// The survivors keep their order.
+//
+// This is the analysis the "eliminate_redundant_portfolios" notebooks did in SQL. It compares each
+// portfolio with all the simpler ones, so it takes quadratic time.
+func EliminateRedundantPortfolios(results []*PortfolioStat, opts RedundancyOptions) (survivors []*PortfolioStat, eliminated []EliminatedPortfolio) {
+	metrics := metricsOrAll(opts.Metrics)
+	tolerances := make([]float64, len(metrics))
+	for i, m := range metrics {
+		tolerances[i] = opts.Tolerances[m.Name]
+	}
+
+	type candidate struct {
+		stat   *PortfolioStat
+		assets map[string]bool
+	}
+	candidates := make([]candidate, len(results))
+	for i, stat := range results {
+		candidates[i] = candidate{stat: stat, assets: heldAssets(stat)}
+	}
+	// the simplest portfolios are checked first, so they're the ones reported
+	simplest := append([]candidate(nil), candidates...)
+	sort.SliceStable(simplest, func(i, j int) bool { return len(simplest[i].assets) < len(simplest[j].assets) })
+
+	for _, c := range candidates {
+		var redundantTo *PortfolioStat
+		var reason string
+		for _, simpler := range simplest {
+			if len(simpler.assets) >= len(c.assets) {
+				break
+			}
+			if opts.SubsetsOnly && !isSubset(simpler.assets, c.assets) {
+				continue
+			}
+			if ok, why := isRedundant(c.stat, simpler.stat, metrics, tolerances); ok {
+				redundantTo, reason = simpler.stat, why
+				break
+			}
+		}
+		if redundantTo == nil {
+			survivors = append(survivors, c.stat)
+			continue
+		}
+		eliminated = append(eliminated, EliminatedPortfolio{
+			Stat:        c.stat,
+			RedundantTo: redundantTo,
+			Reason:      fmt.Sprintf("redundant to %v %v: %s", redundantTo.Assets, redundantTo.Percentages, reason),
+		})
+	}
+	return survivors, eliminated
+}
+
+// isRedundant returns true if p doesn't improve any metric over the simpler portfolio by more than its tolerance,
+// and describes its largest improvement.
+func isRedundant(p, simpler *PortfolioStat, metrics []*Metric, tolerances []float64) (bool, string) {
+	var (
+		largest     *Metric
+		largestDiff float64
+		largestTol  float64
+	)
+	for i, m := range metrics {
+		improvement := m.Value(p) - m.Value(simpler)
+		if m.LessIsBetter {
+			improvement = -improvement
+		}
+		if improvement > tolerances[i] {
+			return false, ""
+		}
+		if improvement > 0 && (largest == nil || improvement-tolerances[i] > largestDiff-largestTol) {
+			largest, largestDiff, largestTol = m, improvement, tolerances[i]
+		}
+	}
+	if largest == nil {
+		return true, "no metric improved"
+	}
+	return true, fmt.Sprintf("largest improvement was %s by %s, within the tolerance of %s",
+		largest.Name, largest.Format(largestDiff), largest.Format(largestTol))
+}
+
+func heldAssets(p *PortfolioStat) map[string]bool {
+	res := make(map[string]bool, len(p.Assets))
+	for i, asset := range p.Assets {
+		if i >= len(p.Percentages) || p.Percentages[i] > 0 {
+			res[asset] = true
+		}
+	}
+	return res
+}
+
+func isSubset(sub, super map[string]bool) bool {
+	for asset := range sub {
+		if !super[asset] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,55 @@
+package portfolio_analysis
+
+import (
+	"testing"
+
+	. "github.com/onsi/gomega"
+
+	. "github.com/slatteryjim/portfolio-analysis/types"
+)
+
+func TestEliminateRedundantPortfolios(t *testing.T) {
+	metrics := MustMetrics("PWR30", "StdDev")
+	var (
+		tsm       = &PortfolioStat{Assets: []string{"TSM"}, Percentages: ReadablePercents(100), PWR30: 0.030, StdDev: 0.17}
+		ltt       = &PortfolioStat{Assets: []string{"LTT"}, Percentages: ReadablePercents(100), PWR30: 0.020, StdDev: 0.12}
+		tsmLTT    = &PortfolioStat{Assets: []string{"TSM", "LTT"}, Percentages: ReadablePercents(50, 50), PWR30: 0.040, StdDev: 0.10}
+		tsmGold   = &PortfolioStat{Assets: []string{"TSM", "Gold"}, Percentages: ReadablePercents(50, 50), PWR30: 0.030, StdDev: 0.18}
+		tsmLTTSTT = &PortfolioStat{Assets: []string{"TSM", "LTT", "STT"}, Percentages: ReadablePercents(40, 40, 20), PWR30: 0.0401, StdDev: 0.09}
+		// STT isn't held, so this only holds one asset
+		tsmSTT0 = &PortfolioStat{Assets: []string{"TSM", "STT"}, Percentages: ReadablePercents(100, 0), PWR30: 0.030, StdDev: 0.17}
+		results = []*PortfolioStat{tsmLTTSTT, tsmGold, tsmLTT, tsm, ltt, tsmSTT0}
+	)
+	t.Run("no tolerance", func(t *testing.T) {
+		g := NewGomegaWithT(t)
+		survivors, eliminated := EliminateRedundantPortfolios(results, RedundancyOptions{Metrics: metrics})
+		g.Expect(survivors).To(Equal([]*PortfolioStat{tsmLTTSTT, tsmLTT, tsm, ltt, tsmSTT0}))
+		g.Expect(eliminated).To(HaveLen(1))
+		g.Expect(eliminated[0].Stat).To(Equal(tsmGold))
+		g.Expect(eliminated[0].RedundantTo).To(Equal(tsm))
+		g.Expect(eliminated[0].String()).To(Equal("[TSM Gold] [50% 50%]: redundant to [TSM] [100%]: no metric improved"))
+	})
+	t.Run("with tolerances", func(t *testing.T) {
+		g := NewGomegaWithT(t)
+		survivors, eliminated := EliminateRedundantPortfolios(results, RedundancyOptions{
+			Metrics:    metrics,
+			Tolerances: map[string]float64{"PWR30": 0.001, "StdDev": 0.02},
+		})
+		g.Expect(survivors).To(Equal([]*PortfolioStat{tsmLTT, tsm, ltt, tsmSTT0}))
+		g.Expect(eliminated).To(HaveLen(2))
+		g.Expect(eliminated[0].Stat).To(Equal(tsmLTTSTT))
+		g.Expect(eliminated[0].RedundantTo).To(Equal(tsmLTT))
+		g.Expect(eliminated[0].Reason).To(Equal("redundant to [TSM LTT] [50% 50%]: largest improvement was PWR30 by 0.010%, within the tolerance of 0.100%"))
+	})
+	t.Run("subsets only", func(t *testing.T) {
+		g := NewGomegaWithT(t)
+		// LTT alone isn't a subset of TSM+Gold, so it isn't compared
+		worseThanLTT := &PortfolioStat{Assets: []string{"TSM", "Gold"}, Percentages: ReadablePercents(50, 50), PWR30: 0.01, StdDev: 0.20}
+		survivors, eliminated := EliminateRedundantPortfolios([]*PortfolioStat{worseThanLTT, ltt}, RedundancyOptions{Metrics: metrics, SubsetsOnly: true})
+		g.Expect(survivors).To(HaveLen(2))
+		g.Expect(eliminated).To(BeEmpty())
+
+		_, eliminated = EliminateRedundantPortfolios([]*PortfolioStat{worseThanLTT, ltt}, RedundancyOptions{Metrics: metrics})
+		g.Expect(eliminated).To(HaveLen(1))
+	})
+}
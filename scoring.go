@@ -5,6 +5,7 @@ import (
 	"math"
 	"runtime"
 	"sort"
+	"strings"
 	"sync"
 	"time"
 
@@ -57,6 +58,10 @@ type (
 		LongestDrawdownRank      Rank
 		StartDateSensitivityRank Rank
 
+		// values and ranks of any metrics added with RegisterMetric, by name
+		Extra      map[string]float64
+		ExtraRanks map[string]Rank
+
 		// Score the rankings!
 		OverallRankScore float64
 
@@ -71,95 +76,57 @@ type (
 )
 
 func (p PortfolioStat) String() string {
-	return fmt.Sprintf("%v %v (%d) RF:%0.2f AvgReturn:%0.3f%%(%d) BLT:%0.3f%%(%d) BST:%0.3f%%(%d) PWR:%0.3f%%(%d) SWR:%0.3f%%(%d) StdDev:%0.3f%%(%d) Ulcer:%0.1f(%d) DeepestDrawdown:%0.2f%%(%d) LongestDrawdown:%d(%d), StartDateSensitivity:%0.2f%%(%d)",
-		p.Assets,
-		p.Percentages,
-		p.OverallRankScoreRank.Ordinal,
-		p.RebalanceFactor,
-		p.AvgReturn*100,
-		p.AvgReturnRank.Ordinal,
-		p.BaselineLTReturn*100,
-		p.BaselineLTReturnRank.Ordinal,
-		p.BaselineSTReturn*100,
-		p.BaselineSTReturnRank.Ordinal,
-		p.PWR30*100,
-		p.PWR30Rank.Ordinal,
-		p.SWR30*100,
-		p.SWR30Rank.Ordinal,
-		p.StdDev*100,
-		p.StdDevRank.Ordinal,
-		p.UlcerScore,
-		p.UlcerScoreRank.Ordinal,
-		p.DeepestDrawdown*100,
-		p.DeepestDrawdownRank.Ordinal,
-		p.LongestDrawdown,
-		p.LongestDrawdownRank.Ordinal,
-		p.StartDateSensitivity*100,
-		p.StartDateSensitivityRank.Ordinal,
-	)
+	var sb strings.Builder
+	sb.WriteString(fmt.Sprintf("%v %v (%d) RF:%0.2f", p.Assets, p.Percentages, p.OverallRankScoreRank.Ordinal, p.RebalanceFactor))
+	for _, m := range metrics {
+		separator := " "
+		if m.Name == "StartDateSensitivity" {
+			// the format has always had a comma here
+			separator = ", "
+		}
+		sb.WriteString(fmt.Sprintf("%s%s:%s(%d)", separator, m.Label, m.Format(m.Value(&p)), m.Rank(&p).Ordinal))
+	}
+	return sb.String()
 }
 
+// DiffPerformance returns a copy of p with each metric's value replaced by its difference from the other's.
 func (p PortfolioStat) DiffPerformance(other PortfolioStat) PortfolioStat {
-	copied := *p.Clone()
-	copied.AvgReturn -= other.AvgReturn
-	copied.BaselineLTReturn -= other.BaselineLTReturn
-	copied.BaselineSTReturn -= other.BaselineSTReturn
-	copied.PWR30 -= other.PWR30
-	copied.SWR30 -= other.SWR30
-	copied.StdDev -= other.StdDev
-	copied.UlcerScore -= other.UlcerScore
-	copied.DeepestDrawdown -= other.DeepestDrawdown
-	copied.LongestDrawdown -= other.LongestDrawdown
-	copied.StartDateSensitivity -= other.StartDateSensitivity
-	return copied
+	copied := p.Clone()
+	for _, m := range metrics {
+		m.SetValue(copied, m.Value(&p)-m.Value(&other))
+	}
+	return *copied
 }
 
+// AsGoodOrBetterThan returns true if every metric of p is as good or better than the other's.
 func (p *PortfolioStat) AsGoodOrBetterThan(other *PortfolioStat) bool {
-	return p.AvgReturn >= other.AvgReturn &&
-		p.BaselineLTReturn >= other.BaselineLTReturn &&
-		p.BaselineSTReturn >= other.BaselineSTReturn &&
-		p.PWR30 >= other.PWR30 &&
-		p.SWR30 >= other.SWR30 &&
-		p.StdDev <= other.StdDev &&
-		p.UlcerScore <= other.UlcerScore &&
-		p.DeepestDrawdown >= other.DeepestDrawdown &&
-		p.LongestDrawdown <= other.LongestDrawdown &&
-		p.StartDateSensitivity <= other.StartDateSensitivity
+	for _, m := range metrics {
+		if !m.AsGoodOrBetter(m.Value(p), m.Value(other)) {
+			return false
+		}
+	}
+	return true
 }
 
 // Clone returns a deep copy.
 func (p PortfolioStat) Clone() *PortfolioStat {
-	// deep copy the slices
-	assets := make([]string, len(p.Assets))
-	copy(assets, p.Assets)
-	percentages := make([]Percent, len(p.Percentages))
-	copy(percentages, p.Percentages)
-
-	return &PortfolioStat{
-		Assets:                   assets,
-		Percentages:              percentages,
-		RebalanceFactor:          p.RebalanceFactor,
-		AvgReturn:                p.AvgReturn,
-		BaselineLTReturn:         p.BaselineLTReturn,
-		BaselineSTReturn:         p.BaselineSTReturn,
-		PWR30:                    p.PWR30,
-		SWR30:                    p.SWR30,
-		StdDev:                   p.StdDev,
-		UlcerScore:               p.UlcerScore,
-		DeepestDrawdown:          p.DeepestDrawdown,
-		LongestDrawdown:          p.LongestDrawdown,
-		StartDateSensitivity:     p.StartDateSensitivity,
-		AvgReturnRank:            p.AvgReturnRank,
-		PWR30Rank:                p.PWR30Rank,
-		SWR30Rank:                p.SWR30Rank,
-		StdDevRank:               p.StdDevRank,
-		UlcerScoreRank:           p.UlcerScoreRank,
-		DeepestDrawdownRank:      p.DeepestDrawdownRank,
-		LongestDrawdownRank:      p.LongestDrawdownRank,
-		StartDateSensitivityRank: p.StartDateSensitivityRank,
-		OverallRankScore:         p.OverallRankScore,
-		OverallRankScoreRank:     p.OverallRankScoreRank,
+	copied := p
+	// deep copy the slices and maps
+	copied.Assets = append([]string(nil), p.Assets...)
+	copied.Percentages = append([]Percent(nil), p.Percentages...)
+	if p.Extra != nil {
+		copied.Extra = make(map[string]float64, len(p.Extra))
+		for k, v := range p.Extra {
+			copied.Extra[k] = v
+		}
+	}
+	if p.ExtraRanks != nil {
+		copied.ExtraRanks = make(map[string]Rank, len(p.ExtraRanks))
+		for k, v := range p.ExtraRanks {
+			copied.ExtraRanks[k] = v
+		}
 	}
+	return &copied
 }
 
 func (p PortfolioStat) MustReturns() []Percent {
@@ -255,157 +222,74 @@ func evaluatePortfolios(perms []Combination, assetMap map[string][]Percent) ([]*
 }
 
 func EvaluatePortfolio(portfolioReturns []Percent, p Combination) *PortfolioStat {
-	minPWR30, minSWR30 := minPWRAndSWR(portfolioReturns, 30)
-	maxUlcerScore, deepestDrawdown, longestDrawdown := drawdownScores(portfolioReturns)
-
-	return &PortfolioStat{
-		Assets:               p.Assets,
-		Percentages:          p.Percentages,
-		AvgReturn:            average(portfolioReturns),
-		BaselineLTReturn:     baselineLongTermReturn(portfolioReturns),
-		BaselineSTReturn:     baselineShortTermReturn(portfolioReturns),
-		PWR30:                minPWR30,
-		SWR30:                minSWR30,
-		StdDev:               StandardDeviation(portfolioReturns),
-		UlcerScore:           maxUlcerScore,
-		DeepestDrawdown:      deepestDrawdown,
-		LongestDrawdown:      longestDrawdown,
-		StartDateSensitivity: startDateSensitivity(portfolioReturns),
+	var (
+		in   = MetricInputs{Returns: portfolioReturns}
+		stat = &PortfolioStat{
+			Assets:      p.Assets,
+			Percentages: p.Percentages,
+		}
+	)
+	defer in.Release()
+	for _, m := range metrics {
+		m.SetValue(stat, m.Compute(&in))
 	}
+	return stat
 }
 
 // EvaluatePortfolioIfAsGoodOrBetterThan evaluates the given portfolioReturns and returns
 // a non-nil PortfolioStat only if the performance metrics are all as good or better than the given
 // otherStat porformance.
-// It can return early if any of the metrics aren't as good.
+// It can return early if any of the metrics aren't as good, checking the cheapest metrics first.
 func EvaluatePortfolioIfAsGoodOrBetterThan(portfolioReturns []Percent, p Combination, other *PortfolioStat) *PortfolioStat {
-	avgReturn := average(portfolioReturns)
-	if avgReturn < other.AvgReturn {
-		return nil
-	}
-	stdDev := StandardDeviation(portfolioReturns)
-	if stdDev > other.StdDev {
-		return nil
-	}
-	minPWR30, minSWR30 := minPWRAndSWR(portfolioReturns, 30)
-	if minPWR30 < other.PWR30 {
-		return nil
-	}
-	if minSWR30 < other.SWR30 {
-		return nil
-	}
-	baselineLT := baselineLongTermReturn(portfolioReturns)
-	if baselineLT < other.BaselineLTReturn {
-		return nil
-	}
-	maxUlcerScore, deepestDrawdown, longestDrawdown := drawdownScores(portfolioReturns)
-	if maxUlcerScore > other.UlcerScore {
-		return nil
-	}
-	if deepestDrawdown < other.DeepestDrawdown {
-		return nil
-	}
-	if longestDrawdown > other.LongestDrawdown {
-		return nil
-	}
-	baselineST := baselineShortTermReturn(portfolioReturns)
-	if baselineST < other.BaselineSTReturn {
-		return nil
-	}
-	sensitivity := startDateSensitivity(portfolioReturns)
-	if sensitivity > other.StartDateSensitivity {
-		return nil
-	}
-	return &PortfolioStat{
-		Assets:               p.Assets,
-		Percentages:          p.Percentages,
-		AvgReturn:            avgReturn,
-		BaselineLTReturn:     baselineLT,
-		BaselineSTReturn:     baselineST,
-		PWR30:                minPWR30,
-		SWR30:                minSWR30,
-		StdDev:               stdDev,
-		UlcerScore:           maxUlcerScore,
-		DeepestDrawdown:      deepestDrawdown,
-		LongestDrawdown:      longestDrawdown,
-		StartDateSensitivity: sensitivity,
+	var (
+		in   = MetricInputs{Returns: portfolioReturns}
+		stat = &PortfolioStat{
+			Assets:      p.Assets,
+			Percentages: p.Percentages,
+		}
+	)
+	defer in.Release()
+	for _, m := range metricsByCost {
+		value := m.Compute(&in)
+		if !m.AsGoodOrBetter(value, m.Value(other)) {
+			return nil
+		}
+		m.SetValue(stat, value)
 	}
+	return stat
 }
 
 // RankPortfoliosInPlace this is a "destructive" operation, reordering the list and mutating the ***Rank fields.
 // It sorts the list by the various performance metrics and populates the corresponding Rank field for each.
 // It finishes up by sorting them by their "overall" rank, considering all of the performance metrics equally.
 func RankPortfoliosInPlace(results []*PortfolioStat) {
+	if err := RankPortfoliosWithProfile(results, DefaultScoringProfile()); err != nil {
+		panic(err.Error())
+	}
+}
+
+// RankPortfoliosWithProfile is like RankPortfoliosInPlace, but the overall rank is scored with the given profile.
+func RankPortfoliosWithProfile(results []*PortfolioStat, profile ScoringProfile) error {
+	weighted, err := profile.weightedMetrics()
+	if err != nil {
+		return fmt.Errorf("scoring profile %q: %w", profile.Name, err)
+	}
 	startAt := time.Now()
 	// fmt.Println("...Calculate rank scores for the portfolios")
-	{
-		RankAll("AvgReturn", results, RankAllParams{
-			Metric:       func(stat *PortfolioStat) float64 { return stat.AvgReturn.Float() },
-			LessIsBetter: false,
-			SetRank:      func(stat *PortfolioStat, rank Rank) { stat.AvgReturnRank = rank },
-		})
-		RankAll("BaselineLTReturn", results, RankAllParams{
-			Metric:       func(stat *PortfolioStat) float64 { return stat.BaselineLTReturn.Float() },
-			LessIsBetter: false,
-			SetRank:      func(stat *PortfolioStat, rank Rank) { stat.BaselineLTReturnRank = rank },
-		})
-		RankAll("BaselineSTReturn", results, RankAllParams{
-			Metric:       func(stat *PortfolioStat) float64 { return stat.BaselineSTReturn.Float() },
-			LessIsBetter: false,
-			SetRank:      func(stat *PortfolioStat, rank Rank) { stat.BaselineSTReturnRank = rank },
-		})
-		RankAll("PWR30", results, RankAllParams{
-			Metric:       func(stat *PortfolioStat) float64 { return stat.PWR30.Float() },
-			LessIsBetter: false,
-			SetRank:      func(stat *PortfolioStat, rank Rank) { stat.PWR30Rank = rank },
-		})
-		RankAll("SWR30", results, RankAllParams{
-			Metric:       func(stat *PortfolioStat) float64 { return stat.SWR30.Float() },
-			LessIsBetter: false,
-			SetRank:      func(stat *PortfolioStat, rank Rank) { stat.SWR30Rank = rank },
-		})
-		RankAll("StdDev", results, RankAllParams{
-			Metric:       func(stat *PortfolioStat) float64 { return stat.StdDev.Float() },
-			LessIsBetter: true,
-			SetRank:      func(stat *PortfolioStat, rank Rank) { stat.StdDevRank = rank },
-		})
-		RankAll("UlcerScore", results, RankAllParams{
-			Metric:       func(stat *PortfolioStat) float64 { return stat.UlcerScore },
-			LessIsBetter: true,
-			SetRank:      func(stat *PortfolioStat, rank Rank) { stat.UlcerScoreRank = rank },
-		})
-		RankAll("DeepestDrawdown", results, RankAllParams{
-			Metric:       func(stat *PortfolioStat) float64 { return stat.DeepestDrawdown.Float() },
-			LessIsBetter: false,
-			SetRank:      func(stat *PortfolioStat, rank Rank) { stat.DeepestDrawdownRank = rank },
-		})
-		RankAll("LongestDrawdown", results, RankAllParams{
-			Metric:       func(stat *PortfolioStat) float64 { return float64(stat.LongestDrawdown) },
-			LessIsBetter: true,
-			SetRank:      func(stat *PortfolioStat, rank Rank) { stat.LongestDrawdownRank = rank },
-		})
-		RankAll("StartDateSensitivity", results, RankAllParams{
-			Metric:       func(stat *PortfolioStat) float64 { return stat.StartDateSensitivity.Float() },
-			LessIsBetter: true,
-			SetRank:      func(stat *PortfolioStat, rank Rank) { stat.StartDateSensitivityRank = rank },
+	for _, m := range metrics {
+		RankAll(m.Name, results, RankAllParams{
+			Metric:       m.Value,
+			LessIsBetter: m.LessIsBetter,
+			SetRank:      m.SetRank,
 		})
 	}
 	// fmt.Println("Finished basic rank scores in", time.Since(startAt))
 	startAt = time.Now()
-	// fmt.Println("...rank by all their ranks (equally weighted)")
+	// fmt.Println("...rank by all their ranks, scored by the profile")
 	{
 		// populate the OverallRankScore for all
 		for i, p := range results {
-			p.OverallRankScore = math.Pow(p.AvgReturnRank.Percentage, 2) +
-				math.Pow(p.BaselineLTReturnRank.Percentage, 2) +
-				math.Pow(p.BaselineSTReturnRank.Percentage, 2) +
-				math.Pow(p.PWR30Rank.Percentage, 2) +
-				math.Pow(p.SWR30Rank.Percentage, 2) +
-				math.Pow(p.StdDevRank.Percentage, 2) +
-				math.Pow(p.UlcerScoreRank.Percentage, 2) +
-				math.Pow(p.LongestDrawdownRank.Percentage, 2) +
-				math.Pow(p.DeepestDrawdownRank.Percentage, 2) +
-				math.Pow(p.StartDateSensitivityRank.Percentage, 2)
+			p.OverallRankScore = profile.score(p, weighted)
 			if i%10_000_000 == 0 {
 				fmt.Println(" - populating OverallRankScore row", i+1)
 			}
@@ -418,6 +302,7 @@ func RankPortfoliosInPlace(results []*PortfolioStat) {
 		})
 	}
 	fmt.Println("Elapsed:", time.Since(startAt))
+	return nil
 }
 
 type RankAllParams struct {
@@ -432,11 +317,17 @@ func RankAll(
 	params RankAllParams,
 ) {
 	// startAt := time.Now()
-	if params.LessIsBetter {
-		sort.Slice(results, func(i, j int) bool { return params.Metric(results[i]) < params.Metric(results[j]) })
-	} else {
-		sort.Slice(results, func(i, j int) bool { return params.Metric(results[i]) > params.Metric(results[j]) })
+	// the NaNs are ranked last, all together
+	better := func(a, b float64) bool {
+		if aNaN, bNaN := math.IsNaN(a), math.IsNaN(b); aNaN || bNaN {
+			return !aNaN && bNaN
+		}
+		if params.LessIsBetter {
+			return a < b
+		}
+		return a > b
 	}
+	sort.Slice(results, func(i, j int) bool { return better(params.Metric(results[i]), params.Metric(results[j])) })
 	ranks := make([]int, len(results))
 	var (
 		rank      = 0
@@ -444,7 +335,7 @@ func RankAll(
 	)
 	for i, portfolioStat := range results {
 		value := params.Metric(portfolioStat)
-		if i == 0 || lastValue != value {
+		if i == 0 || !sameValue(lastValue, value) {
 			rank++
 			lastValue = value
 		}
@@ -483,16 +374,12 @@ func FindMany(results []*PortfolioStat, pred func(p *PortfolioStat) bool) []*Por
 // Assumes that the model and all tested inputs have already been ranked against one another.
 func AsGoodOrBetterThan(model *PortfolioStat) func(p *PortfolioStat) bool {
 	return func(p *PortfolioStat) bool {
-		return p.AvgReturnRank.Ordinal <= model.AvgReturnRank.Ordinal &&
-			p.BaselineLTReturnRank.Ordinal <= model.BaselineLTReturnRank.Ordinal &&
-			p.BaselineSTReturnRank.Ordinal <= model.BaselineSTReturnRank.Ordinal &&
-			p.PWR30Rank.Ordinal <= model.PWR30Rank.Ordinal &&
-			p.SWR30Rank.Ordinal <= model.SWR30Rank.Ordinal &&
-			p.StdDevRank.Ordinal <= model.StdDevRank.Ordinal &&
-			p.UlcerScoreRank.Ordinal <= model.UlcerScoreRank.Ordinal &&
-			p.DeepestDrawdownRank.Ordinal <= model.DeepestDrawdownRank.Ordinal &&
-			p.LongestDrawdownRank.Ordinal <= model.LongestDrawdownRank.Ordinal &&
-			p.StartDateSensitivityRank.Ordinal <= model.StartDateSensitivityRank.Ordinal
+		for _, m := range metrics {
+			if m.Rank(p).Ordinal > m.Rank(model).Ordinal {
+				return false
+			}
+		}
+		return true
 	}
 }
 
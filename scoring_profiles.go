@@ -0,0 +1,258 @@
+package portfolio_analysis
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"sort"
+)
+
+// Aggregation combines a portfolio's weighted rank percentages into its OverallRankScore.
+// Rank percentages go from 1 (best) to 100 (worst), so a lower score is better.
+type Aggregation int
+
+const (
+	// SumOfSquares sums the squared rank percentages, times their weights. It punishes poor ranks more
+	// than it rewards good ones. This is what RankPortfoliosInPlace has always used.
+	SumOfSquares Aggregation = iota
+	// WeightedAverage is the weighted average of the rank percentages.
+	WeightedAverage
+	// Chebyshev scores a portfolio by its worst weighted rank percentage, so it favors portfolios without any weak spots.
+	Chebyshev
+	// Geometric is the weighted geometric mean of the rank percentages, which rewards excelling at a few metrics.
+	Geometric
+)
+
+var aggregationNames = []string{"SumOfSquares", "WeightedAverage", "Chebyshev", "Geometric"}
+
+func (a Aggregation) String() string {
+	if a < 0 || int(a) >= len(aggregationNames) {
+		return fmt.Sprintf("Aggregation(%d)", int(a))
+	}
+	return aggregationNames[a]
+}
+
+func (a Aggregation) MarshalText() ([]byte, error) {
+	if a < 0 || int(a) >= len(aggregationNames) {
+		return nil, fmt.Errorf("unknown aggregation %d", int(a))
+	}
+	return []byte(a.String()), nil
+}
+
+func (a *Aggregation) UnmarshalText(text []byte) error {
+	for i, name := range aggregationNames {
+		if name == string(text) {
+			*a = Aggregation(i)
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown aggregation %q", text)
+}
+
+// ScoringProfile decides how RankPortfoliosWithProfile combines the metric ranks into the OverallRankScore.
+type ScoringProfile struct {
+	Name string
+	// Weights has the weight of each participating metric, by name. Other metrics are still ranked,
+	// but don't count towards the overall score.
+	Weights     map[string]float64
+	Aggregation Aggregation
+}
+
+var (
+	// RetireeScoringProfile cares most about how much can be withdrawn, and how bad the drawdowns get.
+	RetireeScoringProfile = ScoringProfile{
+		Name: "Retiree",
+		Weights: map[string]float64{
+			"PWR30":                4,
+			"SWR30":                2,
+			"BaselineSTReturn":     1,
+			"UlcerScore":           1,
+			"DeepestDrawdown":      1,
+			"LongestDrawdown":      1,
+			"StartDateSensitivity": 1,
+		},
+		Aggregation: SumOfSquares,
+	}
+
+	// AccumulatorScoringProfile cares most about long-term growth, and can ride out the drawdowns.
+	AccumulatorScoringProfile = ScoringProfile{
+		Name: "Accumulator",
+		Weights: map[string]float64{
+			"BaselineLTReturn": 4,
+			"AvgReturn":        2,
+			"PWR30":            1,
+		},
+		Aggregation: WeightedAverage,
+	}
+
+	scoringProfiles = map[string]ScoringProfile{}
+)
+
+// defaultScoringProfileName is the name DefaultScoringProfile can be found by, unless a profile is registered with it.
+const defaultScoringProfileName = "Default"
+
+// DefaultScoringProfile considers all of the registered metrics equally, with SumOfSquares. It's built from the
+// registry when it's called, so a metric added with RegisterMetric counts toward the OverallRankScore too.
+func DefaultScoringProfile() ScoringProfile {
+	weights := make(map[string]float64, len(metrics))
+	for _, m := range metrics {
+		weights[m.Name] = 1
+	}
+	return ScoringProfile{
+		Name:        defaultScoringProfileName,
+		Weights:     weights,
+		Aggregation: SumOfSquares,
+	}
+}
+
+func init() {
+	for _, p := range []ScoringProfile{RetireeScoringProfile, AccumulatorScoringProfile} {
+		if err := RegisterScoringProfile(p); err != nil {
+			panic(err.Error())
+		}
+	}
+}
+
+// RegisterScoringProfile saves the profile under its name, so it can be reused with ScoringProfileByName.
+// It replaces any profile registered with the same name.
+func RegisterScoringProfile(p ScoringProfile) error {
+	if p.Name == "" {
+		return fmt.Errorf("scoring profile must have a name")
+	}
+	if _, err := p.weightedMetrics(); err != nil {
+		return fmt.Errorf("scoring profile %q: %w", p.Name, err)
+	}
+	scoringProfiles[p.Name] = p
+	return nil
+}
+
+// ScoringProfileByName returns the registered profile with the given name, or the DefaultScoringProfile for "Default".
+func ScoringProfileByName(name string) (ScoringProfile, bool) {
+	p, ok := scoringProfiles[name]
+	if !ok && name == defaultScoringProfileName {
+		return DefaultScoringProfile(), true
+	}
+	return p, ok
+}
+
+// ScoringProfileNames returns the names of all the registered profiles, sorted.
+func ScoringProfileNames() []string {
+	names := make([]string, 0, len(scoringProfiles)+1)
+	for name := range scoringProfiles {
+		names = append(names, name)
+	}
+	if _, ok := scoringProfiles[defaultScoringProfileName]; !ok {
+		names = append(names, defaultScoringProfileName)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// SaveScoringProfiles writes the profiles to a JSON file.
+func SaveScoringProfiles(filename string, profiles ...ScoringProfile) error {
+	byts, err := json.MarshalIndent(profiles, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filename, byts, 0644)
+}
+
+// LoadScoringProfiles reads the profiles from a JSON file written by SaveScoringProfiles, and registers them.
+func LoadScoringProfiles(filename string) ([]ScoringProfile, error) {
+	byts, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var profiles []ScoringProfile
+	if err := json.Unmarshal(byts, &profiles); err != nil {
+		return nil, fmt.Errorf("reading scoring profiles from %s: %w", filename, err)
+	}
+	for _, p := range profiles {
+		if err := RegisterScoringProfile(p); err != nil {
+			return nil, err
+		}
+	}
+	return profiles, nil
+}
+
+type weightedMetric struct {
+	metric *Metric
+	weight float64
+}
+
+// scoreOrder is the order the rank percentages have always been summed in, which has the longest drawdown before the
+// deepest, unlike the registry. Keeping it keeps the scores, and so the overall ranks, identical.
+var scoreOrder = []string{"AvgReturn", "BaselineLTReturn", "BaselineSTReturn", "PWR30", "SWR30", "StdDev",
+	"UlcerScore", "LongestDrawdown", "DeepestDrawdown", "StartDateSensitivity"}
+
+// metricsInScoreOrder returns the metrics in the scoreOrder, followed by any others in the registry's order.
+func metricsInScoreOrder() []*Metric {
+	res := MustMetrics(scoreOrder...)
+	for _, m := range metrics {
+		if !containsString(scoreOrder, m.Name) {
+			res = append(res, m)
+		}
+	}
+	return res
+}
+
+// weightedMetrics returns the participating metrics, in the order they're scored by metricsInScoreOrder.
+func (p ScoringProfile) weightedMetrics() ([]weightedMetric, error) {
+	if len(p.Weights) == 0 {
+		return nil, fmt.Errorf("no metrics are weighted")
+	}
+	var res []weightedMetric
+	for _, m := range metricsInScoreOrder() {
+		if weight, ok := p.Weights[m.Name]; ok {
+			res = append(res, weightedMetric{metric: m, weight: weight})
+		}
+	}
+	if len(res) != len(p.Weights) {
+		for name := range p.Weights {
+			if _, ok := MetricByName(name); !ok {
+				return nil, fmt.Errorf("unknown metric %q", name)
+			}
+		}
+	}
+	var totalWeight float64
+	for _, wm := range res {
+		if wm.weight < 0 {
+			return nil, fmt.Errorf("metric %q has a negative weight", wm.metric.Name)
+		}
+		totalWeight += wm.weight
+	}
+	if totalWeight == 0 {
+		return nil, fmt.Errorf("no metrics are weighted")
+	}
+	if p.Aggregation < 0 || int(p.Aggregation) >= len(aggregationNames) {
+		return nil, fmt.Errorf("unknown aggregation %d", int(p.Aggregation))
+	}
+	return res, nil
+}
+
+// score aggregates the portfolio's weighted rank percentages.
+func (p ScoringProfile) score(stat *PortfolioStat, weighted []weightedMetric) float64 {
+	var score, totalWeight float64
+	for _, wm := range weighted {
+		percentage := wm.metric.Rank(stat).Percentage
+		switch p.Aggregation {
+		case SumOfSquares:
+			score += wm.weight * math.Pow(percentage, 2)
+		case WeightedAverage:
+			score += wm.weight * percentage
+		case Chebyshev:
+			score = math.Max(score, wm.weight*percentage)
+		case Geometric:
+			score += wm.weight * math.Log(percentage)
+		}
+		totalWeight += wm.weight
+	}
+	switch p.Aggregation {
+	case WeightedAverage:
+		return score / totalWeight
+	case Geometric:
+		return math.Exp(score / totalWeight)
+	}
+	return score
+}
@@ -0,0 +1,146 @@
+package portfolio_analysis
+
+import (
+	"math"
+	"math/rand"
+	"path/filepath"
+	"testing"
+
+	. "github.com/onsi/gomega"
+)
+
+// rankedStats returns three portfolios: one that's best at everything but PWR30, one that's only best at PWR30,
+// and one in the middle.
+func rankedStats() (allRounder, withdrawer, middling *PortfolioStat) {
+	allRounder, withdrawer, middling = &PortfolioStat{Assets: []string{"allRounder"}}, &PortfolioStat{Assets: []string{"withdrawer"}}, &PortfolioStat{Assets: []string{"middling"}}
+	for _, m := range Metrics() {
+		better, worse := 2.0, 0.0
+		if m.LessIsBetter {
+			better, worse = worse, better
+		}
+		m.SetValue(allRounder, better)
+		m.SetValue(withdrawer, worse)
+		m.SetValue(middling, 1)
+	}
+	pwr30, _ := MetricByName("PWR30")
+	pwr30.SetValue(allRounder, 0)
+	pwr30.SetValue(withdrawer, 2)
+	return allRounder, withdrawer, middling
+}
+
+func TestRankPortfoliosWithProfile(t *testing.T) {
+	t.Run("default profile", func(t *testing.T) {
+		g := NewGomegaWithT(t)
+		allRounder, withdrawer, middling := rankedStats()
+		results := []*PortfolioStat{withdrawer, middling, allRounder}
+		RankPortfoliosInPlace(results)
+		g.Expect(results).To(Equal([]*PortfolioStat{allRounder, middling, withdrawer}))
+		// nine metrics ranked first of three (34%), and PWR30 ranked last (100%)
+		g.Expect(allRounder.OverallRankScore).To(Equal(9*34*34 + 100*100.0))
+	})
+	t.Run("default profile sums in the original order", func(t *testing.T) {
+		g := NewGomegaWithT(t)
+		r := rand.New(rand.NewSource(1))
+		var results []*PortfolioStat
+		for i := 0; i < 1000; i++ {
+			stat := &PortfolioStat{}
+			for _, m := range Metrics() {
+				m.SetValue(stat, r.Float64())
+			}
+			results = append(results, stat)
+		}
+		RankPortfoliosInPlace(results)
+		for _, p := range results {
+			// the scores are identical to the original sum, with the longest drawdown before the deepest
+			g.Expect(p.OverallRankScore).To(Equal(math.Pow(p.AvgReturnRank.Percentage, 2) +
+				math.Pow(p.BaselineLTReturnRank.Percentage, 2) +
+				math.Pow(p.BaselineSTReturnRank.Percentage, 2) +
+				math.Pow(p.PWR30Rank.Percentage, 2) +
+				math.Pow(p.SWR30Rank.Percentage, 2) +
+				math.Pow(p.StdDevRank.Percentage, 2) +
+				math.Pow(p.UlcerScoreRank.Percentage, 2) +
+				math.Pow(p.LongestDrawdownRank.Percentage, 2) +
+				math.Pow(p.DeepestDrawdownRank.Percentage, 2) +
+				math.Pow(p.StartDateSensitivityRank.Percentage, 2)))
+		}
+	})
+	t.Run("PWR30 only", func(t *testing.T) {
+		g := NewGomegaWithT(t)
+		allRounder, withdrawer, middling := rankedStats()
+		results := []*PortfolioStat{allRounder, middling, withdrawer}
+		err := RankPortfoliosWithProfile(results, ScoringProfile{Name: "PWR", Weights: map[string]float64{"PWR30": 1}})
+		g.Expect(err).To(Succeed())
+		g.Expect(results).To(Equal([]*PortfolioStat{withdrawer, middling, allRounder}))
+		// the other metrics are still ranked
+		g.Expect(allRounder.AvgReturnRank.Ordinal).To(Equal(1))
+	})
+	t.Run("aggregations", func(t *testing.T) {
+		g := NewGomegaWithT(t)
+		weights := map[string]float64{"PWR30": 3, "AvgReturn": 1}
+		scores := map[Aggregation]float64{}
+		for _, aggregation := range []Aggregation{SumOfSquares, WeightedAverage, Chebyshev, Geometric} {
+			allRounder, withdrawer, middling := rankedStats()
+			results := []*PortfolioStat{allRounder, middling, withdrawer}
+			g.Expect(RankPortfoliosWithProfile(results, ScoringProfile{Name: "test", Weights: weights, Aggregation: aggregation})).To(Succeed())
+			// PWR30 rank is 34%, AvgReturn is 100%
+			scores[aggregation] = withdrawer.OverallRankScore
+		}
+		g.Expect(scores[SumOfSquares]).To(Equal(3*34*34 + 1*100*100.0))
+		g.Expect(scores[WeightedAverage]).To(Equal((3*34 + 1*100.0) / 4))
+		g.Expect(scores[Chebyshev]).To(Equal(3 * 34.0))
+		g.Expect(scores[Geometric]).To(BeNumerically("~", math.Pow(34*34*34*100, 1.0/4), 1e-12))
+	})
+	t.Run("invalid profiles", func(t *testing.T) {
+		g := NewGomegaWithT(t)
+		err := RankPortfoliosWithProfile(nil, ScoringProfile{Name: "empty"})
+		g.Expect(err).To(MatchError(`scoring profile "empty": no metrics are weighted`))
+		err = RankPortfoliosWithProfile(nil, ScoringProfile{Name: "typo", Weights: map[string]float64{"PWR": 1}})
+		g.Expect(err).To(MatchError(`scoring profile "typo": unknown metric "PWR"`))
+		err = RankPortfoliosWithProfile(nil, ScoringProfile{Name: "negative", Weights: map[string]float64{"PWR30": -1}})
+		g.Expect(err).To(MatchError(`scoring profile "negative": metric "PWR30" has a negative weight`))
+		err = RankPortfoliosWithProfile(nil, ScoringProfile{Name: "zero", Weights: map[string]float64{"PWR30": 0}})
+		g.Expect(err).To(MatchError(`scoring profile "zero": no metrics are weighted`))
+	})
+}
+
+func TestScoringProfiles(t *testing.T) {
+	g := NewGomegaWithT(t)
+	g.Expect(ScoringProfileNames()).To(ContainElements("Accumulator", "Default", "Retiree"))
+	retiree, ok := ScoringProfileByName("Retiree")
+	g.Expect(ok).To(BeTrue())
+	g.Expect(retiree.Weights["PWR30"]).To(Equal(4.0))
+	defaultProfile, ok := ScoringProfileByName("Default")
+	g.Expect(ok).To(BeTrue())
+	g.Expect(defaultProfile).To(Equal(DefaultScoringProfile()))
+	g.Expect(defaultProfile.Weights).To(HaveLen(len(Metrics())))
+
+	g.Expect(RegisterScoringProfile(ScoringProfile{Weights: map[string]float64{"PWR30": 1}})).
+		To(MatchError("scoring profile must have a name"))
+
+	t.Run("save and load", func(t *testing.T) {
+		g := NewGomegaWithT(t)
+		filename := filepath.Join(t.TempDir(), "profiles.json")
+		custom := ScoringProfile{Name: "Custom", Weights: map[string]float64{"PWR30": 2, "UlcerScore": 1}, Aggregation: Chebyshev}
+		defer delete(scoringProfiles, custom.Name)
+		g.Expect(SaveScoringProfiles(filename, custom, RetireeScoringProfile)).To(Succeed())
+
+		profiles, err := LoadScoringProfiles(filename)
+		g.Expect(err).To(Succeed())
+		g.Expect(profiles).To(Equal([]ScoringProfile{custom, RetireeScoringProfile}))
+		loaded, ok := ScoringProfileByName("Custom")
+		g.Expect(ok).To(BeTrue())
+		g.Expect(loaded).To(Equal(custom))
+
+		_, err = LoadScoringProfiles(filepath.Join(t.TempDir(), "missing.json"))
+		g.Expect(err).To(HaveOccurred())
+	})
+	t.Run("aggregation names", func(t *testing.T) {
+		g := NewGomegaWithT(t)
+		g.Expect(Geometric.String()).To(Equal("Geometric"))
+		g.Expect(Aggregation(9).String()).To(Equal("Aggregation(9)"))
+		var a Aggregation
+		g.Expect(a.UnmarshalText([]byte("WeightedAverage"))).To(Succeed())
+		g.Expect(a).To(Equal(WeightedAverage))
+		g.Expect(a.UnmarshalText([]byte("Nope"))).To(MatchError(`unknown aggregation "Nope"`))
+	})
+}
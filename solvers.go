@@ -0,0 +1,292 @@
+package portfolio_analysis
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+
+	"github.com/slatteryjim/portfolio-analysis/data"
+	. "github.com/slatteryjim/portfolio-analysis/types"
+)
+
+// The classic allocations, to compare against the search results. They're long-only: the weights are
+// all at least 0%, and sum to 100%. They're computed from the historical annual returns of the assets,
+// over the years they all have data for.
+
+// MinimumVarianceCombination returns the allocation of the assets with the least variance.
+func MinimumVarianceCombination(assets ...string) (Combination, error) {
+	return solveCombination(assets, MinimumVarianceWeights)
+}
+
+// MaximumSharpeCombination returns the allocation of the assets with the best Sharpe ratio (the tangency portfolio):
+// its average return above the risk-free rate, divided by its standard deviation.
+func MaximumSharpeCombination(riskFree Percent, assets ...string) (Combination, error) {
+	return solveCombination(assets, func(returnsList [][]Percent) ([]Percent, error) {
+		return MaximumSharpeWeights(returnsList, riskFree)
+	})
+}
+
+// RiskParityCombination returns the allocation of the assets where each contributes equally to its variance.
+func RiskParityCombination(assets ...string) (Combination, error) {
+	return solveCombination(assets, RiskParityWeights)
+}
+
+func solveCombination(assets []string, solve func([][]Percent) ([]Percent, error)) (Combination, error) {
+	if len(assets) == 0 {
+		return Combination{}, errors.New("no assets")
+	}
+	weights, err := solve(data.PortfolioReturnsList(assets...))
+	if err != nil {
+		return Combination{}, err
+	}
+	return Combination{Assets: assets, Percentages: weights}, nil
+}
+
+// MinimumVarianceWeights returns the weights of the returns with the least variance.
+// It minimizes the variance by projected gradient descent.
+func MinimumVarianceWeights(returnsList [][]Percent) ([]Percent, error) {
+	_, cov, err := meanAndCovariance(returnsList)
+	if err != nil {
+		return nil, err
+	}
+	// the gradient of the variance is 2Σw, so a step of 1/(2*λmax) converges.
+	// λmax is bounded by the largest absolute row sum.
+	bound := maxAbsRowSum(cov)
+	if bound == 0 {
+		return nil, errors.New("the returns have no variance")
+	}
+	var (
+		n    = len(cov)
+		w    = equalWeights(n)
+		step = 1 / (2 * bound)
+	)
+	for iteration := 0; iteration < solverIterations; iteration++ {
+		grad := mulMatVec(cov, w)
+		next := make([]float64, n)
+		for i := range next {
+			next[i] = w[i] - step*2*grad[i]
+		}
+		next = projectOntoSimplex(next)
+		converged := maxAbsDiff(next, w) < solverTolerance
+		w = next
+		if converged {
+			break
+		}
+	}
+	return toPercents(w), nil
+}
+
+// MaximumSharpeWeights returns the weights of the returns with the best Sharpe ratio.
+// It maximizes the ratio by projected gradient ascent, with a backtracking line search.
+func MaximumSharpeWeights(returnsList [][]Percent, riskFree Percent) ([]Percent, error) {
+	mean, cov, err := meanAndCovariance(returnsList)
+	if err != nil {
+		return nil, err
+	}
+	n := len(cov)
+	sharpe := func(w []float64) (float64, []float64) {
+		var excess float64
+		for i := range w {
+			excess += w[i] * (mean[i] - riskFree.Float())
+		}
+		covW := mulMatVec(cov, w)
+		variance := dot(w, covW)
+		if variance <= 0 {
+			return math.Inf(-1), nil
+		}
+		stdDev := math.Sqrt(variance)
+		grad := make([]float64, n)
+		for i := range grad {
+			grad[i] = (mean[i]-riskFree.Float())/stdDev - excess*covW[i]/(variance*stdDev)
+		}
+		return excess / stdDev, grad
+	}
+
+	w := equalWeights(n)
+	current, grad := sharpe(w)
+	if grad == nil {
+		return nil, errors.New("the returns have no variance")
+	}
+	step := 1.0
+	for iteration := 0; iteration < solverIterations && step > solverTolerance; iteration++ {
+		next := make([]float64, n)
+		for i := range next {
+			next[i] = w[i] + step*grad[i]
+		}
+		next = projectOntoSimplex(next)
+		value, nextGrad := sharpe(next)
+		if value <= current {
+			step /= 2
+			continue
+		}
+		converged := maxAbsDiff(next, w) < solverTolerance
+		w, current, grad = next, value, nextGrad
+		step *= 2
+		if converged {
+			break
+		}
+	}
+	return toPercents(w), nil
+}
+
+// RiskParityWeights returns the weights of the returns where each contributes equally to the variance:
+// the equal-risk-contribution portfolio. It's found by cyclical coordinate descent,
+// as described in "A Fast Algorithm for Computing High-dimensional Risk Parity Portfolios" by Griveau-Billion et al.
+func RiskParityWeights(returnsList [][]Percent) ([]Percent, error) {
+	_, cov, err := meanAndCovariance(returnsList)
+	if err != nil {
+		return nil, err
+	}
+	n := len(cov)
+	for i := range cov {
+		if cov[i][i] <= 0 {
+			return nil, fmt.Errorf("asset #%d has no variance", i+1)
+		}
+	}
+	var (
+		budget = 1 / float64(n)
+		y      = equalWeights(n)
+	)
+	// minimize y'Σy/2 - budget*Σln(y), whose solution is proportional to the risk parity weights
+	for iteration := 0; iteration < solverIterations; iteration++ {
+		var maxChange float64
+		for i := range y {
+			var others float64
+			for j := range y {
+				if j != i {
+					others += cov[i][j] * y[j]
+				}
+			}
+			next := (-others + math.Sqrt(others*others+4*cov[i][i]*budget)) / (2 * cov[i][i])
+			maxChange = math.Max(maxChange, math.Abs(next-y[i]))
+			y[i] = next
+		}
+		if maxChange < solverTolerance {
+			break
+		}
+	}
+	var total float64
+	for _, v := range y {
+		total += v
+	}
+	for i := range y {
+		y[i] /= total
+	}
+	return toPercents(y), nil
+}
+
+const (
+	solverIterations = 100_000
+	solverTolerance  = 1e-12
+)
+
+// meanAndCovariance returns the average return of each of the returns, and their sample covariance matrix.
+func meanAndCovariance(returnsList [][]Percent) ([]float64, [][]float64, error) {
+	if len(returnsList) == 0 {
+		return nil, nil, errors.New("no returns")
+	}
+	nYears := len(returnsList[0])
+	for i, returns := range returnsList {
+		if len(returns) != nYears {
+			return nil, nil, fmt.Errorf("expected returns #%d to have %d years but got %d", i+1, nYears, len(returns))
+		}
+	}
+	if nYears < 2 {
+		return nil, nil, fmt.Errorf("at least 2 years of returns are required, got %d", nYears)
+	}
+	n := len(returnsList)
+	mean := make([]float64, n)
+	for i, returns := range returnsList {
+		mean[i] = average(returns).Float()
+	}
+	cov := make([][]float64, n)
+	for i := range cov {
+		cov[i] = make([]float64, n)
+	}
+	for i := 0; i < n; i++ {
+		for j := i; j < n; j++ {
+			var total float64
+			for year := 0; year < nYears; year++ {
+				total += (returnsList[i][year].Float() - mean[i]) * (returnsList[j][year].Float() - mean[j])
+			}
+			cov[i][j] = total / float64(nYears-1)
+			cov[j][i] = cov[i][j]
+		}
+	}
+	return mean, cov, nil
+}
+
+// projectOntoSimplex returns the closest point to v whose values are non-negative and sum to 1.
+// See "Efficient Projections onto the l1-Ball for Learning in High Dimensions" by Duchi et al.
+func projectOntoSimplex(v []float64) []float64 {
+	sorted := append([]float64(nil), v...)
+	sort.Sort(sort.Reverse(sort.Float64Slice(sorted)))
+	var (
+		runningSum float64
+		theta      float64
+	)
+	for i, x := range sorted {
+		runningSum += x
+		if t := (runningSum - 1) / float64(i+1); x-t > 0 {
+			theta = t
+		}
+	}
+	res := make([]float64, len(v))
+	for i, x := range v {
+		res[i] = math.Max(x-theta, 0)
+	}
+	return res
+}
+
+func mulMatVec(m [][]float64, v []float64) []float64 {
+	res := make([]float64, len(m))
+	for i, row := range m {
+		res[i] = dot(row, v)
+	}
+	return res
+}
+
+func dot(a, b []float64) float64 {
+	var res float64
+	for i := range a {
+		res += a[i] * b[i]
+	}
+	return res
+}
+
+func maxAbsRowSum(m [][]float64) float64 {
+	var res float64
+	for _, row := range m {
+		var total float64
+		for _, x := range row {
+			total += math.Abs(x)
+		}
+		res = math.Max(res, total)
+	}
+	return res
+}
+
+func maxAbsDiff(a, b []float64) float64 {
+	var res float64
+	for i := range a {
+		res = math.Max(res, math.Abs(a[i]-b[i]))
+	}
+	return res
+}
+
+func equalWeights(n int) []float64 {
+	res := make([]float64, n)
+	for i := range res {
+		res[i] = 1 / float64(n)
+	}
+	return res
+}
+
+func toPercents(xs []float64) []Percent {
+	res := make([]Percent, len(xs))
+	for i, x := range xs {
+		res[i] = Percent(x)
+	}
+	return res
+}
@@ -0,0 +1,111 @@
+package portfolio_analysis
+
+import (
+	"math"
+	"testing"
+
+	. "github.com/onsi/gomega"
+
+	"github.com/slatteryjim/portfolio-analysis/data"
+	. "github.com/slatteryjim/portfolio-analysis/types"
+)
+
+func TestAllocationSolvers(t *testing.T) {
+	var (
+		assets      = []string{"TSM", "LTT", "Gold"}
+		returnsList = data.PortfolioReturnsList(assets...)
+	)
+	mean, cov, err := meanAndCovariance(returnsList)
+	if err != nil {
+		t.Fatal(err)
+	}
+	variance := func(w []Percent) float64 {
+		ws := make([]float64, len(w))
+		for i, p := range w {
+			ws[i] = p.Float()
+		}
+		return dot(ws, mulMatVec(cov, ws))
+	}
+	sharpe := func(w []Percent, riskFree Percent) float64 {
+		var excess float64
+		for i, p := range w {
+			excess += p.Float() * (mean[i] - riskFree.Float())
+		}
+		return excess / math.Sqrt(variance(w))
+	}
+	// grid has all of the allocations of the assets in steps of 1%
+	var grid [][]Percent
+	for a := 0; a <= 100; a++ {
+		for b := 0; b <= 100-a; b++ {
+			grid = append(grid, []Percent{Percent(a) / 100, Percent(b) / 100, Percent(100-a-b) / 100})
+		}
+	}
+	expectValidWeights := func(g *WithT, c Combination) {
+		g.Expect(c.Assets).To(Equal(assets))
+		g.Expect(sum(c.Percentages).Float()).To(BeNumerically("~", 1, 1e-9))
+		for _, p := range c.Percentages {
+			g.Expect(p).To(BeNumerically(">=", 0))
+		}
+		// and it can be evaluated like any other combination
+		returns, err := PortfolioReturns(returnsList, c.Percentages)
+		g.Expect(err).To(Succeed())
+		t.Log(EvaluatePortfolio(returns, c))
+	}
+
+	t.Run("minimum variance", func(t *testing.T) {
+		g := NewGomegaWithT(t)
+		c, err := MinimumVarianceCombination(assets...)
+		g.Expect(err).To(Succeed())
+		expectValidWeights(g, c)
+		for _, w := range grid {
+			g.Expect(variance(c.Percentages)).To(BeNumerically("<=", variance(w)+1e-12))
+		}
+	})
+	t.Run("maximum Sharpe", func(t *testing.T) {
+		for _, riskFree := range []Percent{0, 0.02, 0.05} {
+			g := NewGomegaWithT(t)
+			c, err := MaximumSharpeCombination(riskFree, assets...)
+			g.Expect(err).To(Succeed())
+			expectValidWeights(g, c)
+			for _, w := range grid {
+				g.Expect(sharpe(c.Percentages, riskFree)).To(BeNumerically(">=", sharpe(w, riskFree)-1e-9), "risk free %v", riskFree)
+			}
+		}
+	})
+	t.Run("risk parity", func(t *testing.T) {
+		g := NewGomegaWithT(t)
+		c, err := RiskParityCombination(assets...)
+		g.Expect(err).To(Succeed())
+		expectValidWeights(g, c)
+		// each asset contributes the same amount to the variance
+		ws := make([]float64, len(c.Percentages))
+		for i, p := range c.Percentages {
+			ws[i] = p.Float()
+		}
+		covW := mulMatVec(cov, ws)
+		for i := range ws {
+			g.Expect(ws[i] * covW[i]).To(BeNumerically("~", variance(c.Percentages)/3, 1e-12))
+		}
+	})
+	t.Run("errors", func(t *testing.T) {
+		g := NewGomegaWithT(t)
+		_, err := MinimumVarianceCombination()
+		g.Expect(err).To(MatchError("no assets"))
+		_, err = RiskParityWeights([][]Percent{ReadablePercents(1, 2), ReadablePercents(1)})
+		g.Expect(err).To(MatchError("expected returns #2 to have 2 years but got 1"))
+		_, err = MaximumSharpeWeights([][]Percent{ReadablePercents(1)}, 0)
+		g.Expect(err).To(MatchError("at least 2 years of returns are required, got 1"))
+		_, err = RiskParityWeights([][]Percent{ReadablePercents(1, 2), ReadablePercents(3, 3)})
+		g.Expect(err).To(MatchError("asset #2 has no variance"))
+		_, err = MinimumVarianceWeights([][]Percent{ReadablePercents(3, 3)})
+		g.Expect(err).To(MatchError("the returns have no variance"))
+	})
+}
+
+func Test_projectOntoSimplex(t *testing.T) {
+	g := NewGomegaWithT(t)
+	g.Expect(projectOntoSimplex([]float64{0.2, 0.3, 0.5})).To(Equal([]float64{0.2, 0.3, 0.5}))
+	g.Expect(projectOntoSimplex([]float64{1, 1})).To(Equal([]float64{0.5, 0.5}))
+	g.Expect(projectOntoSimplex([]float64{2, 0, -1})).To(Equal([]float64{1, 0, 0}))
+	g.Expect(projectOntoSimplex([]float64{0.5, 0.5, -0.5})).To(Equal([]float64{0.5, 0.5, 0}))
+}
@@ -0,0 +1,552 @@
+package portfolio_analysis
+
+import (
+	"bufio"
+	"compress/gzip"
+	"container/heap"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"sort"
+)
+
+// StatSource replays a stream of portfolio stats, calling fn for each of them in the same order every time.
+// RankStream reads its source several times.
+type StatSource func(fn func(*PortfolioStat) error) error
+
+// SliceStatSource streams the stats of a slice.
+func SliceStatSource(stats []*PortfolioStat) StatSource {
+	return func(fn func(*PortfolioStat) error) error {
+		for _, stat := range stats {
+			if err := fn(stat); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// GobStatSource streams the stats from a gzipped file of GOB-encoded stats, like the ".gobl.gz" snapshots.
+func GobStatSource(filename string) StatSource {
+	return func(fn func(*PortfolioStat) error) error {
+		f, err := os.Open(filename)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		gzipReader, err := gzip.NewReader(f)
+		if err != nil {
+			return err
+		}
+		decoder := gob.NewDecoder(gzipReader)
+		for {
+			var stat *PortfolioStat
+			if err := decoder.Decode(&stat); err == io.EOF {
+				return nil
+			} else if err != nil {
+				return err
+			}
+			if err := fn(stat); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// GobStatWriter writes stats to a gzipped file of GOB-encoded stats, which GobStatSource can read.
+type GobStatWriter struct {
+	f       *os.File
+	gzipped *gzip.Writer
+	encoder *gob.Encoder
+}
+
+func NewGobStatWriter(filename string) (*GobStatWriter, error) {
+	f, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return nil, err
+	}
+	gzipped := gzip.NewWriter(f)
+	return &GobStatWriter{f: f, gzipped: gzipped, encoder: gob.NewEncoder(gzipped)}, nil
+}
+
+func (w *GobStatWriter) Write(stat *PortfolioStat) error {
+	return w.encoder.Encode(stat)
+}
+
+func (w *GobStatWriter) Close() error {
+	if err := w.gzipped.Close(); err != nil {
+		w.f.Close()
+		return err
+	}
+	return w.f.Close()
+}
+
+// StreamRankOptions configures RankStream.
+type StreamRankOptions struct {
+	// Profile scores the overall rank. Defaults to DefaultScoringProfile.
+	Profile *ScoringProfile
+	// ChunkSize is the number of values per metric held in memory before they are sorted and spilled
+	// to a temporary file. Defaults to 1,000,000.
+	ChunkSize int
+	// TempDir holds the temporary files. Defaults to os.TempDir().
+	TempDir string
+}
+
+// RankStream ranks the stats of a stream too large to hold in memory, producing the same ranks as
+// RankPortfoliosWithProfile, and passes each ranked stat to sink in the source's order.
+//
+// Rather than sorting the stats, it sorts each metric's values along with the position of their stat in the stream,
+// externally (spilling sorted chunks to temporary files, and merging them), which gives each value its position
+// among the distinct values. Those are sorted back into the stream's order, the same way, so they can be read
+// alongside the stream, and every temporary file is written and read sequentially. The source is read three times:
+// to collect the metric values, to collect the overall scores, and to assign the ranks.
+// NaN values are ranked last, like RankAll ranks them.
+func RankStream(source StatSource, sink func(*PortfolioStat) error, opts StreamRankOptions) error {
+	profile := DefaultScoringProfile()
+	if opts.Profile != nil {
+		profile = *opts.Profile
+	}
+	weighted, err := profile.weightedMetrics()
+	if err != nil {
+		return fmt.Errorf("scoring profile %q: %w", profile.Name, err)
+	}
+	if opts.ChunkSize <= 0 {
+		opts.ChunkSize = 1_000_000
+	}
+	if opts.TempDir == "" {
+		opts.TempDir = os.TempDir()
+	}
+	dir, err := os.MkdirTemp(opts.TempDir, "rank-stream-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	// collect the metric values, with the position of their stat in the stream
+	sorters := make([]*recordSorter, len(metrics))
+	for i := range metrics {
+		sorters[i] = &recordSorter{dir: dir, chunkSize: opts.ChunkSize, less: byValue}
+	}
+	var seq int64
+	err = source(func(stat *PortfolioStat) error {
+		for i, m := range metrics {
+			if err := sorters[i].add(rankRecord{seq: seq, value: m.Value(stat)}); err != nil {
+				return err
+			}
+		}
+		seq++
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	positions := make([]*rankPositions, len(metrics))
+	defer func() {
+		for _, p := range positions {
+			if p != nil {
+				p.close()
+			}
+		}
+	}()
+	for i, m := range metrics {
+		if positions[i], err = sorters[i].positions(m.LessIsBetter); err != nil {
+			return fmt.Errorf("sorting %s: %w", m.Name, err)
+		}
+		sorters[i] = nil
+	}
+
+	// joinRanks reads the source along with the positions of its values, and calls fn with each stat, once its
+	// metrics are ranked and its overall score is computed
+	joinRanks := func(fn func(seq int64, stat *PortfolioStat) error) error {
+		readers := make([]*positionReader, len(metrics))
+		for i, p := range positions {
+			r, err := p.reader()
+			if err != nil {
+				return err
+			}
+			defer r.close()
+			readers[i] = r
+		}
+		var seq int64
+		err := source(func(stat *PortfolioStat) error {
+			for i, m := range metrics {
+				rank, err := readers[i].next()
+				if err != nil {
+					return fmt.Errorf("ranking %s: %w", m.Name, err)
+				}
+				m.SetRank(stat, rank)
+			}
+			stat.OverallRankScore = profile.score(stat, weighted)
+			err := fn(seq, stat)
+			seq++
+			return err
+		})
+		if err == nil && len(readers) > 0 && readers[0].more() {
+			err = errors.New("the source has fewer stats than it had the first time it was read")
+		}
+		return err
+	}
+
+	// collect the overall scores
+	scores := &recordSorter{dir: dir, chunkSize: opts.ChunkSize, less: byValue}
+	err = joinRanks(func(seq int64, stat *PortfolioStat) error {
+		return scores.add(rankRecord{seq: seq, value: stat.OverallRankScore})
+	})
+	if err != nil {
+		return err
+	}
+	overall, err := scores.positions(true)
+	if err != nil {
+		return fmt.Errorf("sorting OverallRankScore: %w", err)
+	}
+	defer overall.close()
+	overallReader, err := overall.reader()
+	if err != nil {
+		return err
+	}
+	defer overallReader.close()
+
+	// assign all the ranks
+	return joinRanks(func(_ int64, stat *PortfolioStat) error {
+		rank, err := overallReader.next()
+		if err != nil {
+			return fmt.Errorf("ranking OverallRankScore: %w", err)
+		}
+		stat.OverallRankScoreRank = rank
+		return sink(stat)
+	})
+}
+
+// rankRecord is the value of the stat at seq in the stream, or its position among the distinct values.
+type rankRecord struct {
+	seq      int64
+	value    float64
+	position int64
+}
+
+// rankRecordSize is the size of an encoded rankRecord.
+const rankRecordSize = 24
+
+// byValue orders the records by their value, with the NaNs last, and then by their stat's position in the stream.
+func byValue(a, b rankRecord) bool {
+	if aNaN, bNaN := math.IsNaN(a.value), math.IsNaN(b.value); aNaN || bNaN {
+		if aNaN != bNaN {
+			return bNaN
+		}
+	} else if a.value != b.value {
+		return a.value < b.value
+	}
+	return a.seq < b.seq
+}
+
+// bySeq orders the records by their stat's position in the stream.
+func bySeq(a, b rankRecord) bool {
+	return a.seq < b.seq
+}
+
+// sameValue returns true if the values are equal, or both NaN, so they have the same rank.
+func sameValue(a, b float64) bool {
+	return a == b || (math.IsNaN(a) && math.IsNaN(b))
+}
+
+// recordSorter sorts a stream of records externally, holding at most chunkSize records in memory.
+type recordSorter struct {
+	dir       string
+	chunkSize int
+	less      func(a, b rankRecord) bool
+	chunk     []rankRecord
+	files     []string
+}
+
+func (s *recordSorter) add(r rankRecord) error {
+	s.chunk = append(s.chunk, r)
+	if len(s.chunk) >= s.chunkSize {
+		return s.spill()
+	}
+	return nil
+}
+
+// spill writes the current chunk, sorted, to a temporary file.
+func (s *recordSorter) spill() error {
+	sort.Slice(s.chunk, func(i, j int) bool { return s.less(s.chunk[i], s.chunk[j]) })
+	f, err := os.CreateTemp(s.dir, "chunk-")
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	for _, r := range s.chunk {
+		if err := writeRecord(w, r); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	s.files = append(s.files, f.Name())
+	s.chunk = s.chunk[:0]
+	return nil
+}
+
+// merge calls fn with all of the records, in order, merging the spilled chunks, and then removes them.
+func (s *recordSorter) merge(fn func(rankRecord) error) error {
+	if len(s.files) == 0 {
+		sort.Slice(s.chunk, func(i, j int) bool { return s.less(s.chunk[i], s.chunk[j]) })
+		for _, r := range s.chunk {
+			if err := fn(r); err != nil {
+				return err
+			}
+		}
+		s.chunk = nil
+		return nil
+	}
+	if len(s.chunk) > 0 {
+		if err := s.spill(); err != nil {
+			return err
+		}
+	}
+	s.chunk = nil
+	defer func() {
+		for _, name := range s.files {
+			os.Remove(name)
+		}
+		s.files = nil
+	}()
+	h := mergeHeap{less: s.less}
+	for _, name := range s.files {
+		f, err := os.Open(name)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		src := &mergeSource{r: bufio.NewReader(f)}
+		if ok, err := src.next(); err != nil {
+			return err
+		} else if ok {
+			h.sources = append(h.sources, src)
+		}
+	}
+	heap.Init(&h)
+	for len(h.sources) > 0 {
+		src := h.sources[0]
+		if err := fn(src.record); err != nil {
+			return err
+		}
+		if ok, err := src.next(); err != nil {
+			return err
+		} else if ok {
+			heap.Fix(&h, 0)
+		} else {
+			heap.Pop(&h)
+		}
+	}
+	return nil
+}
+
+// positions sorts the values, and returns the position of each stat's value among the distinct values, in the
+// order of the stream.
+func (s *recordSorter) positions(lessIsBetter bool) (*rankPositions, error) {
+	var (
+		p        = &rankPositions{lessIsBetter: lessIsBetter}
+		inMemory = len(s.files) == 0
+		bySeqs   *recordSorter
+		last     float64
+		position int64 = -1
+	)
+	if inMemory {
+		// every stat's value is in the chunk, so the stats' positions in the stream are its indexes
+		p.values = make([]int64, len(s.chunk))
+	} else {
+		bySeqs = &recordSorter{dir: s.dir, chunkSize: s.chunkSize, less: bySeq}
+	}
+	err := s.merge(func(r rankRecord) error {
+		if position < 0 || !sameValue(r.value, last) {
+			position++
+			last = r.value
+			if !math.IsNaN(r.value) {
+				p.numbers++
+			}
+		}
+		if inMemory {
+			p.values[r.seq] = position
+			return nil
+		}
+		return bySeqs.add(rankRecord{seq: r.seq, position: position})
+	})
+	if err != nil {
+		return nil, err
+	}
+	p.count = position + 1
+	if inMemory {
+		return p, nil
+	}
+
+	// write the positions in the stream's order, so they can be read along with it
+	f, err := os.CreateTemp(s.dir, "positions-")
+	if err != nil {
+		return nil, err
+	}
+	w := bufio.NewWriter(f)
+	err = bySeqs.merge(func(r rankRecord) error {
+		return writeInt(w, r.position)
+	})
+	if err == nil {
+		err = w.Flush()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return nil, err
+	}
+	p.file = f.Name()
+	return p, nil
+}
+
+// rankPositions has the position of each stat's value among the distinct values of a metric, in ascending order
+// with the NaNs last, in the order of the stream. They're held in memory, or in a file.
+type rankPositions struct {
+	lessIsBetter bool
+	// numbers is the number of distinct values that aren't NaN, and count is the number of distinct values,
+	// which includes one more for the NaNs, if there are any
+	numbers, count int64
+
+	values []int64
+	file   string
+}
+
+// rank returns the rank of the value at the position.
+func (p *rankPositions) rank(position int64) Rank {
+	// same as RankAll: a dense rank, with the best value ranked 1, and the NaNs ranked last
+	rank := position + 1
+	if !p.lessIsBetter && position < p.numbers {
+		rank = p.numbers - position
+	}
+	return Rank{Ordinal: int(rank), Percentage: float64(rank)/float64(p.count)*99 + 1}
+}
+
+// reader returns a reader of the ranks of the stream's stats, in order.
+func (p *rankPositions) reader() (*positionReader, error) {
+	r := &positionReader{positions: p}
+	if p.file != "" {
+		f, err := os.Open(p.file)
+		if err != nil {
+			return nil, err
+		}
+		r.file, r.r = f, bufio.NewReader(f)
+	}
+	return r, nil
+}
+
+func (p *rankPositions) close() {
+	if p.file != "" {
+		os.Remove(p.file)
+		p.file = ""
+	}
+}
+
+// positionReader reads the ranks of the stream's stats sequentially.
+type positionReader struct {
+	positions *rankPositions
+	index     int
+	file      *os.File
+	r         *bufio.Reader
+}
+
+// next returns the rank of the next stat in the stream.
+func (r *positionReader) next() (Rank, error) {
+	var position int64
+	if r.r == nil {
+		if r.index >= len(r.positions.values) {
+			return Rank{}, errors.New("the source has more stats than it had the first time it was read")
+		}
+		position = r.positions.values[r.index]
+		r.index++
+	} else {
+		var byts [8]byte
+		if _, err := io.ReadFull(r.r, byts[:]); err == io.EOF {
+			return Rank{}, errors.New("the source has more stats than it had the first time it was read")
+		} else if err != nil {
+			return Rank{}, err
+		}
+		position = int64(binary.LittleEndian.Uint64(byts[:]))
+	}
+	return r.positions.rank(position), nil
+}
+
+// more returns true if there are more ranks to read.
+func (r *positionReader) more() bool {
+	if r.r == nil {
+		return r.index < len(r.positions.values)
+	}
+	_, err := r.r.Peek(1)
+	return err == nil
+}
+
+func (r *positionReader) close() {
+	if r.file != nil {
+		r.file.Close()
+		r.file = nil
+	}
+}
+
+type mergeSource struct {
+	r      *bufio.Reader
+	record rankRecord
+}
+
+func (s *mergeSource) next() (bool, error) {
+	var byts [rankRecordSize]byte
+	if _, err := io.ReadFull(s.r, byts[:]); err == io.EOF {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	s.record = rankRecord{
+		seq:      int64(binary.LittleEndian.Uint64(byts[0:])),
+		value:    math.Float64frombits(binary.LittleEndian.Uint64(byts[8:])),
+		position: int64(binary.LittleEndian.Uint64(byts[16:])),
+	}
+	return true, nil
+}
+
+type mergeHeap struct {
+	sources []*mergeSource
+	less    func(a, b rankRecord) bool
+}
+
+func (h mergeHeap) Len() int            { return len(h.sources) }
+func (h mergeHeap) Less(i, j int) bool  { return h.less(h.sources[i].record, h.sources[j].record) }
+func (h mergeHeap) Swap(i, j int)       { h.sources[i], h.sources[j] = h.sources[j], h.sources[i] }
+func (h *mergeHeap) Push(x interface{}) { h.sources = append(h.sources, x.(*mergeSource)) }
+func (h *mergeHeap) Pop() interface{} {
+	old := h.sources
+	x := old[len(old)-1]
+	h.sources = old[:len(old)-1]
+	return x
+}
+
+func writeRecord(w io.Writer, r rankRecord) error {
+	var byts [rankRecordSize]byte
+	binary.LittleEndian.PutUint64(byts[0:], uint64(r.seq))
+	binary.LittleEndian.PutUint64(byts[8:], math.Float64bits(r.value))
+	binary.LittleEndian.PutUint64(byts[16:], uint64(r.position))
+	_, err := w.Write(byts[:])
+	return err
+}
+
+func writeInt(w io.Writer, v int64) error {
+	var byts [8]byte
+	binary.LittleEndian.PutUint64(byts[:], uint64(v))
+	_, err := w.Write(byts[:])
+	return err
+}
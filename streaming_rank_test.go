@@ -0,0 +1,171 @@
+package portfolio_analysis
+
+import (
+	"math"
+	"math/rand"
+	"path/filepath"
+	"testing"
+
+	. "github.com/onsi/gomega"
+
+	. "github.com/slatteryjim/portfolio-analysis/types"
+)
+
+// rankingStats returns some stats with plenty of ties, identified by their RebalanceFactor.
+func rankingStats(n int) []*PortfolioStat {
+	r := rand.New(rand.NewSource(1))
+	res := make([]*PortfolioStat, n)
+	for i := range res {
+		stat := &PortfolioStat{RebalanceFactor: float64(i)}
+		for _, m := range Metrics() {
+			m.SetValue(stat, float64(r.Intn(50)))
+		}
+		res[i] = stat
+	}
+	return res
+}
+
+func TestRankStream(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		opts StreamRankOptions
+	}{
+		{"in memory", StreamRankOptions{}},
+		{"spilled to disk", StreamRankOptions{ChunkSize: 7}},
+		{"merged chunks fit in memory", StreamRankOptions{ChunkSize: 60}},
+		{"with a profile", StreamRankOptions{ChunkSize: 7, Profile: &RetireeScoringProfile}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			g := NewGomegaWithT(t)
+			profile := DefaultScoringProfile()
+			if tc.opts.Profile != nil {
+				profile = *tc.opts.Profile
+			}
+			inMemory := rankingStats(200)
+			g.Expect(RankPortfoliosWithProfile(inMemory, profile)).To(Succeed())
+			byID := map[float64]*PortfolioStat{}
+			for _, stat := range inMemory {
+				byID[stat.RebalanceFactor] = stat
+			}
+
+			tc.opts.TempDir = t.TempDir()
+			var streamed []*PortfolioStat
+			err := RankStream(SliceStatSource(rankingStats(200)), func(stat *PortfolioStat) error {
+				streamed = append(streamed, stat)
+				return nil
+			}, tc.opts)
+			g.Expect(err).To(Succeed())
+			g.Expect(streamed).To(HaveLen(200))
+			for i, stat := range streamed {
+				// in the source's order
+				g.Expect(stat.RebalanceFactor).To(Equal(float64(i)))
+				g.Expect(stat).To(Equal(byID[stat.RebalanceFactor]))
+			}
+			// the temporary files are cleaned up
+			g.Expect(filepath.Glob(filepath.Join(tc.opts.TempDir, "*"))).To(BeEmpty())
+		})
+	}
+	t.Run("NaNs", func(t *testing.T) {
+		// some of the values are NaNs, which are ranked last, like RankAll ranks them
+		withNaNs := func() []*PortfolioStat {
+			stats := rankingStats(50)
+			for i, stat := range stats {
+				for j, m := range Metrics() {
+					if (i+j)%7 == 0 {
+						m.SetValue(stat, math.NaN())
+					}
+				}
+			}
+			return stats
+		}
+		for _, chunkSize := range []int{0, 7} {
+			g := NewGomegaWithT(t)
+			inMemory := withNaNs()
+			RankPortfoliosInPlace(inMemory)
+			byID := map[float64]*PortfolioStat{}
+			for _, stat := range inMemory {
+				byID[stat.RebalanceFactor] = stat
+			}
+			pwr30, _ := MetricByName("PWR30")
+			var streamed int
+			err := RankStream(SliceStatSource(withNaNs()), func(stat *PortfolioStat) error {
+				expected := byID[stat.RebalanceFactor]
+				for _, m := range Metrics() {
+					g.Expect(m.Rank(stat)).To(Equal(m.Rank(expected)), m.Name)
+				}
+				g.Expect(stat.OverallRankScoreRank).To(Equal(expected.OverallRankScoreRank))
+				if math.IsNaN(pwr30.Value(stat)) {
+					g.Expect(stat.PWR30Rank.Percentage).To(Equal(100.0))
+				}
+				streamed++
+				return nil
+			}, StreamRankOptions{ChunkSize: chunkSize, TempDir: t.TempDir()})
+			g.Expect(err).To(Succeed())
+			g.Expect(streamed).To(Equal(50))
+		}
+	})
+	t.Run("the source changes", func(t *testing.T) {
+		g := NewGomegaWithT(t)
+		for _, chunkSize := range []int{0, 7} {
+			for _, change := range []int{-1, 1} {
+				var (
+					reads  int
+					stats  = rankingStats(20)
+					source = func(fn func(*PortfolioStat) error) error {
+						n := len(stats)
+						if reads > 0 {
+							n += change
+						}
+						reads++
+						return SliceStatSource(rankingStats(n))(fn)
+					}
+				)
+				err := RankStream(source, func(*PortfolioStat) error { return nil }, StreamRankOptions{ChunkSize: chunkSize, TempDir: t.TempDir()})
+				g.Expect(err).To(HaveOccurred())
+				g.Expect(err.Error()).To(ContainSubstring("the source has"))
+			}
+		}
+	})
+	t.Run("invalid profile", func(t *testing.T) {
+		g := NewGomegaWithT(t)
+		err := RankStream(SliceStatSource(nil), nil, StreamRankOptions{Profile: &ScoringProfile{Name: "empty"}})
+		g.Expect(err).To(MatchError(`scoring profile "empty": no metrics are weighted`))
+	})
+}
+
+func TestRankStream_gob(t *testing.T) {
+	g := NewGomegaWithT(t)
+	var (
+		input  = filepath.Join(t.TempDir(), "input.gobl.gz")
+		output = filepath.Join(t.TempDir(), "ranked.gobl.gz")
+		gb     = Combination{Assets: []string{"TSM", "SCV", "LTT", "STT", "GLD"}, Percentages: ReadablePercents(20, 20, 20, 20, 20)}
+		stats  []*PortfolioStat
+	)
+	for f := 0.0; f <= 1.5; f += 0.25 {
+		returns, err := PortfolioTradingSimulation([][]Percent{TSM, SCV, LTT, STT, GLD}, gb.Percentages, f)
+		g.Expect(err).To(Succeed())
+		stat := EvaluatePortfolio(returns, gb)
+		stat.RebalanceFactor = f
+		stats = append(stats, stat)
+	}
+	w, err := NewGobStatWriter(input)
+	g.Expect(err).To(Succeed())
+	for _, stat := range stats {
+		g.Expect(w.Write(stat)).To(Succeed())
+	}
+	g.Expect(w.Close()).To(Succeed())
+
+	// write the ranks back out to another file
+	w, err = NewGobStatWriter(output)
+	g.Expect(err).To(Succeed())
+	g.Expect(RankStream(GobStatSource(input), w.Write, StreamRankOptions{ChunkSize: 2, TempDir: t.TempDir()})).To(Succeed())
+	g.Expect(w.Close()).To(Succeed())
+
+	RankPortfoliosInPlace(stats)
+	var ranked []*PortfolioStat
+	g.Expect(GobStatSource(output)(func(stat *PortfolioStat) error {
+		ranked = append(ranked, stat)
+		return nil
+	})).To(Succeed())
+	g.Expect(ranked).To(ConsistOf(stats))
+}
@@ -4,8 +4,11 @@ import (
 	"flag"
 	"fmt"
 	"io/ioutil"
+	"math"
 	"os"
 	"path/filepath"
+	"regexp"
+	"strconv"
 	"strings"
 	"testing"
 
@@ -39,6 +42,50 @@ func TestMain(m *testing.M) {
 // If the "-update" flag was set, the golden file will be updated to match the
 // given content.
 func ExpectMatchesGoldenFile(t *testing.T, actualContent string) {
+	t.Helper()
+	expectMatchesGoldenFile(t, actualContent, func(expected, actual string) bool { return expected == actual })
+}
+
+// ExpectMatchesGoldenFileWithin is like ExpectMatchesGoldenFile, but the numbers in the content only have to be
+// within the relative tolerance of the golden file's, for values computed in a different order than the ones
+// recorded. Numbers close to zero are compared to 0.1% instead.
+func ExpectMatchesGoldenFileWithin(t *testing.T, actualContent string, tolerance float64) {
+	t.Helper()
+	expectMatchesGoldenFile(t, actualContent, func(expected, actual string) bool {
+		return numbersWithin(expected, actual, tolerance)
+	})
+}
+
+// goldenNumber matches the numbers in the content of a golden file.
+var goldenNumber = regexp.MustCompile(`-?[0-9]+(\.[0-9]+)?(e[-+]?[0-9]+)?`)
+
+// numbersWithin returns true if the contents are the same, except for numbers within the relative tolerance.
+func numbersWithin(expected, actual string, tolerance float64) bool {
+	var (
+		expectedNumbers = goldenNumber.FindAllString(expected, -1)
+		actualNumbers   = goldenNumber.FindAllString(actual, -1)
+	)
+	if len(expectedNumbers) != len(actualNumbers) ||
+		goldenNumber.ReplaceAllString(expected, "#") != goldenNumber.ReplaceAllString(actual, "#") {
+		return false
+	}
+	for i := range expectedNumbers {
+		e, err := strconv.ParseFloat(expectedNumbers[i], 64)
+		if err != nil {
+			return false
+		}
+		a, err := strconv.ParseFloat(actualNumbers[i], 64)
+		if err != nil {
+			return false
+		}
+		if math.Abs(a-e) > tolerance*math.Max(math.Abs(e), 1e-3) {
+			return false
+		}
+	}
+	return true
+}
+
+func expectMatchesGoldenFile(t *testing.T, actualContent string, matches func(expected, actual string) bool) {
 	t.Helper()
 	g := NewGomegaWithT(t)
 
@@ -58,7 +105,7 @@ func ExpectMatchesGoldenFile(t *testing.T, actualContent string) {
 	g.Expect(err).ToNot(HaveOccurred(), "reading golden file")
 	expected := string(byts)
 
-	if expected != actualContent {
+	if !matches(expected, actualContent) {
 		t.Errorf("Content did not match golden file. (Run `make test-update-goldenfiles` if you need to update the golden file to match the latest code changes.)")
 		fmt.Println("Golden content:")
 		fmt.Println(expected)
@@ -0,0 +1,288 @@
+package portfolio_analysis
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/slatteryjim/portfolio-analysis/data"
+	. "github.com/slatteryjim/portfolio-analysis/types"
+)
+
+// TaxRates are the rates applied to income and gains in a taxable account.
+type TaxRates struct {
+	LongTermGains Percent
+	// Collectibles applies to the long-term gains of collectible assets, like Gold.
+	Collectibles Percent
+	// Ordinary applies to non-qualified dividends.
+	Ordinary Percent
+}
+
+// AssetTaxTreatment describes how an asset held in a taxable account is taxed.
+type AssetTaxTreatment struct {
+	// Collectible assets have their gains taxed at the collectibles rate.
+	Collectible bool
+	// DividendYield is the portion of the asset's value paid out as income each year, which is taxed annually
+	// (and reinvested after taxes). The rest of the asset's return is unrealized price growth.
+	DividendYield Percent
+	// QualifiedDividends are taxed at the long-term gains rate rather than the ordinary rate.
+	QualifiedDividends bool
+}
+
+// TaxParams configures SimulateTrading to simulate a taxable account.
+type TaxParams struct {
+	Rates TaxRates
+	// Assets has the tax treatment of each asset, in the same order as the target allocations.
+	Assets []AssetTaxTreatment
+	// Inflation is the inflation rate of each year. Cost basis has to be tracked in nominal terms, so
+	// when given, the asset returns are converted to nominal returns for the simulation.
+	// Without it the real returns are treated as nominal, which understates the gains.
+	Inflation []Percent
+}
+
+// TaxTreatments returns the usual tax treatment of the given assets: Gold is a collectible.
+// Dividend yields aren't available in the data, so they are left at zero.
+func TaxTreatments(assets ...string) []AssetTaxTreatment {
+	res := make([]AssetTaxTreatment, len(assets))
+	for i, asset := range assets {
+		res[i].Collectible = asset == "Gold" || asset == "GLD"
+	}
+	return res
+}
+
+type taxLot struct {
+	value Percent
+	basis Percent
+}
+
+// taxableAccount tracks the cost basis of each asset's lots through SimulateTrading.
+// All amounts are nominal, relative to the initial balance of 1.00.
+type taxableAccount struct {
+	TaxParams
+	lots [][]taxLot
+	// realized gains (or losses) this year
+	longTermGains    Percent
+	collectibleGains Percent
+	// capital losses carried forward to offset future gains
+	lossCarryforward Percent
+	// taxes paid on dividends this year
+	dividendTaxes Percent
+}
+
+func newTaxableAccount(params TaxParams, targetAllocations []Percent, years int) (*taxableAccount, error) {
+	if len(params.Assets) != len(targetAllocations) {
+		return nil, fmt.Errorf("tax treatments must be given for each asset: got %d treatments for %d assets", len(params.Assets), len(targetAllocations))
+	}
+	if params.Inflation != nil && len(params.Inflation) != years {
+		return nil, fmt.Errorf("inflation must be given for each year: got %d rates for %d years", len(params.Inflation), years)
+	}
+	a := &taxableAccount{
+		TaxParams: params,
+		lots:      make([][]taxLot, len(targetAllocations)),
+	}
+	for i, allocation := range targetAllocations {
+		a.lots[i] = []taxLot{{value: allocation, basis: allocation}}
+	}
+	return a, nil
+}
+
+// grow applies the year's real return to the holding of asset i, taxing its dividends,
+// and returns the holding's new nominal value.
+func (a *taxableAccount) grow(year, i int, holding, realReturn Percent) Percent {
+	growth := realReturn + 1
+	if a.Inflation != nil {
+		growth *= a.Inflation[year] + 1
+	}
+	var (
+		value    = holding * growth
+		dividend = holding * a.Assets[i].DividendYield
+		rate     = a.Rates.Ordinary
+	)
+	if a.Assets[i].QualifiedDividends {
+		rate = a.Rates.LongTermGains
+	}
+	// the existing lots only get the price growth
+	if holding > 0 {
+		priceGrowth := (value - dividend) / holding
+		for j := range a.lots[i] {
+			a.lots[i][j].value *= priceGrowth
+		}
+	}
+	tax := dividend * rate
+	a.dividendTaxes += tax
+	if reinvested := dividend - tax; reinvested > 0 {
+		a.lots[i] = append(a.lots[i], taxLot{value: reinvested, basis: reinvested})
+	}
+	return value - tax
+}
+
+// trade buys (positive amount) or sells (negative amount) asset i. Sales use the oldest lots first,
+// realizing their gains.
+func (a *taxableAccount) trade(i int, amount Percent) {
+	if amount > 0 {
+		a.lots[i] = append(a.lots[i], taxLot{value: amount, basis: amount})
+		return
+	}
+	remaining := -amount
+	lots := a.lots[i]
+	for len(lots) > 0 && remaining > 0 {
+		lot := &lots[0]
+		sold := Percent(math.Min(remaining.Float(), lot.value.Float()))
+		basis := lot.basis * sold / lot.value
+		if a.Assets[i].Collectible {
+			a.collectibleGains += sold - basis
+		} else {
+			a.longTermGains += sold - basis
+		}
+		lot.value -= sold
+		lot.basis -= basis
+		remaining -= sold
+		if lot.value <= 0 {
+			lots = lots[1:]
+		}
+	}
+	a.lots[i] = lots
+}
+
+// settleYear nets the year's realized gains and losses, and returns the taxes for the year.
+// Losses offset gains of the other kind, and net losses are carried forward, offsetting
+// collectible gains first.
+func (a *taxableAccount) settleYear() (dividendTaxes, gainsTaxes Percent) {
+	longTerm, collectible := a.longTermGains, a.collectibleGains
+	if net := longTerm + collectible; net < 0 {
+		a.lossCarryforward -= net
+		longTerm, collectible = 0, 0
+	} else if longTerm < 0 {
+		collectible, longTerm = net, 0
+	} else if collectible < 0 {
+		longTerm, collectible = net, 0
+	}
+	offset := Percent(math.Min(a.lossCarryforward.Float(), collectible.Float()))
+	collectible -= offset
+	a.lossCarryforward -= offset
+	offset = Percent(math.Min(a.lossCarryforward.Float(), longTerm.Float()))
+	longTerm -= offset
+	a.lossCarryforward -= offset
+
+	dividendTaxes = a.dividendTaxes
+	gainsTaxes = longTerm*a.Rates.LongTermGains + collectible*a.Rates.Collectibles
+	a.longTermGains, a.collectibleGains, a.dividendTaxes = 0, 0, 0
+	return dividendTaxes, gainsTaxes
+}
+
+// scale shrinks every lot when costs or taxes are paid out of the holdings.
+// (The gains realized when selling to pay them are ignored.)
+func (a *taxableAccount) scale(factor Percent) {
+	for i := range a.lots {
+		for j := range a.lots[i] {
+			a.lots[i][j].value *= factor
+			a.lots[i][j].basis *= factor
+		}
+	}
+}
+
+// unrealizedGains returns the gains that haven't been taxed yet, of the regular and collectible assets.
+func (a *taxableAccount) unrealizedGains() (longTerm, collectible Percent) {
+	for i, lots := range a.lots {
+		for _, lot := range lots {
+			if a.Assets[i].Collectible {
+				collectible += lot.value - lot.basis
+			} else {
+				longTerm += lot.value - lot.basis
+			}
+		}
+	}
+	return longTerm, collectible
+}
+
+// liquidationTaxes returns the taxes that would be owed if everything were sold.
+func (a *taxableAccount) liquidationTaxes() Percent {
+	longTerm, collectible := a.unrealizedGains()
+	a.longTermGains += longTerm
+	a.collectibleGains += collectible
+	carryforward := a.lossCarryforward
+	_, taxes := a.settleYear()
+	a.lossCarryforward = carryforward
+	return taxes
+}
+
+// TaxedMetrics are the metrics compared before and after taxes.
+type TaxedMetrics struct {
+	CAGR  Percent
+	PWR30 Percent
+	SWR30 Percent
+}
+
+// TaxableAccountStat compares a portfolio's performance in a taxable account, before and after taxes.
+// All of the metrics are in real terms.
+type TaxableAccountStat struct {
+	Assets      []string
+	Percentages []Percent
+
+	PreTax   TaxedMetrics
+	AfterTax TaxedMetrics
+	// AfterLiquidationCAGR also pays the taxes on all of the remaining gains at the end.
+	AfterLiquidationCAGR Percent
+	// TaxesPaid is the sum of all the taxes paid, as a fraction of the portfolio's initial balance (nominal).
+	TaxesPaid Percent
+}
+
+func (s TaxableAccountStat) String() string {
+	return fmt.Sprintf("%v %v CAGR:%0.3f%%->%0.3f%%(%0.3f%%) PWR:%0.3f%%->%0.3f%% SWR:%0.3f%%->%0.3f%% TaxesPaid:%0.1f%%",
+		s.Assets,
+		s.Percentages,
+		s.PreTax.CAGR*100,
+		s.AfterTax.CAGR*100,
+		s.AfterLiquidationCAGR*100,
+		s.PreTax.PWR30*100,
+		s.AfterTax.PWR30*100,
+		s.PreTax.SWR30*100,
+		s.AfterTax.SWR30*100,
+		s.TaxesPaid*100,
+	)
+}
+
+// EvaluateTaxableAccount simulates holding the combination in a taxable account, comparing its performance
+// before and after taxes. params.Taxes is required; if it has no Inflation, the inflation for the years
+// covered by the assets is used so that gains are taxed in nominal terms.
+func EvaluateTaxableAccount(p Combination, params TradingParams) (*TaxableAccountStat, error) {
+	if params.Taxes == nil {
+		return nil, fmt.Errorf("tax params are required")
+	}
+	var (
+		returnsList = data.PortfolioReturnsList(p.Assets...)
+		taxes       = *params.Taxes
+	)
+	if taxes.Inflation == nil {
+		taxes.Inflation = data.PortfolioInflation(p.Assets...)
+	}
+	preTax, err := SimulateTrading(returnsList, p.Percentages, TradingParams{Policy: params.Policy, Costs: params.Costs})
+	if err != nil {
+		return nil, err
+	}
+	params.Taxes = &taxes
+	afterTax, err := SimulateTrading(returnsList, p.Percentages, params)
+	if err != nil {
+		return nil, err
+	}
+	// real value remaining after liquidating at the end
+	liquidated := cumulative(afterTax.Returns) - GrowthMultiplier(afterTax.LiquidationTaxes/Percent(cumulative(taxes.Inflation)))
+
+	res := &TaxableAccountStat{
+		Assets:               p.Assets,
+		Percentages:          p.Percentages,
+		PreTax:               taxedMetrics(preTax.Returns),
+		AfterTax:             taxedMetrics(afterTax.Returns),
+		AfterLiquidationCAGR: Percent(math.Pow(liquidated.Float(), 1/float64(len(afterTax.Returns))) - 1),
+		TaxesPaid:            afterTax.Taxes,
+	}
+	return res, nil
+}
+
+func taxedMetrics(returns []Percent) TaxedMetrics {
+	pwr30, swr30 := minPWRAndSWR(returns, 30)
+	return TaxedMetrics{
+		CAGR:  cagr(returns),
+		PWR30: pwr30,
+		SWR30: swr30,
+	}
+}
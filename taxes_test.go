@@ -0,0 +1,208 @@
+package portfolio_analysis
+
+import (
+	"testing"
+
+	. "github.com/onsi/gomega"
+
+	"github.com/slatteryjim/portfolio-analysis/data"
+	. "github.com/slatteryjim/portfolio-analysis/types"
+)
+
+func TestSimulateTrading_taxes(t *testing.T) {
+	var (
+		assets = [][]Percent{
+			ReadablePercents(100, 100), // first asset doubles each year
+			ReadablePercents(0, 0),
+		}
+		targetAllocations = ReadablePercents(50, 50)
+		rates             = TaxRates{LongTermGains: 0.20, Collectibles: 0.28, Ordinary: 0.35}
+	)
+	t.Run("errors", func(t *testing.T) {
+		g := NewGomegaWithT(t)
+		_, err := SimulateTrading(assets, targetAllocations, TradingParams{
+			Policy: RebalanceAnnually,
+			Taxes:  &TaxParams{Rates: rates},
+		})
+		g.Expect(err).To(MatchError("tax treatments must be given for each asset: got 0 treatments for 2 assets"))
+
+		_, err = SimulateTrading(assets, targetAllocations, TradingParams{
+			Policy: RebalanceAnnually,
+			Taxes:  &TaxParams{Rates: rates, Assets: make([]AssetTaxTreatment, 2), Inflation: ReadablePercents(3)},
+		})
+		g.Expect(err).To(MatchError("inflation must be given for each year: got 1 rates for 2 years"))
+	})
+	t.Run("no taxes owed matches the pre-tax simulation", func(t *testing.T) {
+		g := NewGomegaWithT(t)
+		preTax, err := SimulateTrading([][]Percent{TSM, SCV, LTT, STT, GLD}, ReadablePercents(20, 20, 20, 20, 20), TradingParams{Policy: RebalanceAnnually})
+		g.Expect(err).To(Succeed())
+		sim, err := SimulateTrading([][]Percent{TSM, SCV, LTT, STT, GLD}, ReadablePercents(20, 20, 20, 20, 20), TradingParams{
+			Policy: RebalanceAnnually,
+			Taxes:  &TaxParams{Assets: make([]AssetTaxTreatment, 5)},
+		})
+		g.Expect(err).To(Succeed())
+		g.Expect(sim.Returns).To(Equal(preTax.Returns))
+		g.Expect(sim.Taxes).To(Equal(Percent(0)))
+	})
+	t.Run("realized gains are taxed", func(t *testing.T) {
+		g := NewGomegaWithT(t)
+		sim, err := SimulateTrading(assets, targetAllocations, TradingParams{
+			Policy: RebalanceAnnually,
+			Taxes:  &TaxParams{Rates: rates, Assets: make([]AssetTaxTreatment, 2)},
+		})
+		g.Expect(err).To(Succeed())
+		// the first asset grows to 1.00, and 0.25 of it is sold with a basis of 0.125
+		g.Expect(sim.Years[0].Taxes.Float()).To(BeNumerically("~", 0.125*0.20, 1e-15))
+		g.Expect(sim.Returns[0].Float()).To(BeNumerically("~", 0.5-0.025, 1e-15))
+		g.Expect(sim.Taxes).To(BeNumerically(">", sim.Years[0].Taxes))
+		g.Expect(sim.LiquidationTaxes).To(BeNumerically(">", 0))
+	})
+	t.Run("collectibles have their own rate", func(t *testing.T) {
+		g := NewGomegaWithT(t)
+		sim, err := SimulateTrading(assets, targetAllocations, TradingParams{
+			Policy: RebalanceAnnually,
+			Taxes:  &TaxParams{Rates: rates, Assets: []AssetTaxTreatment{{Collectible: true}, {}}},
+		})
+		g.Expect(err).To(Succeed())
+		g.Expect(sim.Years[0].Taxes.Float()).To(BeNumerically("~", 0.125*0.28, 1e-15))
+	})
+	t.Run("buy and hold defers the gains until liquidation", func(t *testing.T) {
+		g := NewGomegaWithT(t)
+		sim, err := SimulateTrading(assets, targetAllocations, TradingParams{
+			Policy: NeverRebalance,
+			Taxes:  &TaxParams{Rates: rates, Assets: make([]AssetTaxTreatment, 2)},
+		})
+		g.Expect(err).To(Succeed())
+		g.Expect(sim.Taxes).To(Equal(Percent(0)))
+		// the first asset grew from 0.5 to 2.0
+		g.Expect(sim.LiquidationTaxes.Float()).To(BeNumerically("~", 1.5*0.20, 1e-15))
+	})
+	t.Run("dividends are taxed every year", func(t *testing.T) {
+		g := NewGomegaWithT(t)
+		sim, err := SimulateTrading(assets, targetAllocations, TradingParams{
+			Policy: NeverRebalance,
+			Taxes: &TaxParams{Rates: rates, Assets: []AssetTaxTreatment{
+				{},
+				{DividendYield: 0.04},
+			}},
+		})
+		g.Expect(err).To(Succeed())
+		g.Expect(sim.Years[0].Taxes.Float()).To(BeNumerically("~", 0.5*0.04*0.35, 1e-15))
+		g.Expect(sim.Returns[0].Float()).To(BeNumerically("~", 0.5-0.5*0.04*0.35, 1e-15))
+
+		qualified, err := SimulateTrading(assets, targetAllocations, TradingParams{
+			Policy: NeverRebalance,
+			Taxes: &TaxParams{Rates: rates, Assets: []AssetTaxTreatment{
+				{},
+				{DividendYield: 0.04, QualifiedDividends: true},
+			}},
+		})
+		g.Expect(err).To(Succeed())
+		g.Expect(qualified.Years[0].Taxes.Float()).To(BeNumerically("~", 0.5*0.04*0.20, 1e-15))
+	})
+	t.Run("inflation is taxed, but returns are still real", func(t *testing.T) {
+		g := NewGomegaWithT(t)
+		noTaxes, err := SimulateTrading(assets, targetAllocations, TradingParams{
+			Policy: RebalanceAnnually,
+			Taxes:  &TaxParams{Assets: make([]AssetTaxTreatment, 2), Inflation: ReadablePercents(10, 10)},
+		})
+		g.Expect(err).To(Succeed())
+		g.Expect(noTaxes.Returns[0].Float()).To(BeNumerically("~", 0.5, 1e-15))
+		g.Expect(noTaxes.Returns[1].Float()).To(BeNumerically("~", 0.5, 1e-15))
+
+		sim, err := SimulateTrading(assets, targetAllocations, TradingParams{
+			Policy: RebalanceAnnually,
+			Taxes:  &TaxParams{Rates: rates, Assets: make([]AssetTaxTreatment, 2), Inflation: ReadablePercents(10, 10)},
+		})
+		g.Expect(err).To(Succeed())
+		// the nominal growth is taxed, so the real return is lower than without inflation
+		g.Expect(sim.Returns[0].Float()).To(BeNumerically("<", 0.475))
+	})
+}
+
+func Test_taxableAccount_settleYear(t *testing.T) {
+	newAccount := func() *taxableAccount {
+		a, err := newTaxableAccount(TaxParams{
+			Rates:  TaxRates{LongTermGains: 0.20, Collectibles: 0.28},
+			Assets: make([]AssetTaxTreatment, 1),
+		}, ReadablePercents(100), 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return a
+	}
+	t.Run("losses offset the other kind of gains", func(t *testing.T) {
+		g := NewGomegaWithT(t)
+		a := newAccount()
+		a.longTermGains, a.collectibleGains = -0.1, 0.3
+		_, taxes := a.settleYear()
+		g.Expect(taxes.Float()).To(BeNumerically("~", 0.2*0.28, 1e-15))
+		g.Expect(a.lossCarryforward).To(Equal(Percent(0)))
+	})
+	t.Run("net losses are carried forward", func(t *testing.T) {
+		g := NewGomegaWithT(t)
+		a := newAccount()
+		a.longTermGains, a.collectibleGains = -0.3, 0.1
+		_, taxes := a.settleYear()
+		g.Expect(taxes).To(Equal(Percent(0)))
+		g.Expect(a.lossCarryforward.Float()).To(BeNumerically("~", 0.2, 1e-15))
+
+		// offsetting collectible gains first
+		a.longTermGains, a.collectibleGains = 0.3, 0.1
+		_, taxes = a.settleYear()
+		g.Expect(taxes.Float()).To(BeNumerically("~", 0.2*0.20, 1e-15))
+		g.Expect(a.lossCarryforward.Float()).To(BeNumerically("~", 0, 1e-15))
+	})
+}
+
+func TestEvaluateTaxableAccount(t *testing.T) {
+	g := NewGomegaWithT(t)
+	assets := []string{"TSM", "SCV", "LTT", "STT", "Gold"}
+	combination := Combination{Assets: assets, Percentages: ReadablePercents(20, 20, 20, 20, 20)}
+
+	_, err := EvaluateTaxableAccount(combination, TradingParams{Policy: RebalanceAnnually})
+	g.Expect(err).To(MatchError("tax params are required"))
+
+	stat, err := EvaluateTaxableAccount(combination, TradingParams{
+		Policy: RebalanceAnnually,
+		Taxes: &TaxParams{
+			Rates:  TaxRates{LongTermGains: 0.15, Collectibles: 0.28, Ordinary: 0.32},
+			Assets: TaxTreatments(assets...),
+		},
+	})
+	g.Expect(err).To(Succeed())
+	t.Log(stat)
+
+	returns, err := PortfolioReturns(data.PortfolioReturnsList(assets...), combination.Percentages)
+	g.Expect(err).To(Succeed())
+	pre := EvaluatePortfolio(returns, combination)
+	g.Expect(stat.PreTax.PWR30).To(BeNumerically("~", pre.PWR30, 1e-14))
+	g.Expect(stat.PreTax.SWR30).To(BeNumerically("~", pre.SWR30, 1e-14))
+	g.Expect(stat.TaxesPaid).To(BeNumerically(">", 0))
+	g.Expect(stat.AfterTax.CAGR).To(BeNumerically("<", stat.PreTax.CAGR))
+	g.Expect(stat.AfterTax.PWR30).To(BeNumerically("<", stat.PreTax.PWR30))
+	g.Expect(stat.AfterTax.SWR30).To(BeNumerically("<", stat.PreTax.SWR30))
+	g.Expect(stat.AfterLiquidationCAGR).To(BeNumerically("<", stat.AfterTax.CAGR))
+
+	// rebalancing less often defers taxes
+	everyThree, err := EvaluateTaxableAccount(combination, TradingParams{
+		Policy: RebalanceEveryNYears(3),
+		Taxes: &TaxParams{
+			Rates:     TaxRates{LongTermGains: 0.15, Collectibles: 0.28, Ordinary: 0.32},
+			Assets:    TaxTreatments(assets...),
+			Inflation: data.PortfolioInflation(assets...),
+		},
+	})
+	g.Expect(err).To(Succeed())
+	t.Log(everyThree)
+	g.Expect(everyThree.TaxesPaid).To(BeNumerically("<", stat.TaxesPaid))
+}
+
+func TestTaxTreatments(t *testing.T) {
+	g := NewGomegaWithT(t)
+	g.Expect(TaxTreatments("TSM", "Gold", "GLD")).To(Equal([]AssetTaxTreatment{
+		{},
+		{Collectible: true},
+		{Collectible: true},
+	}))
+}
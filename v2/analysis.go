@@ -1,9 +1,11 @@
 package v2
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	pa "github.com/slatteryjim/portfolio-analysis"
@@ -13,214 +15,301 @@ import (
 
 // GoFindKAssetsBetterThanX will spin up multiple goroutines to look at all `k` combination of the given names.
 // Any combinations that have stats better than the given ideal will be written to the returned channel.
-// When all combinations have been evaluated, the returned channel will be closed.
-func GoFindKAssetsBetterThanX(ideal *pa.PortfolioStat, k int, names []string) <-chan *pa.PortfolioStat {
-	var resultsCh = make(chan *pa.PortfolioStat, 10)
+// When all combinations have been evaluated, or the context is done, the returned channel will be closed.
+// The progress counts how far the search got.
+func GoFindKAssetsBetterThanX(ctx context.Context, ideal *pa.PortfolioStat, k int, names []string, opts SearchOptions) (<-chan *pa.PortfolioStat, *SearchProgress) {
+	// look at all `k` combinations of assets
+	return GoFindKAssetsInRangeBetterThanX(ctx, ideal, k, names, 0, pa.Binomial(len(names), k), opts)
+}
+
+// GoFindKAssetsInRangeBetterThanX is like GoFindKAssetsBetterThanX, but it only looks at the `k` combinations ranked
+// from start up to, but not including, end. A search can be split into shards with pa.ShardRange,
+// each run by its own process, and their results merged with MergeResultsSQLite.
+func GoFindKAssetsInRangeBetterThanX(ctx context.Context, ideal *pa.PortfolioStat, k int, names []string, start, end int, opts SearchOptions) (<-chan *pa.PortfolioStat, *SearchProgress) {
+	targetAllocations := make([]Percent, k)
+	for i := 0; i < k; i++ {
+		targetAllocations[i] = Percent(1.0 / float64(k))
+	}
+	combinationsCh := pa.GoEnumerateCombinationRange(ctx, names, k, start, end, opts.batchSize())
+	return goEvaluateCombinations(ctx, ideal, combinationsCh, end-start, func([]string, [][]Percent) ([][]Percent, int) {
+		return [][]Percent{targetAllocations}, 0
+	}, 0, opts)
+}
+
+// SearchProgress counts how far a search got. The counts can be read while the search is running.
+type SearchProgress struct {
+	total        int64
+	startAt      time.Time
+	combinations int64
+	evaluated    int64
+	pruned       int64
+	found        int64
+}
+
+func newSearchProgress(total int) *SearchProgress {
+	return &SearchProgress{total: int64(total), startAt: time.Now()}
+}
+
+// Total returns the number of combinations of assets to evaluate.
+func (p *SearchProgress) Total() int64 {
+	return p.total
+}
+
+// Combinations returns the number of combinations of assets evaluated.
+func (p *SearchProgress) Combinations() int64 {
+	return atomic.LoadInt64(&p.combinations)
+}
+
+// Evaluated returns the number of portfolios evaluated.
+func (p *SearchProgress) Evaluated() int64 {
+	return atomic.LoadInt64(&p.evaluated)
+}
+
+// Pruned returns the number of portfolios that were skipped, because they couldn't have been as good as the ideal.
+func (p *SearchProgress) Pruned() int64 {
+	return atomic.LoadInt64(&p.pruned)
+}
+
+// Found returns the number of portfolios written to the results.
+func (p *SearchProgress) Found() int64 {
+	return atomic.LoadInt64(&p.found)
+}
+
+// Event returns a snapshot of the progress.
+func (p *SearchProgress) Event() ProgressEvent {
+	e := ProgressEvent{
+		Combinations: p.Combinations(),
+		Total:        p.total,
+		Evaluated:    p.Evaluated(),
+		Pruned:       p.Pruned(),
+		Found:        p.Found(),
+		Elapsed:      time.Since(p.startAt),
+	}
+	if seconds := e.Elapsed.Seconds(); seconds > 0 {
+		e.PerSecond = float64(e.Combinations) / seconds
+	}
+	if e.PerSecond > 0 && e.Total > e.Combinations {
+		e.ETA = time.Duration(float64(e.Total-e.Combinations) / e.PerSecond * float64(time.Second))
+	}
+	return e
+}
+
+func (p *SearchProgress) String() string {
+	return fmt.Sprintf("%d combinations, %d portfolios evaluated, %d pruned, %d found", p.Combinations(), p.Evaluated(), p.Pruned(), p.Found())
+}
+
+// goEvaluateCombinations spreads the combinations of assets across a pool of workers,
+// evaluating each combination at every one of its allocations. The total is only used to report progress.
+// If the step isn't zero, the allocations are on a grid of that step, so their returns are computed with a sweep.
+// Any portfolios that have stats better than the given ideal will be written to the returned channel.
+// When all portfolios have been evaluated, or the context is done, the returned channel will be closed.
+func goEvaluateCombinations(ctx context.Context, ideal *pa.PortfolioStat, combinationsCh <-chan [][]string, total int, allocations allocationsFunc, step Percent, opts SearchOptions) (<-chan *pa.PortfolioStat, *SearchProgress) {
+	var (
+		resultsCh = make(chan *pa.PortfolioStat, opts.buffer())
+		progress  = newSearchProgress(total)
+	)
 	go func() {
 		defer close(resultsCh)
-		startAt := time.Now()
-		// look at all `k` combinations of assets
-		targetAllocations := make([]Percent, k)
-		for i := 0; i < k; i++ {
-			targetAllocations[i] = Percent(1.0 / float64(k))
-		}
-		nCr := pa.Binomial(len(names), k)
-		fmt.Println()
-		fmt.Println(time.Now(), "k =", k, "nCr =", nCr, "TargetAllocations", targetAllocations)
+		stopReporting := opts.goReportProgress(progress)
+		// the last event reports whether the search was cancelled
+		defer func() { stopReporting(ctx.Err()) }()
 
 		GoEvaluateAndFindBetterThan := func(assetCombinationBatches <-chan [][]string) <-chan *pa.PortfolioStat {
-			out := make(chan *pa.PortfolioStat, 10)
+			out := make(chan *pa.PortfolioStat, opts.buffer())
 			go func() {
 				defer close(out)
 				for batch := range assetCombinationBatches {
+					// count locally, and add to the progress once per batch
+					var combinations, evaluated, pruned int64
+				combinationsLoop:
 					for _, assets := range batch {
-						returnsList := data.PortfolioReturnsList(assets...)
-						returns, err := pa.PortfolioReturns(returnsList, targetAllocations)
-						if err != nil {
-							panic(err.Error())
+						if ctx.Err() != nil {
+							break
 						}
-						combination := pa.Combination{Assets: assets, Percentages: targetAllocations}
-						var stat *pa.PortfolioStat
-						if ideal != nil {
-							stat = pa.EvaluatePortfolioIfAsGoodOrBetterThan(returns, combination, ideal)
-						} else {
-							stat = pa.EvaluatePortfolio(returns, combination)
+						returnsList := data.PortfolioReturnsList(assets...)
+						targets, skipped := allocations(assets, returnsList)
+						pruned += int64(skipped)
+						if opts.Cache != nil {
+							opts.Cache.prefetchAllocations(assets, targets)
 						}
-						if stat != nil {
-							out <- stat
+						portfolioReturns := portfolioReturnsFunc(returnsList, step)
+						for _, targetAllocations := range targets {
+							// a grid can have thousands of allocations, so don't finish them once the search is stopped
+							if ctx.Err() != nil {
+								break combinationsLoop
+							}
+							evaluated++
+							if stat := evaluateCombination(ideal, assets, targetAllocations, portfolioReturns, opts.Cache); stat != nil {
+								select {
+								case out <- stat:
+								case <-ctx.Done():
+								}
+							}
 						}
+						combinations++
+					}
+					atomic.AddInt64(&progress.combinations, combinations)
+					atomic.AddInt64(&progress.evaluated, evaluated)
+					atomic.AddInt64(&progress.pruned, pruned)
+					if ctx.Err() != nil {
+						return
 					}
 				}
 			}()
 			return out
 		}
 
-		combinationsCh := pa.GoEnumerateCombinations(names, k, 10_000)
-		// fan out to multiple workers, 9 workers was a sweet spot
+		// fan out to multiple workers
 		var workersOutput []<-chan *pa.PortfolioStat
-		for i := 0; i < 9; i++ {
+		for i := 0; i < opts.workers(); i++ {
 			results := GoEvaluateAndFindBetterThan(combinationsCh)
 			workersOutput = append(workersOutput, results)
 		}
 		// merge workers' output
-		for result := range pa.GoMerge(workersOutput...) {
-			resultsCh <- result
+		for result := range pa.GoMerge(ctx, workersOutput...) {
+			select {
+			case resultsCh <- result:
+				atomic.AddInt64(&progress.found, 1)
+			case <-ctx.Done():
+			}
 		}
-
-		elapsed := time.Since(startAt)
-		fmt.Printf("Finished evaluating %d portfolios in %v (%d portfolios per second)\n",
-			nCr, elapsed, int(float64(nCr)/elapsed.Seconds()))
 	}()
-	return resultsCh
+	return resultsCh, progress
 }
 
-func EncodeResultsToSQLite(sqliteFile string, results <-chan *pa.PortfolioStat) error {
-	db, err := sql.Open("sqlite3", sqliteFile+"?mode=rwc")
-	if err != nil {
-		return err
+// portfolioReturnsFunc returns a func that computes the returns of the assets at an allocation, like
+// pa.PortfolioReturns. If the step isn't zero, the allocations must be on a grid of that step, like WeightGrid's, and
+// the returns are computed with a pa.AllocationSweep, which gives the same returns faster as it moves from one
+// allocation to the next. Its returns are only valid until it's called again.
+func portfolioReturnsFunc(returnsList [][]Percent, step Percent) func(allocation []Percent) []Percent {
+	if step == 0 {
+		return func(allocation []Percent) []Percent {
+			returns, err := pa.PortfolioReturns(returnsList, allocation)
+			if err != nil {
+				panic(err.Error())
+			}
+			return returns
+		}
 	}
-	defer db.Close()
+	var sweep *pa.AllocationSweep
+	return func(allocation []Percent) []Percent {
+		if sweep == nil {
+			var err error
+			if sweep, err = pa.NewAllocationSweep(returnsList, step); err != nil {
+				panic(err.Error())
+			}
+		}
+		returns, err := sweep.Set(allocation)
+		if err != nil {
+			panic(err.Error())
+		}
+		return returns
+	}
+}
 
-	const tableName = "portfolios_1pct_10ltt"
-
-	// create table
-	sqlStmt := `
-		DROP TABLE IF EXISTS '` + tableName + `';
-		CREATE TABLE IF NOT EXISTS '` + tableName + `' (
-			assets                TEXT NOT NULL,
-			percentages           TEXT NOT NULL,
-			num_assets            INTEGER,
-			num_years             INTEGER,
-			avg_return            REAL,
-			baseline_lt_return    REAL,
-			baseline_st_return    REAL,
-			pwr30                 REAL,
-			swr30                 REAL,
-			std_dev               REAL,
-			ulcer_score           REAL,
-			deepest_drawdown      REAL,
-			longest_drawdown      REAL,
-			startdate_sensitivity REAL,
-			pwr5                  REAL,
-			pwr10                 REAL,
-			pwr10_stdev           REAL,
-			pwr10_slope           REAL,
-			pwr30_stdev           REAL,
-			pwr30_slope           REAL,
-			percent_tsm           REAL,
-			percent_scv           REAL,
-			percent_ltt           REAL,
-			percent_stt           REAL,
-			percent_gold          REAL,
-			percent_reit          REAL,
-			percent_tips          REAL
-			);
-	`
-	_, err = db.Exec(sqlStmt)
-	if err != nil {
-		return err
+// evaluateCombination evaluates the assets at the target allocations, using the cache if it isn't nil.
+// It returns nil if the portfolio isn't as good or better than the ideal, unless the ideal is nil.
+func evaluateCombination(ideal *pa.PortfolioStat, assets []string, targetAllocations []Percent, returns func(allocation []Percent) []Percent, cache *EvaluationCache) *pa.PortfolioStat {
+	portfolioReturns := func() []Percent {
+		return returns(targetAllocations)
 	}
+	if cache != nil {
+		key := searchEvaluationKey(assets, targetAllocations)
+		if ideal != nil {
+			return cache.EvaluateIfAsGoodOrBetterThan(key, portfolioReturns, ideal)
+		}
+		return cache.Evaluate(key, portfolioReturns)
+	}
+	combination := pa.Combination{Assets: assets, Percentages: targetAllocations}
+	if ideal != nil {
+		return pa.EvaluatePortfolioIfAsGoodOrBetterThan(portfolioReturns(), combination, ideal)
+	}
+	return pa.EvaluatePortfolio(portfolioReturns(), combination)
+}
+
+// resultsTableName is the default table that SQLiteSink writes the results to.
+const resultsTableName = "portfolios_1pct_10ltt"
 
-	tx, err := db.Begin()
+// EncodeResultsToSQLite writes the results to a table in the SQLite file, in one transaction, until the results
+// channel is closed. If the context is done first, it commits the results read so far and returns the context's error.
+// It returns the number of rows written. See SQLiteSink, and WriteResults, which is why the search sending the
+// results must be cancelled if it returns an error.
+func EncodeResultsToSQLite(ctx context.Context, sqliteFile string, results <-chan *pa.PortfolioStat) (int, error) {
+	sink, err := NewSQLiteSink(sqliteFile)
 	if err != nil {
-		return err
-	}
-	stmt, err := tx.Prepare(`
-			INSERT INTO '` + tableName + `' (
-				assets,
-				percentages,                    
-				num_assets,
-				num_years,
-				avg_return,
-				baseline_lt_return,
-				baseline_st_return,
-				pwr30,
-				swr30,
-				std_dev,
-				ulcer_score,
-				deepest_drawdown,
-				longest_drawdown,
-				startdate_sensitivity,
-				pwr5,
-				pwr10,
-				pwr10_stdev,
-				pwr10_slope,
-				pwr30_stdev,
-				pwr30_slope,
-				percent_tsm,
-				percent_scv,
-				percent_ltt,
-				percent_stt,
-				percent_gold,
-				percent_reit,
-				percent_tips
-			)
-			VALUES(?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
-		`)
+		return 0, err
+	}
+	return WriteResults(ctx, sink, results)
+}
+
+// MergeResultsSQLite merges the results that EncodeResultsToSQLite wrote to each of the shard files into the SQLite
+// file, replacing any results it had. It returns the number of rows merged.
+func MergeResultsSQLite(sqliteFile string, shardFiles ...string) (int, error) {
+	return MergeResultsTableSQLite(sqliteFile, resultsTableName, shardFiles...)
+}
+
+// MergeResultsTableSQLite is like MergeResultsSQLite, but merges the results that a SQLiteSink wrote to the given
+// table, along with the runs that wrote them.
+func MergeResultsTableSQLite(sqliteFile, table string, shardFiles ...string) (int, error) {
+	if !isSQLiteIdentifier(table) || table == runsTableName {
+		return 0, fmt.Errorf("invalid results table name %q", table)
+	}
+	db, err := sql.Open("sqlite3", sqliteFile+"?mode=rwc")
 	if err != nil {
-		return err
+		return 0, err
+	}
+	defer db.Close()
+	// the shards are attached to the connection, so only use one
+	db.SetMaxOpenConns(1)
+
+	if _, err := db.Exec(`DROP TABLE IF EXISTS '` + table + `'`); err != nil {
+		return 0, err
 	}
 	var totalRows int
-	for stat := range results {
-		returnsList := data.PortfolioReturnsList(stat.Assets...)
-		returns, err := pa.PortfolioReturns(returnsList, stat.Percentages)
+	for i, shardFile := range shardFiles {
+		n, err := mergeShard(db, shardFile, table, i == 0)
 		if err != nil {
-			return err
+			return 0, fmt.Errorf("merging %q: %w", shardFile, err)
 		}
-		minPWR10, _ := pa.MinPWR(returns, 10)
-		minPWR5, _ := pa.MinPWR(returns, 5)
-		pwrs10 := pa.AllPWRs(returns, 10)
-		pwrs30 := pa.AllPWRs(returns, 30)
-		percentTSM, _ := stat.Percentage("TSM")
-		percentSCV, _ := stat.Percentage("SCV")
-		percentLTT, _ := stat.Percentage("LTT")
-		percentSTT, _ := stat.Percentage("STT")
-		percentGold, _ := stat.Percentage("Gold")
-		percentREIT, _ := stat.Percentage("REIT")
-		percentTIPS, _ := stat.Percentage("TIPS")
-		_, err = stmt.Exec(
-			"|"+strings.Join(stat.Assets, "|")+"|",               // encode as string
-			"|"+strings.Join(Strings(stat.Percentages), "|")+"|", // encode as string
-			len(stat.Assets), // NumAssets
-			len(returns),     // NumYears
-			stat.AvgReturn.Float(),
-			stat.BaselineLTReturn.Float(),
-			stat.BaselineSTReturn.Float(),
-			stat.PWR30.Float(),
-			stat.SWR30.Float(),
-			stat.StdDev.Float(),
-			stat.UlcerScore,
-			stat.DeepestDrawdown.Float(),
-			stat.LongestDrawdown,
-			stat.StartDateSensitivity.Float(),
-			minPWR5.Float(),
-			minPWR10.Float(),
-			pa.StandardDeviation(pwrs10).Float(),
-			pa.Slope(pwrs10).Float(),
-			pa.StandardDeviation(pwrs30).Float(),
-			pa.Slope(pwrs30).Float(),
-			percentTSM.Float(),
-			percentSCV.Float(),
-			percentLTT.Float(),
-			percentSTT.Float(),
-			percentGold.Float(),
-			percentREIT.Float(),
-			percentTIPS.Float(),
-		)
-		if err != nil {
-			return err
+		totalRows += n
+	}
+	return totalRows, nil
+}
+
+// mergeShard copies the results from the shard file's table into the database, with the runs that wrote them,
+// first creating the results table like the shard's, if asked to.
+func mergeShard(db *sql.DB, shardFile, table string, createTable bool) (int, error) {
+	if _, err := db.Exec(`ATTACH DATABASE ? AS shard`, "file:"+shardFile+"?mode=ro"); err != nil {
+		return 0, err
+	}
+	defer db.Exec(`DETACH DATABASE shard`)
+
+	if createTable {
+		for _, name := range []string{runsTableName, table} {
+			var schema string
+			err := db.QueryRow(`SELECT sql FROM shard.sqlite_master WHERE type = 'table' AND name = ?`, name).Scan(&schema)
+			if err != nil {
+				return 0, fmt.Errorf("table %q: %w", name, err)
+			}
+			schema = strings.Replace(schema, "CREATE TABLE", "CREATE TABLE IF NOT EXISTS", 1)
+			if _, err := db.Exec(schema); err != nil {
+				return 0, err
+			}
+		}
+		if _, err := db.Exec(`DELETE FROM main.`+runsTableName+` WHERE results_table = ?`, table); err != nil {
+			return 0, err
 		}
-		totalRows++
 	}
-	if err := tx.Commit(); err != nil {
-		return err
+	_, err := db.Exec(`INSERT OR IGNORE INTO main.`+runsTableName+` SELECT * FROM shard.`+runsTableName+` WHERE results_table = ?`, table)
+	if err != nil {
+		return 0, err
 	}
-	if err := stmt.Close(); err != nil {
-		return err
+	res, err := db.Exec(`INSERT INTO main.'` + table + `' SELECT * FROM shard.'` + table + `'`)
+	if err != nil {
+		return 0, err
 	}
-
-	fmt.Println("Wrote total rows:", totalRows)
-	return nil
+	n, err := res.RowsAffected()
+	return int(n), err
 }
 
 func Strings[T fmt.Stringer](values []T) []string {
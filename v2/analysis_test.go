@@ -1,8 +1,13 @@
 package v2
 
 import (
+	"context"
+	"database/sql"
 	"fmt"
 	"math"
+	"os"
+	"os/signal"
+	"path/filepath"
 	"sort"
 	"sync"
 	"testing"
@@ -77,22 +82,35 @@ func TestAllKAssetPortfolios(t *testing.T) {
 		// minStat := pa.MustGoldenButterflyStat()
 		var minStat *pa.PortfolioStat // nil; accept all portfolios
 
+		// Ctrl-C stops the search, keeping the results written so far
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+		defer stop()
+
 		resultsCh := make(chan *pa.PortfolioStat, 10)
 		go func() {
 			defer close(resultsCh)
-			for k := 1; k <= 5; k++ {
+			for k := 1; k <= 5 && ctx.Err() == nil; k++ {
 				count := 0
-				for result := range GoFindKAssetsBetterThanX(minStat, k, names) {
+				kResultsCh, progress := GoFindKAssetsBetterThanX(ctx, minStat, k, names, SearchOptions{
+					ProgressInterval: 30 * time.Second,
+					OnProgress: func(e ProgressEvent) {
+						fmt.Println(" -", e)
+					},
+				})
+				for result := range kResultsCh {
 					count++
-					resultsCh <- result
+					select {
+					case resultsCh <- result:
+					case <-ctx.Done():
+					}
 				}
-				fmt.Printf("k=%d result count: %d\n", k, count)
+				fmt.Printf("k=%d result count: %d (%v)\n", k, count, progress)
 			}
 		}()
 
 		// just count results
 		// CountResults(resultsCh)
-		err := EncodeResultsToSQLite("output/portfolios.sqlite", resultsCh)
+		_, err := EncodeResultsToSQLite(ctx, "output/portfolios.sqlite", resultsCh)
 		g.Expect(err).To(Succeed())
 	})
 	t.Run("Evaluate trimmed down list", func(t *testing.T) {
@@ -165,7 +183,8 @@ func TestAllKAssetPortfolios(t *testing.T) {
 			defer close(resultsCh)
 			for k := 11; k <= 11; k++ {
 				count := 0
-				for result := range GoFindKAssetsBetterThanX(gbStat, k, names) {
+				kResultsCh, _ := GoFindKAssetsBetterThanX(context.Background(), gbStat, k, names, SearchOptions{})
+				for result := range kResultsCh {
 					count++
 					resultsCh <- result
 				}
@@ -181,6 +200,42 @@ func TestAllKAssetPortfolios(t *testing.T) {
 		}
 		fmt.Println("\nOverall result count:", count)
 	})
+	t.Run("save better than GoldenButterfly as JSONL", func(t *testing.T) {
+		t.Skip("Run manually")
+		g := NewGomegaWithT(t)
+		sink, err := NewJSONLSink("testdata/betterThanGoldenButterflyPortfolios.jsonl.gz")
+		g.Expect(err).To(Succeed())
+
+		// stop reading the snapshots if the sink fails
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		var (
+			resultsCh = make(chan *pa.PortfolioStat)
+			readErrCh = make(chan error, 1)
+		)
+		go func() {
+			defer close(resultsCh)
+			for k := 1; k <= 11; k++ {
+				input := fmt.Sprintf("testdata/snapshot/TestAllKAssetPortfolios_PortfolioStats_k%d_betterThanGoldenButterfly.gobl.gz", k)
+				err := pa.GobStatSource(input)(func(stat *pa.PortfolioStat) error {
+					select {
+					case resultsCh <- stat:
+						return nil
+					case <-ctx.Done():
+						return ctx.Err()
+					}
+				})
+				if err != nil {
+					readErrCh <- err
+					return
+				}
+			}
+			readErrCh <- nil
+		}()
+		_, err = WriteResults(ctx, sink, resultsCh)
+		g.Expect(err).To(Succeed())
+		g.Expect(<-readErrCh).To(Succeed())
+	})
 	/*
 		t.Run("parse GOBL.gz", func(t *testing.T) {
 			goblFileBetterThanGB = func(k int) string {
@@ -507,7 +562,7 @@ func TestPortfolioCombinations_GoldenButterflyAndOtherAssets(t *testing.T) {
 	// spawn a goroutine to convert the slice to the channel
 	resultsCh := make(chan *pa.PortfolioStat)
 	wg := GoWriteSliceToChannel(results, resultsCh)
-	err := EncodeResultsToSQLite("output/portfolios_varying_percentages.sqlite", resultsCh)
+	_, err := EncodeResultsToSQLite(context.Background(), "output/portfolios_varying_percentages.sqlite", resultsCh)
 	g.Expect(err).To(Succeed())
 
 	Log(t, "Waiting for goroutine to finish")
@@ -538,3 +593,183 @@ func Logf(t *testing.T, format string, content ...interface{}) {
 	// fmt.Printf(format, content...)
 	t.Logf(format, content...)
 }
+
+func Test_portfolioReturnsFunc(t *testing.T) {
+	g := NewGomegaWithT(t)
+	var (
+		assets      = []string{"TSM", "SCV", "LTT", "Gold"}
+		returnsList = data.PortfolioReturnsList(assets...)
+		grid        = WeightGrid{Step: types.ReadablePercent(5)}
+		fromScratch = portfolioReturnsFunc(returnsList, 0)
+		sweep       = portfolioReturnsFunc(returnsList, grid.Step)
+	)
+	// the sweep's returns are identical to PortfolioReturns', at every allocation on the grid
+	for _, allocation := range grid.Allocations(assets) {
+		expected, err := pa.PortfolioReturns(returnsList, allocation)
+		g.Expect(err).To(Succeed())
+		g.Expect(fromScratch(allocation)).To(Equal(expected))
+		g.Expect(sweep(allocation)).To(Equal(expected), "%v", allocation)
+	}
+	g.Expect(func() { sweep(types.ReadablePercents(50, 50, 1, -1)) }).To(Panic())
+}
+
+func TestEncodeResultsToSQLite(t *testing.T) {
+	g := NewGomegaWithT(t)
+	stat, err := mustEvaluatePortfolio(pa.Combination{
+		Assets:      []string{"TSM", "SCV", "LTT", "STT", "Gold"},
+		Percentages: types.ReadablePercents(20, 20, 20, 20, 20),
+	})
+	g.Expect(err).To(Succeed())
+	resultsCh := make(chan *pa.PortfolioStat, 1)
+	resultsCh <- stat
+	close(resultsCh)
+
+	file := filepath.Join(t.TempDir(), "portfolios.sqlite")
+	g.Expect(EncodeResultsToSQLite(context.Background(), file, resultsCh)).To(Equal(1))
+
+	db, err := sql.Open("sqlite3", file)
+	g.Expect(err).To(Succeed())
+	defer db.Close()
+	// every registered metric has its own column
+	for _, m := range pa.Metrics() {
+		var value float64
+		err := db.QueryRow(`SELECT ` + m.Column + ` FROM portfolios_1pct_10ltt`).Scan(&value)
+		g.Expect(err).To(Succeed(), m.Name)
+		g.Expect(value).To(Equal(m.Value(stat)), m.Name)
+	}
+	// and so does every unranked metric, computed from the portfolio's returns
+	unranked := pa.ComputeUnranked(nil, stat.MustReturns())
+	for i, m := range pa.UnrankedMetrics() {
+		var value float64
+		err := db.QueryRow(`SELECT ` + m.Column + ` FROM portfolios_1pct_10ltt`).Scan(&value)
+		g.Expect(err).To(Succeed(), m.Name)
+		g.Expect(value).To(Equal(unranked[i]), m.Name)
+	}
+}
+
+func TestGoFindKAssetsBetterThanX_Cancelled(t *testing.T) {
+	g := NewGomegaWithT(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	names := data.Names()
+	// without an ideal, every portfolio is a result
+	resultsCh, progress := GoFindKAssetsBetterThanX(ctx, nil, 3, names, SearchOptions{})
+	for i := 0; i < 10; i++ {
+		g.Expect(<-resultsCh).ToNot(BeNil())
+	}
+	cancel()
+	for range resultsCh {
+	}
+	g.Expect(progress.Found()).To(BeNumerically(">=", 10))
+	g.Expect(progress.Evaluated()).To(BeNumerically("<", pa.Binomial(len(names), 3)))
+	g.Expect(progress.Combinations()).To(Equal(progress.Evaluated()))
+}
+
+func TestEncodeResultsToSQLite_Cancelled(t *testing.T) {
+	g := NewGomegaWithT(t)
+	stat, err := mustEvaluatePortfolio(pa.Combination{
+		Assets:      []string{"TSM", "SCV", "LTT", "STT", "Gold"},
+		Percentages: types.ReadablePercents(20, 20, 20, 20, 20),
+	})
+	g.Expect(err).To(Succeed())
+	ctx, cancel := context.WithCancel(context.Background())
+	// the results channel is never closed
+	resultsCh := make(chan *pa.PortfolioStat)
+
+	file := filepath.Join(t.TempDir(), "portfolios.sqlite")
+	type encoded struct {
+		rows int
+		err  error
+	}
+	doneCh := make(chan encoded)
+	go func() {
+		rows, err := EncodeResultsToSQLite(ctx, file, resultsCh)
+		doneCh <- encoded{rows, err}
+	}()
+	resultsCh <- stat
+	cancel()
+	done := <-doneCh
+	g.Expect(done.err).To(MatchError(context.Canceled))
+	g.Expect(done.rows).To(Equal(1))
+
+	// the rows read before it was cancelled were committed
+	db, err := sql.Open("sqlite3", file)
+	g.Expect(err).To(Succeed())
+	defer db.Close()
+	var count int
+	g.Expect(db.QueryRow(`SELECT COUNT(*) FROM portfolios_1pct_10ltt`).Scan(&count)).To(Succeed())
+	g.Expect(count).To(Equal(1))
+}
+
+func TestMergeResultsSQLite(t *testing.T) {
+	g := NewGomegaWithT(t)
+	var (
+		names      = []string{"TSM", "SCV", "LTT", "STT", "Gold", "TIPS"}
+		total      = pa.Binomial(len(names), 3)
+		dir        = t.TempDir()
+		shardFiles []string
+	)
+	// split the search into shards, each written to its own file
+	for shard := 0; shard < 3; shard++ {
+		start, end := pa.ShardRange(total, shard, 3)
+		resultsCh, _ := GoFindKAssetsInRangeBetterThanX(context.Background(), nil, 3, names, start, end, SearchOptions{})
+		shardFile := filepath.Join(dir, fmt.Sprintf("shard%d.sqlite", shard))
+		g.Expect(EncodeResultsToSQLite(context.Background(), shardFile, resultsCh)).To(Equal(end - start))
+		shardFiles = append(shardFiles, shardFile)
+	}
+
+	file := filepath.Join(dir, "portfolios.sqlite")
+	g.Expect(MergeResultsSQLite(file, shardFiles...)).To(Equal(total))
+	// merging again replaces the results
+	g.Expect(MergeResultsSQLite(file, shardFiles...)).To(Equal(total))
+
+	db, err := sql.Open("sqlite3", file)
+	g.Expect(err).To(Succeed())
+	defer db.Close()
+	var count int
+	g.Expect(db.QueryRow(`SELECT COUNT(DISTINCT assets) FROM portfolios_1pct_10ltt`).Scan(&count)).To(Succeed())
+	g.Expect(count).To(Equal(total))
+	// along with the runs that wrote them
+	g.Expect(db.QueryRow(`SELECT COUNT(*) FROM runs`).Scan(&count)).To(Succeed())
+	g.Expect(count).To(Equal(3))
+	g.Expect(db.QueryRow(`SELECT COUNT(DISTINCT run_id) FROM portfolios_1pct_10ltt`).Scan(&count)).To(Succeed())
+	g.Expect(count).To(Equal(3))
+
+	_, err = MergeResultsSQLite(file, filepath.Join(dir, "missing.sqlite"))
+	g.Expect(err).To(MatchError(ContainSubstring("missing.sqlite")))
+	g.Expect(filepath.Join(dir, "missing.sqlite")).ToNot(BeAnExistingFile())
+}
+
+func TestMergeResultsTableSQLite(t *testing.T) {
+	g := NewGomegaWithT(t)
+	stat, err := mustEvaluatePortfolio(pa.Combination{Assets: []string{"TSM", "LTT"}, Percentages: types.ReadablePercents(60, 40)})
+	g.Expect(err).To(Succeed())
+	var (
+		dir        = t.TempDir()
+		opts       = SQLiteSinkOptions{Table: "stocks_bonds", Assets: []string{"TSM", "LTT"}}
+		shardFiles []string
+	)
+	for shard := 0; shard < 2; shard++ {
+		shardFile := filepath.Join(dir, fmt.Sprintf("shard%d.sqlite", shard))
+		sink, err := NewSQLiteSinkWithOptions(shardFile, opts)
+		g.Expect(err).To(Succeed())
+		g.Expect(sink.Write(stat)).To(Succeed())
+		g.Expect(sink.Close()).To(Succeed())
+		shardFiles = append(shardFiles, shardFile)
+	}
+
+	file := filepath.Join(dir, "portfolios.sqlite")
+	g.Expect(MergeResultsTableSQLite(file, "stocks_bonds", shardFiles...)).To(Equal(2))
+	// the default table isn't in the shards
+	_, err = MergeResultsSQLite(file, shardFiles...)
+	g.Expect(err).To(MatchError(ContainSubstring(`table "portfolios_1pct_10ltt"`)))
+	_, err = MergeResultsTableSQLite(file, "runs", shardFiles...)
+	g.Expect(err).To(MatchError(`invalid results table name "runs"`))
+
+	db, err := sql.Open("sqlite3", file)
+	g.Expect(err).To(Succeed())
+	defer db.Close()
+	var count int
+	g.Expect(db.QueryRow(`SELECT COUNT(*) FROM runs WHERE results_table = 'stocks_bonds'`).Scan(&count)).To(Succeed())
+	g.Expect(count).To(Equal(2))
+}
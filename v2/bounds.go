@@ -0,0 +1,72 @@
+package v2
+
+import (
+	"sort"
+
+	pa "github.com/slatteryjim/portfolio-analysis"
+	. "github.com/slatteryjim/portfolio-analysis/types"
+)
+
+// allocationsFunc returns the allocations to evaluate a combination of assets at, given their returns,
+// along with the number of allocations that were pruned without being evaluated.
+type allocationsFunc func(assets []string, returnsList [][]Percent) (allocations [][]Percent, pruned int)
+
+// gridAllocations returns all of the allocations on the grid, except those that can't be as good or better than
+// the ideal, unless the ideal is nil, or pruning is disabled.
+func gridAllocations(grid WeightGrid, ideal *pa.PortfolioStat, opts SearchOptions) allocationsFunc {
+	return func(assets []string, returnsList [][]Percent) ([][]Percent, int) {
+		if ideal == nil || opts.DisablePruning {
+			return grid.Allocations(assets), 0
+		}
+		return grid.allocations(assets, avgReturnBound(grid, assets, returnsList, ideal.AvgReturn.Float()))
+	}
+}
+
+// avgReturnTolerance allows for the rounding of the average returns, so the bound never prunes a portfolio that
+// would've measured up.
+const avgReturnTolerance = 1e-9
+
+// avgReturnBound returns a bound for WeightGrid.allocations that's false once the allocation can't reach the
+// minimum average return, however the rest of the assets are allocated.
+// The average return of a portfolio that's rebalanced annually is the weighted average of its assets' average
+// returns, so the best that the rest of the assets can do is to fill up the ones with the best average returns first.
+func avgReturnBound(grid WeightGrid, assets []string, returnsList [][]Percent, minAvgReturn float64) func(units []int, i, remaining int) bool {
+	var (
+		total, lo, hi = grid.units(assets)
+		avgReturns    = make([]float64, len(assets))
+		best          = make([]int, len(assets))
+	)
+	for j, returns := range returnsList {
+		var sum float64
+		for _, r := range returns {
+			sum += r.Float()
+		}
+		avgReturns[j] = sum / float64(len(returns))
+		best[j] = j
+	}
+	sort.SliceStable(best, func(a, b int) bool { return avgReturns[best[a]] > avgReturns[best[b]] })
+
+	return func(units []int, i, remaining int) bool {
+		var (
+			sum   float64
+			extra = remaining
+		)
+		for j := 0; j < i; j++ {
+			sum += float64(units[j]) * avgReturns[j]
+		}
+		// the rest of the assets hold at least their minimum, and the extra goes to the best of them
+		for j := i; j < len(assets); j++ {
+			sum += float64(lo[j]) * avgReturns[j]
+			extra -= lo[j]
+		}
+		for _, j := range best {
+			if j < i || extra <= 0 {
+				continue
+			}
+			u := minInt(extra, hi[j]-lo[j])
+			sum += float64(u) * avgReturns[j]
+			extra -= u
+		}
+		return sum/float64(total) >= minAvgReturn-avgReturnTolerance
+	}
+}
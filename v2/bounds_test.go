@@ -0,0 +1,105 @@
+package v2
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	. "github.com/onsi/gomega"
+
+	pa "github.com/slatteryjim/portfolio-analysis"
+	"github.com/slatteryjim/portfolio-analysis/data"
+	"github.com/slatteryjim/portfolio-analysis/types"
+)
+
+func TestAvgReturnBound(t *testing.T) {
+	g := NewGomegaWithT(t)
+	var (
+		assets      = []string{"TSM", "LTT", "Gold", "STT"}
+		returnsList = data.PortfolioReturnsList(assets...)
+	)
+	for _, grid := range []WeightGrid{
+		{Step: 0.05},
+		{Step: 0.1, Min: map[string]types.Percent{"Gold": 0.2}, Max: map[string]types.Percent{"TSM": 0.4}},
+	} {
+		all := grid.Allocations(assets)
+		for _, minAvgReturn := range []float64{-1, 0.02, 0.03, 0.04, 0.05, 0.06, 1} {
+			bounded, skipped := grid.allocations(assets, avgReturnBound(grid, assets, returnsList, minAvgReturn))
+			g.Expect(len(bounded) + skipped).To(Equal(len(all)))
+
+			// only the allocations that can't reach the minimum are skipped
+			kept := map[string]bool{}
+			for _, allocation := range bounded {
+				kept[fmt.Sprint(allocation)] = true
+			}
+			var reaching int
+			for _, allocation := range all {
+				returns, err := pa.PortfolioReturns(returnsList, allocation)
+				g.Expect(err).To(Succeed())
+				if avg := pa.EvaluatePortfolio(returns, pa.Combination{}).AvgReturn.Float(); avg >= minAvgReturn {
+					reaching++
+					g.Expect(kept).To(HaveKey(fmt.Sprint(allocation)), "%+v %v %v", grid, minAvgReturn, allocation)
+				}
+			}
+			switch minAvgReturn {
+			case -1:
+				g.Expect(skipped).To(BeZero())
+			case 1:
+				g.Expect(bounded).To(BeEmpty())
+			default:
+				g.Expect(len(bounded)).To(BeNumerically(">=", reaching))
+			}
+		}
+	}
+}
+
+func TestGoFindKAssetWeightingsBetterThanX_Pruning(t *testing.T) {
+	names := []string{"TSM", "SCV", "LTT", "STT", "Gold", "TIPS"}
+	// search returns all of the portfolios the search found, formatted and sorted, and its progress
+	search := func(g *GomegaWithT, ideal *pa.PortfolioStat, k int, opts SearchOptions) ([]string, *SearchProgress) {
+		resultsCh, progress, err := GoFindKAssetWeightingsBetterThanX(context.Background(), ideal, k, names, WeightGrid{Step: 0.1}, opts)
+		g.Expect(err).To(Succeed())
+		return formattedResults(collect(resultsCh)), progress
+	}
+	for _, ideal := range []pa.Combination{
+		{Assets: []string{"TSM", "LTT"}, Percentages: types.ReadablePercents(50, 50)},
+		{Assets: []string{"SCV", "STT"}, Percentages: types.ReadablePercents(70, 30)},
+		{Assets: []string{"TSM", "SCV", "Gold"}, Percentages: types.ReadablePercents(40, 40, 20)},
+	} {
+		ideal := ideal
+		t.Run(fmt.Sprint(ideal.Assets, ideal.Percentages), func(t *testing.T) {
+			g := NewGomegaWithT(t)
+			idealStat, err := mustEvaluatePortfolio(ideal)
+			g.Expect(err).To(Succeed())
+			for k := 2; k <= 3; k++ {
+				expected, exhaustive := search(g, idealStat, k, SearchOptions{DisablePruning: true})
+				g.Expect(exhaustive.Pruned()).To(BeZero())
+
+				actual, progress := search(g, idealStat, k, SearchOptions{})
+				g.Expect(actual).To(Equal(expected), "k=%d", k)
+				g.Expect(progress.Pruned()).To(BeNumerically(">", 0), "k=%d", k)
+				g.Expect(progress.Evaluated()+progress.Pruned()).To(Equal(exhaustive.Evaluated()), "k=%d", k)
+			}
+		})
+	}
+
+	t.Run("constrained", func(t *testing.T) {
+		g := NewGomegaWithT(t)
+		constraints, err := pa.ParseAssetConstraints(`
+			require: LTT
+			Gold <= 30%
+		`)
+		g.Expect(err).To(Succeed())
+		ideal, err := mustEvaluatePortfolio(pa.Combination{Assets: []string{"TSM", "LTT"}, Percentages: types.ReadablePercents(50, 50)})
+		g.Expect(err).To(Succeed())
+		search := func(opts SearchOptions) ([]string, *SearchProgress) {
+			resultsCh, progress, err := GoFindConstrainedKAssetsBetterThanX(context.Background(), ideal, 3, names, WeightGrid{Step: 0.1}, constraints, opts)
+			g.Expect(err).To(Succeed())
+			return formattedResults(collect(resultsCh)), progress
+		}
+		expected, _ := search(SearchOptions{DisablePruning: true})
+		actual, progress := search(SearchOptions{})
+		g.Expect(actual).To(Equal(expected))
+		g.Expect(progress.Pruned()).To(BeNumerically(">", 0))
+	})
+}
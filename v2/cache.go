@@ -0,0 +1,470 @@
+package v2
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	pa "github.com/slatteryjim/portfolio-analysis"
+	"github.com/slatteryjim/portfolio-analysis/data"
+	. "github.com/slatteryjim/portfolio-analysis/types"
+)
+
+// EvaluationKey identifies an evaluation of a portfolio: what was evaluated, and how.
+type EvaluationKey struct {
+	// Dataset is the revision of the returns data, e.g. data.Revision().
+	Dataset     string
+	Assets      []string
+	Percentages []Percent
+	// Window is the range of years evaluated, or empty for all of the years that the assets overlap.
+	Window string
+	// Rebalance is the rebalance policy, e.g. pa.RebalanceAnnually.String().
+	Rebalance string
+}
+
+// searchEvaluationKey returns the key of the evaluations done by the searches, which use all of the years of the
+// current data, rebalancing annually, like pa.PortfolioReturns.
+func searchEvaluationKey(assets []string, percentages []Percent) EvaluationKey {
+	return EvaluationKey{
+		Dataset:     data.Revision(),
+		Assets:      assets,
+		Percentages: percentages,
+		Rebalance:   pa.RebalanceAnnually.String(),
+	}
+}
+
+// Hash returns the address of the evaluation in the cache.
+func (k EvaluationKey) Hash() string {
+	var sb strings.Builder
+	sb.WriteString(k.Dataset)
+	for _, asset := range k.Assets {
+		sb.WriteString("\x00")
+		sb.WriteString(asset)
+	}
+	sb.WriteString("\x00\x00")
+	for _, p := range k.Percentages {
+		// the exact value, so nearly equal allocations aren't confused
+		sb.WriteString(strconv.FormatFloat(p.Float(), 'g', -1, 64))
+		sb.WriteString("\x00")
+	}
+	sb.WriteString("\x00")
+	sb.WriteString(k.Window)
+	sb.WriteString("\x00")
+	sb.WriteString(k.Rebalance)
+	hash := sha256.Sum256([]byte(sb.String()))
+	return hex.EncodeToString(hash[:])
+}
+
+// EvaluationCache stores the values of the metrics of evaluated portfolios in a SQLite file, addressed by the hash
+// of their EvaluationKey. Each metric's value is stored separately, along with the metric's Version, so when a metric
+// is registered or its Version changes, the cached portfolios only need that metric computed.
+// The values are kept in memory in front of the database: a search prefetches the values of each combination's
+// allocations in one query, and a background goroutine writes the values computed in batches, so the workers
+// evaluating portfolios don't wait on the database.
+// It's safe to use concurrently. It must be closed to write all of the values, and mustn't be used after that.
+type EvaluationCache struct {
+	db *sql.DB
+
+	mu sync.RWMutex
+	// front holds the values read from or written to the database, by hash and metric name.
+	// A hash with no values was looked up, and isn't in the database. The maps are replaced, not modified.
+	front map[string]map[string]float64
+
+	// writes are written to the database by the writer, which closes writerDone once writes is closed
+	writes     chan evaluationWrite
+	writerDone chan struct{}
+
+	errMu sync.Mutex
+	err   error
+
+	hits, computed, reads int64
+}
+
+// evaluationWrite holds the values computed for a portfolio, to be written to the database.
+type evaluationWrite struct {
+	hash     string
+	key      EvaluationKey
+	values   map[string]float64
+	versions map[string]int
+	// flushed, if set, is closed once everything sent before it is written
+	flushed chan struct{}
+}
+
+const (
+	// evaluationCacheFlushSize is the number of portfolios' values that are written in one transaction.
+	evaluationCacheFlushSize = 10_000
+	// evaluationCacheFrontSize is the number of portfolios' values that are kept in memory. Once there are more,
+	// they're dropped, and read back from the database as needed.
+	evaluationCacheFrontSize = 1_000_000
+	// evaluationCacheQuerySize is the number of hashes that are looked up in one query.
+	evaluationCacheQuerySize = 500
+)
+
+// OpenEvaluationCache opens the cache in the SQLite file, creating it if needed.
+func OpenEvaluationCache(sqliteFile string) (*EvaluationCache, error) {
+	db, err := sql.Open("sqlite3", sqliteFile+"?mode=rwc&_journal_mode=WAL&_busy_timeout=5000")
+	if err != nil {
+		return nil, err
+	}
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS evaluations (
+			hash        TEXT PRIMARY KEY,
+			dataset     TEXT NOT NULL,
+			assets      TEXT NOT NULL,
+			percentages TEXT NOT NULL,
+			years       TEXT NOT NULL,
+			rebalance   TEXT NOT NULL
+		);
+		CREATE TABLE IF NOT EXISTS metric_values (
+			hash    TEXT NOT NULL,
+			metric  TEXT NOT NULL,
+			version INTEGER NOT NULL,
+			value   REAL,
+			PRIMARY KEY (hash, metric, version)
+		) WITHOUT ROWID;
+	`)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	c := &EvaluationCache{
+		db:         db,
+		front:      map[string]map[string]float64{},
+		writes:     make(chan evaluationWrite, evaluationCacheFlushSize),
+		writerDone: make(chan struct{}),
+	}
+	go c.write()
+	return c, nil
+}
+
+// Hits returns the number of metric values that were found in the cache.
+func (c *EvaluationCache) Hits() int64 {
+	return atomic.LoadInt64(&c.hits)
+}
+
+// Computed returns the number of metric values that weren't in the cache, so they were computed.
+func (c *EvaluationCache) Computed() int64 {
+	return atomic.LoadInt64(&c.computed)
+}
+
+// Err returns the first error reading or writing the database. The cache keeps evaluating portfolios after an error,
+// but it might not store them.
+func (c *EvaluationCache) Err() error {
+	c.errMu.Lock()
+	defer c.errMu.Unlock()
+	return c.err
+}
+
+// Prefetch reads the cached values of the portfolios into memory, in as few queries as it can, so evaluating them
+// doesn't query the database one portfolio at a time.
+func (c *EvaluationCache) Prefetch(keys []EvaluationKey) {
+	var hashes []string
+	c.mu.RLock()
+	for _, key := range keys {
+		hash := key.Hash()
+		if _, ok := c.front[hash]; !ok {
+			hashes = append(hashes, hash)
+		}
+	}
+	c.mu.RUnlock()
+	c.lookup(hashes)
+}
+
+// EvaluateCombination is like pa.EvaluatePortfolio of the combination's pa.PortfolioReturns, over all of the years
+// of the current data, but only computes the metrics whose values aren't cached.
+func (c *EvaluationCache) EvaluateCombination(combination pa.Combination) (*pa.PortfolioStat, error) {
+	returns, err := pa.PortfolioReturns(data.PortfolioReturnsList(combination.Assets...), combination.Percentages)
+	if err != nil {
+		return nil, err
+	}
+	key := searchEvaluationKey(combination.Assets, combination.Percentages)
+	return c.Evaluate(key, func() []Percent { return returns }), nil
+}
+
+// MustGoldenButterflyStat is like pa.MustGoldenButterflyStat, but only computes the metrics whose values aren't
+// cached.
+func (c *EvaluationCache) MustGoldenButterflyStat() *pa.PortfolioStat {
+	stat, err := c.EvaluateCombination(pa.GoldenButterflyCombination())
+	if err != nil {
+		panic(err.Error())
+	}
+	return stat
+}
+
+// prefetchAllocations prefetches the values of the assets at each of the allocations.
+func (c *EvaluationCache) prefetchAllocations(assets []string, allocations [][]Percent) {
+	keys := make([]EvaluationKey, len(allocations))
+	for i, percentages := range allocations {
+		keys[i] = searchEvaluationKey(assets, percentages)
+	}
+	c.Prefetch(keys)
+}
+
+// prefetchCombinations prefetches the values of each of the combinations of assets at the allocation.
+func (c *EvaluationCache) prefetchCombinations(combinations [][]string, percentages []Percent) {
+	keys := make([]EvaluationKey, len(combinations))
+	for i, assets := range combinations {
+		keys[i] = searchEvaluationKey(assets, percentages)
+	}
+	c.Prefetch(keys)
+}
+
+// Evaluate is like pa.EvaluatePortfolio, but only computes the metrics whose values aren't cached.
+// The returns are only called for if there are metrics to compute.
+func (c *EvaluationCache) Evaluate(key EvaluationKey, returns func() []Percent) *pa.PortfolioStat {
+	return c.evaluate(key, returns, pa.Metrics(), nil)
+}
+
+// EvaluateIfAsGoodOrBetterThan is like pa.EvaluatePortfolioIfAsGoodOrBetterThan, but it first checks the cached
+// metrics, and only computes the metrics whose values aren't cached.
+func (c *EvaluationCache) EvaluateIfAsGoodOrBetterThan(key EvaluationKey, returns func() []Percent, other *pa.PortfolioStat) *pa.PortfolioStat {
+	return c.evaluate(key, returns, pa.MetricsByCost(), other)
+}
+
+func (c *EvaluationCache) evaluate(key EvaluationKey, returns func() []Percent, metrics []*pa.Metric, other *pa.PortfolioStat) *pa.PortfolioStat {
+	var (
+		hash   = key.Hash()
+		cached = c.get(hash)
+		stat   = &pa.PortfolioStat{Assets: key.Assets, Percentages: key.Percentages}
+	)
+	// check the cached values first, they're free
+	var missing []*pa.Metric
+	for _, m := range metrics {
+		value, ok := cached[m.Name]
+		if !ok {
+			missing = append(missing, m)
+			continue
+		}
+		atomic.AddInt64(&c.hits, 1)
+		if other != nil && !m.AsGoodOrBetter(value, m.Value(other)) {
+			return nil
+		}
+		m.SetValue(stat, value)
+	}
+	if len(missing) == 0 {
+		return stat
+	}
+
+	var (
+		in       = pa.MetricInputs{Returns: returns()}
+		computed = map[string]float64{}
+		versions = map[string]int{}
+	)
+	defer in.Release()
+	// store whatever's computed, even if the portfolio doesn't measure up
+	defer func() {
+		atomic.AddInt64(&c.computed, int64(len(computed)))
+		c.put(hash, key, computed, versions)
+	}()
+	for _, m := range missing {
+		value := m.Compute(&in)
+		computed[m.Name] = value
+		versions[m.Name] = m.Version
+		if other != nil && !m.AsGoodOrBetter(value, m.Value(other)) {
+			return nil
+		}
+		m.SetValue(stat, value)
+	}
+	return stat
+}
+
+// get returns the cached values of the metrics, by name, reading them from the database if they weren't prefetched.
+func (c *EvaluationCache) get(hash string) map[string]float64 {
+	c.mu.RLock()
+	values, ok := c.front[hash]
+	c.mu.RUnlock()
+	if ok {
+		return values
+	}
+	return c.lookup([]string{hash})[hash]
+}
+
+// lookup reads the values of the portfolios from the database into memory, and returns them by hash.
+func (c *EvaluationCache) lookup(hashes []string) map[string]map[string]float64 {
+	res := map[string]map[string]float64{}
+	for i := 0; i < len(hashes); i += evaluationCacheQuerySize {
+		chunk := hashes[i:minInt(i+evaluationCacheQuerySize, len(hashes))]
+		for _, hash := range chunk {
+			res[hash] = map[string]float64{}
+		}
+		if err := c.read(chunk, res); err != nil {
+			c.fail(err)
+			// don't remember that they're missing, they might not be
+			return res
+		}
+	}
+	return c.remember(res)
+}
+
+// read reads the values of the metrics of the portfolios from the database into their maps, if they were computed
+// by the metric's current version.
+func (c *EvaluationCache) read(hashes []string, values map[string]map[string]float64) error {
+	atomic.AddInt64(&c.reads, 1)
+	versions := map[string]int{}
+	for _, m := range pa.Metrics() {
+		versions[m.Name] = m.Version
+	}
+	args := make([]any, len(hashes))
+	for i, hash := range hashes {
+		args[i] = hash
+	}
+	rows, err := c.db.Query(`SELECT hash, metric, version, value FROM metric_values WHERE hash IN (?`+
+		strings.Repeat(`, ?`, len(hashes)-1)+`)`, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var (
+			hash, name string
+			version    int
+			value      sql.NullFloat64
+		)
+		if err := rows.Scan(&hash, &name, &version, &value); err != nil {
+			return err
+		}
+		if current, ok := versions[name]; !ok || version != current {
+			continue
+		}
+		// SQLite stores NaN as NULL
+		values[hash][name] = math.NaN()
+		if value.Valid {
+			values[hash][name] = value.Float64
+		}
+	}
+	return rows.Err()
+}
+
+// remember merges the values into memory, and returns them merged with any values already there.
+func (c *EvaluationCache) remember(values map[string]map[string]float64) map[string]map[string]float64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.front)+len(values) > evaluationCacheFrontSize {
+		c.front = map[string]map[string]float64{}
+	}
+	for hash, v := range values {
+		if existing, ok := c.front[hash]; ok {
+			merged := make(map[string]float64, len(existing)+len(v))
+			for name, value := range v {
+				merged[name] = value
+			}
+			for name, value := range existing {
+				merged[name] = value
+			}
+			v = merged
+			values[hash] = v
+		}
+		c.front[hash] = v
+	}
+	return values
+}
+
+// put remembers the values, and sends them to be written.
+func (c *EvaluationCache) put(hash string, key EvaluationKey, values map[string]float64, versions map[string]int) {
+	if len(values) == 0 {
+		return
+	}
+	c.remember(map[string]map[string]float64{hash: values})
+	c.writes <- evaluationWrite{hash: hash, key: key, values: values, versions: versions}
+}
+
+// Flush waits for the values computed so far to be written to the database.
+func (c *EvaluationCache) Flush() error {
+	flushed := make(chan struct{})
+	c.writes <- evaluationWrite{flushed: flushed}
+	<-flushed
+	return c.Err()
+}
+
+// Close writes the values computed to the database, and closes it.
+func (c *EvaluationCache) Close() error {
+	close(c.writes)
+	<-c.writerDone
+	if err := c.Err(); err != nil {
+		c.db.Close()
+		return err
+	}
+	return c.db.Close()
+}
+
+// write writes the values sent to it in batches, until the writes are closed.
+func (c *EvaluationCache) write() {
+	defer close(c.writerDone)
+	var pending []evaluationWrite
+	writePending := func() {
+		if len(pending) == 0 {
+			return
+		}
+		if err := c.writeBatch(pending); err != nil {
+			c.fail(err)
+		}
+		pending = pending[:0]
+	}
+	for w := range c.writes {
+		if w.flushed != nil {
+			writePending()
+			close(w.flushed)
+			continue
+		}
+		pending = append(pending, w)
+		// write what's pending once the workers stop sending more, or there's a batch of it
+		if len(pending) >= evaluationCacheFlushSize || len(c.writes) == 0 {
+			writePending()
+		}
+	}
+	writePending()
+}
+
+// writeBatch writes the values in one transaction.
+func (c *EvaluationCache) writeBatch(batch []evaluationWrite) error {
+	tx, err := c.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	insertEvaluation, err := tx.Prepare(`INSERT OR IGNORE INTO evaluations VALUES (?, ?, ?, ?, ?, ?)`)
+	if err != nil {
+		return err
+	}
+	defer insertEvaluation.Close()
+	insertValue, err := tx.Prepare(`INSERT OR REPLACE INTO metric_values VALUES (?, ?, ?, ?)`)
+	if err != nil {
+		return err
+	}
+	defer insertValue.Close()
+
+	for _, w := range batch {
+		_, err := insertEvaluation.Exec(w.hash, w.key.Dataset,
+			"|"+strings.Join(w.key.Assets, "|")+"|",
+			"|"+strings.Join(Strings(w.key.Percentages), "|")+"|",
+			w.key.Window, w.key.Rebalance)
+		if err != nil {
+			return err
+		}
+		for name, value := range w.values {
+			if _, err := insertValue.Exec(w.hash, name, w.versions[name], value); err != nil {
+				return err
+			}
+		}
+	}
+	return tx.Commit()
+}
+
+func (c *EvaluationCache) fail(err error) {
+	c.errMu.Lock()
+	defer c.errMu.Unlock()
+	c.err = firstError(c.err, fmt.Errorf("evaluation cache: %w", err))
+}
+
+func firstError(err, next error) error {
+	if err != nil {
+		return err
+	}
+	return next
+}
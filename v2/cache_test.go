@@ -0,0 +1,244 @@
+package v2
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	. "github.com/onsi/gomega"
+
+	pa "github.com/slatteryjim/portfolio-analysis"
+	"github.com/slatteryjim/portfolio-analysis/data"
+	"github.com/slatteryjim/portfolio-analysis/types"
+)
+
+func TestEvaluationKey_Hash(t *testing.T) {
+	g := NewGomegaWithT(t)
+	key := searchEvaluationKey([]string{"TSM", "LTT"}, types.ReadablePercents(60, 40))
+	g.Expect(key.Hash()).To(HaveLen(64))
+	g.Expect(key.Hash()).To(Equal(searchEvaluationKey([]string{"TSM", "LTT"}, types.ReadablePercents(60, 40)).Hash()))
+
+	// everything about the evaluation is part of the key
+	for _, other := range []EvaluationKey{
+		searchEvaluationKey([]string{"LTT", "TSM"}, types.ReadablePercents(60, 40)),
+		searchEvaluationKey([]string{"TSM", "LTT"}, types.ReadablePercents(40, 60)),
+		searchEvaluationKey([]string{"TSM", "LTT"}, []types.Percent{0.6, 0.4000000001}),
+		{Dataset: "other", Assets: key.Assets, Percentages: key.Percentages, Rebalance: key.Rebalance},
+		{Dataset: key.Dataset, Assets: key.Assets, Percentages: key.Percentages, Rebalance: key.Rebalance, Window: "1972-2021"},
+		{Dataset: key.Dataset, Assets: key.Assets, Percentages: key.Percentages, Rebalance: pa.NeverRebalance.String()},
+		// the separators keep the fields apart
+		searchEvaluationKey([]string{"TSML", "TT"}, types.ReadablePercents(60, 40)),
+	} {
+		g.Expect(other.Hash()).ToNot(Equal(key.Hash()), "%+v", other)
+	}
+}
+
+func TestEvaluationCache(t *testing.T) {
+	g := NewGomegaWithT(t)
+	file := filepath.Join(t.TempDir(), "cache.sqlite")
+	cache, err := OpenEvaluationCache(file)
+	g.Expect(err).To(Succeed())
+
+	var (
+		assets      = []string{"TSM", "SCV", "LTT", "STT", "Gold"}
+		percentages = types.ReadablePercents(20, 20, 20, 20, 20)
+		key         = searchEvaluationKey(assets, percentages)
+		calls       int
+		returns     = func() []types.Percent {
+			calls++
+			returns, err := pa.PortfolioReturns(data.PortfolioReturnsList(assets...), percentages)
+			g.Expect(err).To(Succeed())
+			return returns
+		}
+		expected = pa.EvaluatePortfolio(returns(), pa.Combination{Assets: assets, Percentages: percentages})
+		metrics  = int64(len(pa.Metrics()))
+	)
+	calls = 0
+	g.Expect(cache.Evaluate(key, returns)).To(Equal(expected))
+	g.Expect(calls).To(Equal(1))
+	g.Expect(cache.Computed()).To(Equal(metrics))
+
+	// the second time, it's all cached, even before it's written
+	g.Expect(cache.Evaluate(key, returns)).To(Equal(expected))
+	g.Expect(calls).To(Equal(1))
+	g.Expect(cache.Hits()).To(Equal(metrics))
+	g.Expect(cache.Close()).To(Succeed())
+
+	// and after it's reopened
+	reopen := func() {
+		cache, err = OpenEvaluationCache(file)
+		g.Expect(err).To(Succeed())
+	}
+	reopen()
+	defer func() { g.Expect(cache.Close()).To(Succeed()) }()
+	g.Expect(cache.Evaluate(key, returns)).To(Equal(expected))
+	g.Expect(calls).To(Equal(1))
+	g.Expect(cache.Computed()).To(BeZero())
+
+	t.Run("only computes missing metrics", func(t *testing.T) {
+		g := NewGomegaWithT(t)
+		// as if the metric was registered after the portfolio was cached
+		_, err := cache.db.Exec(`DELETE FROM metric_values WHERE metric = 'UlcerScore'`)
+		g.Expect(err).To(Succeed())
+		g.Expect(cache.Close()).To(Succeed())
+		reopen()
+		computed := cache.Computed()
+		g.Expect(cache.Evaluate(key, returns)).To(Equal(expected))
+		g.Expect(calls).To(Equal(2))
+		g.Expect(cache.Computed() - computed).To(Equal(int64(1)))
+		g.Expect(cache.Flush()).To(Succeed())
+	})
+
+	t.Run("recomputes the metrics whose version changed", func(t *testing.T) {
+		g := NewGomegaWithT(t)
+		m, ok := pa.MetricByName("UlcerScore")
+		g.Expect(ok).To(BeTrue())
+		m.Version++
+		defer func() { m.Version-- }()
+		g.Expect(cache.Close()).To(Succeed())
+		reopen()
+		computed := cache.Computed()
+		g.Expect(cache.Evaluate(key, returns)).To(Equal(expected))
+		g.Expect(calls).To(Equal(3))
+		g.Expect(cache.Computed() - computed).To(Equal(int64(1)))
+	})
+
+	t.Run("if as good or better", func(t *testing.T) {
+		g := NewGomegaWithT(t)
+		worse := *expected
+		worse.PWR30 -= 0.01
+		better := *expected
+		better.UlcerScore -= 1
+		g.Expect(cache.EvaluateIfAsGoodOrBetterThan(key, returns, &worse)).To(Equal(expected))
+		g.Expect(cache.EvaluateIfAsGoodOrBetterThan(key, returns, expected)).To(Equal(expected))
+		g.Expect(cache.EvaluateIfAsGoodOrBetterThan(key, returns, &better)).To(BeNil())
+		// without computing anything
+		g.Expect(calls).To(Equal(3))
+
+		// a portfolio that's only partly evaluated caches the metrics it got to
+		other := searchEvaluationKey([]string{"TSM", "LTT"}, types.ReadablePercents(50, 50))
+		otherReturns := func() []types.Percent {
+			returns, err := pa.PortfolioReturns(data.PortfolioReturnsList(other.Assets...), other.Percentages)
+			g.Expect(err).To(Succeed())
+			return returns
+		}
+		computed := cache.Computed()
+		g.Expect(cache.EvaluateIfAsGoodOrBetterThan(other, otherReturns, pa.MustGoldenButterflyStat())).To(BeNil())
+		partly := cache.Computed() - computed
+		g.Expect(partly).To(BeNumerically("<", metrics))
+		g.Expect(cache.Evaluate(other, otherReturns)).ToNot(BeNil())
+		g.Expect(cache.Computed() - computed).To(Equal(metrics))
+	})
+	t.Run("prefetch", func(t *testing.T) {
+		g := NewGomegaWithT(t)
+		g.Expect(cache.Close()).To(Succeed())
+		reopen()
+		other := searchEvaluationKey([]string{"TSM", "LTT"}, types.ReadablePercents(50, 50))
+		missing := searchEvaluationKey([]string{"TSM", "LTT"}, types.ReadablePercents(40, 60))
+		cache.Prefetch([]EvaluationKey{key, other, missing})
+		g.Expect(cache.reads).To(Equal(int64(1)))
+
+		// evaluating them doesn't read the database again
+		g.Expect(cache.Evaluate(key, returns)).To(Equal(expected))
+		g.Expect(cache.Evaluate(other, func() []types.Percent { panic("cached") })).ToNot(BeNil())
+		g.Expect(cache.Computed()).To(BeZero())
+		g.Expect(cache.Evaluate(missing, func() []types.Percent {
+			returns, err := pa.PortfolioReturns(data.PortfolioReturnsList(missing.Assets...), missing.Percentages)
+			g.Expect(err).To(Succeed())
+			return returns
+		})).ToNot(BeNil())
+		g.Expect(cache.Computed()).To(Equal(metrics))
+		g.Expect(cache.reads).To(Equal(int64(1)))
+	})
+
+	t.Run("golden butterfly", func(t *testing.T) {
+		g := NewGomegaWithT(t)
+		g.Expect(cache.MustGoldenButterflyStat()).To(Equal(pa.MustGoldenButterflyStat()))
+		computed := cache.Computed()
+		g.Expect(cache.MustGoldenButterflyStat()).To(Equal(pa.MustGoldenButterflyStat()))
+		g.Expect(cache.Computed()).To(Equal(computed))
+
+		_, err := cache.EvaluateCombination(pa.Combination{Assets: []string{"TSM"}, Percentages: types.ReadablePercents(50)})
+		g.Expect(err).To(MatchError(ContainSubstring("must sum to 100%")))
+	})
+	g.Expect(cache.Err()).To(Succeed())
+}
+
+func TestSearchOptions_Cache(t *testing.T) {
+	g := NewGomegaWithT(t)
+	cache, err := OpenEvaluationCache(filepath.Join(t.TempDir(), "cache.sqlite"))
+	g.Expect(err).To(Succeed())
+	defer cache.Close()
+
+	names := []string{"TSM", "SCV", "LTT", "STT", "Gold", "TIPS"}
+	search := func(opts SearchOptions) []string {
+		resultsCh, _ := GoFindKAssetsBetterThanX(context.Background(), nil, 3, names, opts)
+		return formattedResults(collect(resultsCh))
+	}
+	expected := search(SearchOptions{})
+	g.Expect(search(SearchOptions{Cache: cache})).To(Equal(expected))
+	computed := cache.Computed()
+	g.Expect(computed).To(Equal(int64(pa.Binomial(len(names), 3) * len(pa.Metrics()))))
+
+	// the repeated search is all cached
+	g.Expect(search(SearchOptions{Cache: cache})).To(Equal(expected))
+	g.Expect(cache.Computed()).To(Equal(computed))
+	g.Expect(cache.Err()).To(Succeed())
+}
+
+// Compare a weight-grid search of 3,420 portfolios without the cache, with an empty cache, and with every portfolio
+// cached. With the metric kernel, reading a portfolio's metrics from SQLite costs more than computing them, so the
+// cache pays off for metrics that are costlier to compute, not for the searches' throughput. (On one CPU.)
+//
+// $ go test -bench ^BenchmarkEvaluationCache$ -run ^$ -benchmem
+//
+// BenchmarkEvaluationCache/uncached        39   29648351 ns/op   2886120 B/op   15325 allocs/op
+// BenchmarkEvaluationCache/cold             3  357496231 ns/op  41906280 B/op  653811 allocs/op
+// BenchmarkEvaluationCache/warm             8  151524745 ns/op  16088042 B/op  399329 allocs/op
+func BenchmarkEvaluationCache(b *testing.B) {
+	var (
+		names = []string{"TSM", "SCV", "LTT", "STT", "Gold", "TIPS"}
+		grid  = WeightGrid{Step: types.ReadablePercent(5)}
+	)
+	search := func(b *testing.B, cache *EvaluationCache) {
+		resultsCh, _, err := GoFindKAssetWeightingsBetterThanX(context.Background(), nil, 3, names, grid, SearchOptions{Cache: cache})
+		if err != nil {
+			b.Fatal(err)
+		}
+		for range resultsCh {
+		}
+	}
+	searchCached := func(b *testing.B, file string) {
+		cache, err := OpenEvaluationCache(file)
+		if err != nil {
+			b.Fatal(err)
+		}
+		search(b, cache)
+		if err := cache.Close(); err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	b.Run("uncached", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			search(b, nil)
+		}
+	})
+	// every portfolio is computed, and written
+	b.Run("cold", func(b *testing.B) {
+		dir := b.TempDir()
+		for i := 0; i < b.N; i++ {
+			searchCached(b, filepath.Join(dir, fmt.Sprintf("cache%d.sqlite", i)))
+		}
+	})
+	// every portfolio is read from the database
+	b.Run("warm", func(b *testing.B) {
+		file := filepath.Join(b.TempDir(), "cache.sqlite")
+		searchCached(b, file)
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			searchCached(b, file)
+		}
+	})
+}
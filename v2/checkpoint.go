@@ -0,0 +1,318 @@
+package v2
+
+import (
+	"compress/gzip"
+	"context"
+	"database/sql"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io/fs"
+	"math"
+	"os"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	pa "github.com/slatteryjim/portfolio-analysis"
+	"github.com/slatteryjim/portfolio-analysis/data"
+	. "github.com/slatteryjim/portfolio-analysis/types"
+)
+
+// SearchCheckpoint records how far a search of the `k` combinations of the names got.
+// Every combination ranked before the Cursor has been evaluated, and the first Results rows of the results table are
+// the portfolios found among them, in the order of their combinations. The results themselves aren't in the
+// checkpoint, so it stays small however many there are.
+type SearchCheckpoint struct {
+	K     int
+	Names []string
+	// Ideal is the portfolio that the results are as good or better than, or nil if every portfolio is a result.
+	Ideal   *pa.PortfolioStat
+	Cursor  int
+	Results int
+}
+
+// Done returns true if every combination has been evaluated.
+func (c *SearchCheckpoint) Done() bool {
+	return c.Cursor >= pa.Binomial(len(c.Names), c.K)
+}
+
+func (c *SearchCheckpoint) String() string {
+	total := pa.Binomial(len(c.Names), c.K)
+	return fmt.Sprintf("k=%d: %d of %d combinations (%0.1f%%), %d results",
+		c.K, c.Cursor, total, float64(c.Cursor)/float64(total)*100, c.Results)
+}
+
+// sameSearch returns an error if the checkpoint isn't for a search of the `k` combinations of the names, better
+// than the ideal.
+func (c *SearchCheckpoint) sameSearch(ideal *pa.PortfolioStat, k int, names []string) error {
+	if c.K != k || !reflect.DeepEqual(c.Names, names) {
+		return fmt.Errorf("is for k=%d of %v, not k=%d of %v", c.K, c.Names, k, names)
+	}
+	if !sameIdeal(c.Ideal, ideal) {
+		return fmt.Errorf("is for results better than %v, not %v", c.Ideal, ideal)
+	}
+	return nil
+}
+
+// sameIdeal returns true if the ideals are the same portfolio, with the same values for every metric.
+func sameIdeal(a, b *pa.PortfolioStat) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	if !reflect.DeepEqual(a.Assets, b.Assets) || !reflect.DeepEqual(a.Percentages, b.Percentages) {
+		return false
+	}
+	for _, m := range pa.Metrics() {
+		// compare the bits, so NaNs are the same
+		if math.Float64bits(m.Value(a)) != math.Float64bits(m.Value(b)) {
+			return false
+		}
+	}
+	return true
+}
+
+// LoadSearchCheckpoint reads a checkpoint that was saved by a search.
+func LoadSearchCheckpoint(filename string) (*SearchCheckpoint, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	gzipReader, err := gzip.NewReader(f)
+	if err != nil {
+		return nil, err
+	}
+	var checkpoint SearchCheckpoint
+	if err := gob.NewDecoder(gzipReader).Decode(&checkpoint); err != nil {
+		return nil, fmt.Errorf("decoding checkpoint %q: %w", filename, err)
+	}
+	return &checkpoint, nil
+}
+
+// Save writes the checkpoint to the file, replacing it only once it's completely written.
+func (c *SearchCheckpoint) Save(filename string) error {
+	tmp := filename + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	gzipped := gzip.NewWriter(f)
+	if err := gob.NewEncoder(gzipped).Encode(c); err != nil {
+		f.Close()
+		return err
+	}
+	if err := gzipped.Close(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filename)
+}
+
+// FindKAssetsBetterThanXWithCheckpoints is like GoFindKAssetsBetterThanX, but it writes the results to the
+// resultsFile, a SQLite file like EncodeResultsToSQLite's, in the order of their combinations, and saves its progress
+// to the checkpoint file at most once per interval, and when it stops. The results are committed before the
+// checkpoint that counts them is saved.
+// If the checkpoint file already exists, the search resumes from where it left off: any results written after the
+// checkpoint was saved are removed, and the rest of the results are appended, so a resumed search writes the same
+// results as one that ran uninterrupted. It must be the same search, with the same ideal.
+// It returns the last checkpoint. If the context is done first, it also returns the context's error.
+// The progress only counts the work done since it resumed.
+func FindKAssetsBetterThanXWithCheckpoints(ctx context.Context, ideal *pa.PortfolioStat, k int, names []string, checkpointFile, resultsFile string, interval time.Duration, opts SearchOptions) (*SearchCheckpoint, *SearchProgress, error) {
+	checkpoint, err := LoadSearchCheckpoint(checkpointFile)
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		checkpoint = &SearchCheckpoint{K: k, Names: names, Ideal: ideal}
+	case err != nil:
+		return nil, nil, err
+	default:
+		if err := checkpoint.sameSearch(ideal, k, names); err != nil {
+			return nil, nil, fmt.Errorf("checkpoint %q %w", checkpointFile, err)
+		}
+		if err := truncateResultsSQLite(resultsFile, resultsTableName, checkpoint.Results); err != nil {
+			return nil, nil, fmt.Errorf("rolling back the results to checkpoint %q: %w", checkpointFile, err)
+		}
+	}
+	parameters := map[string]any{"k": k, "names": names, "resumed_from": checkpoint.Cursor}
+	if ideal != nil {
+		parameters["ideal"] = ideal.String()
+	}
+	sink, err := NewSQLiteSinkWithOptions(resultsFile, SQLiteSinkOptions{
+		// a new search replaces any results in the file
+		Append: checkpoint.Cursor > 0,
+		Run:    RunMetadata{Parameters: parameters},
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	// save commits the results, then saves the checkpoint that counts them
+	save := func() error {
+		if err := sink.Flush(); err != nil {
+			return err
+		}
+		return checkpoint.Save(checkpointFile)
+	}
+
+	targetAllocations := make([]Percent, k)
+	for i := 0; i < k; i++ {
+		targetAllocations[i] = Percent(1.0 / float64(k))
+	}
+
+	var (
+		savedAt  = time.Now()
+		progress = newSearchProgress(pa.Binomial(len(names), k) - checkpoint.Cursor)
+		// evaluated batches that can't be committed until all of the batches before them are
+		pending = map[int]evaluatedBatch{}
+		// the first error writing the results, after which the search is cancelled
+		writeErr error
+	)
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	stopReporting := opts.goReportProgress(progress)
+	for batch := range goEvaluateRankedBatches(ctx, ideal, checkpoint.Cursor, k, names, targetAllocations, progress, opts) {
+		if writeErr != nil {
+			continue
+		}
+		pending[batch.start] = batch
+		for {
+			next, ok := pending[checkpoint.Cursor]
+			if !ok {
+				break
+			}
+			delete(pending, next.start)
+			for _, stat := range next.results {
+				if writeErr = sink.Write(stat); writeErr != nil {
+					break
+				}
+			}
+			if writeErr != nil {
+				cancel()
+				break
+			}
+			checkpoint.Cursor += next.size
+			checkpoint.Results += len(next.results)
+			atomic.AddInt64(&progress.found, int64(len(next.results)))
+		}
+		if writeErr == nil && time.Since(savedAt) >= interval {
+			if writeErr = save(); writeErr != nil {
+				cancel()
+			}
+			savedAt = time.Now()
+		}
+	}
+	if writeErr != nil {
+		// the checkpoint isn't saved, so the search resumes from the last one
+		sink.Close()
+		stopReporting(writeErr)
+		return checkpoint, progress, writeErr
+	}
+	err = save()
+	if closeErr := sink.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = ctx.Err()
+	}
+	stopReporting(err)
+	return checkpoint, progress, err
+}
+
+// truncateResultsSQLite removes all but the first rows of the results table in the SQLite file, if it has more.
+func truncateResultsSQLite(sqliteFile, table string, rows int) error {
+	db, err := sql.Open("sqlite3", "file:"+sqliteFile+"?mode=rw")
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	// the results are only ever appended, so they're in order of their rowids
+	if rows == 0 {
+		_, err = db.Exec(`DELETE FROM '` + table + `'`)
+	} else {
+		_, err = db.Exec(`DELETE FROM '`+table+`' WHERE rowid > (SELECT rowid FROM '`+table+`' ORDER BY rowid LIMIT 1 OFFSET ?)`, rows-1)
+	}
+	if err != nil {
+		return err
+	}
+	var count int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM '` + table + `'`).Scan(&count); err != nil {
+		return err
+	}
+	if count != rows {
+		return fmt.Errorf("table %q has %d rows, expected at least %d", table, count, rows)
+	}
+	return nil
+}
+
+// evaluatedBatch holds the results of the batch of combinations ranked from its start.
+type evaluatedBatch struct {
+	start, size int
+	results     []*pa.PortfolioStat
+}
+
+// goEvaluateRankedBatches evaluates the `k` combinations of the names ranked from the start, in batches,
+// on a pool of workers. The batches are written to the returned channel as they're completed, in any order.
+// When all combinations have been evaluated, or the context is done, the returned channel will be closed.
+// A batch is only written if all of its combinations were evaluated.
+func goEvaluateRankedBatches(ctx context.Context, ideal *pa.PortfolioStat, start, k int, names []string, targetAllocations []Percent, progress *SearchProgress, opts SearchOptions) <-chan evaluatedBatch {
+	type rankedBatch struct {
+		start        int
+		combinations [][]string
+	}
+	var (
+		batchesCh = make(chan rankedBatch, opts.buffer())
+		out       = make(chan evaluatedBatch, opts.buffer())
+		wg        sync.WaitGroup
+	)
+	// tag each batch with the rank of its first combination
+	go func() {
+		defer close(batchesCh)
+		rank := start
+		for combinations := range pa.GoEnumerateCombinationsFrom(ctx, names, k, start, opts.batchSize()) {
+			select {
+			case batchesCh <- rankedBatch{start: rank, combinations: combinations}:
+			case <-ctx.Done():
+				return
+			}
+			rank += len(combinations)
+		}
+	}()
+
+	worker := func() {
+		defer wg.Done()
+		for batch := range batchesCh {
+			evaluated := evaluatedBatch{start: batch.start, size: len(batch.combinations)}
+			if opts.Cache != nil {
+				opts.Cache.prefetchCombinations(batch.combinations, targetAllocations)
+			}
+			for _, assets := range batch.combinations {
+				if ctx.Err() != nil {
+					return
+				}
+				returnsList := data.PortfolioReturnsList(assets...)
+				if stat := evaluateCombination(ideal, assets, targetAllocations, portfolioReturnsFunc(returnsList, 0), opts.Cache); stat != nil {
+					evaluated.results = append(evaluated.results, stat)
+				}
+			}
+			atomic.AddInt64(&progress.combinations, int64(evaluated.size))
+			atomic.AddInt64(&progress.evaluated, int64(evaluated.size))
+			select {
+			case out <- evaluated:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}
+	wg.Add(opts.workers())
+	for i := 0; i < opts.workers(); i++ {
+		go worker()
+	}
+	go func() {
+		defer close(out)
+		wg.Wait()
+	}()
+	return out
+}
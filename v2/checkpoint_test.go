@@ -0,0 +1,153 @@
+package v2
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	. "github.com/onsi/gomega"
+
+	pa "github.com/slatteryjim/portfolio-analysis"
+	"github.com/slatteryjim/portfolio-analysis/data"
+)
+
+func TestFindKAssetsBetterThanXWithCheckpoints(t *testing.T) {
+	names := data.Names()
+	total := pa.Binomial(len(names), 3)
+	// formatted returns the results formatted, in order
+	formatted := func(results []*pa.PortfolioStat) []string {
+		var res []string
+		for _, stat := range results {
+			res = append(res, fmt.Sprintf("%v %v %v", stat.Assets, stat.Percentages, stat.PWR30))
+		}
+		return res
+	}
+	// readResults reads the results written to the SQLite file
+	readResults := func(g *WithT, resultsFile string) []*pa.PortfolioStat {
+		db, err := sql.Open("sqlite3", resultsFile)
+		g.Expect(err).To(Succeed())
+		defer db.Close()
+		var results []*pa.PortfolioStat
+		g.Expect(SQLiteStatSource(db, resultsTableName)(func(stat *pa.PortfolioStat) error {
+			results = append(results, stat)
+			return nil
+		})).To(Succeed())
+		return results
+	}
+
+	// without an ideal, every portfolio is a result
+	var (
+		dir         = t.TempDir()
+		file        = filepath.Join(dir, "search.checkpoint")
+		resultsFile = filepath.Join(dir, "results.sqlite")
+	)
+	checkpoint, progress, err := FindKAssetsBetterThanXWithCheckpoints(context.Background(), nil, 3, names, file, resultsFile, time.Hour, SearchOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	full := readResults(NewGomegaWithT(t), resultsFile)
+
+	t.Run("uninterrupted", func(t *testing.T) {
+		g := NewGomegaWithT(t)
+		g.Expect(full).To(HaveLen(total))
+		g.Expect(checkpoint.Done()).To(BeTrue())
+		g.Expect(checkpoint.Results).To(Equal(total))
+		g.Expect(progress.Evaluated()).To(BeNumerically("==", total))
+		g.Expect(progress.Found()).To(BeNumerically("==", total))
+		// in the order of the combinations
+		for i, stat := range full[:100] {
+			g.Expect(stat.Assets).To(Equal(combinationOf(names, pa.UnrankCombination(len(names), 3, i))))
+		}
+
+		saved, err := LoadSearchCheckpoint(file)
+		g.Expect(err).To(Succeed())
+		g.Expect(saved).To(Equal(checkpoint))
+
+		// a finished search doesn't have anything left to do
+		_, progress, err := FindKAssetsBetterThanXWithCheckpoints(context.Background(), nil, 3, names, file, resultsFile, time.Hour, SearchOptions{})
+		g.Expect(err).To(Succeed())
+		g.Expect(progress.Evaluated()).To(BeZero())
+		g.Expect(formatted(readResults(g, resultsFile))).To(Equal(formatted(full)))
+	})
+
+	t.Run("resumed", func(t *testing.T) {
+		g := NewGomegaWithT(t)
+		var (
+			dir         = t.TempDir()
+			file        = filepath.Join(dir, "search.checkpoint")
+			resultsFile = filepath.Join(dir, "results.sqlite")
+		)
+		// the results were written past the checkpoint, before the search died
+		sink, err := NewSQLiteSink(resultsFile)
+		g.Expect(err).To(Succeed())
+		for _, stat := range full[:10_100] {
+			g.Expect(sink.Write(stat)).To(Succeed())
+		}
+		g.Expect(sink.Close()).To(Succeed())
+		checkpoint := &SearchCheckpoint{K: 3, Names: names, Cursor: 10_000, Results: 10_000}
+		g.Expect(checkpoint.Save(file)).To(Succeed())
+
+		_, progress, err := FindKAssetsBetterThanXWithCheckpoints(context.Background(), nil, 3, names, file, resultsFile, 0, SearchOptions{})
+		g.Expect(err).To(Succeed())
+		g.Expect(progress.Evaluated()).To(BeNumerically("==", total-10_000))
+		g.Expect(formatted(readResults(g, resultsFile))).To(Equal(formatted(full)))
+	})
+
+	t.Run("cancelled", func(t *testing.T) {
+		g := NewGomegaWithT(t)
+		var (
+			dir         = t.TempDir()
+			file        = filepath.Join(dir, "search.checkpoint")
+			resultsFile = filepath.Join(dir, "results.sqlite")
+		)
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		checkpoint, _, err := FindKAssetsBetterThanXWithCheckpoints(ctx, nil, 3, names, file, resultsFile, time.Hour, SearchOptions{})
+		g.Expect(err).To(MatchError(context.Canceled))
+
+		// the checkpoint is saved when it stops, with the results it counts
+		saved, err := LoadSearchCheckpoint(file)
+		g.Expect(err).To(Succeed())
+		g.Expect(saved).To(Equal(checkpoint))
+		g.Expect(saved.Done()).To(BeFalse())
+		g.Expect(formatted(readResults(g, resultsFile))).To(Equal(formatted(full[:saved.Cursor])))
+
+		_, _, err = FindKAssetsBetterThanXWithCheckpoints(context.Background(), nil, 3, names, file, resultsFile, time.Hour, SearchOptions{})
+		g.Expect(err).To(Succeed())
+		g.Expect(formatted(readResults(g, resultsFile))).To(Equal(formatted(full)))
+	})
+
+	t.Run("different search", func(t *testing.T) {
+		g := NewGomegaWithT(t)
+		_, _, err := FindKAssetsBetterThanXWithCheckpoints(context.Background(), nil, 2, names, file, resultsFile, time.Hour, SearchOptions{})
+		g.Expect(err).To(MatchError(ContainSubstring("is for k=3")))
+
+		// or a different ideal
+		ideal := full[0]
+		_, _, err = FindKAssetsBetterThanXWithCheckpoints(context.Background(), ideal, 3, names, file, resultsFile, time.Hour, SearchOptions{})
+		g.Expect(err).To(MatchError(ContainSubstring("is for results better than <nil>")))
+
+		dir := t.TempDir()
+		file := filepath.Join(dir, "search.checkpoint")
+		g.Expect((&SearchCheckpoint{K: 3, Names: names, Ideal: ideal}).Save(file)).To(Succeed())
+		other := ideal.Clone()
+		other.PWR30 += 0.01
+		_, _, err = FindKAssetsBetterThanXWithCheckpoints(context.Background(), other, 3, names, file, filepath.Join(dir, "results.sqlite"), time.Hour, SearchOptions{})
+		g.Expect(err).To(MatchError(ContainSubstring("is for results better than")))
+		// a checkpoint's ideal survives being saved
+		loaded, err := LoadSearchCheckpoint(file)
+		g.Expect(err).To(Succeed())
+		g.Expect(loaded.sameSearch(ideal, 3, names)).To(Succeed())
+	})
+}
+
+func combinationOf(names []string, indices []int) []string {
+	res := make([]string, len(indices))
+	for i, index := range indices {
+		res[i] = names[index]
+	}
+	return res
+}
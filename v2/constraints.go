@@ -0,0 +1,75 @@
+package v2
+
+import (
+	"context"
+
+	pa "github.com/slatteryjim/portfolio-analysis"
+	. "github.com/slatteryjim/portfolio-analysis/types"
+)
+
+// GoFindConstrainedKAssetsBetterThanX is like GoFindKAssetWeightingsBetterThanX, but it only evaluates the portfolios
+// the constraints allow. The disallowed sets of assets are pruned from the enumeration, and the weight bounds tighten
+// the grid. With a zero grid, each combination is only evaluated at equal weights, like GoFindKAssetsBetterThanX.
+func GoFindConstrainedKAssetsBetterThanX(ctx context.Context, ideal *pa.PortfolioStat, k int, names []string, grid WeightGrid, constraints pa.AssetConstraints, opts SearchOptions) (<-chan *pa.PortfolioStat, *SearchProgress, error) {
+	if err := constraints.Validate(); err != nil {
+		return nil, nil, err
+	}
+	var allocations allocationsFunc
+	if grid.Step == 0 {
+		targetAllocations := make([]Percent, k)
+		for i := 0; i < k; i++ {
+			targetAllocations[i] = Percent(1.0 / float64(k))
+		}
+		allocations = func(assets []string, _ [][]Percent) ([][]Percent, int) {
+			if !constraints.Allows(assets, targetAllocations) {
+				return nil, 0
+			}
+			return [][]Percent{targetAllocations}, 0
+		}
+	} else {
+		if err := grid.Validate(); err != nil {
+			return nil, nil, err
+		}
+		grid = grid.constrained(names, constraints)
+		gridAllocations := gridAllocations(grid, ideal, opts)
+		allocations = func(assets []string, returnsList [][]Percent) ([][]Percent, int) {
+			// the grid honors each asset's own bounds, but the bounds of groups of assets are checked here
+			all, pruned := gridAllocations(assets, returnsList)
+			res := all[:0]
+			for _, allocation := range all {
+				if constraints.Allows(assets, allocation) {
+					res = append(res, allocation)
+				}
+			}
+			return res, pruned
+		}
+	}
+	var total int
+	if k <= len(names) {
+		total = pa.Binomial(len(names), k)
+	}
+	combinationsCh := constraints.GoEnumerateCombinations(ctx, names, k, opts.batchSize())
+	resultsCh, progress := goEvaluateCombinations(ctx, ideal, combinationsCh, total, allocations, grid.Step, opts)
+	return resultsCh, progress, nil
+}
+
+// constrained returns a copy of the grid with each asset's bounds tightened by the constraints.
+func (w WeightGrid) constrained(names []string, constraints pa.AssetConstraints) WeightGrid {
+	res := WeightGrid{Step: w.Step, Min: map[string]Percent{}, Max: map[string]Percent{}}
+	for _, name := range names {
+		min, max := constraints.WeightBounds(name)
+		if gridMin, ok := w.Min[name]; ok && gridMin > min {
+			min = gridMin
+		}
+		if gridMax, ok := w.Max[name]; ok && gridMax < max {
+			max = gridMax
+		}
+		if min > 0 {
+			res.Min[name] = min
+		}
+		if max < 1 {
+			res.Max[name] = max
+		}
+	}
+	return res
+}
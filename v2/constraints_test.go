@@ -0,0 +1,88 @@
+package v2
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"testing"
+
+	. "github.com/onsi/gomega"
+
+	pa "github.com/slatteryjim/portfolio-analysis"
+	"github.com/slatteryjim/portfolio-analysis/types"
+)
+
+func TestGoFindConstrainedKAssetsBetterThanX(t *testing.T) {
+	names := []string{"TSM", "SCV", "LTT", "STT", "Gold", "REIT"}
+	constraints, err := pa.ParseAssetConstraints(`
+		require: TSM
+		forbid: REIT
+		at least one of: LTT, STT
+		Gold <= 20%
+		LTT + STT >= 40%
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// search returns all of the portfolios the search found, formatted and sorted
+	search := func(resultsCh <-chan *pa.PortfolioStat, _ *SearchProgress, err error) ([]string, error) {
+		if err != nil {
+			return nil, err
+		}
+		var res []string
+		for stat := range resultsCh {
+			res = append(res, fmt.Sprintf("%v %v", stat.Assets, stat.Percentages))
+		}
+		sort.Strings(res)
+		return res, nil
+	}
+	// filtered returns the portfolios the constraints allow, of those an unconstrained search found
+	filtered := func(resultsCh <-chan *pa.PortfolioStat, _ *SearchProgress, err error) ([]string, error) {
+		if err != nil {
+			return nil, err
+		}
+		var res []string
+		for stat := range resultsCh {
+			if constraints.Allows(stat.Assets, stat.Percentages) {
+				res = append(res, fmt.Sprintf("%v %v", stat.Assets, stat.Percentages))
+			}
+		}
+		sort.Strings(res)
+		return res, nil
+	}
+
+	t.Run("equal weights", func(t *testing.T) {
+		g := NewGomegaWithT(t)
+		for k := 2; k <= 4; k++ {
+			actual, err := search(GoFindConstrainedKAssetsBetterThanX(context.Background(), nil, k, names, WeightGrid{}, constraints, SearchOptions{}))
+			g.Expect(err).To(Succeed())
+			resultsCh, progress := GoFindKAssetsBetterThanX(context.Background(), nil, k, names, SearchOptions{})
+			expected, _ := filtered(resultsCh, progress, nil)
+			g.Expect(actual).To(Equal(expected), "k=%d", k)
+		}
+		// only TSM+LTT and TSM+STT are allowed with 2 assets
+		g.Expect(search(GoFindConstrainedKAssetsBetterThanX(context.Background(), nil, 2, names, WeightGrid{}, constraints, SearchOptions{}))).To(Equal([]string{
+			"[TSM LTT] [50% 50%]",
+			"[TSM STT] [50% 50%]",
+		}))
+	})
+	t.Run("weight grid", func(t *testing.T) {
+		g := NewGomegaWithT(t)
+		grid := WeightGrid{Step: 0.1, Max: map[string]types.Percent{"TSM": 0.5}}
+		for k := 2; k <= 4; k++ {
+			actual, err := search(GoFindConstrainedKAssetsBetterThanX(context.Background(), nil, k, names, grid, constraints, SearchOptions{}))
+			g.Expect(err).To(Succeed())
+			g.Expect(actual).ToNot(BeEmpty())
+			expected, err := filtered(GoFindKAssetWeightingsBetterThanX(context.Background(), nil, k, names, grid, SearchOptions{}))
+			g.Expect(err).To(Succeed())
+			g.Expect(actual).To(Equal(expected), "k=%d", k)
+		}
+	})
+	t.Run("invalid", func(t *testing.T) {
+		g := NewGomegaWithT(t)
+		_, _, err := GoFindConstrainedKAssetsBetterThanX(context.Background(), nil, 2, names, WeightGrid{}, pa.AssetConstraints{Required: []string{"TSM"}, Forbidden: []string{"TSM"}}, SearchOptions{})
+		g.Expect(err).To(MatchError("TSM is both required and forbidden"))
+		_, _, err = GoFindConstrainedKAssetsBetterThanX(context.Background(), nil, 2, names, WeightGrid{Step: 0.3}, constraints, SearchOptions{})
+		g.Expect(err).To(MatchError("step 30% doesn't divide evenly into 100%"))
+	})
+}
@@ -0,0 +1,325 @@
+package v2
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	pa "github.com/slatteryjim/portfolio-analysis"
+)
+
+// DistributedSearch describes a search of the `k` combinations of the names, like GoFindKAssetsBetterThanX,
+// that's split into shards by a Coordinator, and run by workers in other processes.
+type DistributedSearch struct {
+	Ideal *pa.PortfolioStat
+	K     int
+	Names []string
+}
+
+// Shard is the range of combinations ranked from Start up to, but not including, End.
+type Shard struct {
+	ID         int
+	Start, End int
+}
+
+// shardLease is what the coordinator sends a worker: the search, and the shard of it to run.
+// The worker echoes the Token back with its results, so the coordinator only accepts results for the shards it
+// leased, in this search.
+type shardLease struct {
+	Search DistributedSearch
+	Shard  Shard
+	Token  string
+}
+
+// shardResults is what a worker sends the coordinator once it's run a shard.
+type shardResults struct {
+	Worker  string
+	ShardID int
+	Token   string
+	Results []*pa.PortfolioStat
+}
+
+type shardState struct {
+	Shard
+	worker   string
+	leasedAt time.Time
+	// tokens are the tokens of every lease of the shard, since a lease that timed out can still finish first
+	tokens  []string
+	done    bool
+	results []*pa.PortfolioStat
+}
+
+// Coordinator hands out the shards of a search to workers over HTTP, and collects their results.
+// A worker leases a shard with a POST to /lease, and posts its results to /results. If a worker doesn't post its
+// results before the lease times out, the shard is leased to another worker, and whichever finishes first wins.
+// The messages are gob-encoded.
+type Coordinator struct {
+	search       DistributedSearch
+	leaseTimeout time.Duration
+	// token is random, so the leases of one search can't be mistaken for another's
+	token string
+
+	mu        sync.Mutex
+	shards    []*shardState
+	leases    int
+	remaining int
+	done      chan struct{}
+}
+
+// NewCoordinator splits the search into shards of up to shardSize combinations.
+func NewCoordinator(search DistributedSearch, shardSize int, leaseTimeout time.Duration) (*Coordinator, error) {
+	if shardSize <= 0 {
+		return nil, fmt.Errorf("shardSize must be positive, got %d", shardSize)
+	}
+	if leaseTimeout <= 0 {
+		return nil, fmt.Errorf("leaseTimeout must be positive, got %v", leaseTimeout)
+	}
+	token, err := newRunID()
+	if err != nil {
+		return nil, err
+	}
+	c := &Coordinator{
+		search:       search,
+		leaseTimeout: leaseTimeout,
+		token:        token,
+		done:         make(chan struct{}),
+	}
+	total := pa.Binomial(len(search.Names), search.K)
+	for start := 0; start < total; start += shardSize {
+		end := start + shardSize
+		if end > total {
+			end = total
+		}
+		c.shards = append(c.shards, &shardState{Shard: Shard{ID: len(c.shards), Start: start, End: end}})
+	}
+	c.remaining = len(c.shards)
+	if c.remaining == 0 {
+		close(c.done)
+	}
+	return c, nil
+}
+
+func (c *Coordinator) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	switch r.URL.Path {
+	case "/lease":
+		var worker string
+		if err := gob.NewDecoder(r.Body).Decode(&worker); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		lease, status := c.lease(worker)
+		if status != http.StatusOK {
+			w.WriteHeader(status)
+			return
+		}
+		// if the worker doesn't get the lease, the shard is leased again once it times out
+		_ = gob.NewEncoder(w).Encode(lease)
+	case "/results":
+		var results shardResults
+		if err := gob.NewDecoder(r.Body).Decode(&results); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := c.complete(results); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// lease leases the next shard to the worker, along with http.StatusOK. If all of the shards are leased, it returns
+// http.StatusNoContent, so the worker tries again later, and once they're all done, it returns http.StatusGone.
+func (c *Coordinator) lease(worker string) (shardLease, int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.remaining == 0 {
+		return shardLease{}, http.StatusGone
+	}
+	now := time.Now()
+	for _, s := range c.shards {
+		if s.done || (s.worker != "" && now.Sub(s.leasedAt) < c.leaseTimeout) {
+			continue
+		}
+		c.leases++
+		token := fmt.Sprintf("%s-%d", c.token, c.leases)
+		s.worker, s.leasedAt, s.tokens = worker, now, append(s.tokens, token)
+		return shardLease{Search: c.search, Shard: s.Shard, Token: token}, http.StatusOK
+	}
+	return shardLease{}, http.StatusNoContent
+}
+
+// complete records the results of a shard, unless another worker already did. The results must echo the token of
+// one of the shard's leases.
+func (c *Coordinator) complete(results shardResults) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if results.ShardID < 0 || results.ShardID >= len(c.shards) {
+		return fmt.Errorf("no shard %d", results.ShardID)
+	}
+	s := c.shards[results.ShardID]
+	if !containsString(s.tokens, results.Token) {
+		return fmt.Errorf("shard %d wasn't leased with the token %q", results.ShardID, results.Token)
+	}
+	if s.done {
+		return nil
+	}
+	s.done, s.results = true, results.Results
+	c.remaining--
+	if c.remaining == 0 {
+		close(c.done)
+	}
+	return nil
+}
+
+// Wait waits for all of the shards to be done, and returns their results, in the order of the shards.
+// If the context is done first, it returns the context's error.
+func (c *Coordinator) Wait(ctx context.Context) ([]*pa.PortfolioStat, error) {
+	select {
+	case <-c.done:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var res []*pa.PortfolioStat
+	for _, s := range c.shards {
+		res = append(res, s.results...)
+	}
+	return res, nil
+}
+
+// RunCoordinator serves a coordinator for the search on the listener until all of the shards are done,
+// then writes their results to the output file, in the format of its extension, like OpenResultSink.
+// It keeps serving while the results are written, and for a grace period afterward, so the workers waiting for a
+// shard learn that the search is done, rather than finding the coordinator gone.
+// It returns the number of results written.
+func RunCoordinator(ctx context.Context, listener net.Listener, search DistributedSearch, shardSize int, leaseTimeout time.Duration, outputFile string) (int, error) {
+	coordinator, err := NewCoordinator(search, shardSize, leaseTimeout)
+	if err != nil {
+		listener.Close()
+		return 0, err
+	}
+	server := &http.Server{Handler: coordinator}
+	go server.Serve(listener)
+	defer func() {
+		select {
+		case <-time.After(coordinatorGracePeriod):
+		case <-ctx.Done():
+		}
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), coordinatorGracePeriod)
+		defer cancel()
+		if err := server.Shutdown(shutdownCtx); err != nil {
+			server.Close()
+		}
+	}()
+	results, err := coordinator.Wait(ctx)
+	if err != nil {
+		return 0, err
+	}
+	sink, err := OpenResultSink(outputFile)
+	if err != nil {
+		return 0, err
+	}
+	resultsCh := make(chan *pa.PortfolioStat, len(results))
+	for _, result := range results {
+		resultsCh <- result
+	}
+	close(resultsCh)
+	return WriteResults(ctx, sink, resultsCh)
+}
+
+// RunWorker leases shards of the search from the coordinator at the URL, and runs them with
+// GoFindKAssetsInRangeBetterThanX and the options, until the search is done, or the context is done.
+// It returns the number of shards it ran.
+func RunWorker(ctx context.Context, coordinatorURL, worker string, opts SearchOptions) (int, error) {
+	coordinatorURL = strings.TrimSuffix(coordinatorURL, "/")
+	var shards int
+	for {
+		lease, err := post[shardLease](ctx, coordinatorURL+"/lease", worker)
+		switch {
+		case errors.Is(err, errSearchDone):
+			return shards, nil
+		case err != nil:
+			return shards, err
+		case lease == nil:
+			// every shard is leased, but one might be reassigned
+			select {
+			case <-time.After(workerPollInterval):
+				continue
+			case <-ctx.Done():
+				return shards, ctx.Err()
+			}
+		}
+
+		search := lease.Search
+		resultsCh, _ := GoFindKAssetsInRangeBetterThanX(ctx, search.Ideal, search.K, search.Names, lease.Shard.Start, lease.Shard.End, opts)
+		results := shardResults{Worker: worker, ShardID: lease.Shard.ID, Token: lease.Token}
+		for result := range resultsCh {
+			results.Results = append(results.Results, result)
+		}
+		if err := ctx.Err(); err != nil {
+			return shards, err
+		}
+		if _, err := post[struct{}](ctx, coordinatorURL+"/results", results); err != nil {
+			return shards, err
+		}
+		shards++
+	}
+}
+
+// workerPollInterval is how long a worker waits before asking for a shard again, when they're all leased.
+const workerPollInterval = 250 * time.Millisecond
+
+// coordinatorGracePeriod is how long RunCoordinator keeps serving once the search is done, long enough for every
+// worker waiting for a shard to ask again.
+const coordinatorGracePeriod = 2 * workerPollInterval
+
+var errSearchDone = errors.New("search done")
+
+// post gob-encodes the request and posts it to the URL, decoding the response.
+// It returns nil if there's no content, and errSearchDone if the search is done.
+func post[T any](ctx context.Context, url string, request any) (*T, error) {
+	var body bytes.Buffer
+	if err := gob.NewEncoder(&body).Encode(request); err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, &body)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		var res T
+		if err := gob.NewDecoder(resp.Body).Decode(&res); err != nil {
+			return nil, err
+		}
+		return &res, nil
+	case http.StatusNoContent:
+		return nil, nil
+	case http.StatusGone:
+		return nil, errSearchDone
+	default:
+		body, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("%s: %s %s", url, resp.Status, body)
+	}
+}
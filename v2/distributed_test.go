@@ -0,0 +1,161 @@
+package v2
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	. "github.com/onsi/gomega"
+
+	pa "github.com/slatteryjim/portfolio-analysis"
+	"github.com/slatteryjim/portfolio-analysis/types"
+)
+
+func TestCoordinator(t *testing.T) {
+	g := NewGomegaWithT(t)
+	var (
+		names = []string{"TSM", "SCV", "LTT", "STT", "Gold", "TIPS"}
+		// without an ideal, every portfolio is a result
+		search = DistributedSearch{K: 3, Names: names}
+	)
+	coordinator, err := NewCoordinator(search, 3, 200*time.Millisecond)
+	g.Expect(err).To(Succeed())
+	server := httptest.NewServer(coordinator)
+	defer server.Close()
+	g.Expect(coordinator.shards).To(HaveLen(7))
+
+	// a worker that dies after leasing a shard
+	lease, err := post[shardLease](context.Background(), server.URL+"/lease", "dead")
+	g.Expect(err).To(Succeed())
+	g.Expect(lease.Search).To(Equal(search))
+	g.Expect(lease.Shard).To(Equal(Shard{ID: 0, Start: 0, End: 3}))
+	g.Expect(lease.Token).To(HavePrefix(coordinator.token))
+
+	var (
+		wg     sync.WaitGroup
+		shards = make([]int, 3)
+		errs   = make([]error, 3)
+	)
+	for i := range shards {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			shards[i], errs[i] = RunWorker(context.Background(), server.URL, fmt.Sprint("worker", i), SearchOptions{})
+		}(i)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	results, err := coordinator.Wait(ctx)
+	g.Expect(err).To(Succeed())
+	wg.Wait()
+	g.Expect(errs).To(Equal([]error{nil, nil, nil}))
+	// the dead worker's shard was reassigned
+	g.Expect(shards[0] + shards[1] + shards[2]).To(Equal(7))
+
+	resultsCh, _ := GoFindKAssetsBetterThanX(context.Background(), nil, 3, names, SearchOptions{})
+	g.Expect(formattedResults(results)).To(Equal(formattedResults(collect(resultsCh))))
+
+	// the dead worker's results are ignored once the shard is done
+	_, err = post[struct{}](context.Background(), server.URL+"/results", shardResults{Worker: "dead", ShardID: 0, Token: lease.Token})
+	g.Expect(err).To(Succeed())
+	g.Expect(coordinator.Wait(ctx)).To(HaveLen(len(results)))
+
+	// results must echo the token of one of the shard's leases
+	_, err = post[struct{}](context.Background(), server.URL+"/results", shardResults{Worker: "stale", ShardID: 0})
+	g.Expect(err).To(MatchError(ContainSubstring(`shard 0 wasn't leased with the token ""`)))
+	_, err = post[struct{}](context.Background(), server.URL+"/results", shardResults{Worker: "dead", ShardID: 1, Token: lease.Token})
+	g.Expect(err).To(MatchError(ContainSubstring(fmt.Sprintf("shard 1 wasn't leased with the token %q", lease.Token))))
+	other, err := NewCoordinator(search, 3, 200*time.Millisecond)
+	g.Expect(err).To(Succeed())
+	otherLease, status := other.lease("another search")
+	g.Expect(status).To(Equal(http.StatusOK))
+	g.Expect(otherLease.Shard.ID).To(Equal(0))
+	_, err = post[struct{}](context.Background(), server.URL+"/results", shardResults{Worker: "another search", ShardID: 0, Token: otherLease.Token})
+	g.Expect(err).To(MatchError(ContainSubstring("shard 0 wasn't leased with the token")))
+
+	_, err = post[struct{}](context.Background(), server.URL+"/results", shardResults{Worker: "confused", ShardID: 7})
+	g.Expect(err).To(MatchError(ContainSubstring("no shard 7")))
+}
+
+func TestNewCoordinator(t *testing.T) {
+	g := NewGomegaWithT(t)
+	search := DistributedSearch{K: 3, Names: []string{"TSM", "SCV", "LTT", "STT", "Gold", "TIPS"}}
+	_, err := NewCoordinator(search, 0, time.Minute)
+	g.Expect(err).To(MatchError("shardSize must be positive, got 0"))
+	_, err = NewCoordinator(search, -1, time.Minute)
+	g.Expect(err).To(MatchError("shardSize must be positive, got -1"))
+	_, err = NewCoordinator(search, 3, 0)
+	g.Expect(err).To(MatchError("leaseTimeout must be positive, got 0s"))
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	g.Expect(err).To(Succeed())
+	_, err = RunCoordinator(context.Background(), listener, search, 0, time.Minute, filepath.Join(t.TempDir(), "portfolios.sqlite"))
+	g.Expect(err).To(MatchError("shardSize must be positive, got 0"))
+}
+
+func TestRunCoordinator(t *testing.T) {
+	g := NewGomegaWithT(t)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	g.Expect(err).To(Succeed())
+	third := types.Percent(1.0 / 3)
+	ideal, err := mustEvaluatePortfolio(pa.Combination{
+		Assets:      []string{"TSM", "LTT", "Gold"},
+		Percentages: []types.Percent{third, third, third},
+	})
+	g.Expect(err).To(Succeed())
+	var (
+		names  = []string{"TSM", "SCV", "LTT", "STT", "Gold", "TIPS"}
+		search = DistributedSearch{Ideal: ideal, K: 3, Names: names}
+		file   = filepath.Join(t.TempDir(), "portfolios.sqlite")
+		url    = "http://" + listener.Addr().String()
+	)
+	// more workers than shards, so most of them are waiting for a shard when the search is done
+	var (
+		wg     sync.WaitGroup
+		shards = make([]int, 5)
+		errs   = make([]error, 5)
+	)
+	for i := range shards {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			shards[i], errs[i] = RunWorker(context.Background(), url, fmt.Sprint("worker", i), SearchOptions{})
+		}(i)
+	}
+	rows, err := RunCoordinator(context.Background(), listener, search, 10, time.Minute, file)
+	g.Expect(err).To(Succeed())
+	// every worker was told the search is done
+	wg.Wait()
+	g.Expect(errs).To(Equal(make([]error, 5)))
+	g.Expect(shards[0] + shards[1] + shards[2] + shards[3] + shards[4]).To(Equal(2))
+
+	resultsCh, _ := GoFindKAssetsBetterThanX(context.Background(), search.Ideal, 3, names, SearchOptions{})
+	g.Expect(rows).To(BeNumerically(">=", 1))
+	g.Expect(rows).To(Equal(len(collect(resultsCh))))
+	g.Expect(file).To(BeAnExistingFile())
+}
+
+func collect(resultsCh <-chan *pa.PortfolioStat) []*pa.PortfolioStat {
+	var res []*pa.PortfolioStat
+	for result := range resultsCh {
+		res = append(res, result)
+	}
+	return res
+}
+
+// formattedResults returns the results formatted, and sorted.
+func formattedResults(results []*pa.PortfolioStat) []string {
+	var res []string
+	for _, stat := range results {
+		res = append(res, fmt.Sprintf("%v %v %v", stat.Assets, stat.Percentages, stat.PWR30))
+	}
+	sort.Strings(res)
+	return res
+}
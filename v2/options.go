@@ -0,0 +1,120 @@
+package v2
+
+import (
+	"fmt"
+	"runtime"
+	"time"
+)
+
+// SearchOptions tune how a search runs. The zero value uses the defaults.
+type SearchOptions struct {
+	// Workers is the number of goroutines evaluating portfolios. It defaults to runtime.NumCPU().
+	Workers int
+	// BatchSize is the number of combinations of assets handed to a worker at a time. It defaults to 10,000.
+	BatchSize int
+	// Buffer is the size of the buffers of the channels between the stages of the search. It defaults to 10.
+	Buffer int
+	// OnProgress, if set, is called with the search's progress once per ProgressInterval, and once more when the
+	// search stops. It's never called concurrently.
+	OnProgress func(ProgressEvent)
+	// ProgressInterval defaults to 1 second.
+	ProgressInterval time.Duration
+	// DisablePruning evaluates every portfolio of a weight-grid search, rather than skipping the allocations that
+	// can't be as good as the ideal. The results are the same either way.
+	DisablePruning bool
+	// Cache, if set, is checked for the portfolios' metrics before they're computed, and stores the metrics computed.
+	Cache *EvaluationCache
+}
+
+func (o SearchOptions) workers() int {
+	if o.Workers <= 0 {
+		return runtime.NumCPU()
+	}
+	return o.Workers
+}
+
+func (o SearchOptions) batchSize() int {
+	if o.BatchSize <= 0 {
+		return 10_000
+	}
+	return o.BatchSize
+}
+
+func (o SearchOptions) buffer() int {
+	if o.Buffer <= 0 {
+		return 10
+	}
+	return o.Buffer
+}
+
+func (o SearchOptions) progressInterval() time.Duration {
+	if o.ProgressInterval <= 0 {
+		return time.Second
+	}
+	return o.ProgressInterval
+}
+
+// goReportProgress calls OnProgress with the progress once per interval, until the returned function is called,
+// which reports the progress one last time, with the error that stopped the search, if any.
+func (o SearchOptions) goReportProgress(progress *SearchProgress) (stop func(err error)) {
+	if o.OnProgress == nil {
+		return func(error) {}
+	}
+	var (
+		done    = make(chan struct{})
+		stopped = make(chan struct{})
+	)
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(o.progressInterval())
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				o.OnProgress(progress.Event())
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func(err error) {
+		close(done)
+		<-stopped
+		event := progress.Event()
+		event.Done, event.Err = true, err
+		o.OnProgress(event)
+	}
+}
+
+// ProgressEvent is a snapshot of a search's progress.
+type ProgressEvent struct {
+	// Combinations is the number of combinations of assets evaluated, out of the Total.
+	// When the combinations are pruned, as by a constrained search, the Total counts them before they're pruned.
+	Combinations, Total int64
+	// Evaluated is the number of portfolios evaluated, Pruned is the number skipped because they couldn't have been
+	// as good as the ideal, and Found is the number written to the results.
+	Evaluated, Pruned, Found int64
+	Elapsed                  time.Duration
+	// PerSecond is the number of combinations evaluated per second,
+	// and ETA is how much longer the rest of them would take at that rate.
+	PerSecond float64
+	ETA       time.Duration
+	// Done is true for the last event, once the search has stopped.
+	Done bool
+	// Err is why the search stopped early, like the context's error, in the last event.
+	// It's nil if every combination was evaluated.
+	Err error
+}
+
+// Fraction returns the fraction of the combinations that have been evaluated.
+func (e ProgressEvent) Fraction() float64 {
+	if e.Total == 0 {
+		return 1
+	}
+	return float64(e.Combinations) / float64(e.Total)
+}
+
+func (e ProgressEvent) String() string {
+	return fmt.Sprintf("%d of %d combinations (%0.1f%%), %d portfolios evaluated, %d pruned, %d found, %0.0f combinations per second, ETA %v",
+		e.Combinations, e.Total, e.Fraction()*100, e.Evaluated, e.Pruned, e.Found, e.PerSecond, e.ETA.Round(time.Second))
+}
@@ -0,0 +1,102 @@
+package v2
+
+import (
+	"context"
+	"runtime"
+	"testing"
+	"time"
+
+	. "github.com/onsi/gomega"
+
+	pa "github.com/slatteryjim/portfolio-analysis"
+	"github.com/slatteryjim/portfolio-analysis/data"
+)
+
+func TestSearchOptions_Defaults(t *testing.T) {
+	g := NewGomegaWithT(t)
+	var opts SearchOptions
+	g.Expect(opts.workers()).To(Equal(runtime.NumCPU()))
+	g.Expect(opts.batchSize()).To(Equal(10_000))
+	g.Expect(opts.buffer()).To(Equal(10))
+	g.Expect(opts.progressInterval()).To(Equal(time.Second))
+
+	opts = SearchOptions{Workers: 3, BatchSize: 100, Buffer: 1, ProgressInterval: time.Minute}
+	g.Expect(opts.workers()).To(Equal(3))
+	g.Expect(opts.batchSize()).To(Equal(100))
+	g.Expect(opts.buffer()).To(Equal(1))
+	g.Expect(opts.progressInterval()).To(Equal(time.Minute))
+}
+
+func TestSearchOptions_OnProgress(t *testing.T) {
+	g := NewGomegaWithT(t)
+	var (
+		names  = data.Names()
+		total  = int64(pa.Binomial(len(names), 3))
+		events []ProgressEvent
+	)
+	// without an ideal, every portfolio is a result
+	resultsCh, progress := GoFindKAssetsBetterThanX(context.Background(), nil, 3, names, SearchOptions{
+		Workers:          2,
+		BatchSize:        100,
+		Buffer:           1,
+		ProgressInterval: time.Millisecond,
+		OnProgress: func(e ProgressEvent) {
+			events = append(events, e)
+		},
+	})
+	var found int64
+	for range resultsCh {
+		found++
+	}
+	// the last event is reported before the results are closed
+	g.Expect(len(events)).To(BeNumerically(">", 1))
+	last := events[len(events)-1]
+	g.Expect(last.Done).To(BeTrue())
+	g.Expect(last.Err).To(BeNil())
+	g.Expect(last.Combinations).To(Equal(total))
+	g.Expect(last.Total).To(Equal(total))
+	g.Expect(last.Evaluated).To(Equal(total))
+	g.Expect(last.Found).To(Equal(found))
+	g.Expect(last.Fraction()).To(Equal(1.0))
+	g.Expect(last.PerSecond).To(BeNumerically(">", 0))
+	g.Expect(last.ETA).To(BeZero())
+	g.Expect(progress.Event().Combinations).To(Equal(total))
+
+	for i, e := range events[:len(events)-1] {
+		g.Expect(e.Done).To(BeFalse())
+		g.Expect(e.Combinations).To(BeNumerically("<=", events[i+1].Combinations))
+		g.Expect(e.Elapsed).To(BeNumerically("<=", events[i+1].Elapsed))
+	}
+}
+
+func TestSearchOptions_OnProgress_Cancelled(t *testing.T) {
+	g := NewGomegaWithT(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var last ProgressEvent
+	resultsCh, _ := GoFindKAssetsBetterThanX(ctx, nil, 3, data.Names(), SearchOptions{
+		OnProgress: func(e ProgressEvent) { last = e },
+	})
+	<-resultsCh
+	cancel()
+	for range resultsCh {
+	}
+	// the last event says why the search stopped
+	g.Expect(last.Done).To(BeTrue())
+	g.Expect(last.Err).To(MatchError(context.Canceled))
+	g.Expect(last.Fraction()).To(BeNumerically("<", 1))
+}
+
+func TestProgressEvent(t *testing.T) {
+	g := NewGomegaWithT(t)
+	e := ProgressEvent{Combinations: 250, Total: 1000, Evaluated: 500, Found: 7, Elapsed: 5 * time.Second, PerSecond: 50, ETA: 15 * time.Second}
+	g.Expect(e.Fraction()).To(Equal(0.25))
+	g.Expect(e.String()).To(Equal("250 of 1000 combinations (25.0%), 500 portfolios evaluated, 0 pruned, 7 found, 50 combinations per second, ETA 15s"))
+	g.Expect(ProgressEvent{}.Fraction()).To(Equal(1.0))
+
+	// the ETA is estimated from the rate so far
+	progress := &SearchProgress{total: 1000, startAt: time.Now().Add(-10 * time.Second), combinations: 250}
+	e = progress.Event()
+	g.Expect(e.PerSecond).To(BeNumerically("~", 25, 0.1))
+	g.Expect(e.ETA).To(BeNumerically("~", 30*time.Second, time.Second))
+}
@@ -0,0 +1,223 @@
+package v2
+
+import (
+	"database/sql"
+	"fmt"
+	"math"
+	"strings"
+
+	pa "github.com/slatteryjim/portfolio-analysis"
+	. "github.com/slatteryjim/portfolio-analysis/types"
+)
+
+// overallRankColumns are the columns that RankResultsSQLite writes the overall score and rank to.
+var overallRankColumns = []sqliteColumn{
+	{"overall_rank_score", "REAL"},
+	{"overall_rank", "INTEGER"},
+	{"overall_rank_pct", "REAL"},
+}
+
+// rankColumns returns the columns that RankResultsSQLite writes the ranks of the registered metrics to, followed by
+// the overall rank columns.
+func rankColumns() []sqliteColumn {
+	var columns []sqliteColumn
+	for _, m := range pa.Metrics() {
+		columns = append(columns,
+			sqliteColumn{m.Column + "_rank", "INTEGER"},
+			sqliteColumn{m.Column + "_rank_pct", "REAL"},
+		)
+	}
+	return append(columns, overallRankColumns...)
+}
+
+// queryer is a *sql.DB or *sql.Tx.
+type queryer interface {
+	Query(query string, args ...any) (*sql.Rows, error)
+}
+
+// SQLiteStatSource streams the results from a table that a SQLiteSink wrote, in the order they were written, with
+// their assets, percentages, and the values of the registered metrics. RankStream can rank them, like
+// RankResultsSQLite does.
+func SQLiteStatSource(db *sql.DB, table string) pa.StatSource {
+	return sqliteStatSource(db, table, nil)
+}
+
+// sqliteStatSource is like SQLiteStatSource, but it calls onRow, if it's not nil, with the rowid of each result
+// before the result is passed on.
+func sqliteStatSource(q queryer, table string, onRow func(rowid int64)) pa.StatSource {
+	return func(fn func(*pa.PortfolioStat) error) error {
+		if !isSQLiteIdentifier(table) {
+			return fmt.Errorf("invalid results table name %q", table)
+		}
+		existing, err := tableColumns(q, "main", table)
+		if err != nil {
+			return err
+		}
+		if len(existing) == 0 {
+			return fmt.Errorf("no results table %q", table)
+		}
+		// the percentage columns, by name, and their index among the selected percentages
+		var percentColumns []string
+		percentIndexes := map[string]int{}
+		for _, column := range existing {
+			if strings.HasPrefix(column, "percent_") {
+				percentIndexes[column] = len(percentColumns)
+				percentColumns = append(percentColumns, column)
+			}
+		}
+		metrics := pa.Metrics()
+		selected := []string{"rowid", "assets"}
+		for _, m := range metrics {
+			selected = append(selected, m.Column)
+		}
+		selected = append(selected, percentColumns...)
+
+		rows, err := q.Query(`SELECT ` + strings.Join(selected, ", ") + ` FROM '` + table + `' ORDER BY rowid`)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		var (
+			rowid       int64
+			assets      string
+			values      = make([]sql.NullFloat64, len(metrics)+len(percentColumns))
+			destination = []any{&rowid, &assets}
+		)
+		for i := range values {
+			destination = append(destination, &values[i])
+		}
+		// value returns the value of the column, or NaN if it's NULL, as SQLite stores NaN
+		value := func(i int) float64 {
+			if !values[i].Valid {
+				return math.NaN()
+			}
+			return values[i].Float64
+		}
+		for rows.Next() {
+			if err := rows.Scan(destination...); err != nil {
+				return err
+			}
+			stat := &pa.PortfolioStat{Assets: strings.Split(strings.Trim(assets, "|"), "|")}
+			for i, m := range metrics {
+				m.SetValue(stat, value(i))
+			}
+			stat.Percentages = make([]Percent, len(stat.Assets))
+			for i, asset := range stat.Assets {
+				index, ok := percentIndexes[assetColumn(asset)]
+				if !ok {
+					return fmt.Errorf("table %q doesn't have a column for the asset %q", table, asset)
+				}
+				stat.Percentages[i] = Percent(value(len(metrics) + index))
+			}
+			if onRow != nil {
+				onRow(rowid)
+			}
+			if err := fn(stat); err != nil {
+				return err
+			}
+		}
+		return rows.Err()
+	}
+}
+
+// RankResultsSQLite ranks the results in a table of the SQLite file, like RankPortfoliosWithProfile would, but
+// without holding them in memory, with pa.RankStream. Then it writes the ranks back to the table: each metric's rank
+// to the "<column>_rank" and "<column>_rank_pct" columns, and the overall score and rank to the "overall_rank_score",
+// "overall_rank", and "overall_rank_pct" columns, which are added if the table doesn't have them yet.
+// It returns the number of results ranked.
+func RankResultsSQLite(sqliteFile, table string, opts pa.StreamRankOptions) (int, error) {
+	if !isSQLiteIdentifier(table) || table == runsTableName {
+		return 0, fmt.Errorf("invalid results table name %q", table)
+	}
+	db, err := sql.Open("sqlite3", "file:"+sqliteFile+"?mode=rw")
+	if err != nil {
+		return 0, err
+	}
+	defer db.Close()
+	// the results are read and updated in the same transaction
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	existing, err := tableColumns(tx, "main", table)
+	if err != nil {
+		return 0, err
+	}
+	if len(existing) == 0 {
+		return 0, fmt.Errorf("no results table %q", table)
+	}
+	columns := rankColumns()
+	names := columnNames(columns)
+	for _, c := range columns {
+		if !containsString(existing, c.name) {
+			if _, err := tx.Exec(`ALTER TABLE '` + table + `' ADD COLUMN ` + c.name + ` ` + c.typ); err != nil {
+				return 0, err
+			}
+		}
+	}
+	// the ranks are collected in a temporary table while the results are read, and written to the results table
+	// once they're all read, as SQLite doesn't define what a query sees of the rows updated while it's reading
+	if _, err := tx.Exec(`DROP TABLE IF EXISTS temp.` + ranksTableName); err != nil {
+		return 0, err
+	}
+	if _, err := tx.Exec(`CREATE TEMP TABLE ` + ranksTableName + ` (row INTEGER PRIMARY KEY, ` + strings.Join(names, ", ") + `)`); err != nil {
+		return 0, err
+	}
+	stmt, err := tx.Prepare(`INSERT INTO temp.` + ranksTableName + ` (row, ` + strings.Join(names, ", ") + `)
+		VALUES (?` + strings.Repeat(", ?", len(names)) + `)`)
+	if err != nil {
+		return 0, err
+	}
+	defer stmt.Close()
+
+	var (
+		metrics = pa.Metrics()
+		rowid   int64
+		n       int
+		values  = make([]any, 0, len(columns)+1)
+	)
+	source := sqliteStatSource(tx, table, func(id int64) { rowid = id })
+	err = pa.RankStream(source, func(stat *pa.PortfolioStat) error {
+		values = append(values[:0], rowid)
+		for _, m := range metrics {
+			rank := m.Rank(stat)
+			values = append(values, rank.Ordinal, rank.Percentage)
+		}
+		values = append(values,
+			stat.OverallRankScore,
+			stat.OverallRankScoreRank.Ordinal,
+			stat.OverallRankScoreRank.Percentage,
+		)
+		if _, err := stmt.Exec(values...); err != nil {
+			return err
+		}
+		n++
+		return nil
+	}, opts)
+	if err != nil {
+		return 0, err
+	}
+	_, err = tx.Exec(`UPDATE '` + table + `' SET (` + strings.Join(names, ", ") + `) =
+		(SELECT ` + strings.Join(names, ", ") + ` FROM temp.` + ranksTableName + ` WHERE row = '` + table + `'.rowid)`)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := tx.Exec(`DROP TABLE temp.` + ranksTableName); err != nil {
+		return 0, err
+	}
+	return n, tx.Commit()
+}
+
+// ranksTableName is the temporary table that RankResultsSQLite collects the ranks in.
+const ranksTableName = "ranks"
+
+func containsString(values []string, s string) bool {
+	for _, v := range values {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
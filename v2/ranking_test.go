@@ -0,0 +1,89 @@
+package v2
+
+import (
+	"context"
+	"database/sql"
+	"path/filepath"
+	"testing"
+
+	. "github.com/onsi/gomega"
+
+	pa "github.com/slatteryjim/portfolio-analysis"
+)
+
+func TestRankResultsSQLite(t *testing.T) {
+	g := NewGomegaWithT(t)
+	names := []string{"TSM", "SCV", "LTT", "STT", "Gold", "TIPS", "Int'l Bd"}
+	resultsCh, _ := GoFindKAssetsBetterThanX(context.Background(), nil, 2, names, SearchOptions{})
+	var stats []*pa.PortfolioStat
+	for stat := range resultsCh {
+		stats = append(stats, stat)
+	}
+	file := filepath.Join(t.TempDir(), "results.sqlite")
+	opts := SQLiteSinkOptions{Table: "pairs", Append: true}
+	sink, err := NewSQLiteSinkWithOptions(file, opts)
+	g.Expect(err).To(Succeed())
+	for _, stat := range stats {
+		g.Expect(sink.Write(stat)).To(Succeed())
+	}
+	g.Expect(sink.Close()).To(Succeed())
+
+	db, err := sql.Open("sqlite3", file)
+	g.Expect(err).To(Succeed())
+	defer db.Close()
+
+	t.Run("SQLiteStatSource", func(t *testing.T) {
+		g := NewGomegaWithT(t)
+		var read []*pa.PortfolioStat
+		g.Expect(SQLiteStatSource(db, "pairs")(func(stat *pa.PortfolioStat) error {
+			read = append(read, stat)
+			return nil
+		})).To(Succeed())
+		// in the order they were written
+		g.Expect(read).To(Equal(stats))
+
+		err := SQLiteStatSource(db, "missing")(func(*pa.PortfolioStat) error { return nil })
+		g.Expect(err).To(MatchError(`no results table "missing"`))
+	})
+
+	g.Expect(RankResultsSQLite(file, "pairs", pa.StreamRankOptions{ChunkSize: 4, TempDir: t.TempDir()})).To(Equal(len(stats)))
+	// ranking the results in memory gives the same ranks
+	pa.RankPortfoliosInPlace(stats)
+	for _, stat := range stats {
+		var (
+			pwr30Rank, overallRank int
+			pwr30RankPct, score    float64
+		)
+		err := db.QueryRow(`SELECT pwr30_rank, pwr30_rank_pct, overall_rank_score, overall_rank FROM pairs WHERE assets = ?`,
+			"|"+stat.Assets[0]+"|"+stat.Assets[1]+"|").Scan(&pwr30Rank, &pwr30RankPct, &score, &overallRank)
+		g.Expect(err).To(Succeed())
+		g.Expect(pwr30Rank).To(Equal(stat.PWR30Rank.Ordinal), "%v", stat.Assets)
+		g.Expect(pwr30RankPct).To(Equal(stat.PWR30Rank.Percentage), "%v", stat.Assets)
+		g.Expect(score).To(Equal(stat.OverallRankScore), "%v", stat.Assets)
+		g.Expect(overallRank).To(Equal(stat.OverallRankScoreRank.Ordinal), "%v", stat.Assets)
+	}
+
+	// ranking again reuses the rank columns, and the ranked table can still be appended to
+	g.Expect(RankResultsSQLite(file, "pairs", pa.StreamRankOptions{TempDir: t.TempDir()})).To(Equal(len(stats)))
+	sink, err = NewSQLiteSinkWithOptions(file, opts)
+	g.Expect(err).To(Succeed())
+	g.Expect(sink.Write(stats[0])).To(Succeed())
+	g.Expect(sink.Close()).To(Succeed())
+	var unranked int
+	g.Expect(db.QueryRow(`SELECT COUNT(*) FROM pairs WHERE overall_rank IS NULL`).Scan(&unranked)).To(Succeed())
+	g.Expect(unranked).To(Equal(1))
+
+	// a NaN is stored as NULL, and ranked last
+	_, err = db.Exec(`UPDATE pairs SET pwr30 = NULL WHERE rowid = 1`)
+	g.Expect(err).To(Succeed())
+	g.Expect(RankResultsSQLite(file, "pairs", pa.StreamRankOptions{TempDir: t.TempDir()})).To(Equal(len(stats) + 1))
+	var nanRank, maxRank int
+	g.Expect(db.QueryRow(`SELECT pwr30_rank FROM pairs WHERE rowid = 1`).Scan(&nanRank)).To(Succeed())
+	g.Expect(db.QueryRow(`SELECT MAX(pwr30_rank) FROM pairs`).Scan(&maxRank)).To(Succeed())
+	g.Expect(nanRank).To(Equal(maxRank))
+	g.Expect(db.QueryRow(`SELECT COUNT(*) FROM pairs WHERE pwr30_rank = ?`, maxRank).Scan(&unranked)).To(Succeed())
+	g.Expect(unranked).To(Equal(1))
+
+	_, err = RankResultsSQLite(file, "missing", pa.StreamRankOptions{})
+	g.Expect(err).To(MatchError(`no results table "missing"`))
+}
@@ -0,0 +1,674 @@
+package v2
+
+import (
+	"compress/gzip"
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/csv"
+	"encoding/gob"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	pa "github.com/slatteryjim/portfolio-analysis"
+	"github.com/slatteryjim/portfolio-analysis/data"
+)
+
+// ResultSink stores the results of a search.
+type ResultSink interface {
+	// Write stores the result, though it may be buffered until the sink is flushed.
+	Write(stat *pa.PortfolioStat) error
+	// Flush stores the buffered results.
+	Flush() error
+	// Close flushes the sink, and releases its resources.
+	Close() error
+}
+
+// WriteResults writes the results to the sink until the results channel is closed, then closes the sink.
+// If the context is done first, it closes the sink with the results read so far, and returns the context's error.
+// If the sink fails, it closes the sink and stops reading the results, returning the error with any error closing
+// the sink appended. The results aren't read after an error, so whatever's sending them would block: the caller must
+// cancel the context of the search sending them if it returns an error, e.g.
+//
+//	ctx, cancel := context.WithCancel(ctx)
+//	defer cancel()
+//	resultsCh, _ := GoFindKAssetsBetterThanX(ctx, ideal, k, names, opts)
+//	n, err := WriteResults(ctx, sink, resultsCh)
+//
+// It returns the number of results written.
+func WriteResults(ctx context.Context, sink ResultSink, results <-chan *pa.PortfolioStat) (int, error) {
+	var n int
+	for {
+		select {
+		case stat, ok := <-results:
+			if !ok {
+				return n, sink.Close()
+			}
+			if err := sink.Write(stat); err != nil {
+				return n, withCloseError(fmt.Errorf("writing result #%d: %w", n+1, err), sink.Close())
+			}
+			n++
+		case <-ctx.Done():
+			return n, withCloseError(ctx.Err(), sink.Close())
+		}
+	}
+}
+
+// withCloseError returns err, with the message of any error closing after it appended.
+func withCloseError(err, closeErr error) error {
+	if closeErr == nil {
+		return err
+	}
+	return fmt.Errorf("%w (closing: %v)", err, closeErr)
+}
+
+// OpenResultSink creates a sink that writes to the file, in the format of its extension:
+//   - .sqlite or .db: SQLite, like NewSQLiteSink
+//   - .jsonl: JSON lines, like NewJSONLSink
+//   - .csv: CSV, like NewCSVSink
+//   - .gobl: gob lines, like NewGobLinesSink
+//
+// Any of the formats but SQLite can be gzipped, by adding .gz to the extension, e.g. "results.jsonl.gz".
+func OpenResultSink(filename string) (ResultSink, error) {
+	switch ext := strings.TrimSuffix(filename, ".gz"); {
+	case strings.HasSuffix(ext, ".jsonl"):
+		return NewJSONLSink(filename)
+	case strings.HasSuffix(ext, ".csv"):
+		return NewCSVSink(filename)
+	case strings.HasSuffix(ext, ".gobl"):
+		return NewGobLinesSink(filename)
+	case ext != filename:
+		return nil, fmt.Errorf("%q: only .jsonl, .csv, and .gobl results can be gzipped", filename)
+	case strings.HasSuffix(filename, ".sqlite") || strings.HasSuffix(filename, ".db"):
+		return NewSQLiteSink(filename)
+	}
+	return nil, fmt.Errorf("%q: unknown results format, expected .sqlite, .db, .jsonl, .csv, or .gobl", filename)
+}
+
+// OpenResultSinks opens a sink for each of the files, like OpenResultSink, and fans out to all of them.
+func OpenResultSinks(filenames ...string) (ResultSink, error) {
+	var sinks []ResultSink
+	for _, filename := range filenames {
+		sink, err := OpenResultSink(filename)
+		if err != nil {
+			for _, opened := range sinks {
+				opened.Close()
+			}
+			return nil, err
+		}
+		sinks = append(sinks, sink)
+	}
+	return NewFanOutSink(sinks...), nil
+}
+
+// FanOutSink writes each result to all of its sinks.
+type FanOutSink struct {
+	sinks []ResultSink
+}
+
+// NewFanOutSink returns a sink that writes to all of the sinks.
+func NewFanOutSink(sinks ...ResultSink) *FanOutSink {
+	return &FanOutSink{sinks: sinks}
+}
+
+// Write writes the result to each sink, stopping at the first one that fails.
+func (s *FanOutSink) Write(stat *pa.PortfolioStat) error {
+	for i, sink := range s.sinks {
+		if err := sink.Write(stat); err != nil {
+			return fmt.Errorf("sink #%d: %w", i+1, err)
+		}
+	}
+	return nil
+}
+
+// Flush flushes each sink, returning the first error.
+func (s *FanOutSink) Flush() error {
+	var err error
+	for i, sink := range s.sinks {
+		if e := sink.Flush(); e != nil {
+			err = firstError(err, fmt.Errorf("sink #%d: %w", i+1, e))
+		}
+	}
+	return err
+}
+
+// Close closes every sink, even if some fail, returning the first error.
+func (s *FanOutSink) Close() error {
+	var err error
+	for i, sink := range s.sinks {
+		if e := sink.Close(); e != nil {
+			err = firstError(err, fmt.Errorf("sink #%d: %w", i+1, e))
+		}
+	}
+	return err
+}
+
+// SQLiteSinkOptions configure a SQLiteSink. The zero value replaces the default results table, with a column for the
+// percentage of each of the assets in data.Names().
+type SQLiteSinkOptions struct {
+	// Table is the name of the results table. It defaults to "portfolios_1pct_10ltt".
+	Table string
+	// Assets are the assets that get a column for their percentage, named like "percent_tsm". It defaults to every
+	// asset in data.Names(). Writing a portfolio with any other asset fails, rather than losing its percentage.
+	Assets []string
+	// Append adds the results to the table, if it already exists, rather than replacing it. The table's columns
+	// must be the same as the ones the sink would create.
+	Append bool
+	// Run describes the run that's writing the results, for the runs table.
+	Run RunMetadata
+}
+
+func (o SQLiteSinkOptions) table() string {
+	if o.Table == "" {
+		return resultsTableName
+	}
+	return o.Table
+}
+
+func (o SQLiteSinkOptions) assets() []string {
+	if len(o.Assets) == 0 {
+		return data.Names()
+	}
+	return o.Assets
+}
+
+// RunMetadata describes a run that wrote results, so the results can be traced back to how they were found.
+type RunMetadata struct {
+	// Dataset is the revision of the returns data. It defaults to data.Revision().
+	Dataset string
+	// Parameters describe the search, e.g. {"k": 3, "step": "1%"}. They're stored as JSON.
+	Parameters map[string]any
+}
+
+// runsTableName is the table that SQLiteSink records each run in. Each of the results has the id of its run.
+const runsTableName = "runs"
+
+// runTimeFormat is the format of the times in the runs table, which sort in order.
+const runTimeFormat = "2006-01-02T15:04:05.000000Z07:00"
+
+// SQLiteSink writes the results to a table in a SQLite file, in one transaction until it's flushed.
+// Besides the metrics, including the unranked ones that it computes from each row's returns, the table has a column
+// for the percentage of each of its assets, and the id of the run in the runs table, which records the dataset, the
+// parameters, when the run started and finished, and how many rows it wrote.
+// It isn't safe to use concurrently.
+type SQLiteSink struct {
+	db      *sql.DB
+	tx      *sql.Tx
+	stmt    *sql.Stmt
+	table   string
+	insert  string
+	runID   string
+	metrics []*pa.Metric
+	// assetIndexes has the index of each asset's percentage among the asset columns
+	assetIndexes map[string]int
+	percentages  []any
+	// unranked has the values of the unranked metrics, which are only computed for the rows that are written
+	unranked []float64
+	rows     int
+}
+
+// NewSQLiteSink creates the results table in the SQLite file, replacing any results it had, with the default options.
+func NewSQLiteSink(sqliteFile string) (*SQLiteSink, error) {
+	return NewSQLiteSinkWithOptions(sqliteFile, SQLiteSinkOptions{})
+}
+
+// NewSQLiteSinkWithOptions creates the results table in the SQLite file, unless it's appending to it, and records
+// the start of the run in the runs table.
+func NewSQLiteSinkWithOptions(sqliteFile string, opts SQLiteSinkOptions) (*SQLiteSink, error) {
+	table := opts.table()
+	if !isSQLiteIdentifier(table) || table == runsTableName {
+		return nil, fmt.Errorf("invalid results table name %q", table)
+	}
+	assets := opts.assets()
+	s := &SQLiteSink{
+		table:        table,
+		metrics:      pa.Metrics(),
+		assetIndexes: make(map[string]int, len(assets)),
+		percentages:  make([]any, len(assets)),
+	}
+	assetColumns := make([]string, len(assets))
+	for i, asset := range assets {
+		column := assetColumn(asset)
+		for j := 0; j < i; j++ {
+			if assetColumns[j] == column {
+				return nil, fmt.Errorf("assets %q and %q would both be in the column %s", assets[j], asset, column)
+			}
+		}
+		assetColumns[i] = column
+		s.assetIndexes[asset] = i
+	}
+	columns := s.columns(assetColumns)
+	s.insert = `INSERT INTO '` + table + `' (` + strings.Join(columnNames(columns), ", ") + `)
+		VALUES(` + strings.TrimSuffix(strings.Repeat("?, ", len(columns)), ", ") + `)`
+	runID, err := newRunID()
+	if err != nil {
+		return nil, err
+	}
+	s.runID = runID
+
+	db, err := sql.Open("sqlite3", sqliteFile+"?mode=rwc")
+	if err != nil {
+		return nil, err
+	}
+	s.db = db
+	err = s.createTables(columns, opts)
+	if err == nil {
+		err = s.begin()
+	}
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// sqliteColumn is a column of the results table.
+type sqliteColumn struct {
+	name, typ string
+}
+
+// columns returns the columns of the results table, with the given asset columns.
+func (s *SQLiteSink) columns(assetColumns []string) []sqliteColumn {
+	columns := []sqliteColumn{
+		{"run_id", "TEXT NOT NULL"},
+		{"assets", "TEXT NOT NULL"},
+		{"percentages", "TEXT NOT NULL"},
+		{"num_assets", "INTEGER"},
+		{"num_years", "INTEGER"},
+	}
+	for _, m := range s.metrics {
+		columns = append(columns, sqliteColumn{m.Column, "REAL"})
+	}
+	for _, m := range pa.UnrankedMetrics() {
+		columns = append(columns, sqliteColumn{m.Column, "REAL"})
+	}
+	for _, name := range assetColumns {
+		columns = append(columns, sqliteColumn{name, "REAL"})
+	}
+	return columns
+}
+
+// createTables creates the runs table if needed, and the results table, dropping it first unless it's appending,
+// in which case an existing table must have the same columns. Then it records the start of the run.
+func (s *SQLiteSink) createTables(columns []sqliteColumn, opts SQLiteSinkOptions) error {
+	_, err := s.db.Exec(`
+		CREATE TABLE IF NOT EXISTS ` + runsTableName + ` (
+			id            TEXT PRIMARY KEY,
+			results_table TEXT NOT NULL,
+			dataset       TEXT NOT NULL,
+			parameters    TEXT NOT NULL,
+			started_at    TEXT NOT NULL,
+			finished_at   TEXT,
+			rows          INTEGER
+		);
+	`)
+	if err != nil {
+		return err
+	}
+	if opts.Append {
+		existing, err := tableColumns(s.db, "main", s.table)
+		if err != nil {
+			return err
+		}
+		if len(existing) > 0 && !appendableColumns(existing, columnNames(columns)) {
+			return fmt.Errorf("can't append to table %q: it has the columns %v, expected %v", s.table, existing, columnNames(columns))
+		}
+	} else {
+		if _, err := s.db.Exec(`DELETE FROM `+runsTableName+` WHERE results_table = ?`, s.table); err != nil {
+			return err
+		}
+		if _, err := s.db.Exec(`DROP TABLE IF EXISTS '` + s.table + `'`); err != nil {
+			return err
+		}
+	}
+	var sb strings.Builder
+	sb.WriteString(`CREATE TABLE IF NOT EXISTS '` + s.table + `' (`)
+	for i, c := range columns {
+		if i > 0 {
+			sb.WriteString(",")
+		}
+		sb.WriteString(fmt.Sprintf("\n\t%-21s %s", c.name, c.typ))
+	}
+	sb.WriteString("\n)")
+	if _, err := s.db.Exec(sb.String()); err != nil {
+		return err
+	}
+
+	dataset := opts.Run.Dataset
+	if dataset == "" {
+		dataset = data.Revision()
+	}
+	parameters, err := json.Marshal(opts.Run.Parameters)
+	if err != nil {
+		return fmt.Errorf("encoding the run's parameters: %w", err)
+	}
+	_, err = s.db.Exec(`INSERT INTO `+runsTableName+` (id, results_table, dataset, parameters, started_at) VALUES (?, ?, ?, ?, ?)`,
+		s.runID, s.table, dataset, string(parameters), time.Now().UTC().Format(runTimeFormat))
+	return err
+}
+
+// begin starts the transaction the results are inserted in.
+func (s *SQLiteSink) begin() error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	stmt, err := tx.Prepare(s.insert)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	s.tx, s.stmt = tx, stmt
+	return nil
+}
+
+// commit commits the transaction of rows inserted so far.
+func (s *SQLiteSink) commit() error {
+	stmt, tx := s.stmt, s.tx
+	s.stmt, s.tx = nil, nil
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	return stmt.Close()
+}
+
+func (s *SQLiteSink) Write(stat *pa.PortfolioStat) error {
+	for i := range s.percentages {
+		s.percentages[i] = 0.0
+	}
+	for i, asset := range stat.Assets {
+		index, ok := s.assetIndexes[asset]
+		if !ok {
+			return fmt.Errorf("table %q doesn't have a column for the asset %q", s.table, asset)
+		}
+		s.percentages[index] = stat.Percentages[i].Float()
+	}
+	returnsList := data.PortfolioReturnsList(stat.Assets...)
+	returns, err := pa.PortfolioReturns(returnsList, stat.Percentages)
+	if err != nil {
+		return err
+	}
+	values := []any{
+		s.runID,
+		"|" + strings.Join(stat.Assets, "|") + "|",               // encode as string
+		"|" + strings.Join(Strings(stat.Percentages), "|") + "|", // encode as string
+		len(stat.Assets), // NumAssets
+		len(returns),     // NumYears
+	}
+	for _, m := range s.metrics {
+		values = append(values, m.Value(stat))
+	}
+	s.unranked = pa.ComputeUnranked(s.unranked[:0], returns)
+	for _, value := range s.unranked {
+		values = append(values, value)
+	}
+	values = append(values, s.percentages...)
+	if _, err := s.stmt.Exec(values...); err != nil {
+		return err
+	}
+	s.rows++
+	return nil
+}
+
+// Flush commits the rows written so far, and starts a new transaction for the rest.
+func (s *SQLiteSink) Flush() error {
+	if err := s.commit(); err != nil {
+		return err
+	}
+	return s.begin()
+}
+
+// Close commits the rows written, records the end of the run, and closes the SQLite file.
+func (s *SQLiteSink) Close() error {
+	if s.tx == nil {
+		return s.db.Close()
+	}
+	err := s.commit()
+	if err == nil {
+		_, err = s.db.Exec(`UPDATE `+runsTableName+` SET finished_at = ?, rows = ? WHERE id = ?`,
+			time.Now().UTC().Format(runTimeFormat), s.rows, s.runID)
+	}
+	if err != nil {
+		s.db.Close()
+		return err
+	}
+	return s.db.Close()
+}
+
+// assetColumn returns the name of the column of the asset's percentage, e.g. "percent_int_l_bd" for "Int'l Bd".
+func assetColumn(asset string) string {
+	var sb strings.Builder
+	sb.WriteString("percent_")
+	underscore := true
+	for _, r := range strings.ToLower(asset) {
+		if ('a' <= r && r <= 'z') || ('0' <= r && r <= '9') {
+			sb.WriteRune(r)
+			underscore = false
+		} else if !underscore {
+			sb.WriteByte('_')
+			underscore = true
+		}
+	}
+	return strings.TrimSuffix(sb.String(), "_")
+}
+
+// isSQLiteIdentifier reports whether the name can be used as a table name without escaping.
+func isSQLiteIdentifier(name string) bool {
+	if name == "" || ('0' <= name[0] && name[0] <= '9') {
+		return false
+	}
+	for _, r := range name {
+		if !(r == '_' || ('a' <= r && r <= 'z') || ('A' <= r && r <= 'Z') || ('0' <= r && r <= '9')) {
+			return false
+		}
+	}
+	return true
+}
+
+// newRunID returns a random id for a run, so the runs of shards written separately can be merged.
+func newRunID() (string, error) {
+	var id [8]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(id[:]), nil
+}
+
+// tableColumns returns the names of the table's columns in the schema, or none if the table doesn't exist.
+func tableColumns(q queryer, schema, table string) ([]string, error) {
+	rows, err := q.Query(`SELECT name FROM pragma_table_info(?, ?)`, table, schema)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var columns []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		columns = append(columns, name)
+	}
+	return columns, rows.Err()
+}
+
+func columnNames(columns []sqliteColumn) []string {
+	names := make([]string, len(columns))
+	for i, c := range columns {
+		names[i] = c.name
+	}
+	return names
+}
+
+// appendableColumns returns true if the existing columns are the expected ones, followed by any of the rank columns
+// that RankResultsSQLite adds.
+func appendableColumns(existing, expected []string) bool {
+	if len(existing) < len(expected) {
+		return false
+	}
+	for i := range expected {
+		if existing[i] != expected[i] {
+			return false
+		}
+	}
+	ranks := columnNames(rankColumns())
+	for _, column := range existing[len(expected):] {
+		if !containsString(ranks, column) {
+			return false
+		}
+	}
+	return true
+}
+
+// fileSink is a file that's gzipped if its name ends with ".gz".
+type fileSink struct {
+	f      *os.File
+	gzip   *gzip.Writer
+	writer io.Writer
+}
+
+func createFileSink(filename string) (*fileSink, error) {
+	f, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return nil, err
+	}
+	s := &fileSink{f: f, writer: f}
+	if strings.HasSuffix(filename, ".gz") {
+		s.gzip = gzip.NewWriter(f)
+		s.writer = s.gzip
+	}
+	return s, nil
+}
+
+// flush writes the compressed data so far, so it can be read before the file is closed.
+func (s *fileSink) flush() error {
+	if s.gzip == nil {
+		return nil
+	}
+	return s.gzip.Flush()
+}
+
+func (s *fileSink) close() error {
+	if s.gzip != nil {
+		if err := s.gzip.Close(); err != nil {
+			s.f.Close()
+			return err
+		}
+	}
+	return s.f.Close()
+}
+
+// JSONLSink writes each result to a file as a line of JSON.
+type JSONLSink struct {
+	file    *fileSink
+	encoder *json.Encoder
+}
+
+// NewJSONLSink creates the file, which is gzipped if its name ends with ".gz".
+func NewJSONLSink(filename string) (*JSONLSink, error) {
+	file, err := createFileSink(filename)
+	if err != nil {
+		return nil, err
+	}
+	return &JSONLSink{file: file, encoder: json.NewEncoder(file.writer)}, nil
+}
+
+func (s *JSONLSink) Write(stat *pa.PortfolioStat) error {
+	return s.encoder.Encode(stat)
+}
+
+func (s *JSONLSink) Flush() error {
+	return s.file.flush()
+}
+
+func (s *JSONLSink) Close() error {
+	return s.file.close()
+}
+
+// CSVSink writes the results to a CSV file, with a column for the assets, their percentages, and each registered
+// metric, headed by the metrics' SQLite column names.
+type CSVSink struct {
+	file    *fileSink
+	writer  *csv.Writer
+	metrics []*pa.Metric
+	record  []string
+}
+
+// NewCSVSink creates the file, which is gzipped if its name ends with ".gz", and writes the header.
+func NewCSVSink(filename string) (*CSVSink, error) {
+	file, err := createFileSink(filename)
+	if err != nil {
+		return nil, err
+	}
+	s := &CSVSink{file: file, writer: csv.NewWriter(file.writer), metrics: pa.Metrics()}
+	header := []string{"assets", "percentages"}
+	for _, m := range s.metrics {
+		header = append(header, m.Column)
+	}
+	if err := s.writer.Write(header); err != nil {
+		file.close()
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *CSVSink) Write(stat *pa.PortfolioStat) error {
+	s.record = append(s.record[:0],
+		"|"+strings.Join(stat.Assets, "|")+"|",
+		"|"+strings.Join(Strings(stat.Percentages), "|")+"|",
+	)
+	for _, m := range s.metrics {
+		s.record = append(s.record, strconv.FormatFloat(m.Value(stat), 'g', -1, 64))
+	}
+	return s.writer.Write(s.record)
+}
+
+func (s *CSVSink) Flush() error {
+	s.writer.Flush()
+	if err := s.writer.Error(); err != nil {
+		return err
+	}
+	return s.file.flush()
+}
+
+func (s *CSVSink) Close() error {
+	if err := s.Flush(); err != nil {
+		s.file.close()
+		return err
+	}
+	return s.file.close()
+}
+
+// GobLinesSink writes the results to a file as a stream of gob-encoded values, which can be decoded one at a time
+// by a single gob.Decoder.
+type GobLinesSink struct {
+	file    *fileSink
+	encoder *gob.Encoder
+}
+
+// NewGobLinesSink creates the file, which is gzipped if its name ends with ".gz".
+func NewGobLinesSink(filename string) (*GobLinesSink, error) {
+	file, err := createFileSink(filename)
+	if err != nil {
+		return nil, err
+	}
+	return &GobLinesSink{file: file, encoder: gob.NewEncoder(file.writer)}, nil
+}
+
+func (s *GobLinesSink) Write(stat *pa.PortfolioStat) error {
+	return s.encoder.Encode(stat)
+}
+
+func (s *GobLinesSink) Flush() error {
+	return s.file.flush()
+}
+
+func (s *GobLinesSink) Close() error {
+	return s.file.close()
+}
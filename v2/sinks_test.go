@@ -0,0 +1,393 @@
+package v2
+
+import (
+	"compress/gzip"
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	. "github.com/onsi/gomega"
+
+	pa "github.com/slatteryjim/portfolio-analysis"
+	"github.com/slatteryjim/portfolio-analysis/data"
+	"github.com/slatteryjim/portfolio-analysis/types"
+)
+
+func TestOpenResultSink(t *testing.T) {
+	var stats []*pa.PortfolioStat
+	for _, combo := range []pa.Combination{
+		{Assets: []string{"TSM"}, Percentages: types.ReadablePercents(100)},
+		{Assets: []string{"TSM", "LTT"}, Percentages: types.ReadablePercents(60, 40)},
+		{Assets: []string{"TSM", "SCV", "LTT", "STT", "Gold"}, Percentages: types.ReadablePercents(20, 20, 20, 20, 20)},
+	} {
+		stat, err := mustEvaluatePortfolio(combo)
+		if err != nil {
+			t.Fatal(err)
+		}
+		stats = append(stats, stat)
+	}
+	// write writes the stats to a sink for the file
+	write := func(g *WithT, filename string) {
+		sink, err := OpenResultSink(filename)
+		g.Expect(err).To(Succeed())
+		resultsCh := make(chan *pa.PortfolioStat, len(stats))
+		for _, stat := range stats {
+			resultsCh <- stat
+		}
+		close(resultsCh)
+		g.Expect(WriteResults(context.Background(), sink, resultsCh)).To(Equal(len(stats)))
+	}
+	// open opens the file, gunzipping it if its name ends with ".gz"
+	open := func(g *WithT, filename string) io.Reader {
+		f, err := os.Open(filename)
+		g.Expect(err).To(Succeed())
+		t.Cleanup(func() { f.Close() })
+		if filepath.Ext(filename) != ".gz" {
+			return f
+		}
+		r, err := gzip.NewReader(f)
+		g.Expect(err).To(Succeed())
+		return r
+	}
+
+	t.Run("SQLite", func(t *testing.T) {
+		g := NewGomegaWithT(t)
+		file := filepath.Join(t.TempDir(), "results.sqlite")
+		write(g, file)
+		db, err := sql.Open("sqlite3", file)
+		g.Expect(err).To(Succeed())
+		defer db.Close()
+		var count int
+		g.Expect(db.QueryRow(`SELECT COUNT(*) FROM portfolios_1pct_10ltt`).Scan(&count)).To(Succeed())
+		g.Expect(count).To(Equal(len(stats)))
+	})
+	for _, filename := range []string{"results.jsonl", "results.jsonl.gz"} {
+		filename := filename
+		t.Run(filename, func(t *testing.T) {
+			g := NewGomegaWithT(t)
+			file := filepath.Join(t.TempDir(), filename)
+			write(g, file)
+			decoder := json.NewDecoder(open(g, file))
+			for _, expected := range stats {
+				var stat pa.PortfolioStat
+				g.Expect(decoder.Decode(&stat)).To(Succeed())
+				g.Expect(&stat).To(Equal(expected))
+			}
+			g.Expect(decoder.More()).To(BeFalse())
+		})
+	}
+	for _, filename := range []string{"results.csv", "results.csv.gz"} {
+		filename := filename
+		t.Run(filename, func(t *testing.T) {
+			g := NewGomegaWithT(t)
+			file := filepath.Join(t.TempDir(), filename)
+			write(g, file)
+			records, err := csv.NewReader(open(g, file)).ReadAll()
+			g.Expect(err).To(Succeed())
+			g.Expect(records).To(HaveLen(1 + len(stats)))
+			metrics := pa.Metrics()
+			g.Expect(records[0][:3]).To(Equal([]string{"assets", "percentages", "avg_return"}))
+			g.Expect(records[0]).To(HaveLen(2 + len(metrics)))
+			for i, stat := range stats {
+				record := records[i+1]
+				g.Expect(record[0]).To(Equal("|" + strings.Join(stat.Assets, "|") + "|"))
+				g.Expect(record[1]).To(Equal("|" + strings.Join(Strings(stat.Percentages), "|") + "|"))
+				for j, m := range metrics {
+					value, err := strconv.ParseFloat(record[2+j], 64)
+					g.Expect(err).To(Succeed())
+					g.Expect(value).To(Equal(m.Value(stat)), m.Name)
+				}
+			}
+		})
+	}
+	for _, filename := range []string{"results.gobl", "results.gobl.gz"} {
+		filename := filename
+		t.Run(filename, func(t *testing.T) {
+			g := NewGomegaWithT(t)
+			file := filepath.Join(t.TempDir(), filename)
+			write(g, file)
+			decoder := gob.NewDecoder(open(g, file))
+			for _, expected := range stats {
+				var stat pa.PortfolioStat
+				g.Expect(decoder.Decode(&stat)).To(Succeed())
+				g.Expect(&stat).To(Equal(expected))
+			}
+			var stat pa.PortfolioStat
+			g.Expect(decoder.Decode(&stat)).To(MatchError(io.EOF))
+		})
+	}
+	t.Run("fan out", func(t *testing.T) {
+		g := NewGomegaWithT(t)
+		dir := t.TempDir()
+		sink, err := OpenResultSinks(filepath.Join(dir, "results.sqlite"), filepath.Join(dir, "results.jsonl.gz"))
+		g.Expect(err).To(Succeed())
+		resultsCh := make(chan *pa.PortfolioStat, len(stats))
+		for _, stat := range stats {
+			resultsCh <- stat
+		}
+		close(resultsCh)
+		g.Expect(WriteResults(context.Background(), sink, resultsCh)).To(Equal(len(stats)))
+		g.Expect(filepath.Join(dir, "results.sqlite")).To(BeAnExistingFile())
+		g.Expect(filepath.Join(dir, "results.jsonl.gz")).To(BeAnExistingFile())
+	})
+	t.Run("unknown formats", func(t *testing.T) {
+		g := NewGomegaWithT(t)
+		dir := t.TempDir()
+		_, err := OpenResultSink(filepath.Join(dir, "results.txt"))
+		g.Expect(err).To(MatchError(ContainSubstring("unknown results format")))
+		_, err = OpenResultSink(filepath.Join(dir, "results.sqlite.gz"))
+		g.Expect(err).To(MatchError(ContainSubstring("only .jsonl, .csv, and .gobl results can be gzipped")))
+		// the sinks that were opened are closed
+		_, err = OpenResultSinks(filepath.Join(dir, "results.csv"), filepath.Join(dir, "results.txt"))
+		g.Expect(err).To(MatchError(ContainSubstring("unknown results format")))
+		_, err = OpenResultSink(filepath.Join(dir, "missing", "results.csv"))
+		g.Expect(err).To(MatchError(os.ErrNotExist))
+	})
+}
+
+// recordingSink records what's written to it, and fails if it's told to.
+type recordingSink struct {
+	written         []*pa.PortfolioStat
+	flushes, closes int
+	writeErr        error
+	closeErr        error
+}
+
+func (s *recordingSink) Write(stat *pa.PortfolioStat) error {
+	if s.writeErr != nil {
+		return s.writeErr
+	}
+	s.written = append(s.written, stat)
+	return nil
+}
+
+func (s *recordingSink) Flush() error {
+	s.flushes++
+	return nil
+}
+
+func (s *recordingSink) Close() error {
+	s.closes++
+	return s.closeErr
+}
+
+func TestWriteResults(t *testing.T) {
+	stat := &pa.PortfolioStat{Assets: []string{"TSM"}, Percentages: types.ReadablePercents(100)}
+
+	t.Run("cancelled", func(t *testing.T) {
+		g := NewGomegaWithT(t)
+		ctx, cancel := context.WithCancel(context.Background())
+		// the results channel is never closed
+		resultsCh := make(chan *pa.PortfolioStat)
+		sink := &recordingSink{}
+		type written struct {
+			n   int
+			err error
+		}
+		doneCh := make(chan written)
+		go func() {
+			n, err := WriteResults(ctx, sink, resultsCh)
+			doneCh <- written{n, err}
+		}()
+		resultsCh <- stat
+		cancel()
+		done := <-doneCh
+		g.Expect(done.err).To(MatchError(context.Canceled))
+		g.Expect(done.n).To(Equal(1))
+		g.Expect(sink.written).To(HaveLen(1))
+		g.Expect(sink.closes).To(Equal(1))
+	})
+
+	t.Run("the sink fails", func(t *testing.T) {
+		g := NewGomegaWithT(t)
+		resultsCh := make(chan *pa.PortfolioStat, 2)
+		resultsCh <- stat
+		resultsCh <- stat
+		close(resultsCh)
+		failing := errors.New("disk full")
+		sink := &recordingSink{writeErr: failing}
+		n, err := WriteResults(context.Background(), sink, resultsCh)
+		g.Expect(errors.Is(err, failing)).To(BeTrue())
+		g.Expect(err).To(MatchError("writing result #1: disk full"))
+		g.Expect(n).To(BeZero())
+		g.Expect(sink.closes).To(Equal(1))
+
+		// or fails to close
+		resultsCh = make(chan *pa.PortfolioStat)
+		close(resultsCh)
+		sink = &recordingSink{closeErr: failing}
+		_, err = WriteResults(context.Background(), sink, resultsCh)
+		g.Expect(err).To(MatchError(failing))
+
+		// or both, and neither error is lost
+		resultsCh = make(chan *pa.PortfolioStat, 1)
+		resultsCh <- stat
+		closing := errors.New("closing")
+		sink = &recordingSink{writeErr: failing, closeErr: closing}
+		_, err = WriteResults(context.Background(), sink, resultsCh)
+		g.Expect(errors.Is(err, failing)).To(BeTrue())
+		g.Expect(err).To(MatchError("writing result #1: disk full (closing: closing)"))
+	})
+}
+
+func TestFanOutSink(t *testing.T) {
+	g := NewGomegaWithT(t)
+	stat := &pa.PortfolioStat{Assets: []string{"TSM"}, Percentages: types.ReadablePercents(100)}
+	var (
+		failing = errors.New("disk full")
+		a, b    = &recordingSink{}, &recordingSink{}
+		sink    = NewFanOutSink(a, b)
+	)
+	g.Expect(sink.Write(stat)).To(Succeed())
+	g.Expect(sink.Flush()).To(Succeed())
+	g.Expect(a.written).To(Equal([]*pa.PortfolioStat{stat}))
+	g.Expect(b.written).To(Equal([]*pa.PortfolioStat{stat}))
+	g.Expect(a.flushes).To(Equal(1))
+	g.Expect(b.flushes).To(Equal(1))
+
+	b.writeErr = failing
+	g.Expect(sink.Write(stat)).To(MatchError("sink #2: disk full"))
+
+	// every sink is closed, even if one fails
+	a.closeErr = failing
+	g.Expect(sink.Close()).To(MatchError("sink #1: disk full"))
+	g.Expect(a.closes).To(Equal(1))
+	g.Expect(b.closes).To(Equal(1))
+}
+
+func TestSQLiteSink(t *testing.T) {
+	stat, err := mustEvaluatePortfolio(pa.Combination{
+		Assets:      []string{"TSM", "Int'l Bd", "Hi-Yield Corp Bd"},
+		Percentages: types.ReadablePercents(50, 30, 20),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// write writes the stat to a sink with the options
+	write := func(g *WithT, file string, opts SQLiteSinkOptions) {
+		sink, err := NewSQLiteSinkWithOptions(file, opts)
+		g.Expect(err).To(Succeed())
+		g.Expect(sink.Write(stat)).To(Succeed())
+		g.Expect(sink.Close()).To(Succeed())
+	}
+	// count counts the rows of the table
+	count := func(g *WithT, db *sql.DB, table string) int {
+		var n int
+		g.Expect(db.QueryRow(`SELECT COUNT(*) FROM ` + table).Scan(&n)).To(Succeed())
+		return n
+	}
+
+	t.Run("every asset has a column", func(t *testing.T) {
+		g := NewGomegaWithT(t)
+		file := filepath.Join(t.TempDir(), "results.sqlite")
+		write(g, file, SQLiteSinkOptions{
+			Run: RunMetadata{Parameters: map[string]any{"k": 3}},
+		})
+		db, err := sql.Open("sqlite3", file)
+		g.Expect(err).To(Succeed())
+		defer db.Close()
+
+		columns, err := tableColumns(db, "main", "portfolios_1pct_10ltt")
+		g.Expect(err).To(Succeed())
+		for _, asset := range data.Names() {
+			g.Expect(columns).To(ContainElement(assetColumn(asset)))
+		}
+		var tsm, intlBd, hiYield, gold float64
+		err = db.QueryRow(`SELECT percent_tsm, percent_int_l_bd, percent_hi_yield_corp_bd, percent_gold FROM portfolios_1pct_10ltt`).
+			Scan(&tsm, &intlBd, &hiYield, &gold)
+		g.Expect(err).To(Succeed())
+		g.Expect([]float64{tsm, intlBd, hiYield, gold}).To(Equal([]float64{0.5, 0.3, 0.2, 0}))
+
+		// the run is recorded, and the results refer to it
+		var runID, resultsTable, dataset, parameters, startedAt, finishedAt string
+		var rows int
+		err = db.QueryRow(`SELECT id, results_table, dataset, parameters, started_at, finished_at, rows FROM runs`).
+			Scan(&runID, &resultsTable, &dataset, &parameters, &startedAt, &finishedAt, &rows)
+		g.Expect(err).To(Succeed())
+		g.Expect(resultsTable).To(Equal("portfolios_1pct_10ltt"))
+		g.Expect(dataset).To(Equal(data.Revision()))
+		g.Expect(parameters).To(MatchJSON(`{"k": 3}`))
+		g.Expect(startedAt <= finishedAt).To(BeTrue(), "%s <= %s", startedAt, finishedAt)
+		g.Expect(rows).To(Equal(1))
+		var resultRunID string
+		g.Expect(db.QueryRow(`SELECT run_id FROM portfolios_1pct_10ltt`).Scan(&resultRunID)).To(Succeed())
+		g.Expect(resultRunID).To(Equal(runID))
+
+		// writing again replaces the results, and their runs
+		write(g, file, SQLiteSinkOptions{})
+		g.Expect(count(g, db, "portfolios_1pct_10ltt")).To(Equal(1))
+		g.Expect(count(g, db, "runs")).To(Equal(1))
+	})
+
+	t.Run("a table of its own assets", func(t *testing.T) {
+		g := NewGomegaWithT(t)
+		file := filepath.Join(t.TempDir(), "results.sqlite")
+		opts := SQLiteSinkOptions{
+			Table:  "bonds",
+			Assets: []string{"TSM", "Int'l Bd", "Hi-Yield Corp Bd"},
+			Append: true,
+		}
+		write(g, file, opts)
+		write(g, file, opts)
+		db, err := sql.Open("sqlite3", file)
+		g.Expect(err).To(Succeed())
+		defer db.Close()
+		g.Expect(tableColumns(db, "main", "bonds")).To(ContainElements("percent_tsm", "percent_int_l_bd", "percent_hi_yield_corp_bd"))
+		g.Expect(tableColumns(db, "main", "bonds")).ToNot(ContainElement("percent_gold"))
+		// appending kept the first run's results
+		g.Expect(count(g, db, "bonds")).To(Equal(2))
+		g.Expect(count(g, db, "runs")).To(Equal(2))
+		var runs int
+		g.Expect(db.QueryRow(`SELECT COUNT(DISTINCT run_id) FROM bonds`).Scan(&runs)).To(Succeed())
+		g.Expect(runs).To(Equal(2))
+
+		// but not to a table with other columns
+		opts.Assets = []string{"TSM", "Int'l Bd"}
+		_, err = NewSQLiteSinkWithOptions(file, opts)
+		g.Expect(err).To(MatchError(ContainSubstring(`can't append to table "bonds"`)))
+
+		// and a portfolio can't lose the percentage of an asset without a column
+		sink, err := NewSQLiteSinkWithOptions(file, SQLiteSinkOptions{Table: "stocks", Assets: []string{"TSM"}})
+		g.Expect(err).To(Succeed())
+		defer sink.Close()
+		g.Expect(sink.Write(stat)).To(MatchError(`table "stocks" doesn't have a column for the asset "Int'l Bd"`))
+	})
+
+	t.Run("invalid options", func(t *testing.T) {
+		g := NewGomegaWithT(t)
+		file := filepath.Join(t.TempDir(), "results.sqlite")
+		for _, table := range []string{"runs", "1pct", "portfolios'; DROP TABLE runs; --"} {
+			_, err := NewSQLiteSinkWithOptions(file, SQLiteSinkOptions{Table: table})
+			g.Expect(err).To(MatchError(fmt.Sprintf("invalid results table name %q", table)))
+		}
+		_, err := NewSQLiteSinkWithOptions(file, SQLiteSinkOptions{Assets: []string{"Int'l Bd", "Int'l-Bd"}})
+		g.Expect(err).To(MatchError(`assets "Int'l Bd" and "Int'l-Bd" would both be in the column percent_int_l_bd`))
+	})
+}
+
+func Test_assetColumn(t *testing.T) {
+	g := NewGomegaWithT(t)
+	g.Expect(assetColumn("TSM")).To(Equal("percent_tsm"))
+	g.Expect(assetColumn("Gold")).To(Equal("percent_gold"))
+	g.Expect(assetColumn("High Div. Yield")).To(Equal("percent_high_div_yield"))
+	g.Expect(assetColumn("Windsor II")).To(Equal("percent_windsor_ii"))
+	g.Expect(assetColumn("Int'l Bd")).To(Equal("percent_int_l_bd"))
+	// every asset has its own column
+	columns := map[string]string{}
+	for _, asset := range data.Names() {
+		column := assetColumn(asset)
+		g.Expect(columns).ToNot(HaveKey(column), asset)
+		g.Expect(isSQLiteIdentifier(column)).To(BeTrue(), column)
+		columns[column] = asset
+	}
+}
@@ -0,0 +1,226 @@
+package v2
+
+import (
+	"context"
+	"fmt"
+	"math"
+
+	pa "github.com/slatteryjim/portfolio-analysis"
+	. "github.com/slatteryjim/portfolio-analysis/types"
+)
+
+// WeightGrid describes the allocations to try for each combination of assets:
+// every way of splitting 100% into multiples of the Step, within each asset's bounds.
+type WeightGrid struct {
+	// Step is the increment between allocations, e.g. 5%. It must divide evenly into 100%.
+	Step Percent
+	// Min and Max bound the allocation of the assets, by name.
+	// Every asset holds at least one Step, and at most 100%, unless it's bounded further.
+	Min, Max map[string]Percent
+}
+
+// Validate returns an error if the grid can't be enumerated.
+func (w WeightGrid) Validate() error {
+	if w.Step <= 0 || w.Step > 1 {
+		return fmt.Errorf("step must be between 0%% and 100%%, got %v", w.Step)
+	}
+	if units := 1 / w.Step.Float(); math.Abs(units-math.Round(units)) > 1e-9 {
+		return fmt.Errorf("step %v doesn't divide evenly into 100%%", w.Step)
+	}
+	for asset, min := range w.Min {
+		if max, ok := w.Max[asset]; ok && min > max {
+			return fmt.Errorf("%s: min %v is greater than max %v", asset, min, max)
+		}
+	}
+	return nil
+}
+
+// Allocations returns all of the allocations of the given assets on the grid, in lexicographic order.
+// It returns nil if the bounds can't be satisfied.
+func (w WeightGrid) Allocations(assets []string) [][]Percent {
+	res, _ := w.allocations(assets, nil)
+	return res
+}
+
+// allocations is like Allocations, but if the bound isn't nil, it's called with the units of the first i assets
+// before the rest are allocated, and it skips all of those allocations if the bound returns false.
+// It returns the number of allocations it skipped.
+func (w WeightGrid) allocations(assets []string, bound func(units []int, i, remaining int) bool) ([][]Percent, int) {
+	var (
+		total, lo, hi = w.units(assets)
+		// the least and most that the remaining assets can hold, so infeasible branches are pruned
+		loRest = make([]int, len(assets)+1)
+		hiRest = make([]int, len(assets)+1)
+		// the number of allocations of the remaining assets, to count the ones that are skipped
+		counts [][]int
+	)
+	for i := len(assets) - 1; i >= 0; i-- {
+		loRest[i], hiRest[i] = loRest[i+1]+lo[i], hiRest[i+1]+hi[i]
+	}
+	if bound != nil {
+		counts = countAllocations(total, lo, hi)
+	}
+
+	var (
+		res     [][]Percent
+		skipped int
+		units   = make([]int, len(assets))
+		walk    func(i, remaining int)
+	)
+	walk = func(i, remaining int) {
+		if i == len(assets) {
+			if remaining == 0 {
+				res = append(res, toAllocation(units, total))
+			}
+			return
+		}
+		if bound != nil && !bound(units, i, remaining) {
+			skipped += counts[i][remaining]
+			return
+		}
+		for u := maxInt(lo[i], remaining-hiRest[i+1]); u <= minInt(hi[i], remaining-loRest[i+1]); u++ {
+			units[i] = u
+			walk(i+1, remaining-u)
+		}
+	}
+	walk(0, total)
+	return res, skipped
+}
+
+// CountAllocations returns the number of allocations of the given assets on the grid, without enumerating them.
+func (w WeightGrid) CountAllocations(assets []string) int {
+	total, lo, hi := w.units(assets)
+	return countAllocations(total, lo, hi)[0][total]
+}
+
+// RankAllocation returns the position of the allocation of the given assets in the order of Allocations.
+// It returns false if the allocation isn't on the grid.
+func (w WeightGrid) RankAllocation(assets []string, allocation []Percent) (int, bool) {
+	if len(allocation) != len(assets) {
+		return 0, false
+	}
+	var (
+		total, lo, hi = w.units(assets)
+		counts        = countAllocations(total, lo, hi)
+		rank          = 0
+		remaining     = total
+	)
+	for i, p := range allocation {
+		units := p.Float() * float64(total)
+		u := int(math.Round(units))
+		if math.Abs(units-float64(u)) > 1e-9 || u < lo[i] || u > hi[i] || u > remaining {
+			return 0, false
+		}
+		// count the allocations that give this asset fewer units
+		for smaller := lo[i]; smaller < u && smaller <= remaining; smaller++ {
+			rank += counts[i+1][remaining-smaller]
+		}
+		remaining -= u
+	}
+	if remaining != 0 {
+		return 0, false
+	}
+	return rank, true
+}
+
+// UnrankAllocation returns the allocation of the given assets with the given rank in the order of Allocations.
+// It's the inverse of RankAllocation, and it returns nil if the rank is out of range.
+func (w WeightGrid) UnrankAllocation(assets []string, rank int) []Percent {
+	var (
+		total, lo, hi = w.units(assets)
+		counts        = countAllocations(total, lo, hi)
+		units         = make([]int, len(assets))
+		remaining     = total
+	)
+	if rank < 0 || rank >= counts[0][total] {
+		return nil
+	}
+	for i := range assets {
+		// skip past the blocks of allocations that give this asset fewer units
+		for u := lo[i]; u <= minInt(hi[i], remaining); u++ {
+			block := counts[i+1][remaining-u]
+			if rank < block {
+				units[i] = u
+				break
+			}
+			rank -= block
+		}
+		remaining -= units[i]
+	}
+	return toAllocation(units, total)
+}
+
+// units returns the number of steps in 100%, and the least and most steps each of the assets can hold.
+func (w WeightGrid) units(assets []string) (total int, lo, hi []int) {
+	total = int(math.Round(1 / w.Step.Float()))
+	lo, hi = make([]int, len(assets)), make([]int, len(assets))
+	for i, asset := range assets {
+		lo[i], hi[i] = 1, total
+		if min, ok := w.Min[asset]; ok {
+			lo[i] = maxInt(lo[i], int(math.Ceil(min.Float()/w.Step.Float()-1e-9)))
+		}
+		if max, ok := w.Max[asset]; ok {
+			hi[i] = minInt(hi[i], int(math.Floor(max.Float()/w.Step.Float()+1e-9)))
+		}
+	}
+	return total, lo, hi
+}
+
+// countAllocations returns a table of the number of ways that the assets from i onward can hold the remaining units,
+// indexed by i and the remaining units.
+func countAllocations(total int, lo, hi []int) [][]int {
+	counts := make([][]int, len(lo)+1)
+	for i := range counts {
+		counts[i] = make([]int, total+1)
+	}
+	counts[len(lo)][0] = 1
+	for i := len(lo) - 1; i >= 0; i-- {
+		for remaining := 0; remaining <= total; remaining++ {
+			for u := lo[i]; u <= minInt(hi[i], remaining); u++ {
+				counts[i][remaining] += counts[i+1][remaining-u]
+			}
+		}
+	}
+	return counts
+}
+
+// toAllocation converts the units of each asset into percentages.
+func toAllocation(units []int, total int) []Percent {
+	allocation := make([]Percent, len(units))
+	for i, u := range units {
+		// divide rather than multiply, so 15% is 0.15 rather than 0.15000000000000002
+		allocation[i] = Percent(float64(u) / float64(total))
+	}
+	return allocation
+}
+
+// GoFindKAssetWeightingsBetterThanX is like GoFindKAssetsBetterThanX, but it evaluates each `k` combination of the
+// given names at every allocation on the grid, rather than only at equal weights.
+func GoFindKAssetWeightingsBetterThanX(ctx context.Context, ideal *pa.PortfolioStat, k int, names []string, grid WeightGrid, opts SearchOptions) (<-chan *pa.PortfolioStat, *SearchProgress, error) {
+	return GoFindKAssetWeightingsInRangeBetterThanX(ctx, ideal, k, names, grid, 0, pa.Binomial(len(names), k), opts)
+}
+
+// GoFindKAssetWeightingsInRangeBetterThanX is like GoFindKAssetWeightingsBetterThanX, but it only looks at the `k`
+// combinations ranked from start up to, but not including, end, like GoFindKAssetsInRangeBetterThanX.
+func GoFindKAssetWeightingsInRangeBetterThanX(ctx context.Context, ideal *pa.PortfolioStat, k int, names []string, grid WeightGrid, start, end int, opts SearchOptions) (<-chan *pa.PortfolioStat, *SearchProgress, error) {
+	if err := grid.Validate(); err != nil {
+		return nil, nil, err
+	}
+	combinationsCh := pa.GoEnumerateCombinationRange(ctx, names, k, start, end, opts.batchSize())
+	resultsCh, progress := goEvaluateCombinations(ctx, ideal, combinationsCh, end-start, gridAllocations(grid, ideal, opts), grid.Step, opts)
+	return resultsCh, progress, nil
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,164 @@
+package v2
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	. "github.com/onsi/gomega"
+
+	pa "github.com/slatteryjim/portfolio-analysis"
+	"github.com/slatteryjim/portfolio-analysis/types"
+)
+
+func TestWeightGrid_Validate(t *testing.T) {
+	g := NewGomegaWithT(t)
+	g.Expect(WeightGrid{Step: 0.05}.Validate()).To(Succeed())
+	g.Expect(WeightGrid{Step: 0.01}.Validate()).To(Succeed())
+	g.Expect(WeightGrid{}.Validate()).To(MatchError("step must be between 0% and 100%, got 0%"))
+	g.Expect(WeightGrid{Step: 0.03}.Validate()).To(MatchError("step 3% doesn't divide evenly into 100%"))
+	g.Expect(WeightGrid{Step: 0.1,
+		Min: map[string]types.Percent{"Gold": 0.3},
+		Max: map[string]types.Percent{"Gold": 0.2},
+	}.Validate()).To(MatchError("Gold: min 30% is greater than max 20%"))
+}
+
+func TestWeightGrid_Allocations(t *testing.T) {
+	g := NewGomegaWithT(t)
+	grid := WeightGrid{Step: 0.25}
+	g.Expect(grid.Allocations([]string{"TSM"})).To(Equal([][]types.Percent{types.ReadablePercents(100)}))
+	g.Expect(grid.Allocations([]string{"TSM", "LTT"})).To(Equal([][]types.Percent{
+		types.ReadablePercents(25, 75),
+		types.ReadablePercents(50, 50),
+		types.ReadablePercents(75, 25),
+	}))
+	// every asset holds at least one step
+	g.Expect(grid.Allocations([]string{"TSM", "SCV", "LTT", "STT", "Gold"})).To(BeEmpty())
+
+	// same count as the root package's Combinations, which also includes the smaller subsets
+	grid = WeightGrid{Step: 0.05}
+	g.Expect(grid.Allocations([]string{"TSM", "SCV", "LTT", "STT", "Gold"})).To(HaveLen(3876)) // C(19,4)
+	g.Expect(pa.Combinations([]string{"TSM", "SCV", "LTT", "STT", "Gold"}, types.ReadablePercents(pa.SeriesRange(5)...))).
+		To(HaveLen(3876 + 5*969 + 10*171 + 10*19 + 5))
+
+	// bounded
+	grid = WeightGrid{Step: 0.1,
+		Min: map[string]types.Percent{"Gold": 0.25},
+		Max: map[string]types.Percent{"Gold": 0.4, "TSM": 0.3},
+	}
+	g.Expect(grid.Allocations([]string{"TSM", "Gold", "LTT"})).To(Equal([][]types.Percent{
+		types.ReadablePercents(10, 30, 60),
+		types.ReadablePercents(10, 40, 50),
+		types.ReadablePercents(20, 30, 50),
+		types.ReadablePercents(20, 40, 40),
+		types.ReadablePercents(30, 30, 40),
+		types.ReadablePercents(30, 40, 30),
+	}))
+	// infeasible
+	grid.Min["LTT"] = 0.8
+	g.Expect(grid.Allocations([]string{"TSM", "Gold", "LTT"})).To(BeEmpty())
+}
+
+func TestWeightGrid_RankAllocation(t *testing.T) {
+	g := NewGomegaWithT(t)
+	assets := []string{"TSM", "Gold", "LTT", "STT"}
+	for _, grid := range []WeightGrid{
+		{Step: 0.25},
+		{Step: 0.05},
+		{Step: 0.1,
+			Min: map[string]types.Percent{"Gold": 0.25, "STT": 0.1},
+			Max: map[string]types.Percent{"Gold": 0.4, "TSM": 0.3},
+		},
+		{Step: 0.1, Min: map[string]types.Percent{"LTT": 0.8}},
+	} {
+		// the ranks follow the order of Allocations
+		allocations := grid.Allocations(assets)
+		g.Expect(grid.CountAllocations(assets)).To(Equal(len(allocations)), "%+v", grid)
+		for i, allocation := range allocations {
+			rank, ok := grid.RankAllocation(assets, allocation)
+			g.Expect(ok).To(BeTrue(), "%+v %v", grid, allocation)
+			g.Expect(rank).To(Equal(i), "%+v %v", grid, allocation)
+			g.Expect(grid.UnrankAllocation(assets, i)).To(Equal(allocation), "%+v %d", grid, i)
+		}
+		g.Expect(grid.UnrankAllocation(assets, len(allocations))).To(BeNil())
+		g.Expect(grid.UnrankAllocation(assets, -1)).To(BeNil())
+	}
+
+	// not on the grid
+	grid := WeightGrid{Step: 0.1, Max: map[string]types.Percent{"TSM": 0.3}}
+	_, ok := grid.RankAllocation(assets, types.ReadablePercents(10, 20, 30, 40))
+	g.Expect(ok).To(BeTrue())
+	for _, allocation := range [][]types.Percent{
+		types.ReadablePercents(15, 15, 30, 40),
+		types.ReadablePercents(40, 10, 10, 40),
+		types.ReadablePercents(10, 20, 30, 30),
+		types.ReadablePercents(10, 20, 70),
+		types.ReadablePercents(0, 30, 30, 40),
+	} {
+		_, ok := grid.RankAllocation(assets, allocation)
+		g.Expect(ok).To(BeFalse(), "%v", allocation)
+	}
+}
+
+func TestGoFindKAssetWeightingsBetterThanX(t *testing.T) {
+	g := NewGomegaWithT(t)
+	names := []string{"TSM", "LTT", "Gold"}
+	grid := WeightGrid{Step: 0.25, Max: map[string]types.Percent{"Gold": 0.25}}
+	resultsCh, _, err := GoFindKAssetWeightingsBetterThanX(context.Background(), nil, 2, names, grid, SearchOptions{})
+	g.Expect(err).To(Succeed())
+	var results []*pa.PortfolioStat
+	for stat := range resultsCh {
+		results = append(results, stat)
+	}
+	var portfolios []string
+	for _, stat := range results {
+		portfolios = append(portfolios, fmt.Sprintf("%v %v", stat.Assets, stat.Percentages))
+		expected, err := mustEvaluatePortfolio(pa.Combination{Assets: stat.Assets, Percentages: stat.Percentages})
+		g.Expect(err).To(Succeed())
+		g.Expect(stat).To(Equal(expected))
+	}
+	g.Expect(portfolios).To(ConsistOf(
+		"[TSM LTT] [25% 75%]",
+		"[TSM LTT] [50% 50%]",
+		"[TSM LTT] [75% 25%]",
+		"[TSM Gold] [75% 25%]",
+		"[LTT Gold] [75% 25%]",
+	))
+
+	// only keep those better than an ideal
+	ideal, err := mustEvaluatePortfolio(pa.Combination{Assets: []string{"TSM", "LTT"}, Percentages: types.ReadablePercents(50, 50)})
+	g.Expect(err).To(Succeed())
+	resultsCh, _, err = GoFindKAssetWeightingsBetterThanX(context.Background(), ideal, 2, names, grid, SearchOptions{})
+	g.Expect(err).To(Succeed())
+	for stat := range resultsCh {
+		g.Expect(stat.AsGoodOrBetterThan(ideal)).To(BeTrue())
+	}
+
+	_, _, err = GoFindKAssetWeightingsBetterThanX(context.Background(), nil, 2, names, WeightGrid{Step: 0.3}, SearchOptions{})
+	g.Expect(err).To(MatchError("step 30% doesn't divide evenly into 100%"))
+}
+
+func TestGoFindKAssetWeightingsBetterThanX_Cancelled(t *testing.T) {
+	g := NewGomegaWithT(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	// each combination has thousands of allocations on the grid
+	var (
+		grid           = WeightGrid{Step: 0.01}
+		names          = []string{"TSM", "SCV", "LTT", "STT"}
+		perCombination = len(grid.Allocations(names[:3]))
+	)
+	g.Expect(perCombination).To(BeNumerically(">", 1000))
+
+	// without an ideal, every portfolio is a result
+	resultsCh, progress, err := GoFindKAssetWeightingsBetterThanX(ctx, nil, 3, names, grid, SearchOptions{Workers: 1, BatchSize: 1, Buffer: 1})
+	g.Expect(err).To(Succeed())
+	<-resultsCh
+	cancel()
+	for range resultsCh {
+	}
+	// the worker stops in the middle of the combination's allocations,
+	// though the results can be closed before it's added its count to the progress
+	g.Consistently(progress.Evaluated, 200*time.Millisecond).Should(BeNumerically("<", perCombination))
+}